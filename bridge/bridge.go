@@ -0,0 +1,201 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package bridge mirrors the services of another service catalog, Consul or
+// an etcd directory, into SkyDNS and optionally the services of SkyDNS back.
+// It lets services move over to SkyDNS one at a time.
+package bridge
+
+import (
+	"errors"
+	"github.com/skynetservices/skydns/client"
+	"github.com/skynetservices/skydns/msg"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Conflict policies, for imported services with the name and environment of a
+// service registered with SkyDNS itself.
+const (
+	ConflictBoth   = "both"   // import the service alongside the SkyDNS one
+	ConflictSkyDNS = "skydns" // SkyDNS wins, the service isn't imported
+)
+
+// ErrConflictPolicy is returned for unknown conflict policies.
+var ErrConflictPolicy = errors.New("Conflict policy must be both or skydns")
+
+// Catalog is another service catalog. The UUIDs of the services it returns
+// start with the Name of the catalog and a dash, which is how imported services
+// are told apart from the services registered with SkyDNS itself.
+type Catalog interface {
+	Name() string
+	Services() (map[string]msg.Service, error) // UUID -> service
+
+	// Put and Delete write the services of SkyDNS back to the catalog, under
+	// names Services leaves out, and Written returns the services written
+	// back so far by UUID
+	Put(uuid string, s msg.Service) error
+	Delete(uuid string) error
+	Written() (map[string]msg.Service, error)
+}
+
+// Registry is the part of the SkyDNS client the bridge uses.
+type Registry interface {
+	Add(uuid string, s *msg.Service) error
+	Delete(uuid string) error
+	Update(uuid string, ttl uint32) error
+	GetAllServices() ([]*msg.Service, error)
+}
+
+// Bridge reconciles SkyDNS with a catalog.
+type Bridge struct {
+	Interval  time.Duration // between reconciliations
+	Conflict  string        // one of the Conflict* policies
+	WriteBack bool          // if set, write the services of SkyDNS back to the catalog
+
+	catalog  Catalog
+	registry Registry
+	written  map[string]msg.Service // services written back, by UUID; nil until read from the catalog
+}
+
+// New returns a Bridge between the catalog and the registry.
+func New(catalog Catalog, registry Registry) *Bridge {
+	return &Bridge{Interval: 30 * time.Second, Conflict: ConflictBoth, catalog: catalog, registry: registry}
+}
+
+// Run reconciles every Interval until stop is closed.
+func (b *Bridge) Run(stop <-chan bool) {
+	tick := time.NewTicker(b.Interval)
+	defer tick.Stop()
+	for {
+		if err := b.Reconcile(); err != nil {
+			slog.Error("Syncing", "catalog", b.catalog.Name(), "err", err)
+		}
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Reconcile syncs SkyDNS with the catalog once. Imported services get a TTL of
+// three intervals, so they expire when the bridge stops.
+func (b *Bridge) Reconcile() error {
+	if b.Conflict != ConflictBoth && b.Conflict != ConflictSkyDNS {
+		return ErrConflictPolicy
+	}
+	imported, err := b.catalog.Services()
+	if err != nil {
+		return err
+	}
+	all, err := b.registry.GetAllServices()
+	if err != nil {
+		return err
+	}
+
+	prefix := b.catalog.Name() + "-"
+	ttl := uint32(3 * b.Interval / time.Second)
+	existing := make(map[string]msg.Service) // imported before
+	native := make(map[string]msg.Service)   // registered with SkyDNS itself
+	names := make(map[string]bool)           // name.environment of the native services
+	for _, s := range all {
+		if strings.HasPrefix(s.UUID, prefix) {
+			existing[s.UUID] = *s
+			continue
+		}
+		native[s.UUID] = *s
+		names[nameKey(*s)] = true
+	}
+
+	for uuid, s := range imported {
+		if b.Conflict == ConflictSkyDNS && names[nameKey(s)] {
+			continue
+		}
+		s.UUID, s.TTL = uuid, ttl
+		if old, ok := existing[uuid]; ok {
+			delete(existing, uuid)
+			if same(old, s) {
+				err := b.registry.Update(uuid, ttl)
+				if err == nil {
+					continue
+				}
+				if err != client.ErrServiceNotFound {
+					slog.Error("Heartbeat", "uuid", uuid, "err", err)
+					continue
+				}
+			} else if err := b.registry.Delete(uuid); err != nil {
+				slog.Error("Removing service", "uuid", uuid, "err", err)
+				continue
+			}
+		}
+		if err := b.registry.Add(uuid, &s); err != nil {
+			slog.Error("Importing service", "uuid", uuid, "catalog", b.catalog.Name(), "err", err)
+			continue
+		}
+		slog.Info("Imported service", "uuid", uuid, "catalog", b.catalog.Name())
+	}
+	// Services that are gone from the catalog, or lost to a conflict
+	for uuid := range existing {
+		if err := b.registry.Delete(uuid); err != nil {
+			slog.Error("Removing service", "uuid", uuid, "err", err)
+			continue
+		}
+		slog.Info("Removed service, it is gone from the catalog", "uuid", uuid, "catalog", b.catalog.Name())
+	}
+
+	if b.WriteBack {
+		b.writeBack(native)
+	}
+	return nil
+}
+
+// writeBack writes the native services that changed since the last time to
+// the catalog, and deletes the ones that are gone. The services written back
+// before the bridge started are read from the catalog, so the ones removed
+// from SkyDNS in the meantime are deleted as well.
+func (b *Bridge) writeBack(native map[string]msg.Service) {
+	if b.written == nil {
+		written, err := b.catalog.Written()
+		if err != nil {
+			slog.Error("Reading services written back", "catalog", b.catalog.Name(), "err", err)
+			return
+		}
+		if written == nil {
+			written = make(map[string]msg.Service)
+		}
+		b.written = written
+	}
+	for uuid, s := range native {
+		if old, ok := b.written[uuid]; ok && same(old, s) {
+			continue
+		}
+		if err := b.catalog.Put(uuid, s); err != nil {
+			slog.Error("Writing service back", "uuid", uuid, "catalog", b.catalog.Name(), "err", err)
+			continue
+		}
+		b.written[uuid] = s
+	}
+	for uuid := range b.written {
+		if _, ok := native[uuid]; ok {
+			continue
+		}
+		if err := b.catalog.Delete(uuid); err != nil {
+			slog.Error("Deleting service written back", "uuid", uuid, "catalog", b.catalog.Name(), "err", err)
+			continue
+		}
+		delete(b.written, uuid)
+	}
+}
+
+func nameKey(s msg.Service) string {
+	return strings.ToLower(s.Name + "." + s.Environment)
+}
+
+// same reports whether a and b describe the same service, TTLs aside.
+func same(a, b msg.Service) bool {
+	return a.Name == b.Name && a.Version == b.Version && a.Environment == b.Environment &&
+		a.Region == b.Region && a.Host == b.Host && a.Port == b.Port
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package bridge
+
+import (
+	"encoding/json"
+	"github.com/skynetservices/skydns/client"
+	"github.com/skynetservices/skydns/msg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeCatalog is a catalog in memory.
+type fakeCatalog struct {
+	services map[string]msg.Service
+	written  map[string]msg.Service
+}
+
+func (c *fakeCatalog) Name() string                              { return "fake" }
+func (c *fakeCatalog) Services() (map[string]msg.Service, error) { return c.services, nil }
+func (c *fakeCatalog) Put(uuid string, s msg.Service) error      { c.written[uuid] = s; return nil }
+func (c *fakeCatalog) Delete(uuid string) error                  { delete(c.written, uuid); return nil }
+
+func (c *fakeCatalog) Written() (map[string]msg.Service, error) {
+	written := make(map[string]msg.Service)
+	for uuid, s := range c.written {
+		written[uuid] = s
+	}
+	return written, nil
+}
+
+// fakeRegistry is a SkyDNS registry in memory, it counts the calls.
+type fakeRegistry struct {
+	services               map[string]msg.Service
+	adds, deletes, updates int
+}
+
+func (r *fakeRegistry) Add(uuid string, s *msg.Service) error {
+	r.adds++
+	if _, ok := r.services[uuid]; ok {
+		return client.ErrConflictingUUID
+	}
+	r.services[uuid] = *s
+	return nil
+}
+
+func (r *fakeRegistry) Delete(uuid string) error {
+	r.deletes++
+	delete(r.services, uuid)
+	return nil
+}
+
+func (r *fakeRegistry) Update(uuid string, ttl uint32) error {
+	r.updates++
+	if _, ok := r.services[uuid]; !ok {
+		return client.ErrServiceNotFound
+	}
+	return nil
+}
+
+func (r *fakeRegistry) GetAllServices() ([]*msg.Service, error) {
+	var all []*msg.Service
+	for uuid, s := range r.services {
+		s := s
+		s.UUID = uuid
+		all = append(all, &s)
+	}
+	return all, nil
+}
+
+func TestReconcile(t *testing.T) {
+	web := msg.Service{Name: "web", Version: "1.0.0", Environment: "production", Region: "dc1", Host: "10.0.0.1", Port: 80}
+	db := msg.Service{Name: "db", Version: "1.0.0", Environment: "production", Region: "dc1", Host: "10.0.0.2", Port: 5432}
+	catalog := &fakeCatalog{services: map[string]msg.Service{"fake-web": web, "fake-db": db}, written: make(map[string]msg.Service)}
+	registry := &fakeRegistry{services: map[string]msg.Service{"native-db": db}}
+	b := New(catalog, registry)
+	b.Interval = 10 * time.Second
+
+	if err := b.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := registry.services["fake-web"]; !ok || s.TTL != 30 || s.Host != "10.0.0.1" {
+		t.Fatalf("Expected the catalog service imported with a TTL of three intervals, got %+v", registry.services)
+	}
+	if _, ok := registry.services["fake-db"]; !ok {
+		t.Fatal("Expected a conflicting service imported with the policy both")
+	}
+
+	// Unchanged services get a heartbeat, changed ones are replaced
+	web.Port = 8080
+	catalog.services["fake-web"] = web
+	registry.adds, registry.updates = 0, 0
+	if err := b.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if registry.updates != 1 || registry.adds != 1 || registry.services["fake-web"].Port != 8080 {
+		t.Fatalf("Expected one heartbeat and one service replaced, got %d and %d: %+v", registry.updates, registry.adds, registry.services)
+	}
+
+	// Services gone from the catalog or lost to a conflict are removed,
+	// native ones are left alone
+	delete(catalog.services, "fake-web")
+	b.Conflict = ConflictSkyDNS
+	if err := b.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(registry.services) != 1 || registry.services["native-db"].Host != "10.0.0.2" {
+		t.Fatalf("Expected only the native service left, got %+v", registry.services)
+	}
+
+	b.Conflict = "catalog"
+	if err := b.Reconcile(); err != ErrConflictPolicy {
+		t.Fatalf("Expected an error for an unknown conflict policy, got %v", err)
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	db := msg.Service{Name: "db", Version: "1.0.0", Environment: "production", Region: "dc1", Host: "10.0.0.2", Port: 5432}
+	// Written back before a restart, and removed from SkyDNS since
+	stale := msg.Service{Name: "old", Version: "1.0.0", Environment: "production", Region: "dc1", Host: "10.0.0.3", Port: 80}
+	catalog := &fakeCatalog{services: map[string]msg.Service{}, written: map[string]msg.Service{"stale": stale}}
+	registry := &fakeRegistry{services: map[string]msg.Service{"native-db": db}}
+	b := New(catalog, registry)
+	b.WriteBack = true
+
+	if err := b.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.written) != 1 || catalog.written["native-db"].Host != "10.0.0.2" {
+		t.Fatalf("Expected only the native service written back, got %+v", catalog.written)
+	}
+
+	registry.Delete("native-db")
+	if err := b.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.written) != 0 {
+		t.Fatalf("Expected the removed service deleted from the catalog, got %+v", catalog.written)
+	}
+}
+
+func TestConsul(t *testing.T) {
+	var deregistered map[string]string
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("dc") != "dc1" && req.Method == "GET" {
+			t.Errorf("Expected the datacenter in the query, got %s", req.URL)
+		}
+		switch req.URL.Path {
+		case "/v1/catalog/services":
+			json.NewEncoder(w).Encode(map[string][]string{"web": {"version=2.0.0"}, "db": {writtenTag}})
+		case "/v1/catalog/service/web":
+			json.NewEncoder(w).Encode([]consulService{
+				{Node: "node1", Address: "10.0.0.1", Datacenter: "dc1", ServiceID: "web1", ServiceName: "web", ServicePort: 80,
+					ServiceTags: []string{"version=2.0.0", "environment=staging"}},
+				{Node: "Node2", Address: "10.0.0.2", Datacenter: "dc1", ServiceID: "web:2", ServiceName: "web", ServiceAddress: "10.0.1.2", ServicePort: 80},
+			})
+		case "/v1/catalog/service/db":
+			json.NewEncoder(w).Encode([]consulService{
+				{Node: "10.0.0.3", Address: "10.0.0.3", Datacenter: "dc1", ServiceID: "skydns-123", ServiceName: "db", ServicePort: 5432,
+					ServiceTags: []string{writtenTag, "version=1.0.0", "environment=production"}},
+			})
+		case "/v1/catalog/deregister":
+			b, _ := ioutil.ReadAll(req.Body)
+			json.Unmarshal(b, &deregistered)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer consul.Close()
+
+	c := NewConsul(consul.URL)
+	c.Datacenter = "dc1"
+	services, err := c.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]msg.Service{
+		"consul-node1-web1":  {Name: "web", Version: "2.0.0", Environment: "staging", Region: "dc1", Host: "10.0.0.1", Port: 80},
+		"consul-node2-web-2": {Name: "web", Version: DefaultVersion, Environment: DefaultEnvironment, Region: "dc1", Host: "10.0.1.2", Port: 80},
+	}
+	if !reflect.DeepEqual(services, want) {
+		t.Fatalf("Wrong services imported from Consul:\n%+v\nexpected\n%+v", services, want)
+	}
+
+	// The services written back are found after a restart, with their node
+	written, err := c.Written()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := written["123"]; len(written) != 1 || !ok || s.Name != "db" || s.Host != "10.0.0.3" {
+		t.Fatalf("Wrong services written back: %+v", written)
+	}
+	if err := c.Delete("123"); err != nil {
+		t.Fatal(err)
+	}
+	if deregistered["Node"] != "10.0.0.3" || deregistered["ServiceID"] != "skydns-123" {
+		t.Fatalf("Expected the service deregistered from its node, got %v", deregistered)
+	}
+}
+
+func TestEtcd(t *testing.T) {
+	etcd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v2/keys/services" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(`{"node":{"key":"/services","dir":true,"nodes":[
+			{"key":"/services/web1","value":"{\"Name\":\"web\",\"Version\":\"1.0.0\",\"Environment\":\"production\",\"Region\":\"east\",\"Host\":\"10.0.0.1\",\"Port\":80}"},
+			{"key":"/services/db","dir":true,"nodes":[
+				{"key":"/services/db/Primary","value":"{\"Name\":\"db\",\"Host\":\"10.0.0.2\",\"Port\":5432}"},
+				{"key":"/services/db/notes","value":"not a service"}
+			]},
+			{"key":"/services/skydns-123","value":"{\"Name\":\"api\",\"Host\":\"10.0.0.3\",\"Port\":8080}"}
+		]}}`))
+	}))
+	defer etcd.Close()
+
+	e := NewEtcd(etcd.URL, "services/")
+	services, err := e.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]msg.Service{
+		"etcd-web1":       {Name: "web", Version: "1.0.0", Environment: "production", Region: "east", Host: "10.0.0.1", Port: 80},
+		"etcd-db-primary": {Name: "db", Host: "10.0.0.2", Port: 5432},
+	}
+	if !reflect.DeepEqual(services, want) {
+		t.Fatalf("Wrong services imported from etcd:\n%+v\nexpected\n%+v", services, want)
+	}
+
+	written, err := e.Written()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := written["123"]; len(written) != 1 || !ok || s.Name != "api" {
+		t.Fatalf("Wrong services written back: %+v", written)
+	}
+
+	// A directory that doesn't exist has no services
+	e = NewEtcd(etcd.URL, "/other")
+	if services, err := e.Services(); err != nil || len(services) != 0 {
+		t.Fatalf("Expected no services in a missing directory, got %v, %v", services, err)
+	}
+}
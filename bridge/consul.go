@@ -0,0 +1,234 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/skynetservices/skydns/msg"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Defaults of imported services that don't say otherwise.
+const (
+	DefaultVersion     = "1.0.0"
+	DefaultEnvironment = "production"
+)
+
+// writtenTag marks the services written back to Consul, which aren't imported.
+const writtenTag = "skydns"
+
+// Consul is the catalog of a Consul agent. Services are imported with the
+// datacenter as their region, and the version and environment from their
+// version=... and environment=... tags.
+type Consul struct {
+	Datacenter  string // if set, the datacenter to use instead of the one of the agent
+	Environment string // of services without an environment tag, defaults to DefaultEnvironment
+
+	base  string
+	http  *http.Client
+	nodes map[string]string // UUID -> node of the services written back
+}
+
+// NewConsul returns the catalog of the Consul agent at addr, e.g.
+// http://127.0.0.1:8500.
+func NewConsul(addr string) *Consul {
+	return &Consul{Environment: DefaultEnvironment, base: strings.TrimSuffix(addr, "/"), http: &http.Client{Timeout: 10 * time.Second}, nodes: make(map[string]string)}
+}
+
+// Name returns "consul".
+func (c *Consul) Name() string { return "consul" }
+
+// consulService is a service in the Consul catalog.
+type consulService struct {
+	Node           string
+	Address        string
+	Datacenter     string
+	ServiceID      string
+	ServiceName    string
+	ServiceAddress string
+	ServicePort    uint16
+	ServiceTags    []string
+}
+
+// Services returns the services in the catalog.
+func (c *Consul) Services() (map[string]msg.Service, error) {
+	entries, err := c.entries(false)
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string]msg.Service)
+	for _, e := range entries {
+		if s, written := c.service(e); !written {
+			services[c.Name()+"-"+label(e.Node+"-"+e.ServiceID)] = s
+		}
+	}
+	return services, nil
+}
+
+// Written returns the services written back with Put, which are found by
+// their tag. It also learns their nodes, so Delete works for services written
+// back before a restart.
+func (c *Consul) Written() (map[string]msg.Service, error) {
+	entries, err := c.entries(true)
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string]msg.Service)
+	for _, e := range entries {
+		s, written := c.service(e)
+		if !written || !strings.HasPrefix(e.ServiceID, "skydns-") {
+			continue
+		}
+		uuid := strings.TrimPrefix(e.ServiceID, "skydns-")
+		c.nodes[uuid] = e.Node
+		services[uuid] = s
+	}
+	return services, nil
+}
+
+// entries returns the entries of all services in the catalog, or only of the
+// services with an entry written back if written is set.
+func (c *Consul) entries(written bool) ([]consulService, error) {
+	var names map[string][]string // name -> tags
+	if err := c.get("/v1/catalog/services", &names); err != nil {
+		return nil, err
+	}
+	var all []consulService
+	for name, tags := range names {
+		if written && !hasTag(tags, writtenTag) {
+			continue
+		}
+		var entries []consulService
+		if err := c.get("/v1/catalog/service/"+url.QueryEscape(name), &entries); err != nil {
+			return nil, err
+		}
+		all = append(all, entries...)
+	}
+	return all, nil
+}
+
+// service returns the service of the catalog entry e, and whether it was
+// written back from SkyDNS.
+func (c *Consul) service(e consulService) (s msg.Service, written bool) {
+	s = msg.Service{
+		Name:        e.ServiceName,
+		Version:     DefaultVersion,
+		Environment: c.Environment,
+		Region:      e.Datacenter,
+		Host:        e.ServiceAddress,
+		Port:        e.ServicePort,
+	}
+	if s.Host == "" {
+		s.Host = e.Address
+	}
+	for _, t := range e.ServiceTags {
+		switch {
+		case t == writtenTag:
+			written = true
+		case strings.HasPrefix(t, "version="):
+			s.Version = t[len("version="):]
+		case strings.HasPrefix(t, "environment="):
+			s.Environment = t[len("environment="):]
+		}
+	}
+	return s, written
+}
+
+// Put registers s in the catalog, on a node named after its host.
+func (c *Consul) Put(uuid string, s msg.Service) error {
+	reg := map[string]interface{}{
+		"Datacenter": c.Datacenter,
+		"Node":       s.Host,
+		"Address":    s.Host,
+		"Service": map[string]interface{}{
+			"ID":      "skydns-" + uuid,
+			"Service": s.Name,
+			"Tags":    []string{writtenTag, "version=" + s.Version, "environment=" + s.Environment},
+			"Port":    s.Port,
+		},
+	}
+	if err := c.put("/v1/catalog/register", reg); err != nil {
+		return err
+	}
+	c.nodes[uuid] = s.Host
+	return nil
+}
+
+// Delete removes the service written back with Put.
+func (c *Consul) Delete(uuid string) error {
+	dereg := map[string]string{"Datacenter": c.Datacenter, "Node": c.nodes[uuid], "ServiceID": "skydns-" + uuid}
+	if err := c.put("/v1/catalog/deregister", dereg); err != nil {
+		return err
+	}
+	delete(c.nodes, uuid)
+	return nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Consul) query() string {
+	if c.Datacenter == "" {
+		return ""
+	}
+	return "?dc=" + url.QueryEscape(c.Datacenter)
+}
+
+func (c *Consul) get(path string, v interface{}) error {
+	resp, err := c.http.Get(c.base + path + c.query())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Consul returned %s for %s", resp.Status, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Consul) put(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", c.base+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Consul returned %s for %s", resp.Status, path)
+	}
+	return nil
+}
+
+// label returns s as a DNS label, UUIDs are the first label of the names of
+// services.
+func label(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, s)
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/skynetservices/skydns/msg"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// writtenPrefix starts the keys of the services written back to etcd, which
+// aren't imported.
+const writtenPrefix = "skydns-"
+
+// Etcd is a directory of an etcd server, with a key for each service holding
+// the service as JSON in the format of the SkyDNS API.
+type Etcd struct {
+	base string
+	dir  string
+	http *http.Client
+}
+
+// NewEtcd returns the catalog in the directory dir of the etcd server at addr,
+// e.g. http://127.0.0.1:4001 and /services.
+func NewEtcd(addr, dir string) *Etcd {
+	return &Etcd{base: strings.TrimSuffix(addr, "/"), dir: "/" + strings.Trim(dir, "/"), http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name returns "etcd".
+func (e *Etcd) Name() string { return "etcd" }
+
+// etcdNode is a key or directory in etcd.
+type etcdNode struct {
+	Key   string
+	Value string
+	Dir   bool
+	Nodes []etcdNode
+}
+
+// Services returns the services in the directory and the directories below
+// it. Keys that don't hold a service are skipped.
+func (e *Etcd) Services() (map[string]msg.Service, error) {
+	root, err := e.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string]msg.Service)
+	var walk func(n etcdNode)
+	walk = func(n etcdNode) {
+		if n.Dir {
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+			return
+		}
+		if strings.HasPrefix(path.Base(n.Key), writtenPrefix) {
+			return
+		}
+		var s msg.Service
+		if err := json.Unmarshal([]byte(n.Value), &s); err != nil || s.Name == "" {
+			return
+		}
+		rel := strings.Trim(strings.TrimPrefix(n.Key, e.dir), "/")
+		services[e.Name()+"-"+label(strings.Replace(rel, "/", "-", -1))] = s
+	}
+	walk(root)
+	return services, nil
+}
+
+// Written returns the services written back with Put, the skydns-<uuid> keys
+// in the directory.
+func (e *Etcd) Written() (map[string]msg.Service, error) {
+	root, err := e.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string]msg.Service)
+	for _, n := range root.Nodes {
+		base := path.Base(n.Key)
+		if n.Dir || !strings.HasPrefix(base, writtenPrefix) {
+			continue
+		}
+		var s msg.Service
+		if err := json.Unmarshal([]byte(n.Value), &s); err != nil {
+			continue
+		}
+		services[strings.TrimPrefix(base, writtenPrefix)] = s
+	}
+	return services, nil
+}
+
+// keys returns the directory with all keys below it, an empty one if it
+// doesn't exist.
+func (e *Etcd) keys() (etcdNode, error) {
+	var reply struct{ Node etcdNode }
+	resp, err := e.http.Get(e.base + "/v2/keys" + e.dir + "?recursive=true")
+	if err != nil {
+		return reply.Node, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return reply.Node, nil
+	default:
+		return reply.Node, fmt.Errorf("etcd returned %s for %s", resp.Status, e.dir)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	return reply.Node, err
+}
+
+// Put writes s to the key skydns-<uuid> in the directory.
+func (e *Etcd) Put(uuid string, s msg.Service) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return e.do("PUT", uuid, url.Values{"value": {string(b)}})
+}
+
+// Delete removes the key written by Put.
+func (e *Etcd) Delete(uuid string) error {
+	return e.do("DELETE", uuid, nil)
+}
+
+func (e *Etcd) do(method, uuid string, v url.Values) error {
+	req, err := http.NewRequest(method, e.base+"/v2/keys"+e.dir+"/"+writtenPrefix+url.QueryEscape(uuid), strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("etcd returned %s for %s", resp.Status, uuid)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/skynetservices/skydns/msg"
+	"net/http"
+)
+
+// BatchResult is the outcome of registering one service of a batch, see
+// AddBatch.
+type BatchResult struct {
+	UUID   string
+	Status int // HTTP status code, as if the service had been registered alone
+	Error  string
+}
+
+// AddBatch registers services, each with its UUID, in one request.
+func (c *Client) AddBatch(services []msg.Service) ([]BatchResult, error) {
+	b := bytes.NewBuffer(nil)
+	if err := msg.DefaultCodec.Encode(b, services); err != nil {
+		return nil, err
+	}
+	resp, err := c.do("POST", servicePath("batch"), b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrInvalidResponse
+	}
+
+	var out []BatchResult
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetAliases returns all aliases.
+func (c *Client) GetAliases() ([]msg.Alias, error) {
+	resp, err := c.do("GET", "/skydns/aliases/", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrInvalidResponse
+	}
+
+	var out []msg.Alias
+	if err := msg.DefaultCodec.Decode(resp.Body, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AddAlias adds the alias a, replacing an alias with the same name.
+func (c *Client) AddAlias(a msg.Alias) error {
+	b := bytes.NewBuffer(nil)
+	if err := json.NewEncoder(b).Encode(a); err != nil {
+		return err
+	}
+	resp, err := c.do("PUT", "/skydns/aliases/"+a.Name, b.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return ErrInvalidResponse
+	}
+	return nil
+}
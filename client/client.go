@@ -10,6 +10,7 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 var (
@@ -18,24 +19,28 @@ var (
 	ErrInvalidResponse = errors.New("Invalid HTTP response")
 	ErrServiceNotFound = errors.New("Service not found")
 	ErrConflictingUUID = errors.New("Conflicting UUID")
+	ErrQuotaExceeded   = errors.New("Quota exceeded")
 )
 
 type (
 	Client struct {
-		base    string
-		secret  string
-		h       *http.Client
-		basedns string
-		domain  string
-		d       *dns.Client
-		DNS     bool // if true use the DNS when listing servies
+		servers    *endpoints // HTTP API servers
+		secret     string
+		keyName    string // if set, requests are signed with key
+		key        string
+		h          *http.Client
+		dnsServers *endpoints
+		domain     string
+		d          *dns.Client
+		DNS        bool // if true use the DNS when listing servies
 	}
 
 	NameCount map[string]int
 )
 
 // NewClient creates a new skydns client with the specificed host address and
-// DNS port.
+// DNS port. Both may be comma separated lists of servers, which are failed
+// over to when a server times out or returns server errors.
 func NewClient(base, secret, domain, basedns string) (*Client, error) {
 	if base == "" {
 		return nil, ErrNoHttpAddress
@@ -44,25 +49,21 @@ func NewClient(base, secret, domain, basedns string) (*Client, error) {
 		return nil, ErrNoDnsAddress
 	}
 	return &Client{
-		base:    base,
-		basedns: basedns,
-		domain:  dns.Fqdn(domain),
-		secret:  secret,
-		h:       &http.Client{},
-		d:       &dns.Client{},
+		servers:    newEndpoints(base),
+		dnsServers: newEndpoints(basedns),
+		domain:     dns.Fqdn(domain),
+		secret:     secret,
+		h:          &http.Client{Timeout: 5 * time.Second},
+		d:          &dns.Client{},
 	}, nil
 }
 
 func (c *Client) Add(uuid string, s *msg.Service) error {
 	b := bytes.NewBuffer(nil)
-	if err := json.NewEncoder(b).Encode(s); err != nil {
+	if err := msg.DefaultCodec.Encode(b, s); err != nil {
 		return err
 	}
-	req, err := c.newRequest("PUT", c.joinUrl(uuid), b)
-	if err != nil {
-		return err
-	}
-	resp, err := c.h.Do(req)
+	resp, err := c.do("PUT", servicePath(uuid), b.Bytes())
 	if err != nil {
 		return err
 	}
@@ -75,17 +76,15 @@ func (c *Client) Add(uuid string, s *msg.Service) error {
 		return nil
 	case http.StatusConflict:
 		return ErrConflictingUUID
+	case http.StatusTooManyRequests:
+		return ErrQuotaExceeded
 	default:
 		return ErrInvalidResponse
 	}
 }
 
 func (c *Client) Delete(uuid string) error {
-	req, err := c.newRequest("DELETE", c.joinUrl(uuid), nil)
-	if err != nil {
-		return err
-	}
-	resp, err := c.h.Do(req)
+	resp, err := c.do("DELETE", servicePath(uuid), nil)
 	if err != nil {
 		return err
 	}
@@ -96,11 +95,7 @@ func (c *Client) Delete(uuid string) error {
 }
 
 func (c *Client) Get(uuid string) (*msg.Service, error) {
-	req, err := c.newRequest("GET", c.joinUrl(uuid), nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.h.Do(req)
+	resp, err := c.do("GET", servicePath(uuid), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -117,7 +112,7 @@ func (c *Client) Get(uuid string) (*msg.Service, error) {
 	}
 
 	var s *msg.Service
-	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+	if err := msg.DefaultCodec.Decode(resp.Body, &s); err != nil {
 		return nil, err
 	}
 	return s, nil
@@ -125,26 +120,24 @@ func (c *Client) Get(uuid string) (*msg.Service, error) {
 
 func (c *Client) Update(uuid string, ttl uint32) error {
 	b := bytes.NewBuffer([]byte(fmt.Sprintf(`{"TTL":%d}`, ttl)))
-	req, err := c.newRequest("PATCH", c.joinUrl(uuid), b)
-	if err != nil {
-		return err
-	}
-	resp, err := c.h.Do(req)
+	resp, err := c.do("PATCH", servicePath(uuid), b.Bytes())
 	if err != nil {
 		return err
 	}
 	if resp.Body != nil {
 		defer resp.Body.Close()
 	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrServiceNotFound
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return ErrInvalidResponse
+	}
 	return nil
 }
 
 func (c *Client) GetAllServices() ([]*msg.Service, error) {
-	req, err := c.newRequest("GET", c.joinUrl(""), nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.h.Do(req)
+	resp, err := c.do("GET", servicePath(""), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -154,7 +147,7 @@ func (c *Client) GetAllServices() ([]*msg.Service, error) {
 
 	var out []*msg.Service
 	if resp.StatusCode == http.StatusOK {
-		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		if err := msg.DefaultCodec.Decode(resp.Body, &out); err != nil {
 			return nil, err
 		}
 	}
@@ -166,7 +159,7 @@ func (c *Client) GetAllServicesDNS() ([]*msg.Service, error) {
 	if err != nil {
 		return nil, err
 	}
-	resp, _, err := c.d.Exchange(req, c.basedns)
+	resp, err := c.exchange(req)
 	if err != nil {
 		return nil, err
 	}
@@ -187,11 +180,7 @@ func (c *Client) GetAllServicesDNS() ([]*msg.Service, error) {
 }
 
 func (c *Client) GetRegions() (NameCount, error) {
-	req, err := c.newRequest("GET", fmt.Sprintf("%s/skydns/regions/", c.base), nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.h.Do(req)
+	resp, err := c.do("GET", "/skydns/regions/", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -207,11 +196,7 @@ func (c *Client) GetRegions() (NameCount, error) {
 }
 
 func (c *Client) GetEnvironments() (NameCount, error) {
-	req, err := c.newRequest("GET", fmt.Sprintf("%s/skydns/environments/", c.base), nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.h.Do(req)
+	resp, err := c.do("GET", "/skydns/environments/", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -231,11 +216,7 @@ func (c *Client) AddCallback(uuid string, cb *msg.Callback) error {
 	if err := json.NewEncoder(buf).Encode(cb); err != nil {
 		return err
 	}
-	req, err := c.newRequest("PUT", fmt.Sprintf("%s/skydns/callbacks/%s", c.base, uuid), buf)
-	if err != nil {
-		return err
-	}
-	resp, err := c.h.Do(req)
+	resp, err := c.do("PUT", "/skydns/callbacks/"+uuid, buf.Bytes())
 	if err != nil {
 		return err
 	}
@@ -253,16 +234,34 @@ func (c *Client) AddCallback(uuid string, cb *msg.Callback) error {
 	}
 }
 
-func (c *Client) joinUrl(uuid string) string {
-	return fmt.Sprintf("%s/skydns/services/%s", c.base, uuid)
+func servicePath(uuid string) string {
+	return "/skydns/services/" + uuid
+}
+
+// SetSigningKey makes the client sign its requests with the secret key of the
+// token name, instead of sending the shared secret.
+func (c *Client) SetSigningKey(name, key string) {
+	c.keyName, c.key = name, key
 }
 
-func (c *Client) newRequest(method, url string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, url, body)
-	if c.secret != "" {
+func (c *Client) newRequest(method, url string, body []byte) (*http.Request, error) {
+	var b io.Reader
+	if body != nil {
+		b = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, b)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.key != "":
+		date := time.Now().UTC().Format(http.TimeFormat)
+		req.Header.Set("Date", date)
+		req.Header.Set("Authorization", "HMAC "+c.keyName+":"+msg.Signature(c.key, method, req.URL.RequestURI(), date, body))
+	case c.secret != "":
 		req.Header.Add("Authorization", c.secret)
 	}
-	return req, err
+	return req, nil
 }
 
 func (c *Client) newRequestDNS(qname string, qtype uint16) (*dns.Msg, error) {
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"encoding/json"
+	"github.com/skynetservices/skydns/msg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer answers every request with the status of its path, and counts
+// the requests it got by method.
+type fakeServer struct {
+	*httptest.Server
+	sync.Mutex
+	status   map[string]int
+	requests map[string]int
+}
+
+func newFakeServer(status map[string]int) *fakeServer {
+	f := &fakeServer{status: status, requests: make(map[string]int)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f.Lock()
+		f.requests[req.Method]++
+		code, ok := f.status[req.Method+" "+req.URL.Path]
+		f.Unlock()
+		if !ok {
+			code = http.StatusOK
+		}
+		w.WriteHeader(code)
+		if req.Method == "GET" && code == http.StatusOK {
+			json.NewEncoder(w).Encode(&msg.Service{UUID: "123", Name: "TestService"})
+		}
+	}))
+	return f
+}
+
+func (f *fakeServer) set(key string, code int) {
+	f.Lock()
+	defer f.Unlock()
+	f.status[key] = code
+}
+
+func (f *fakeServer) count(method string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.requests[method]
+}
+
+func newTestClient(t *testing.T, addrs ...string) *Client {
+	c, err := NewClient(strings.Join(addrs, ","), "secret", "skydns.local", "127.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestUpdate(t *testing.T) {
+	s := newFakeServer(make(map[string]int))
+	defer s.Close()
+	c := newTestClient(t, s.URL)
+
+	for _, tc := range []struct {
+		code int
+		err  error
+	}{
+		{http.StatusOK, nil},
+		{http.StatusNoContent, nil},
+		{http.StatusNotFound, ErrServiceNotFound},
+		{http.StatusBadRequest, ErrInvalidResponse},
+		{http.StatusForbidden, ErrInvalidResponse},
+		{http.StatusTooManyRequests, ErrInvalidResponse},
+		{http.StatusInternalServerError, ErrInvalidResponse},
+	} {
+		s.set("PATCH /skydns/services/123", tc.code)
+		if err := c.Update("123", 30); err != tc.err {
+			t.Errorf("Wrong error for status %d: %v, expected %v", tc.code, err, tc.err)
+		}
+	}
+}
+
+func TestHelpers(t *testing.T) {
+	s := newFakeServer(map[string]int{
+		"PUT /skydns/services/123":    http.StatusCreated,
+		"PUT /skydns/services/456":    http.StatusConflict,
+		"PUT /skydns/services/789":    http.StatusTooManyRequests,
+		"GET /skydns/services/456":    http.StatusNotFound,
+		"DELETE /skydns/services/456": http.StatusNotFound,
+		"DELETE /skydns/services/789": http.StatusInternalServerError,
+	})
+	defer s.Close()
+	c := newTestClient(t, s.URL)
+
+	if err := c.Add("123", &msg.Service{}); err != nil {
+		t.Errorf("Add failed: %s", err)
+	}
+	if err := c.Add("456", &msg.Service{}); err != ErrConflictingUUID {
+		t.Errorf("Wrong error for a conflicting add: %v", err)
+	}
+	if err := c.Add("789", &msg.Service{}); err != ErrQuotaExceeded {
+		t.Errorf("Wrong error for an add over quota: %v", err)
+	}
+	if serv, err := c.Get("123"); err != nil || serv.Name != "TestService" {
+		t.Errorf("Wrong service: %v, %v", serv, err)
+	}
+	if _, err := c.Get("456"); err != ErrServiceNotFound {
+		t.Errorf("Wrong error for a missing service: %v", err)
+	}
+	if err := c.Deregister("123"); err != nil {
+		t.Errorf("Deregister failed: %s", err)
+	}
+	if err := c.Deregister("456"); err != ErrServiceNotFound {
+		t.Errorf("Wrong error for deregistering a missing service: %v", err)
+	}
+	if err := c.Deregister("789"); err != ErrInvalidResponse {
+		t.Errorf("Wrong error for a failed deregister: %v", err)
+	}
+
+	// Register replaces the service with the same UUID
+	s.set("DELETE /skydns/services/456", http.StatusOK)
+	s.set("PUT /skydns/services/456", http.StatusConflict)
+	if err := c.Register("456", &msg.Service{}); err != ErrConflictingUUID {
+		t.Errorf("Wrong error when the conflict stays: %v", err)
+	}
+	if n := s.count("DELETE"); n != 4 {
+		t.Errorf("Register should deregister the conflicting service, got %d deletes", n)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	down := newFakeServer(map[string]int{"PATCH /skydns/services/123": http.StatusServiceUnavailable})
+	defer down.Close()
+	up := newFakeServer(make(map[string]int))
+	defer up.Close()
+	c := newTestClient(t, down.URL, up.URL)
+	c.SetCircuitBreaker(2, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if err := c.Update("123", 30); err != nil {
+			t.Fatalf("Update should fail over to the healthy server: %s", err)
+		}
+	}
+	if n := up.count("PATCH"); n != 3 {
+		t.Errorf("Healthy server got %d requests, expected 3", n)
+	}
+	// The healthy server moved to the front after its first answer
+	if n := down.count("PATCH"); n != 1 {
+		t.Errorf("Failing server got %d requests, expected 1", n)
+	}
+
+	// A server that is gone counts as a failure too
+	up.Close()
+	if err := c.Update("123", 30); err != ErrInvalidResponse {
+		t.Errorf("Expected the server error when all servers fail, got %v", err)
+	}
+	if err := c.Update("123", 30); err != ErrInvalidResponse {
+		t.Errorf("Expected the server error when all servers fail, got %v", err)
+	}
+
+	// Both circuits are open, the servers are still tried in case they recovered
+	down.set("PATCH /skydns/services/123", http.StatusOK)
+	if err := c.Update("123", 30); err != nil {
+		t.Errorf("Recovered server should be used: %s", err)
+	}
+	if p := c.servers.candidates()[0]; p.addr != down.URL || p.failures != 0 {
+		t.Errorf("Recovered server should be first with a closed circuit: %+v", p)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	var self string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(&Cluster{Leader: self, Members: []string{self, "127.0.0.1:1"}})
+	}))
+	defer s.Close()
+	self = strings.TrimPrefix(s.URL, "http://")
+	c := newTestClient(t, s.URL)
+
+	if err := c.Discover(); err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, p := range c.servers.candidates() {
+		addrs = append(addrs, p.addr)
+	}
+	if len(addrs) != 2 || addrs[0] != s.URL || addrs[1] != "http://127.0.0.1:1" {
+		t.Errorf("Wrong servers after discovery: %v", addrs)
+	}
+	if n := c.CheckHealth(); n != 1 {
+		t.Errorf("Expected 1 healthy server, got %d", n)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	s := newFakeServer(map[string]int{
+		"PATCH /skydns/services/123": http.StatusNotFound,
+		"PUT /skydns/services/123":   http.StatusCreated,
+	})
+	defer s.Close()
+	c := newTestClient(t, s.URL)
+
+	// The service is gone, the heartbeat registers it again
+	h := c.KeepAlive("123", &msg.Service{TTL: 1})
+	deadline := time.Now().Add(5 * time.Second)
+	for s.count("PUT") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.Stop()
+	if s.count("PATCH") == 0 || s.count("PUT") == 0 {
+		t.Fatalf("Expected an update and an add, got %d and %d", s.count("PATCH"), s.count("PUT"))
+	}
+
+	// Other failures are reported
+	s.set("PATCH /skydns/services/123", http.StatusForbidden)
+	h = c.KeepAlive("123", &msg.Service{TTL: 1})
+	defer h.Stop()
+	select {
+	case err := <-h.Errors:
+		if err != ErrInvalidResponse {
+			t.Errorf("Wrong heartbeat error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Failed heartbeat not reported")
+	}
+}
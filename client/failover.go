@@ -0,0 +1,270 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/miekg/dns"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoServers     = errors.New("No SkyDNS servers available")
+	ErrServerFailure = errors.New("SkyDNS server failure")
+)
+
+const (
+	// DefaultMaxFailures is the number of failures in a row after which a server is skipped.
+	DefaultMaxFailures = 3
+	// DefaultCooldown is how long a server is skipped after too many failures.
+	DefaultCooldown = 10 * time.Second
+)
+
+// Cluster describes a SkyDNS cluster, as returned by /skydns/cluster.
+type Cluster struct {
+	Leader  string   // HTTP address of the leader
+	Members []string // HTTP addresses of all members
+}
+
+// endpoint is a SkyDNS server with its circuit breaker.
+type endpoint struct {
+	addr      string
+	failures  int       // failures in a row
+	openUntil time.Time // while in the future the server is skipped
+}
+
+// endpoints is a list of servers that fails over to the next server when one
+// fails, and skips servers that keep failing for a while.
+type endpoints struct {
+	sync.Mutex
+	list        []*endpoint
+	maxFailures int
+	cooldown    time.Duration
+}
+
+func newEndpoints(addrs string) *endpoints {
+	e := &endpoints{maxFailures: DefaultMaxFailures, cooldown: DefaultCooldown}
+	e.set(strings.Split(addrs, ","))
+	return e
+}
+
+// set replaces the servers by addrs, keeping the state of the servers that remain.
+func (e *endpoints) set(addrs []string) {
+	e.Lock()
+	defer e.Unlock()
+
+	old := make(map[string]*endpoint, len(e.list))
+	for _, p := range e.list {
+		old[p.addr] = p
+	}
+	e.list = e.list[:0]
+	for _, a := range addrs {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if p, ok := old[a]; ok {
+			e.list = append(e.list, p)
+		} else {
+			e.list = append(e.list, &endpoint{addr: a})
+		}
+	}
+}
+
+// candidates returns the servers to try in order: the ones with a closed
+// circuit first, then the others, in case they recovered.
+func (e *endpoints) candidates() []*endpoint {
+	e.Lock()
+	defer e.Unlock()
+
+	now := time.Now()
+	var closed, open []*endpoint
+	for _, p := range e.list {
+		if now.Before(p.openUntil) {
+			open = append(open, p)
+		} else {
+			closed = append(closed, p)
+		}
+	}
+	return append(closed, open...)
+}
+
+// fail records a failure of p and opens its circuit after too many of them.
+func (e *endpoints) fail(p *endpoint) {
+	e.Lock()
+	defer e.Unlock()
+
+	p.failures++
+	if p.failures >= e.maxFailures {
+		p.openUntil = time.Now().Add(e.cooldown)
+	}
+}
+
+// succeed closes the circuit of p, and moves it to the front.
+func (e *endpoints) succeed(p *endpoint) {
+	e.Lock()
+	defer e.Unlock()
+
+	p.failures = 0
+	p.openUntil = time.Time{}
+	for i, q := range e.list {
+		if q == p {
+			copy(e.list[1:i+1], e.list[:i])
+			e.list[0] = p
+			break
+		}
+	}
+}
+
+// SetCircuitBreaker makes the client skip a server for cooldown after
+// maxFailures timeouts or server errors in a row.
+func (c *Client) SetCircuitBreaker(maxFailures int, cooldown time.Duration) {
+	for _, e := range []*endpoints{c.servers, c.dnsServers} {
+		e.Lock()
+		e.maxFailures, e.cooldown = maxFailures, cooldown
+		e.Unlock()
+	}
+}
+
+// do sends the request to the first server that answers it without a server
+// error (5xx). When all servers fail the last server error is returned as is.
+func (c *Client) do(method, path string, body []byte) (*http.Response, error) {
+	var last *http.Response
+	err := ErrNoServers
+	for _, p := range c.servers.candidates() {
+		req, e := c.newRequest(method, p.addr+path, body)
+		if e != nil {
+			return nil, e
+		}
+		resp, e := c.h.Do(req)
+		if e != nil {
+			c.servers.fail(p)
+			err = e
+			continue
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			c.servers.fail(p)
+			if last != nil {
+				last.Body.Close()
+			}
+			last = resp
+			continue
+		}
+		c.servers.succeed(p)
+		if last != nil {
+			last.Body.Close()
+		}
+		return resp, nil
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, err
+}
+
+// exchange sends the DNS query m to the first DNS server that answers it.
+func (c *Client) exchange(m *dns.Msg) (*dns.Msg, error) {
+	err := ErrNoServers
+	for _, p := range c.dnsServers.candidates() {
+		r, _, e := c.d.Exchange(m, p.addr)
+		if e != nil || r.Rcode == dns.RcodeServerFailure {
+			c.dnsServers.fail(p)
+			if e == nil {
+				e = ErrServerFailure
+			}
+			err = e
+			continue
+		}
+		c.dnsServers.succeed(p)
+		return r, nil
+	}
+	return nil, err
+}
+
+// GetCluster returns the leader and the members of the cluster.
+func (c *Client) GetCluster() (*Cluster, error) {
+	resp, err := c.do("GET", "/skydns/cluster", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrInvalidResponse
+	}
+
+	var out Cluster
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Discover replaces the HTTP servers the client talks to by the members of
+// the cluster, so the client keeps working when the servers it was created
+// with are gone.
+func (c *Client) Discover() error {
+	cl, err := c.GetCluster()
+	if err != nil {
+		return err
+	}
+	if len(cl.Members) == 0 {
+		return nil
+	}
+	scheme := "http://"
+	for _, p := range c.servers.candidates() {
+		if strings.HasPrefix(p.addr, "https://") {
+			scheme = "https://"
+		}
+	}
+	addrs := make([]string, len(cl.Members))
+	for i, m := range cl.Members {
+		addrs[i] = scheme + m
+	}
+	c.servers.set(addrs)
+	return nil
+}
+
+// CheckHealth asks every HTTP server for the cluster, updating the circuit
+// breakers, and returns the number of servers that are healthy.
+func (c *Client) CheckHealth() (healthy int) {
+	for _, p := range c.servers.candidates() {
+		req, err := c.newRequest("GET", p.addr+"/skydns/cluster", nil)
+		if err != nil {
+			continue
+		}
+		resp, err := c.h.Do(req)
+		if err != nil {
+			c.servers.fail(p)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			c.servers.fail(p)
+			continue
+		}
+		c.servers.succeed(p)
+		healthy++
+	}
+	return
+}
+
+// StartHealthChecks runs CheckHealth every interval until the returned channel
+// is closed.
+func (c *Client) StartHealthChecks(interval time.Duration) chan<- bool {
+	stop := make(chan bool)
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				c.CheckHealth()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return stop
+}
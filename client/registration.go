@@ -0,0 +1,237 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/skynetservices/skydns/msg"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// heartbeatRetry is the wait before a failed heartbeat is retried.
+	heartbeatRetry = 1 * time.Second
+	// watchRetry is the wait before a broken event stream is reconnected.
+	watchRetry = 1 * time.Second
+)
+
+// Event is a change of the registry, as streamed by /skydns/events.
+type Event struct {
+	Type    string // add, remove, expire, update, health or drain
+	Serial  uint32 // serial of the registry after the change
+	Service *msg.Service
+	Alias   *msg.Alias
+}
+
+// Register adds s with uuid. A service already registered with uuid, e.g. by
+// an earlier run of the same process, is replaced.
+func (c *Client) Register(uuid string, s *msg.Service) error {
+	err := c.Add(uuid, s)
+	if err != ErrConflictingUUID {
+		return err
+	}
+	if err := c.Deregister(uuid); err != nil && err != ErrServiceNotFound {
+		return err
+	}
+	return c.Add(uuid, s)
+}
+
+// Deregister removes the service with uuid.
+func (c *Client) Deregister(uuid string) error {
+	resp, err := c.do("DELETE", servicePath(uuid), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrServiceNotFound
+	case resp.StatusCode >= 300:
+		return ErrInvalidResponse
+	}
+	return nil
+}
+
+// Heartbeat keeps a service alive until it is stopped, see KeepAlive.
+type Heartbeat struct {
+	// Errors receives the heartbeats that failed. Errors that aren't received
+	// right away are dropped, the heartbeat goes on regardless.
+	Errors <-chan error
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// Stop stops the heartbeat and waits for a heartbeat in flight. The service
+// is left to expire, call Deregister to remove it right away.
+func (h *Heartbeat) Stop() {
+	h.once.Do(func() { close(h.stop) })
+	<-h.done
+}
+
+// KeepAlive renews the TTL of the service s registered with uuid in the
+// background, three times per TTL so one lost heartbeat doesn't expire it. A
+// failed heartbeat is retried after a second. When the service is gone
+// anyway, because it expired or was removed, it is registered again.
+func (c *Client) KeepAlive(uuid string, s *msg.Service) *Heartbeat {
+	errs := make(chan error, 1)
+	h := &Heartbeat{Errors: errs, stop: make(chan struct{}), done: make(chan struct{})}
+
+	interval := time.Duration(s.TTL) * time.Second / 3
+	if interval < heartbeatRetry {
+		interval = heartbeatRetry
+	}
+	go func() {
+		defer close(h.done)
+		t := time.NewTimer(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-t.C:
+			}
+			err := c.Update(uuid, s.TTL)
+			if err == ErrServiceNotFound {
+				err = c.Add(uuid, s)
+			}
+			next := interval
+			if err != nil {
+				next = heartbeatRetry
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+			t.Reset(next)
+		}
+	}()
+	return h
+}
+
+// Resolve returns the services matching query, a name in the domain format
+// without the domain, e.g. "testservice.production" or "*.*.east". Labels
+// that are left out or are * match anything.
+func (c *Client) Resolve(query string) ([]msg.Service, error) {
+	resp, err := c.do("GET", servicePath("")+"?query="+url.QueryEscape(query), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrServiceNotFound
+	default:
+		return nil, ErrInvalidResponse
+	}
+
+	var out []msg.Service
+	if err := msg.DefaultCodec.Decode(resp.Body, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Watch streams the changes of the registry from now on, until the returned
+// function is called. A broken stream is reconnected, to the next server if
+// need be, and resumes after the last event received.
+func (c *Client) Watch() (<-chan Event, func()) {
+	events := make(chan Event)
+	stop := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		defer close(events)
+		var last string
+		for {
+			if resp, err := c.stream(last); err == nil {
+				last = c.readEvents(resp, events, stop, last)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(watchRetry):
+			}
+		}
+	}()
+	return events, func() { once.Do(func() { close(stop) }) }
+}
+
+// stream opens the event stream on the first server that has it, resuming
+// after the event with id last if it is set.
+func (c *Client) stream(last string) (*http.Response, error) {
+	err := ErrNoServers
+	for _, p := range c.servers.candidates() {
+		req, e := c.newRequest("GET", p.addr+"/skydns/events", nil)
+		if e != nil {
+			return nil, e
+		}
+		if last != "" {
+			req.Header.Set("Last-Event-ID", last)
+		}
+		// The stream stays open, it can't have the timeout of c.h
+		resp, e := http.DefaultClient.Do(req)
+		if e != nil {
+			c.servers.fail(p)
+			err = e
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = ErrInvalidResponse
+			continue
+		}
+		c.servers.succeed(p)
+		return resp, nil
+	}
+	return nil, err
+}
+
+// readEvents sends the events in resp on events until the stream ends or stop
+// is closed, and returns the id of the last event sent.
+func (c *Client) readEvents(resp *http.Response, events chan<- Event, stop <-chan struct{}, last string) string {
+	defer resp.Body.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Unblocks the read below when the watch is stopped
+		select {
+		case <-stop:
+			resp.Body.Close()
+		case <-done:
+		}
+	}()
+
+	var id, data string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id:"):
+			id = strings.TrimSpace(line[3:])
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(line[5:])
+		case line == "" && data != "":
+			var e Event
+			if err := json.Unmarshal([]byte(data), &e); err == nil {
+				select {
+				case events <- e:
+				case <-stop:
+					return last
+				}
+				if _, err := strconv.ParseUint(id, 10, 32); err == nil {
+					last = id
+				}
+			}
+			id, data = "", ""
+		}
+	}
+	return last
+}
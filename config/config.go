@@ -0,0 +1,316 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package config sets command line flags from a configuration file and from
+// environment variables. The file is TOML, of which tables of keys with
+// strings, integers, floats, booleans and arrays of those are understood:
+//
+//	[forwarding]
+//	nameserver = ["8.8.8.8:53", "8.8.4.4:53"]
+//	upstreamcheck = "5s"
+//
+// A key sets the flag with its name, arrays are joined with commas.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Error is an error in the configuration, it names the key that is wrong.
+type Error struct {
+	Source string // file:line, or the environment variable
+	Key    string // table.key, empty for syntax errors
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Key == "" {
+		return e.Source + ": " + e.Err.Error()
+	}
+	return e.Source + ": " + e.Key + ": " + e.Err.Error()
+}
+
+// Setting is a key of a configuration file and its value, as a flag takes it.
+type Setting struct {
+	Key   string // table.key in lower case
+	Value string
+	Line  int
+}
+
+// File is a configuration file.
+type File struct {
+	Name     string
+	Settings []Setting
+}
+
+// Load reads the configuration file name.
+func Load(name string) (*File, error) {
+	r, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return Parse(name, r)
+}
+
+// Parse reads a configuration file from r, name is used in errors.
+func Parse(name string, r io.Reader) (*File, error) {
+	f := &File{Name: name}
+	seen := make(map[string]bool)
+	table := ""
+	scanner := bufio.NewScanner(r)
+	for i := 1; scanner.Scan(); i++ {
+		line, start := strings.TrimSpace(stripComment(scanner.Text())), i
+		if line == "" {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", name, start)
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, &Error{Source: source, Err: errors.New("Invalid table header")}
+			}
+			table = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if !bareKey(table) {
+				return nil, &Error{Source: source, Err: errors.New("Invalid table name " + table)}
+			}
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, &Error{Source: source, Err: errors.New("Expected key = value")}
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:eq]))
+		if !bareKey(key) {
+			return nil, &Error{Source: source, Err: errors.New("Invalid key " + key)}
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		raw := strings.TrimSpace(line[eq+1:])
+		// Arrays may span lines
+		for strings.HasPrefix(raw, "[") && !balanced(raw) && scanner.Scan() {
+			i++
+			raw += " " + strings.TrimSpace(stripComment(scanner.Text()))
+		}
+
+		value, err := parseValue(raw)
+		if err != nil {
+			return nil, &Error{Source: source, Key: key, Err: err}
+		}
+		if seen[key] {
+			return nil, &Error{Source: source, Key: key, Err: errors.New("Duplicate key")}
+		}
+		seen[key] = true
+		f.Settings = append(f.Settings, Setting{Key: key, Value: value, Line: start})
+	}
+	return f, scanner.Err()
+}
+
+// Apply sets the flags of fs to the settings of f. Tables lists the flags the
+// keys of each table may set, a key outside of the tables is an error. Flags
+// in skip, e.g. those given on the command line, are left alone.
+func (f *File) Apply(fs *flag.FlagSet, tables map[string][]string, skip map[string]bool) error {
+	flags := make(map[string]string) // table.flag in lower case -> flag name
+	for table, names := range tables {
+		for _, name := range names {
+			flags[table+"."+strings.ToLower(name)] = name
+		}
+	}
+	for _, s := range f.Settings {
+		source := fmt.Sprintf("%s:%d", f.Name, s.Line)
+		name, ok := flags[s.Key]
+		if !ok {
+			return &Error{Source: source, Key: s.Key, Err: errors.New("Unknown key")}
+		}
+		if skip[name] {
+			continue
+		}
+		if err := fs.Set(name, s.Value); err != nil {
+			return &Error{Source: source, Key: s.Key, Err: invalid(s.Value, err)}
+		}
+	}
+	return nil
+}
+
+// Reset sets the flags the keys of tables may set back to their defaults,
+// except those in skip, so a key removed from the file is reverted when the
+// file is applied again.
+func Reset(fs *flag.FlagSet, tables map[string][]string, skip map[string]bool) error {
+	for _, names := range tables {
+		for _, name := range names {
+			fl := fs.Lookup(name)
+			if fl == nil || skip[name] {
+				continue
+			}
+			if err := fs.Set(name, fl.DefValue); err != nil {
+				return &Error{Source: "default", Key: name, Err: invalid(fl.DefValue, err)}
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyEnv sets the flags of fs that have an environment variable, named
+// prefix followed by the name of the flag in upper case, e.g. SKYDNS_MINTTL.
+// Flags in skip are left alone. It returns the names of the flags it set.
+func ApplyEnv(fs *flag.FlagSet, prefix string, skip map[string]bool) (map[string]bool, error) {
+	set := make(map[string]bool)
+	var err error
+	fs.VisitAll(func(fl *flag.Flag) {
+		env := prefix + strings.ToUpper(fl.Name)
+		v, ok := os.LookupEnv(env)
+		if !ok || skip[fl.Name] || err != nil {
+			return
+		}
+		if e := fs.Set(fl.Name, v); e != nil {
+			err = &Error{Source: env, Key: fl.Name, Err: invalid(v, e)}
+			return
+		}
+		set[fl.Name] = true
+	})
+	return set, err
+}
+
+// invalid returns the error for a value a flag doesn't take.
+func invalid(value string, err error) error {
+	return fmt.Errorf("Invalid value %q: %s", value, err)
+}
+
+// parseValue returns the value in raw as a flag takes it.
+func parseValue(raw string) (string, error) {
+	if raw == "" {
+		return "", errors.New("Missing value")
+	}
+	if raw[0] == '[' {
+		if !strings.HasSuffix(raw, "]") || !balanced(raw) {
+			return "", errors.New("Unterminated array")
+		}
+		var values []string
+		for _, elem := range splitArray(raw[1 : len(raw)-1]) {
+			if elem == "" {
+				continue
+			}
+			if elem[0] == '[' {
+				return "", errors.New("Nested arrays aren't supported")
+			}
+			v, err := parseValue(elem)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, v)
+		}
+		return strings.Join(values, ","), nil
+	}
+
+	switch raw[0] {
+	case '"':
+		if len(raw) < 2 || !strings.HasSuffix(raw, `"`) {
+			return "", errors.New("Unterminated string")
+		}
+		v, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", errors.New("Invalid string " + raw)
+		}
+		return v, nil
+	case '\'':
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") || strings.Contains(raw[1:len(raw)-1], "'") {
+			return "", errors.New("Unterminated string")
+		}
+		return raw[1 : len(raw)-1], nil
+	}
+	if raw == "true" || raw == "false" {
+		return raw, nil
+	}
+	n := strings.Replace(raw, "_", "", -1)
+	if _, err := strconv.ParseFloat(n, 64); err != nil {
+		return "", errors.New("Invalid value " + raw + ", strings must be quoted")
+	}
+	return n, nil
+}
+
+// splitArray splits the elements of an array at the commas outside strings.
+func splitArray(s string) (elems []string) {
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			elems = append(elems, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(elems, strings.TrimSpace(s[start:]))
+}
+
+// stripComment removes a comment outside strings from line.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// balanced reports whether the brackets outside strings in s are closed.
+func balanced(s string) bool {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth == 0
+}
+
+// bareKey reports whether k is a bare TOML key.
+func bareKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, c := range k {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
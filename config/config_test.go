@@ -0,0 +1,180 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package config
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		file  string
+		key   string
+		value string
+	}{
+		{"basic string", `[dns]
+minttl = "30"`, "dns.minttl", "30"},
+		{"literal string", `nameserver = 'C:\dns'`, "nameserver", `C:\dns`},
+		{"escapes", `domain = "a\tb\"c"`, "domain", "a\tb\"c"},
+		{"hash in string", `domain = "a#b" # comment`, "domain", "a#b"},
+		{"hash in literal string", `domain = 'a#b'`, "domain", "a#b"},
+		{"comment line", "# nameserver = 1\nminttl = 1", "minttl", "1"},
+		{"integer", "minttl = 1_000", "minttl", "1000"},
+		{"float", "ratelimit = 0.5", "ratelimit", "0.5"},
+		{"boolean", "discover = true", "discover", "true"},
+		{"array", `nameserver = ["8.8.8.8:53", '8.8.4.4:53']`, "nameserver", "8.8.8.8:53,8.8.4.4:53"},
+		{"array of numbers", "ports = [1, 2, 3,]", "ports", "1,2,3"},
+		{"comma in array string", `names = ["a,b", "c]"]`, "names", "a,b,c]"},
+		{"multiline array", "nameserver = [\n  \"8.8.8.8:53\", # first\n  \"8.8.4.4:53\",\n]", "nameserver", "8.8.8.8:53,8.8.4.4:53"},
+		{"upper case", "[DNS]\nMinTTL = 5", "dns.minttl", "5"},
+		{"empty array", "nameserver = []", "nameserver", ""},
+	} {
+		f, err := Parse("test.toml", strings.NewReader(tc.file))
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if len(f.Settings) != 1 || f.Settings[0].Key != tc.key || f.Settings[0].Value != tc.value {
+			t.Errorf("%s: expected %s = %q, got %v", tc.name, tc.key, tc.value, f.Settings)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		file   string
+		source string
+		key    string
+	}{
+		{"bare string", "domain = skydns.local", "test.toml:1", "domain"},
+		{"missing value", "domain =", "test.toml:1", "domain"},
+		{"missing equals", "\ndomain", "test.toml:2", ""},
+		{"unterminated string", `domain = "skydns`, "test.toml:1", "domain"},
+		{"unterminated literal string", "domain = 'sky'dns'", "test.toml:1", "domain"},
+		{"unterminated array", `nameserver = ["8.8.8.8:53"`, "test.toml:1", "nameserver"},
+		{"nested array", "nameserver = [[1], [2]]", "test.toml:1", "nameserver"},
+		{"array of tables", "[[dns]]", "test.toml:1", ""},
+		{"bad table", "[dns", "test.toml:1", ""},
+		{"bad key", "dns.minttl = 1", "test.toml:1", ""},
+		{"duplicate key", "[dns]\nminttl = 1\n[dns]\nminttl = 2", "test.toml:4", "dns.minttl"},
+	} {
+		_, err := Parse("test.toml", strings.NewReader(tc.file))
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%s: expected a configuration error, got %v", tc.name, err)
+			continue
+		}
+		if e.Source != tc.source || e.Key != tc.key {
+			t.Errorf("%s: expected the error at %s for %q, got %s", tc.name, tc.source, tc.key, e)
+		}
+	}
+}
+
+func newFlagSet() (*flag.FlagSet, *int, *string, *time.Duration) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	minTTL := fs.Int("minttl", 60, "")
+	nameserver := fs.String("nameserver", "", "")
+	check := fs.Duration("upstreamCheck", 10*time.Second, "")
+	return fs, minTTL, nameserver, check
+}
+
+var testTables = map[string][]string{
+	"dns":        {"minttl"},
+	"forwarding": {"nameserver", "upstreamCheck"},
+}
+
+func TestApply(t *testing.T) {
+	f, err := Parse("test.toml", strings.NewReader(`
+[dns]
+minttl = 30
+[forwarding]
+nameserver = ["8.8.8.8:53", "8.8.4.4:53"]
+upstreamcheck = "5s"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, minTTL, nameserver, check := newFlagSet()
+	if err := f.Apply(fs, testTables, map[string]bool{"minttl": true}); err != nil {
+		t.Fatal(err)
+	}
+	if *minTTL != 60 || *nameserver != "8.8.8.8:53,8.8.4.4:53" || *check != 5*time.Second {
+		t.Fatalf("Wrong flags: minttl %d, nameserver %q, upstreamcheck %s", *minTTL, *nameserver, *check)
+	}
+
+	for _, tc := range []struct {
+		file string
+		key  string
+	}{
+		{"[dns]\nnameserver = \"8.8.8.8:53\"", "dns.nameserver"}, // in the wrong table
+		{"minttl = 30", "minttl"},                                // outside of the tables
+		{"[dns]\nminttl = \"30s\"", "dns.minttl"},                // not an integer
+	} {
+		f, err := Parse("test.toml", strings.NewReader(tc.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, _, _, _ := newFlagSet()
+		if err, ok := f.Apply(fs, testTables, nil).(*Error); !ok || err.Key != tc.key {
+			t.Errorf("Expected an error for %s, got %v", tc.key, err)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	fs, minTTL, nameserver, check := newFlagSet()
+	fs.Set("minttl", "5")
+	fs.Set("nameserver", "8.8.8.8:53")
+	fs.Set("upstreamCheck", "1s")
+
+	// A key deleted from the file reverts, fixed flags don't
+	if err := Reset(fs, testTables, map[string]bool{"nameserver": true}); err != nil {
+		t.Fatal(err)
+	}
+	if *minTTL != 60 || *nameserver != "8.8.8.8:53" || *check != 10*time.Second {
+		t.Fatalf("Wrong flags after reset: minttl %d, nameserver %q, upstreamcheck %s", *minTTL, *nameserver, *check)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	os.Setenv("SKYDNSTEST_MINTTL", "15")
+	os.Setenv("SKYDNSTEST_NAMESERVER", "8.8.8.8:53")
+	defer os.Unsetenv("SKYDNSTEST_MINTTL")
+	defer os.Unsetenv("SKYDNSTEST_NAMESERVER")
+
+	fs, minTTL, nameserver, _ := newFlagSet()
+	set, err := ApplyEnv(fs, "SKYDNSTEST_", map[string]bool{"nameserver": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *minTTL != 15 || *nameserver != "" || !set["minttl"] || set["nameserver"] {
+		t.Fatalf("Wrong flags from the environment: minttl %d, nameserver %q, set %v", *minTTL, *nameserver, set)
+	}
+
+	// The environment wins over the file
+	f, err := Parse("test.toml", strings.NewReader("[dns]\nminttl = 30"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Apply(fs, testTables, set); err != nil {
+		t.Fatal(err)
+	}
+	if *minTTL != 15 {
+		t.Fatalf("Environment should win over the file, got minttl %d", *minTTL)
+	}
+
+	os.Setenv("SKYDNSTEST_MINTTL", "15s")
+	fs, _, _, _ = newFlagSet()
+	if _, err := ApplyEnv(fs, "SKYDNSTEST_", nil); err == nil || err.(*Error).Source != "SKYDNSTEST_MINTTL" {
+		t.Fatalf("Expected an error naming the environment variable, got %v", err)
+	}
+}
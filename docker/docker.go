@@ -0,0 +1,377 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package docker registers the containers that run on a Docker host as
+// services, from their labels and published ports, and removes them again
+// when they stop.
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/skynetservices/skydns/client"
+	"github.com/skynetservices/skydns/msg"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Labels of containers that describe their services. Containers without
+// LabelName aren't registered.
+const (
+	LabelName        = "skydns.name"
+	LabelVersion     = "skydns.version"     // defaults to DefaultVersion
+	LabelEnvironment = "skydns.environment" // defaults to DefaultEnvironment
+	LabelRegion      = "skydns.region"      // defaults to the region of the Registrar
+	LabelPort        = "skydns.port"        // only register this container port, e.g. 8080/tcp
+)
+
+// Defaults of services of containers.
+const (
+	DefaultVersion     = "1.0.0"
+	DefaultEnvironment = "production"
+	DefaultTTL         = 30 // seconds
+
+	// retryInterval is the time between attempts to connect to Docker.
+	retryInterval = 5 * time.Second
+)
+
+// ErrEndpoint is returned for Docker endpoints that aren't understood.
+var ErrEndpoint = errors.New("Docker endpoint must be unix:///path or tcp://host:port")
+
+// Registry is what containers are registered with, usually a *client.Client.
+// Update returns client.ErrServiceNotFound for services that are gone, they
+// are registered again.
+type Registry interface {
+	Add(uuid string, s *msg.Service) error
+	Delete(uuid string) error
+	Update(uuid string, ttl uint32) error
+}
+
+// Registrar keeps the services of the containers in a Registry.
+type Registrar struct {
+	Host   string // address the services are registered with, defaults to the address the ports are published on
+	Region string // region of containers without LabelRegion
+	TTL    uint32 // of the services, they get a heartbeat every TTL/2 seconds
+
+	registry Registry
+	docker   *http.Client
+	base     string // URL of the Docker API
+
+	mutex      sync.Mutex
+	containers map[string]map[string]*msg.Service // container ID -> UUID -> service
+}
+
+// NewRegistrar returns a Registrar for the Docker daemon at endpoint, e.g.
+// unix:///var/run/docker.sock or tcp://127.0.0.1:2375.
+func NewRegistrar(endpoint string, r Registry) (*Registrar, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	reg := &Registrar{Region: "docker", TTL: DefaultTTL, registry: r, containers: make(map[string]map[string]*msg.Service)}
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		reg.base = "http://docker"
+		reg.docker = &http.Client{Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) { return net.Dial("unix", path) },
+		}}
+	case "tcp":
+		reg.base = "http://" + u.Host
+		reg.docker = &http.Client{}
+	default:
+		return nil, ErrEndpoint
+	}
+	return reg, nil
+}
+
+// container is the part of a container's inspection the Registrar uses.
+type container struct {
+	ID     string
+	Name   string
+	Config struct {
+		Labels map[string]string
+	}
+	State struct {
+		Running bool
+	}
+	NetworkSettings struct {
+		IPAddress string
+		Ports     map[string][]binding // e.g. 8080/tcp -> bindings
+	}
+}
+
+// binding is the address a container port is published on.
+type binding struct {
+	HostIp   string
+	HostPort string
+}
+
+// event is an event of the Docker events API, old Docker versions use Status
+// and ID, newer ones Action and Actor.
+type event struct {
+	Status string `json:"status"`
+	ID     string `json:"id"`
+	Type   string
+	Action string
+	Actor  struct {
+		ID string
+	}
+}
+
+// Run registers the running containers and then follows the events of Docker
+// until stop is closed, reconnecting when the connection breaks.
+func (r *Registrar) Run(stop <-chan bool) {
+	if r.TTL == 0 {
+		r.TTL = DefaultTTL
+	}
+	heartbeat := time.NewTicker(time.Duration(r.TTL) * time.Second / 2)
+	defer heartbeat.Stop()
+	go func() {
+		for {
+			select {
+			case <-heartbeat.C:
+				r.heartbeat()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		if err := r.sync(); err != nil {
+			slog.Error("Listing containers", "err", err)
+		} else if err := r.watch(stop); err != nil {
+			slog.Error("Watching Docker events", "err", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// sync registers the containers that are running and removes the services of
+// containers that no longer are.
+func (r *Registrar) sync() error {
+	var list []struct{ Id string }
+	if err := r.get("/containers/json", &list); err != nil {
+		return err
+	}
+	running := make(map[string]bool, len(list))
+	for _, c := range list {
+		running[c.Id] = true
+		r.start(c.Id)
+	}
+
+	r.mutex.Lock()
+	var gone []string
+	for id := range r.containers {
+		if !running[id] {
+			gone = append(gone, id)
+		}
+	}
+	r.mutex.Unlock()
+	for _, id := range gone {
+		r.die(id)
+	}
+	return nil
+}
+
+// watch handles the start and die events of containers until the stream ends
+// or stop is closed.
+func (r *Registrar) watch(stop <-chan bool) error {
+	filters := url.QueryEscape(`{"type":["container"],"event":["start","die"]}`)
+	req, err := http.NewRequest("GET", r.base+"/events?filters="+filters, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.docker.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Docker returned %s", resp.Status)
+	}
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			resp.Body.Close()
+		case <-done:
+		}
+	}()
+
+	d := json.NewDecoder(resp.Body)
+	for {
+		var e event
+		if err := d.Decode(&e); err != nil {
+			return err
+		}
+		id, action := e.ID, e.Status
+		if e.Actor.ID != "" {
+			id, action = e.Actor.ID, e.Action
+		}
+		switch action {
+		case "start":
+			r.start(id)
+		case "die":
+			r.die(id)
+		}
+	}
+}
+
+// start registers the services of the container with the given id.
+func (r *Registrar) start(id string) {
+	r.mutex.Lock()
+	_, ok := r.containers[id]
+	r.mutex.Unlock()
+	if ok {
+		return
+	}
+
+	var c container
+	if err := r.get("/containers/"+id+"/json", &c); err != nil {
+		slog.Error("Inspecting container", "id", id, "err", err)
+		return
+	}
+	if !c.State.Running {
+		return
+	}
+	services := r.services(c)
+	if len(services) == 0 {
+		return
+	}
+
+	// Services that fail to register are registered by the next heartbeat
+	for uuid, s := range services {
+		// A conflict is a service registered before SkyDNS or the Registrar restarted
+		if err := r.registry.Add(uuid, s); err != nil && err != client.ErrConflictingUUID {
+			slog.Error("Registering container", "container", c.Name, "uuid", uuid, "err", err)
+			continue
+		}
+		slog.Info("Registered container", "container", c.Name, "uuid", uuid)
+	}
+	r.mutex.Lock()
+	r.containers[id] = services
+	r.mutex.Unlock()
+}
+
+// die removes the services of the container with the given id.
+func (r *Registrar) die(id string) {
+	r.mutex.Lock()
+	services := r.containers[id]
+	delete(r.containers, id)
+	r.mutex.Unlock()
+
+	for uuid := range services {
+		if err := r.registry.Delete(uuid); err != nil {
+			slog.Error("Removing service", "uuid", uuid, "err", err)
+			continue
+		}
+		slog.Info("Removed service", "uuid", uuid)
+	}
+}
+
+// heartbeat updates the TTL of the services of all containers, and registers
+// the ones that are missing.
+func (r *Registrar) heartbeat() {
+	r.mutex.Lock()
+	services := make(map[string]*msg.Service)
+	for _, c := range r.containers {
+		for uuid, s := range c {
+			services[uuid] = s
+		}
+	}
+	r.mutex.Unlock()
+
+	for uuid, s := range services {
+		err := r.registry.Update(uuid, r.TTL)
+		if err == client.ErrServiceNotFound {
+			err = r.registry.Add(uuid, s)
+		}
+		if err != nil {
+			slog.Error("Heartbeat", "uuid", uuid, "err", err)
+		}
+	}
+}
+
+// services returns the services of c by UUID, one for each published port or
+// only the one for LabelPort. A container port that isn't published is
+// registered with the address of the container.
+func (r *Registrar) services(c container) map[string]*msg.Service {
+	labels := c.Config.Labels
+	name := labels[LabelName]
+	if name == "" {
+		return nil
+	}
+	label := func(k, def string) string {
+		if v := labels[k]; v != "" {
+			return v
+		}
+		return def
+	}
+
+	ports := c.NetworkSettings.Ports
+	if p := labels[LabelPort]; p != "" {
+		if !strings.Contains(p, "/") {
+			p += "/tcp"
+		}
+		ports = map[string][]binding{p: c.NetworkSettings.Ports[p]}
+	}
+
+	services := make(map[string]*msg.Service)
+	for p, bindings := range ports {
+		host, port := c.NetworkSettings.IPAddress, strings.SplitN(p, "/", 2)[0]
+		if len(bindings) > 0 {
+			host, port = r.Host, bindings[0].HostPort
+			if host == "" && bindings[0].HostIp != "0.0.0.0" && bindings[0].HostIp != "" {
+				host = bindings[0].HostIp
+			}
+		}
+		n, err := strconv.ParseUint(port, 10, 16)
+		if host == "" || err != nil {
+			slog.Error("No address to register container port with", "container", c.Name, "port", p)
+			continue
+		}
+		uuid := c.ID
+		if len(uuid) > 12 {
+			uuid = uuid[:12]
+		}
+		uuid += "-" + strings.Replace(p, "/", "-", 1)
+		services[uuid] = &msg.Service{
+			Name:        name,
+			Version:     label(LabelVersion, DefaultVersion),
+			Environment: label(LabelEnvironment, DefaultEnvironment),
+			Region:      label(LabelRegion, r.Region),
+			Host:        host,
+			Port:        uint16(n),
+			TTL:         r.TTL,
+		}
+	}
+	return services
+}
+
+// get decodes the reply of Docker to a GET of path into v.
+func (r *Registrar) get(path string, v interface{}) error {
+	resp, err := r.docker.Get(r.base + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Docker returned %s for %s", resp.Status, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
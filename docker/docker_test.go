@@ -0,0 +1,211 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package docker
+
+import (
+	"encoding/json"
+	"github.com/skynetservices/skydns/msg"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDocker serves the containers and streams the events sent on events,
+// as the Docker API does.
+type fakeDocker struct {
+	sync.Mutex
+	containers map[string]container
+	events     chan event
+}
+
+func (d *fakeDocker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/containers/json":
+		d.Lock()
+		var list []struct{ Id string }
+		for id, c := range d.containers {
+			if c.State.Running {
+				list = append(list, struct{ Id string }{id})
+			}
+		}
+		d.Unlock()
+		json.NewEncoder(w).Encode(list)
+	case strings.HasPrefix(req.URL.Path, "/containers/"):
+		d.Lock()
+		c, ok := d.containers[strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/containers/"), "/json")]
+		d.Unlock()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		json.NewEncoder(w).Encode(c)
+	case req.URL.Path == "/events":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case e := <-d.events:
+				json.NewEncoder(w).Encode(e)
+				w.(http.Flusher).Flush()
+			case <-req.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (d *fakeDocker) set(c container) {
+	d.Lock()
+	defer d.Unlock()
+	d.containers[c.ID] = c
+}
+
+// fakeRegistry records the services added and deleted.
+type fakeRegistry struct {
+	sync.Mutex
+	services map[string]*msg.Service
+}
+
+func (r *fakeRegistry) Add(uuid string, s *msg.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	r.services[uuid] = s
+	return nil
+}
+
+func (r *fakeRegistry) Delete(uuid string) error {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.services, uuid)
+	return nil
+}
+
+func (r *fakeRegistry) Update(uuid string, ttl uint32) error { return nil }
+
+func (r *fakeRegistry) has(uuid string) bool {
+	r.Lock()
+	defer r.Unlock()
+	_, ok := r.services[uuid]
+	return ok
+}
+
+func newContainer(id string, running bool, labels map[string]string, ports map[string][]binding) container {
+	var c container
+	c.ID, c.Name = id, "/"+id
+	c.Config.Labels = labels
+	c.State.Running = running
+	c.NetworkSettings.IPAddress = "172.17.0.2"
+	c.NetworkSettings.Ports = ports
+	return c
+}
+
+func TestServices(t *testing.T) {
+	r := &Registrar{Region: "docker", TTL: DefaultTTL}
+	published := map[string][]binding{"8080/tcp": {{HostIp: "0.0.0.0", HostPort: "32768"}}, "9000/tcp": nil}
+
+	for _, tc := range []struct {
+		name   string
+		host   string
+		labels map[string]string
+		ports  map[string][]binding
+		want   map[string]msg.Service
+	}{
+		{"no name label", "", map[string]string{LabelVersion: "2.0.0"}, published, map[string]msg.Service{}},
+		{"defaults", "10.0.0.1", map[string]string{LabelName: "web"}, published, map[string]msg.Service{
+			"0123456789ab-8080-tcp": {Name: "web", Version: DefaultVersion, Environment: DefaultEnvironment, Region: "docker", Host: "10.0.0.1", Port: 32768, TTL: DefaultTTL},
+			"0123456789ab-9000-tcp": {Name: "web", Version: DefaultVersion, Environment: DefaultEnvironment, Region: "docker", Host: "172.17.0.2", Port: 9000, TTL: DefaultTTL},
+		}},
+		{"labels", "10.0.0.1", map[string]string{LabelName: "web", LabelVersion: "2.0.0", LabelEnvironment: "staging", LabelRegion: "east", LabelPort: "8080"}, published, map[string]msg.Service{
+			"0123456789ab-8080-tcp": {Name: "web", Version: "2.0.0", Environment: "staging", Region: "east", Host: "10.0.0.1", Port: 32768, TTL: DefaultTTL},
+		}},
+		{"binding address", "", map[string]string{LabelName: "web"}, map[string][]binding{"53/udp": {{HostIp: "10.0.0.2", HostPort: "5353"}}}, map[string]msg.Service{
+			"0123456789ab-53-udp": {Name: "web", Version: DefaultVersion, Environment: DefaultEnvironment, Region: "docker", Host: "10.0.0.2", Port: 5353, TTL: DefaultTTL},
+		}},
+		{"no address", "", map[string]string{LabelName: "web"}, map[string][]binding{"8080/tcp": {{HostIp: "0.0.0.0", HostPort: "32768"}}}, map[string]msg.Service{}},
+	} {
+		r.Host = tc.host
+		services := r.services(newContainer("0123456789abcdef", true, tc.labels, tc.ports))
+		if len(services) != len(tc.want) {
+			t.Errorf("%s: expected %d services, got %v", tc.name, len(tc.want), services)
+			continue
+		}
+		for uuid, want := range tc.want {
+			if s, ok := services[uuid]; !ok || !reflect.DeepEqual(*s, want) {
+				t.Errorf("%s: expected %s to be %+v, got %+v", tc.name, uuid, want, s)
+			}
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	d := &fakeDocker{containers: make(map[string]container), events: make(chan event)}
+	web := map[string]string{LabelName: "web"}
+	ports := map[string][]binding{"8080/tcp": nil}
+	d.set(newContainer("running", true, web, ports))
+	d.set(newContainer("stopped", false, web, ports))
+	d.set(newContainer("unlabeled", true, nil, ports))
+	ts := httptest.NewServer(d)
+	defer ts.Close()
+
+	reg := &fakeRegistry{services: make(map[string]*msg.Service)}
+	r, err := NewRegistrar("tcp://"+strings.TrimPrefix(ts.URL, "http://"), reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan bool)
+	defer close(stop)
+	go r.Run(stop)
+
+	wait := func(f func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if f() {
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+	if !wait(func() bool { return reg.has("running-8080-tcp") }) {
+		t.Fatal("Running container should be registered")
+	}
+	if reg.has("stopped-8080-tcp") || reg.has("unlabeled-8080-tcp") {
+		t.Fatalf("Only running containers with a name should be registered, got %v", reg.services)
+	}
+
+	// A container that starts is registered
+	d.set(newContainer("started", true, web, ports))
+	d.events <- event{Type: "container", Action: "start", Actor: struct{ ID string }{"started"}}
+	if !wait(func() bool { return reg.has("started-8080-tcp") }) {
+		t.Fatal("Started container should be registered")
+	}
+
+	// A container that dies is removed, old Docker versions send Status and ID
+	d.events <- event{Status: "die", ID: "running"}
+	if !wait(func() bool { return !reg.has("running-8080-tcp") }) {
+		t.Fatal("Stopped container should be removed")
+	}
+	if !reg.has("started-8080-tcp") {
+		t.Fatal("Other containers should stay registered")
+	}
+}
+
+func TestNewRegistrar(t *testing.T) {
+	for endpoint, valid := range map[string]bool{
+		"unix:///var/run/docker.sock": true,
+		"tcp://127.0.0.1:2375":        true,
+		"http://127.0.0.1:2375":       false,
+		"127.0.0.1:2375":              false,
+	} {
+		if _, err := NewRegistrar(endpoint, nil); (err == nil) != valid {
+			t.Errorf("%s: expected valid %t, got %v", endpoint, valid, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package logging sets up the leveled, structured logging of SkyDNS, which is
+// done with log/slog. Messages are logged with a key and value for each
+// detail, e.g.
+//
+//	slog.Error("Removing service", "uuid", uuid, "err", err)
+//
+// and written as text or as JSON, one object per line.
+package logging
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// ErrLevel is returned for unknown log levels.
+var ErrLevel = errors.New("Log level must be debug, info, warn or error")
+
+// ParseLevel returns the level named s: debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, ErrLevel
+}
+
+// NewLogger returns a logger writing the records of at least level to w, as
+// JSON if json is set and as key=value text otherwise.
+func NewLogger(w io.Writer, level slog.Level, json bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if json {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// Setup makes the default logger write the records of at least level to
+// stderr. What is logged with the log package, e.g. by libraries, ends up
+// there too, at the info level.
+func Setup(level string, json bool) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(NewLogger(os.Stderr, l, json))
+	return nil
+}
+
+// Fatal logs msg and args at the error level and exits.
+func Fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
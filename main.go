@@ -8,10 +8,14 @@ import (
 	"flag"
 	"github.com/goraft/raft"
 	"github.com/miekg/dns"
-	"github.com/rcrowley/go-metrics"
-	"github.com/rcrowley/go-metrics/stathat"
+	"github.com/skynetservices/skydns/bridge"
+	"github.com/skynetservices/skydns/client"
+	"github.com/skynetservices/skydns/config"
+	"github.com/skynetservices/skydns/docker"
+	"github.com/skynetservices/skydns/logging"
 	"github.com/skynetservices/skydns/server"
-	"log"
+	"github.com/skynetservices/skydns/stats"
+	"io"
 	"net"
 	"os"
 	"strings"
@@ -19,18 +23,92 @@ import (
 )
 
 var (
+	configFile                         string
 	join, ldns, lhttp, dataDir, domain string
 	rtimeout, wtimeout                 time.Duration
-	discover                           bool
+	discover, replica                  bool
 	metricsToStdErr                    bool
 	graphiteServer, stathatUser        string
+	statsdServer, statsdTags           string
 	secret                             string
 	nameserver                         string
+	debugACL                           string
+	debugWindow                        time.Duration
+	cacheSize                          int
+	cacheMaxTTL                        time.Duration
+	minTTL                             uint
+	negCacheTTL                        time.Duration
+	answerCacheSize                    int
+	answerCacheTTL                     time.Duration
+	upstreamCheck, upstreamCooldown    time.Duration
+	upstreamFailures                   int
+	transferACL                        string
+	ixfr                               bool
+	maxBody                            int64
+	maxDepth                           int
+	strictJSON                         bool
+	ldot, ldoh, tlsCert, tlsKey        string
+	apiTLS                             bool
+	apiCA, tokenFile                   string
+	replicaToken                       string
+	lgrpc                              string
+	expiryWarning                      time.Duration
+	shutdownTimeout                    time.Duration
+	snapshotEntries                    uint64
+	rewriteFile                        string
+	templateFile                       string
+	viewFile                           string
+	zoneFile                           string
+	ttlPolicyFile                      string
+	quotaEnvironment, quotaName        int
+	quotaSource                        int
+	webhooks, webhookSecret            string
+	aclFile                            string
+	subnetACL                          string
+	churnHints                         bool
+	maxAnswers                         int
+	glue                               bool
+	stale                              bool
+	maxStale                           time.Duration
+	staleTTL                           int
+	mdns                               bool
+	mdnsInterface                      string
+	forward                            bool
+	checkWorkers                       int
+	dockerEndpoint, dockerHost         string
+	consulAddr, etcdAddr, etcdDir      string
+	syncInterval                       time.Duration
+	syncBack                           bool
+	syncConflict                       string
+	rateLimit                          float64
+	rateBurst, rateSlip                int
+	ratePrefix4, ratePrefix6           int
+	logLevel                           string
+	logJSON                            bool
+	queryLogDest                       string
+	queryLogSample                     float64
+	queryLogFailures                   bool
+	profiling                          bool
 )
 
+// configTables lists the flags each table of the -config file may set.
+var configTables = map[string][]string{
+	"server":     {"domain", "dns", "http", "data", "join", "discover", "replica", "replicatoken", "secret", "rtimeout", "wtimeout", "shutdowntimeout", "snapshot", "forward", "grpc"},
+	"registry":   {"expirywarning", "checkworkers", "docker", "dockerhost", "consul", "etcd", "etcddir", "syncinterval", "syncback", "syncconflict", "ttlpolicy", "quotaenvironment", "quotaname", "quotasource", "webhook", "webhooksecret"},
+	"api":        {"maxbody", "maxdepth", "strictjson", "tokens", "profiling"},
+	"dns":        {"minttl", "negcachettl", "answercache", "answercachettl", "transferacl", "ixfr", "acl", "rewrite", "templates", "views", "subnetacl", "zones", "ratelimit", "rateburst", "rateslip", "rateprefix4", "rateprefix6", "churnhints", "maxanswers", "glue", "stale", "maxstale", "stalettl", "mdns", "mdnsinterface", "debugacl", "debugwindow"},
+	"forwarding": {"nameserver", "cachesize", "cachemaxttl", "upstreamcheck", "upstreamfailures", "upstreamcooldown"},
+	"stats":      {"metricsToStdErr", "graphiteServer", "stathatUser", "statsd", "statsdtags"},
+	"tls":        {"dot", "doh", "tlscert", "tlskey", "apitls", "apica"},
+	"log":        {"loglevel", "logjson", "querylog", "querylogsample", "querylogfailures"},
+}
+
 func init() {
+	flag.StringVar(&configFile, "config", "", "TOML file with settings, flags and SKYDNS_<FLAG> environment variables override it")
 	flag.StringVar(&join, "join", "", "Member of SkyDNS cluster to join can be comma separated list")
 	flag.BoolVar(&discover, "discover", false, "Auto discover SkyDNS cluster. Performs an NS lookup on the -domain to find SkyDNS members")
+	flag.BoolVar(&replica, "replica", false, "Follow the -join or -discover members as a read-only replica, which serves DNS but doesn't take part in raft")
+	flag.StringVar(&replicaToken, "replicatoken", "", "name:secret of the API token a -replica signs its requests to the members with, instead of -secret")
 	flag.StringVar(&domain, "domain",
 		func() string {
 			if x := os.Getenv("SKYDNS_DOMAIN"); x != "" {
@@ -55,45 +133,128 @@ func init() {
 			}
 			return "127.0.0.1:8080"
 		}(), "IP:Port to bind to for HTTP or env. var. SKYDNS")
+	flag.StringVar(&ldot, "dot", "", "IP:Port to bind to for DNS-over-TLS e.g. 127.0.0.1:853")
+	flag.StringVar(&ldoh, "doh", "", "IP:Port to bind to for DNS-over-HTTPS e.g. 127.0.0.1:443")
+	flag.StringVar(&tlsCert, "tlscert", "", "Certificate file for DNS-over-TLS, DNS-over-HTTPS and the HTTPS api")
+	flag.StringVar(&tlsKey, "tlskey", "", "Private key file for DNS-over-TLS, DNS-over-HTTPS and the HTTPS api")
+	flag.BoolVar(&apiTLS, "apitls", false, "Serve the http api, and raft, over HTTPS")
+	flag.StringVar(&apiCA, "apica", "", "CA certificates to verify other members with when -apitls is set, defaults to the system roots")
+	flag.StringVar(&lgrpc, "grpc", "", "IP:Port to bind to for the gRPC api e.g. 127.0.0.1:8053")
+	flag.StringVar(&tokenFile, "tokens", "", "File with tokens for the http api, limited to environments, reloaded on SIGHUP")
 	flag.StringVar(&dataDir, "data", "./data", "SkyDNS data directory")
+	flag.Uint64Var(&snapshotEntries, "snapshot", server.DefaultSnapshotEntries, "Snapshot the registry and compact the raft log every this many log entries, 0 disables snapshots")
 	flag.DurationVar(&rtimeout, "rtimeout", 2*time.Second, "Read timeout")
 	flag.DurationVar(&wtimeout, "wtimeout", 2*time.Second, "Write timeout")
 	flag.BoolVar(&metricsToStdErr, "metricsToStdErr", false, "Write metrics to stderr periodically")
 	flag.StringVar(&graphiteServer, "graphiteServer", "", "Graphite Server connection string e.g. 127.0.0.1:2003")
 	flag.StringVar(&stathatUser, "stathatUser", "", "StatHat account for metrics")
+	flag.StringVar(&statsdServer, "statsd", "", "StatsD server to send metrics to e.g. 127.0.0.1:8125")
+	flag.StringVar(&statsdTags, "statsdtags", "", "Comma separated DogStatsD tags for the metrics sent to -statsd e.g. env:prod,dc:ams")
 	flag.StringVar(&secret, "secret", "", "Shared secret for use with http api")
 	flag.StringVar(&nameserver, "nameserver", "", "Nameserver address to forward (non-local) queries to e.g. 8.8.8.8:53,8.8.4.4:53")
+	flag.IntVar(&cacheSize, "cachesize", 10000, "Number of forwarded replies to cache, 0 disables the cache")
+	flag.DurationVar(&upstreamCheck, "upstreamcheck", 5*time.Second, "Interval of health checks of the nameservers, 0 disables them")
+	flag.IntVar(&upstreamFailures, "upstreamfailures", server.DefaultUpstreamFailures, "Failures in a row after which a nameserver is excluded")
+	flag.DurationVar(&upstreamCooldown, "upstreamcooldown", server.DefaultUpstreamCooldown, "How long a failed nameserver is excluded")
+	flag.DurationVar(&cacheMaxTTL, "cachemaxttl", 1*time.Hour, "Maximum time a forwarded reply is cached")
+	flag.UintVar(&minTTL, "minttl", 60, "TTL in seconds resolvers may cache NXDOMAIN and NODATA answers (SOA minimum TTL)")
+	flag.DurationVar(&negCacheTTL, "negcachettl", 2*time.Second, "Maximum time NXDOMAIN and NODATA answers are cached internally, 0 disables the cache")
+	flag.IntVar(&answerCacheSize, "answercache", 10000, "Number of answers for names in the SkyDNS domain to cache, 0 disables the cache")
+	flag.DurationVar(&answerCacheTTL, "answercachettl", 1*time.Minute, "Maximum time an answer is cached, changes of the registry empty the cache")
+	flag.StringVar(&transferACL, "transferacl", "", "CIDR ranges allowed to transfer the zone (AXFR/IXFR) e.g. 10.0.0.53,10.0.1.0/24")
+	flag.BoolVar(&ixfr, "ixfr", true, "Support incremental zone transfers (IXFR)")
+	flag.Int64Var(&maxBody, "maxbody", 1<<20, "Maximum size in bytes of HTTP API request bodies")
+	flag.IntVar(&maxDepth, "maxdepth", 16, "Maximum nesting depth of JSON in HTTP API request bodies")
+	flag.BoolVar(&strictJSON, "strictjson", false, "Reject HTTP API requests with unknown fields instead of keeping them")
+	flag.DurationVar(&expiryWarning, "expirywarning", 5*time.Second, "Warn about services that expire within this time without having been renewed, 0 disables the warnings")
+	flag.StringVar(&rewriteFile, "rewrite", "", "File with rules rewriting query names before they are resolved, reloaded on SIGHUP")
+	flag.StringVar(&templateFile, "templates", "", "File with templates for synthetic records computed from the registry, reloaded on SIGHUP")
+	flag.StringVar(&viewFile, "views", "", "File with the client networks of the views services can have their own Host and Port in, reloaded on SIGHUP")
+	flag.StringVar(&subnetACL, "subnetacl", "", "CIDR ranges of resolvers whose EDNS0 Client Subnet picks the view of their clients e.g. 10.0.0.53,10.1.0.0/24")
+	flag.StringVar(&zoneFile, "zones", "", "File with the zones served besides -domain and their nameservers, reloaded on SIGHUP")
+	flag.StringVar(&ttlPolicyFile, "ttlpolicy", "", "File with the default, minimum and maximum TTLs of services per environment and name, reloaded on SIGHUP")
+	flag.IntVar(&quotaEnvironment, "quotaenvironment", 0, "Maximum number of services per environment, 0 is unlimited")
+	flag.IntVar(&quotaName, "quotaname", 0, "Maximum number of services per name, 0 is unlimited")
+	flag.IntVar(&quotaSource, "quotasource", 0, "Maximum number of services registered from one IP address, 0 is unlimited")
+	flag.Float64Var(&rateLimit, "ratelimit", 0, "Queries per second allowed per client subnet, 0 disables rate limiting")
+	flag.IntVar(&rateBurst, "rateburst", 50, "Queries a client subnet may burst above the rate limit")
+	flag.IntVar(&rateSlip, "rateslip", 2, "Answer every n'th UDP query over the rate limit with a truncated reply, 0 drops them all")
+	flag.IntVar(&ratePrefix4, "rateprefix4", 24, "Prefix length of the IPv4 subnets clients are rate limited in")
+	flag.IntVar(&ratePrefix6, "rateprefix6", 56, "Prefix length of the IPv6 subnets clients are rate limited in")
+	flag.StringVar(&aclFile, "acl", "", "File with the access lists for queries, recursion and the HTTP API, reloaded on SIGHUP")
+	flag.StringVar(&dockerEndpoint, "docker", "", "Register the containers of the Docker daemon at this endpoint e.g. unix:///var/run/docker.sock")
+	flag.StringVar(&dockerHost, "dockerhost", "", "Address the containers are registered with, defaults to the address their ports are published on")
+	flag.StringVar(&consulAddr, "consul", "", "Mirror the services in the catalog of the Consul agent at this address e.g. http://127.0.0.1:8500")
+	flag.StringVar(&etcdAddr, "etcd", "", "Mirror the services in a directory of the etcd server at this address e.g. http://127.0.0.1:4001")
+	flag.StringVar(&etcdDir, "etcddir", "/services", "Directory of the etcd server the services are in")
+	flag.DurationVar(&syncInterval, "syncinterval", 30*time.Second, "Interval between reconciliations with Consul or etcd")
+	flag.BoolVar(&syncBack, "syncback", false, "Also write the services registered with SkyDNS to Consul or etcd")
+	flag.StringVar(&syncConflict, "syncconflict", bridge.ConflictBoth, "Which services answer for a name in both SkyDNS and Consul or etcd: both or skydns")
+	flag.IntVar(&checkWorkers, "checkworkers", server.DefaultCheckWorkers, "Number of health checks of services run at the same time, 0 disables them")
+	flag.StringVar(&webhooks, "webhook", "", "Comma separated URLs the expiries and removals of services are posted to e.g. https://alerts.example.com/skydns")
+	flag.StringVar(&webhookSecret, "webhooksecret", "", "Key of the HMAC signature of the posts to -webhook")
+	flag.DurationVar(&shutdownTimeout, "shutdowntimeout", server.DefaultShutdownTimeout, "How long to wait for requests in flight on SIGTERM before stopping")
+	flag.BoolVar(&forward, "forward", true, "Forward API writes sent to a follower to the leader, instead of redirecting the client")
+	flag.BoolVar(&churnHints, "churnhints", false, "Hand clients that ask for it the chance an answer changes within its TTL")
+	flag.IntVar(&maxAnswers, "maxanswers", 0, "Maximum number of records in an answer, a sample by priority and weight is returned for names with more, 0 means no limit")
+	flag.BoolVar(&glue, "glue", true, "Put the addresses of SRV targets in the additional section")
+	flag.BoolVar(&stale, "stale", false, "Keep answering from the last known services while the cluster has no leader, and refuse writes")
+	flag.DurationVar(&maxStale, "maxstale", time.Hour, "How long -stale answers are served before queries fail with SERVFAIL, 0 means forever")
+	flag.IntVar(&staleTTL, "stalettl", 10, "Maximum TTL of -stale answers, 0 leaves TTLs alone")
+	flag.BoolVar(&mdns, "mdns", false, "Announce the services over multicast DNS (zeroconf) on the local network")
+	flag.StringVar(&mdnsInterface, "mdnsinterface", "", "Network interface to announce the services on with -mdns, defaults to the system's multicast interface")
+	flag.StringVar(&debugACL, "debugacl", "", "CIDR ranges allowed to enable verbose logging of their queries e.g. 10.0.0.0/8,192.168.1.10")
+	flag.DurationVar(&debugWindow, "debugwindow", 10*time.Minute, "Maximum time verbose logging stays enabled for a client")
+	flag.StringVar(&logLevel, "loglevel", "info", "Lowest level of the messages logged: debug, info, warn or error")
+	flag.BoolVar(&logJSON, "logjson", false, "Log JSON objects, one per line, instead of key=value text")
+	flag.StringVar(&queryLogDest, "querylog", "", "Log the answers to DNS queries to stdout, stderr or this file, empty disables the query log")
+	flag.Float64Var(&queryLogSample, "querylogsample", 1, "Fraction of the DNS queries logged in the query log, between 0 and 1")
+	flag.BoolVar(&queryLogFailures, "querylogfailures", true, "Log failed DNS queries (SERVFAIL, REFUSED) in the query log even when they aren't sampled")
+	flag.BoolVar(&profiling, "profiling", false, "Serve pprof profiles under /debug/pprof/ and registry internals on /skydns/debug/registry")
 }
 
 func main() {
 	members := make([]string, 0)
 	raft.SetLogLevel(0)
 	flag.Parse()
-	nameservers := strings.Split(nameserver, ",")
-	// empty argument given
-	if len(nameservers) == 1 && nameservers[0] == "" {
-		nameservers = make([]string, 0)
-		config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
-		if err == nil {
-			for _, s := range config.Servers {
-				nameservers = append(nameservers, net.JoinHostPort(s, config.Port))
-			}
-		} else {
-			log.Fatal(err)
-			return
-		}
+
+	// Flags on the command line win over the environment, which wins over
+	// the configuration file
+	fixed := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { fixed[f.Name] = true })
+	env, err := config.ApplyEnv(flag.CommandLine, "SKYDNS_", fixed)
+	if err != nil {
+		logging.Fatal("Reading environment", "err", err)
+		return
+	}
+	for name := range env {
+		fixed[name] = true
+	}
+	if err := loadConfig(fixed); err != nil {
+		logging.Fatal("Reading configuration", "file", configFile, "err", err)
+		return
+	}
+	if err := logging.Setup(logLevel, logJSON); err != nil {
+		logging.Fatal("Setting up logging", "err", err)
+		return
+	}
+
+	nameservers, err := nameserverList()
+	if err != nil {
+		logging.Fatal("Reading nameservers", "err", err)
+		return
 	}
 
 	if discover {
 		ns, err := net.LookupNS(domain)
 
 		if err != nil {
-			log.Fatal(err)
+			logging.Fatal("Discovering members", "domain", domain, "err", err)
 			return
 		}
 
 		if len(ns) < 1 {
-			log.Fatal("No NS records found for ", domain)
+			logging.Fatal("No NS records found", "domain", domain)
 			return
 		}
 
@@ -106,26 +267,295 @@ func main() {
 
 	s := server.NewServer(members, domain, ldns, lhttp, dataDir, rtimeout, wtimeout, secret, nameservers)
 
-	// Set up metrics if specified on the command line
-	if metricsToStdErr {
-		go metrics.Log(metrics.DefaultRegistry, 60e9, log.New(os.Stderr, "metrics: ", log.Lmicroseconds))
+	if cacheSize > 0 {
+		s.EnableForwardCache(cacheSize, cacheMaxTTL)
+	}
+
+	s.EnableUpstreamChecks(upstreamCheck, upstreamFailures, upstreamCooldown)
+	if forward {
+		s.EnableForwarding()
+	}
+	if replica {
+		if len(members) == 0 {
+			logging.Fatal("-replica needs the members to follow, with -join or -discover")
+			return
+		}
+		s.EnableReplica(members)
+		if replicaToken != "" {
+			name, key, ok := strings.Cut(replicaToken, ":")
+			if !ok || name == "" || key == "" {
+				logging.Fatal("-replicatoken must be name:secret")
+				return
+			}
+			s.SetReplicaToken(name, key)
+		}
+	}
+
+	s.SetMinTTL(uint32(minTTL))
+	s.SetShutdownTimeout(shutdownTimeout)
+	// Pick up changes of the configuration file and /etc/resolv.conf on SIGHUP
+	s.OnReload(func() error {
+		if err := loadConfig(fixed); err != nil {
+			return err
+		}
+		s.SetMinTTL(uint32(minTTL))
+		s.SetCacheTTLs(cacheMaxTTL, negCacheTTL, answerCacheTTL)
+		s.SetStaleTTL(uint32(staleTTL))
+		ns, err := nameserverList()
+		if err != nil {
+			return err
+		}
+		s.SetNameservers(ns)
+		return nil
+	})
+	s.SetRequestLimits(maxBody, maxDepth, strictJSON)
+	s.SetExpiryWarning(expiryWarning)
+	s.EnableSnapshots(snapshotEntries)
+	if cacheSize > 0 && negCacheTTL > 0 {
+		s.EnableNegativeCache(cacheSize, negCacheTTL)
+	}
+	if answerCacheSize > 0 && answerCacheTTL > 0 {
+		s.EnableAnswerCache(answerCacheSize, answerCacheTTL)
+	}
+
+	if transferACL != "" {
+		if err := s.EnableTransfer(transferACL, ixfr); err != nil {
+			logging.Fatal("Enabling zone transfers", "err", err)
+			return
+		}
+	}
+
+	if apiTLS {
+		if err := s.EnableAPITLS(tlsCert, tlsKey, apiCA); err != nil {
+			logging.Fatal("Enabling HTTPS API", "err", err)
+			return
+		}
+	}
+
+	if tokenFile != "" {
+		if err := s.EnableTokens(tokenFile); err != nil {
+			logging.Fatal("Loading API tokens", "file", tokenFile, "err", err)
+			return
+		}
+	}
+
+	if lgrpc != "" {
+		s.EnableGRPC(lgrpc)
+	}
+
+	if ldot != "" || ldoh != "" {
+		if err := s.EnableTLS(ldot, ldoh, tlsCert, tlsKey); err != nil {
+			logging.Fatal("Enabling encrypted DNS", "err", err)
+			return
+		}
+	}
+
+	if rateLimit > 0 {
+		s.EnableRateLimit(rateLimit, rateBurst, ratePrefix4, ratePrefix6, rateSlip)
+	}
+
+	if checkWorkers > 0 {
+		s.EnableHealthChecks(checkWorkers)
+	}
+
+	if webhooks != "" {
+		if err := s.EnableWebhooks(strings.Split(webhooks, ","), webhookSecret); err != nil {
+			logging.Fatal("Enabling webhooks", "err", err)
+			return
+		}
+	}
+
+	if churnHints {
+		s.EnableChurnHints(10000)
+	}
+	s.SetMaxAnswers(maxAnswers)
+	s.SetGlue(glue)
+	if stale {
+		s.EnableStale(maxStale, uint32(staleTTL))
+	}
+	if mdns {
+		if err := s.EnableMDNS(mdnsInterface); err != nil {
+			logging.Fatal("Enabling multicast DNS", "err", err)
+			return
+		}
+	}
+
+	if aclFile != "" {
+		if err := s.EnableACL(aclFile); err != nil {
+			logging.Fatal("Loading ACLs", "file", aclFile, "err", err)
+			return
+		}
 	}
 
-	if len(graphiteServer) > 1 {
-		addr, err := net.ResolveTCPAddr("tcp", graphiteServer)
+	if rewriteFile != "" {
+		if err := s.EnableRewrite(rewriteFile); err != nil {
+			logging.Fatal("Loading rewrite rules", "file", rewriteFile, "err", err)
+			return
+		}
+	}
+
+	if templateFile != "" {
+		if err := s.EnableTemplates(templateFile); err != nil {
+			logging.Fatal("Loading record templates", "file", templateFile, "err", err)
+			return
+		}
+	}
+
+	if viewFile != "" {
+		if err := s.EnableViews(viewFile); err != nil {
+			logging.Fatal("Loading views", "file", viewFile, "err", err)
+			return
+		}
+	}
+
+	if subnetACL != "" {
+		if err := s.EnableClientSubnet(subnetACL); err != nil {
+			logging.Fatal("Parsing client subnet ACL", "err", err)
+			return
+		}
+	}
+
+	if zoneFile != "" {
+		if err := s.EnableZones(zoneFile); err != nil {
+			logging.Fatal("Loading zones", "file", zoneFile, "err", err)
+			return
+		}
+	}
+
+	if ttlPolicyFile != "" {
+		if err := s.EnableTTLPolicy(ttlPolicyFile); err != nil {
+			logging.Fatal("Loading TTL rules", "file", ttlPolicyFile, "err", err)
+			return
+		}
+	}
+
+	s.SetQuotas(quotaEnvironment, quotaName, quotaSource)
+
+	if profiling {
+		s.EnableProfiling()
+	}
+
+	if debugACL != "" {
+		if err := s.EnableDebug(debugACL, debugWindow); err != nil {
+			logging.Fatal("Enabling query debugging", "err", err)
+			return
+		}
+	}
+
+	if queryLogDest != "" {
+		w, err := openQueryLog(queryLogDest)
 		if err != nil {
-			go metrics.Graphite(metrics.DefaultRegistry, 10e9, "skydns", addr)
+			logging.Fatal("Opening query log", "file", queryLogDest, "err", err)
+			return
 		}
+		s.EnableQueryLog(w, logJSON, queryLogSample, queryLogFailures)
 	}
 
-	if len(stathatUser) > 1 {
-		go stathat.Stathat(metrics.DefaultRegistry, 10e9, stathatUser)
+	// Set up metrics if specified on the command line
+	cfg := stats.Config{StdErr: metricsToStdErr, Graphite: graphiteServer, StatHatUser: stathatUser, StatsD: statsdServer}
+	if statsdTags != "" {
+		cfg.StatsDTags = strings.Split(statsdTags, ",")
 	}
+	collector, err := stats.New(cfg)
+	if err != nil {
+		logging.Fatal("Setting up metrics", "err", err)
+		return
+	}
+	defer collector.Stop()
 
 	waiter, err := s.Start()
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Starting server", "err", err)
 		return
 	}
+
+	if dockerEndpoint != "" {
+		r, err := docker.NewRegistrar(dockerEndpoint, apiClient())
+		if err != nil {
+			logging.Fatal("Connecting to Docker", "err", err)
+			return
+		}
+		r.Host = dockerHost
+		go r.Run(nil)
+	}
+
+	var catalog bridge.Catalog
+	switch {
+	case consulAddr != "" && etcdAddr != "":
+		logging.Fatal("Only one of -consul and -etcd can be used")
+		return
+	case consulAddr != "":
+		catalog = bridge.NewConsul(consulAddr)
+	case etcdAddr != "":
+		catalog = bridge.NewEtcd(etcdAddr, etcdDir)
+	}
+	if catalog != nil {
+		if syncConflict != bridge.ConflictBoth && syncConflict != bridge.ConflictSkyDNS {
+			logging.Fatal("Invalid -syncconflict", "err", bridge.ErrConflictPolicy)
+			return
+		}
+		b := bridge.New(catalog, apiClient())
+		b.Interval, b.Conflict, b.WriteBack = syncInterval, syncConflict, syncBack
+		go b.Run(nil)
+	}
 	waiter.Wait()
 }
+
+// loadConfig sets the flags that aren't in fixed from the -config file. The
+// other flags of the file get their defaults back first, so a key deleted
+// from the file is reverted on SIGHUP.
+func loadConfig(fixed map[string]bool) error {
+	if configFile == "" {
+		return nil
+	}
+	f, err := config.Load(configFile)
+	if err != nil {
+		return err
+	}
+	if err := config.Reset(flag.CommandLine, configTables, fixed); err != nil {
+		return err
+	}
+	return f.Apply(flag.CommandLine, configTables, fixed)
+}
+
+// openQueryLog returns where the query log goes: stdout, stderr or the file
+// dest, which is appended to.
+func openQueryLog(dest string) (io.Writer, error) {
+	switch dest {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	return os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// nameserverList returns the -nameserver addresses, or the nameservers in
+// /etc/resolv.conf when there are none.
+func nameserverList() ([]string, error) {
+	if nameserver != "" {
+		return strings.Split(nameserver, ","), nil
+	}
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+	nameservers := make([]string, 0)
+	for _, s := range conf.Servers {
+		nameservers = append(nameservers, net.JoinHostPort(s, conf.Port))
+	}
+	return nameservers, nil
+}
+
+// apiClient returns a client of the HTTP API of this server.
+func apiClient() *client.Client {
+	scheme := "http"
+	if apiTLS {
+		scheme = "https"
+	}
+	c, err := client.NewClient(scheme+"://"+lhttp, secret, domain, ldns)
+	if err != nil {
+		logging.Fatal("Creating API client", "err", err)
+	}
+	return c
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+// Alias maps the domain Name onto the domain Target, which is answered as a
+// CNAME record. Both are relative to the SkyDNS domain, e.g. db.production
+// is an alias for postgres-primary.production.
+type Alias struct {
+	Name   string
+	Target string
+	TTL    uint32 // Seconds
+}
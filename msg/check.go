@@ -0,0 +1,137 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults of the fields of a Check that aren't set.
+const (
+	DefaultCheckInterval = 10 // seconds
+	DefaultCheckTimeout  = 2  // seconds
+	DefaultCheckFailures = 3
+	DefaultCheckStatus   = http.StatusOK
+)
+
+// ErrCheckTarget is returned for checks of neither or both a TCP address and an
+// HTTP URL.
+var ErrCheckTarget = errors.New("Check needs either TCP or HTTP")
+
+// ErrCheckService is returned for checks of another host or port than the one
+// of the service, the leader would otherwise connect anywhere it is asked to.
+var ErrCheckService = errors.New("Check must connect to the Host and Port of the service")
+
+// Check is an active health check of a service. A service that fails it
+// Failures times in a row is unhealthy until it passes it again.
+type Check struct {
+	TCP      string `json:",omitempty"` // Host:port to connect to
+	HTTP     string `json:",omitempty"` // URL to GET
+	Status   int    `json:",omitempty"` // Expected status of the HTTP GET
+	Interval uint32 `json:",omitempty"` // Seconds between checks
+	Timeout  uint32 `json:",omitempty"` // Seconds a check may take
+	Failures int    `json:",omitempty"` // Failures in a row that make the service unhealthy
+}
+
+// Validate returns an error if c can't be run as the check of s.
+func (c *Check) Validate(s *Service) error {
+	if (c.TCP == "") == (c.HTTP == "") {
+		return ErrCheckTarget
+	}
+	var host, port string
+	if c.TCP != "" {
+		var err error
+		if host, port, err = net.SplitHostPort(c.TCP); err != nil {
+			return err
+		}
+	}
+	if c.HTTP != "" {
+		req, err := http.NewRequest("GET", c.HTTP, nil)
+		if err != nil {
+			return err
+		}
+		switch req.URL.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			return errors.New("Check URL must be http or https")
+		}
+		host = req.URL.Hostname()
+		if p := req.URL.Port(); p != "" {
+			port = p
+		}
+	}
+	if port != strconv.Itoa(int(s.Port)) || !s.isHost(host) {
+		return ErrCheckService
+	}
+	return nil
+}
+
+// isHost reports whether host is the Host of s, or one of its addresses.
+func (s *Service) isHost(host string) bool {
+	if strings.EqualFold(strings.TrimSuffix(host, "."), strings.TrimSuffix(s.Host, ".")) {
+		return true
+	}
+	ip := net.ParseIP(host)
+	ip4, ip6 := s.Addresses()
+	return ip != nil && (ip.Equal(ip4) || ip.Equal(ip6))
+}
+
+// Every returns the interval of the check.
+func (c *Check) Every() time.Duration {
+	if c.Interval == 0 {
+		return DefaultCheckInterval * time.Second
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+// Threshold returns the number of failures in a row that make a service
+// unhealthy.
+func (c *Check) Threshold() int {
+	if c.Failures <= 0 {
+		return DefaultCheckFailures
+	}
+	return c.Failures
+}
+
+// Run runs the check once, it returns nil if the check passed.
+func (c *Check) Run() error {
+	timeout := time.Duration(c.Timeout) * time.Second
+	if c.Timeout == 0 {
+		timeout = DefaultCheckTimeout * time.Second
+	}
+
+	if c.TCP != "" {
+		conn, err := net.DialTimeout("tcp", c.TCP, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(c.HTTP)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	status := c.Status
+	if status == 0 {
+		status = DefaultCheckStatus
+	}
+	if resp.StatusCode != status {
+		return fmt.Errorf("Check of %s returned %d, expected %d", c.HTTP, resp.StatusCode, status)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SchemaVersion is the version of the serialization format of a Service. It
+// is written as the SchemaVersion field of each serialized Service. Data
+// without it is from before versioning and is version 1 as well.
+const SchemaVersion = 1
+
+// Codec serializes values containing services. It is used for the HTTP API,
+// raft commands and snapshots alike, so they always agree on the format.
+type Codec interface {
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+// DefaultCodec is the Codec used by SkyDNS.
+var DefaultCodec Codec = JSONCodec{}
+
+// JSONCodec is a Codec that uses JSON.
+type JSONCodec struct{}
+
+// Encode writes the JSON encoding of v to w.
+func (JSONCodec) Encode(w io.Writer, v interface{}) error { return json.NewEncoder(w).Encode(v) }
+
+// Decode reads the JSON encoded value from r and stores it in v.
+func (JSONCodec) Decode(r io.Reader, v interface{}) error { return json.NewDecoder(r).Decode(v) }
+
+// service has the fields, but not the methods of Service, so it can be
+// encoded and decoded without recursing.
+type service Service
+
+// knownFields holds the lower cased JSON names of the fields of Service.
+var knownFields = func() map[string]bool {
+	f := map[string]bool{"schemaversion": true}
+	t := reflect.TypeOf(Service{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		name := t.Field(i).Name
+		if tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		f[strings.ToLower(name)] = true
+	}
+	return f
+}()
+
+// MarshalJSON encodes s with its schema version, fields that were unknown when
+// s was decoded are written back unchanged.
+func (s Service) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(service(s))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"SchemaVersion":`)
+	buf.WriteString(strconv.Itoa(SchemaVersion))
+	buf.WriteByte(',')
+	buf.Write(b[1 : len(b)-1])
+
+	keys := make([]string, 0, len(s.unknown))
+	for k := range s.unknown {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf.WriteByte(',')
+		buf.Write(mustMarshal(k))
+		buf.WriteByte(':')
+		buf.Write(s.unknown[k])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON decodes a Service of any schema version, fields it doesn't
+// know are kept so they survive when s is encoded again.
+func (s *Service) UnmarshalJSON(b []byte) error {
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return err
+	}
+	var v service
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*s = Service(v)
+	s.unknown = nil
+
+	for k, raw := range all {
+		if knownFields[strings.ToLower(k)] {
+			continue
+		}
+		if s.unknown == nil {
+			s.unknown = make(map[string]json.RawMessage)
+		}
+		s.unknown[k] = raw
+	}
+	return nil
+}
+
+func mustMarshal(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic("skydns: " + err.Error())
+	}
+	return b
+}
+
+// UnknownFields returns the names of the fields that were not known when s was
+// decoded.
+func (s *Service) UnknownFields() []string {
+	f := make([]string, 0, len(s.unknown))
+	for k := range s.unknown {
+		f = append(f, k)
+	}
+	sort.Strings(f)
+	return f
+}
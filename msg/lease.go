@@ -0,0 +1,71 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultLeaseGrace is the number of renewals of a lease that may be missed
+// when Grace isn't set.
+const DefaultLeaseGrace = 3
+
+const (
+	// MaxLeaseInterval is the longest Interval of a lease, in seconds: a day.
+	MaxLeaseInterval = 86400
+	// MaxLeaseGrace is the most renewals of a lease that may be missed.
+	MaxLeaseGrace = 100
+)
+
+var (
+	// ErrLeaseInterval is returned for leases without a renewal interval.
+	ErrLeaseInterval = errors.New("Lease Interval required")
+	// ErrLeaseTooLong is returned for leases with an Interval or Grace over
+	// the maximum, their expiry would be too far out.
+	ErrLeaseTooLong = errors.New("Lease Interval must be at most 86400 and Grace at most 100")
+)
+
+// Lease keeps a service alive while it is renewed every Interval seconds. A
+// missed renewal is forgiven, the service expires after Grace renewals in a
+// row are missed.
+type Lease struct {
+	Interval uint32    // Seconds between renewals
+	Grace    uint32    `json:",omitempty"` // Renewals that may be missed in a row
+	Renewed  time.Time // Set by the leader on each renewal
+}
+
+// Validate returns an error if l can't be kept.
+func (l *Lease) Validate() error {
+	if l.Interval == 0 {
+		return ErrLeaseInterval
+	}
+	if l.Interval > MaxLeaseInterval || l.Grace > MaxLeaseGrace {
+		return ErrLeaseTooLong
+	}
+	return nil
+}
+
+// Threshold returns the number of renewals that may be missed in a row.
+func (l *Lease) Threshold() uint32 {
+	if l.Grace == 0 {
+		return DefaultLeaseGrace
+	}
+	return l.Grace
+}
+
+// Expires returns when the service expires unless the lease is renewed.
+func (l *Lease) Expires() time.Time {
+	return l.Renewed.Add(time.Duration(l.Interval) * time.Duration(l.Threshold()) * time.Second)
+}
+
+// Missed returns the number of renewals missed since the last one, at now.
+func (l *Lease) Missed(now time.Time) uint32 {
+	d := now.Sub(l.Renewed)
+	if d < 0 {
+		return 0
+	}
+	return uint32(d / (time.Duration(l.Interval) * time.Second))
+}
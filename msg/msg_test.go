@@ -0,0 +1,63 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNAPTRValidate(t *testing.T) {
+	long := strings.Repeat("a", 256)
+	for _, tc := range []struct {
+		naptr NAPTR
+		valid bool
+	}{
+		{NAPTR{Flags: "S", Service: "SIP+D2U", Replacement: "sipproxy.production"}, true},
+		{NAPTR{Flags: "u", Service: "E2U+sip", Regexp: "!^.*$!sip:info@example.com!"}, true},
+		{NAPTR{Regexp: "!^.*$!sip:info@example.com!", Replacement: "."}, true},
+		{NAPTR{Flags: "S", Service: strings.Repeat("a", 255), Replacement: "sipproxy"}, true},
+		{NAPTR{Flags: "X", Replacement: "sipproxy"}, false},
+		{NAPTR{Flags: "SA", Replacement: "sipproxy"}, false},
+		{NAPTR{Flags: "S", Service: long, Replacement: "sipproxy"}, false},
+		{NAPTR{Flags: "U", Regexp: long}, false},
+		{NAPTR{Flags: "U", Replacement: "sipproxy"}, false},
+		{NAPTR{Flags: "S"}, false},
+		{NAPTR{Flags: "S", Regexp: "!^.*$!sip:info@example.com!", Replacement: "sipproxy"}, false},
+		{NAPTR{Flags: "S", Replacement: "sip..proxy"}, false},
+		{NAPTR{Flags: "S", Replacement: strings.Repeat("a", 64) + ".production"}, false},
+	} {
+		if err := tc.naptr.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%+v: expected valid %t, got %v", tc.naptr, tc.valid, err)
+		}
+	}
+}
+
+func TestLeaseValidate(t *testing.T) {
+	for _, tc := range []struct {
+		lease Lease
+		err   error
+	}{
+		{Lease{Interval: 10}, nil},
+		{Lease{Interval: MaxLeaseInterval, Grace: MaxLeaseGrace}, nil},
+		{Lease{}, ErrLeaseInterval},
+		{Lease{Interval: MaxLeaseInterval + 1}, ErrLeaseTooLong},
+		{Lease{Interval: 10, Grace: MaxLeaseGrace + 1}, ErrLeaseTooLong},
+		{Lease{Interval: math.MaxUint32, Grace: math.MaxUint32}, ErrLeaseTooLong},
+	} {
+		if err := tc.lease.Validate(); err != tc.err {
+			t.Errorf("%+v: expected %v, got %v", tc.lease, tc.err, err)
+		}
+	}
+
+	// The longest lease expires in the future, its duration doesn't overflow
+	now := time.Now()
+	l := Lease{Interval: MaxLeaseInterval, Grace: MaxLeaseGrace, Renewed: now}
+	if want := now.Add(MaxLeaseInterval * MaxLeaseGrace * time.Second); !l.Expires().Equal(want) {
+		t.Errorf("Wrong expiry of the longest lease: %s, expected %s", l.Expires(), want)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// maxNAPTRString is the most bytes of the Service and Regexp of a NAPTR
+// record, they are character strings on the wire. Flags is a single letter.
+const maxNAPTRString = 255
+
+// NAPTR is a NAPTR record (RFC 3403) served for the name of a service, e.g.
+// one that points SIP clients at the SRV records of the service.
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string `json:",omitempty"` // S (an SRV record follows), A, U (Regexp yields a URI) or P
+	Service     string `json:",omitempty"` // e.g. SIP+D2U
+	Regexp      string `json:",omitempty"`
+	Replacement string `json:",omitempty"` // Relative to the SkyDNS domain without a trailing dot
+}
+
+// Validate returns an error if n isn't a valid NAPTR record.
+func (n *NAPTR) Validate() error {
+	if strings.Trim(strings.ToUpper(n.Flags), "SAUP") != "" || len(n.Flags) > 1 {
+		return errors.New("NAPTR Flags must be one of S, A, U or P")
+	}
+	if len(n.Service) > maxNAPTRString || len(n.Regexp) > maxNAPTRString {
+		return errors.New("NAPTR Service and Regexp must be at most 255 bytes")
+	}
+	if n.Replacement != "" && n.Replacement != "." {
+		if _, ok := dns.IsDomainName(n.Replacement); !ok {
+			return errors.New("NAPTR Replacement must be a domain name")
+		}
+	}
+	if (n.Regexp == "") == (n.Replacement == "" || n.Replacement == ".") {
+		return errors.New("NAPTR needs either a Regexp or a Replacement")
+	}
+	if strings.EqualFold(n.Flags, "U") && n.Regexp == "" {
+		return errors.New("NAPTR with flag U needs a Regexp")
+	}
+	return nil
+}
@@ -7,7 +7,8 @@ package msg
 import (
 	"bytes"
 	"encoding/json"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"strconv"
 	"time"
@@ -20,15 +21,28 @@ type Service struct {
 	Environment string
 	Region      string
 	Host        string
+	Host6       string `json:",omitempty"` // Optional IPv6 address when Host is an IPv4 address
 	Port        uint16
 	TTL         uint32 // Seconds
 	Expires     time.Time
-	Callback    map[string]Callback `json:"-"` // Callbacks are found by UUID
+	Labels      map[string]string   `json:",omitempty"` // Free form, e.g. role=primary
+	Metadata    map[string]string   `json:",omitempty"` // Free form, served in TXT records e.g. owner=payments
+	Check       *Check              `json:",omitempty"` // Optional active health check
+	Lease       *Lease              `json:",omitempty"` // Optional lease, renewed instead of the TTL
+	NAPTR       []NAPTR             `json:",omitempty"` // Optional NAPTR records for the name of the service
+	Views       map[string]View     `json:",omitempty"` // Host and Port per view, e.g. internal and external
+	Zone        string              `json:",omitempty"` // Zone the service is in, empty for the SkyDNS domain
+	Source      string              `json:",omitempty"` // IP address of the client that registered the service
+	Unhealthy   bool                `json:",omitempty"` // Set while the service fails its check
+	Drained     bool                `json:",omitempty"` // Taken out of DNS answers by an administrator
+	Callback    map[string]Callback `json:"-"`          // Callbacks are found by UUID
+
+	unknown map[string]json.RawMessage // Fields from a newer schema version
 }
 
-// RemainingTTL returns the amount of time remaining before expiration.
-func (s *Service) RemainingTTL() uint32 {
-	d := s.Expires.Sub(time.Now())
+// RemainingTTL returns the amount of time remaining before expiration at now.
+func (s *Service) RemainingTTL(now time.Time) uint32 {
+	d := s.Expires.Sub(now)
 	ttl := uint32(d.Seconds())
 
 	if ttl < 1 {
@@ -37,9 +51,89 @@ func (s *Service) RemainingTTL() uint32 {
 	return ttl
 }
 
-// UpdateTTL updates the TTL property to the RemainingTTL.
-func (s *Service) UpdateTTL() {
-	s.TTL = s.RemainingTTL()
+// Addresses returns the IPv4 and IPv6 address of the service, either may be
+// nil. Host is used when it is an IP address, Host6 adds an IPv6 address.
+func (s *Service) Addresses() (ip4, ip6 net.IP) {
+	if ip := net.ParseIP(s.Host); ip != nil {
+		if ip.To4() != nil {
+			ip4 = ip.To4()
+		} else {
+			ip6 = ip
+		}
+	}
+	if ip := net.ParseIP(s.Host6); ip != nil && ip.To4() == nil {
+		ip6 = ip
+	}
+	return
+}
+
+// UpdateTTL updates the TTL property to the RemainingTTL at now. A leased
+// service isn't cached for longer than a renewal interval, even though it
+// lives on for a grace period after that.
+func (s *Service) UpdateTTL(now time.Time) {
+	s.TTL = s.RemainingTTL(now)
+	if s.Lease != nil && s.TTL > s.Lease.Interval {
+		s.TTL = s.Lease.Interval
+	}
+}
+
+// Copy returns a deep copy of s, changing either doesn't change the other.
+func (s Service) Copy() Service {
+	if s.Labels != nil {
+		l := make(map[string]string, len(s.Labels))
+		for k, v := range s.Labels {
+			l[k] = v
+		}
+		s.Labels = l
+	}
+	if s.Metadata != nil {
+		md := make(map[string]string, len(s.Metadata))
+		for k, v := range s.Metadata {
+			md[k] = v
+		}
+		s.Metadata = md
+	}
+	if s.Check != nil {
+		c := *s.Check
+		s.Check = &c
+	}
+	if s.Lease != nil {
+		l := *s.Lease
+		s.Lease = &l
+	}
+	if s.NAPTR != nil {
+		s.NAPTR = append([]NAPTR(nil), s.NAPTR...)
+	}
+	if s.Views != nil {
+		v := make(map[string]View, len(s.Views))
+		for k, view := range s.Views {
+			v[k] = view
+		}
+		s.Views = v
+	}
+	if s.Callback != nil {
+		cb := make(map[string]Callback, len(s.Callback))
+		for k, v := range s.Callback {
+			cb[k] = v
+		}
+		s.Callback = cb
+	}
+	if s.unknown != nil {
+		u := make(map[string]json.RawMessage, len(s.unknown))
+		for k, v := range s.unknown {
+			u[k] = append(json.RawMessage(nil), v...)
+		}
+		s.unknown = u
+	}
+	return s
+}
+
+// View is where a service is found by the clients in a view, if it differs
+// from the Host and Port of the service.
+type View struct {
+	Host  string
+	Host6 string `json:",omitempty"`
+	Port  uint16 `json:",omitempty"` // Port of the service if not set
 }
 
 type Callback struct {
@@ -64,12 +158,12 @@ func (c Callback) Call(s Service) {
 	}
 	req, err := http.NewRequest("DELETE", "http://"+c.Reply+":"+strconv.Itoa(int(c.Port))+"/skydns/callbacks/"+c.UUID, bytes.NewBuffer(b))
 	if err != nil {
-		log.Println("Failed to create req.", err.Error)
+		slog.Error("Creating callback request", "uuid", c.UUID, "err", err)
 		return
 	}
 	if resp, err := http.DefaultClient.Do(req); err == nil {
 		resp.Body.Close()
 	}
-	log.Println("Performed callback to:", c.Reply, c.Port)
+	slog.Info("Performed callback", "uuid", c.UUID, "reply", c.Reply, "port", c.Port)
 	return
 }
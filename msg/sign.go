@@ -0,0 +1,23 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package msg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// Signature returns the base64 encoded HMAC-SHA256, keyed with key, of an HTTP
+// API request with the given method, request URI, Date header and body. A
+// signed request carries it in the header
+//
+//	Authorization: HMAC <token name>:<signature>
+func Signature(key, method, uri, date string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(method + "\n" + uri + "\n" + date + "\n"))
+	h.Write(body)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
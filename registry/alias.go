@@ -0,0 +1,73 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package registry
+
+import (
+	"github.com/skynetservices/skydns/msg"
+	"sort"
+	"strings"
+)
+
+// aliasKey returns the key of the alias with name in the registry.
+func aliasKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// AddAlias adds the alias a to the registry, replacing an existing alias with
+// the same name.
+func (r *DefaultRegistry) AddAlias(a msg.Alias) error {
+	defer r.lock("add-alias")()
+
+	k := aliasKey(a.Name)
+	if old, ok := r.aliases[k]; ok {
+		r.bumpAlias(old, true)
+	}
+	a.Name, a.Target = k, aliasKey(a.Target)
+	r.aliases[k] = a
+	r.bumpAlias(a, false)
+	return nil
+}
+
+// RemoveAlias removes the alias with name from the registry.
+func (r *DefaultRegistry) RemoveAlias(name string) error {
+	defer r.lock("remove-alias")()
+
+	k := aliasKey(name)
+	a, ok := r.aliases[k]
+	if !ok {
+		return ErrNotExists
+	}
+	delete(r.aliases, k)
+	r.bumpAlias(a, true)
+	return nil
+}
+
+// GetAlias retrieves the alias with name.
+func (r *DefaultRegistry) GetAlias(name string) (msg.Alias, error) {
+	defer r.lock("get-alias")()
+
+	if a, ok := r.aliases[aliasKey(name)]; ok {
+		return a, nil
+	}
+	return msg.Alias{}, ErrNotExists
+}
+
+// GetAliases returns all aliases, sorted by name.
+func (r *DefaultRegistry) GetAliases() []msg.Alias {
+	defer r.lock("get-aliases")()
+
+	aliases := make([]msg.Alias, 0, len(r.aliases))
+	for _, a := range r.aliases {
+		aliases = append(aliases, a)
+	}
+	sort.Sort(aliasesByName(aliases))
+	return aliases
+}
+
+type aliasesByName []msg.Alias
+
+func (a aliasesByName) Len() int           { return len(a) }
+func (a aliasesByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a aliasesByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
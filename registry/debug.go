@@ -0,0 +1,59 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package registry
+
+// TreeStats describes the shape and bookkeeping of a registry, to diagnose its
+// memory use and the time its operations take.
+type TreeStats struct {
+	Services int   // services in the registry
+	Depth    int   // number of label levels below the root
+	Nodes    []int // nodes per label level, level 0 is the environment
+	Reverse  int   // IP addresses with services, for PTR queries
+	Aliases  int
+	Expired  int // services expired and waiting to be removed by the leader
+	Watchers int // open watches of the events
+	Journal  int // changes kept in the journal
+}
+
+// TreeStats returns the current TreeStats of r. It walks the whole tree while
+// holding the lock, so it should not be called often.
+func (r *DefaultRegistry) TreeStats() TreeStats {
+	defer r.lock("tree-stats")()
+
+	t := TreeStats{
+		Services: len(r.nodes),
+		Reverse:  len(r.reverse),
+		Aliases:  len(r.aliases),
+		Watchers: len(r.watchers.m),
+		Journal:  r.journal.next,
+	}
+	if r.journal.full {
+		t.Journal = len(r.journal.changes)
+	}
+
+	now := r.now()
+	for _, n := range r.nodes {
+		if now.After(n.value.Expires) {
+			t.Expired++
+		}
+	}
+
+	level := []*node{r.tree}
+	for {
+		var next []*node
+		for _, n := range level {
+			for _, l := range n.leaves {
+				next = append(next, l)
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+		t.Nodes = append(t.Nodes, len(next))
+		level = next
+	}
+	t.Depth = len(t.Nodes)
+	return t
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package registry
+
+import (
+	"errors"
+	"github.com/skynetservices/skydns/msg"
+)
+
+// JournalSize is the number of changes a new DefaultRegistry keeps in its journal.
+const JournalSize = 1024
+
+var ErrJournal = errors.New("Changes are no longer in the journal")
+
+// Change is a service, or an alias when Alias is set, that was added to, or
+// removed from, the registry. A service that is drained or fails its health
+// check, or is put back or passes it again, is a change of Type EventDrain or
+// EventHealth: it is removed from, or added to, the services in rotation.
+type Change struct {
+	Serial  uint32 // serial of the registry after the change
+	Removed bool
+	Service msg.Service
+	Alias   *msg.Alias
+	Type    string `json:",omitempty"` // event of a change of rotation, empty otherwise
+}
+
+// journal is a bounded ring of the most recent changes.
+type journal struct {
+	changes []Change
+	next    int  // index of the next change to write
+	full    bool // whether the ring has wrapped
+}
+
+func newJournal(size int) *journal {
+	return &journal{changes: make([]Change, size)}
+}
+
+func (j *journal) add(c Change) {
+	if len(j.changes) == 0 {
+		return
+	}
+	j.changes[j.next] = c
+	j.next = (j.next + 1) % len(j.changes)
+	if j.next == 0 {
+		j.full = true
+	}
+}
+
+// since returns the changes after serial, oldest first.
+func (j *journal) since(serial, current uint32) ([]Change, error) {
+	if serial == current {
+		return nil, nil
+	}
+
+	var ordered []Change
+	if j.full {
+		ordered = append(ordered, j.changes[j.next:]...)
+	}
+	ordered = append(ordered, j.changes[:j.next]...)
+
+	for i, c := range ordered {
+		// The change that brought the registry to serial+1 must be present
+		if c.Serial == serial+1 {
+			return ordered[i:], nil
+		}
+	}
+	return nil, ErrJournal
+}
+
+// bump increments the serial of the registry and records the change while
+// r.mutex is held.
+func (r *DefaultRegistry) bump(s msg.Service, removed bool) {
+	r.serial++
+	r.journal.add(Change{Serial: r.serial, Removed: removed, Service: s})
+	r.notify(Event{Type: eventType(s, removed, r.now()), Serial: r.serial, Service: &s})
+}
+
+// bumpRotation increments the serial of the registry and records the service
+// s going out of rotation, or coming back, because of the change typ while
+// r.mutex is held. in tells whether s was in rotation before the change,
+// nothing is recorded when that didn't change.
+func (r *DefaultRegistry) bumpRotation(s msg.Service, in bool, typ string) {
+	if in != (!s.Unhealthy && !s.Drained) {
+		r.serial++
+		r.journal.add(Change{Serial: r.serial, Removed: in, Service: s, Type: typ})
+	}
+	r.notify(Event{Type: typ, Serial: r.serial, Service: &s})
+}
+
+// bumpAlias is bump for the alias a.
+func (r *DefaultRegistry) bumpAlias(a msg.Alias, removed bool) {
+	r.serial++
+	r.journal.add(Change{Serial: r.serial, Removed: removed, Alias: &a})
+	typ := EventAdd
+	if removed {
+		typ = EventRemove
+	}
+	r.notify(Event{Type: typ, Serial: r.serial, Alias: &a})
+}
+
+// Serial returns the serial of the registry, it is incremented every time a
+// service or alias is added or removed, and when a service goes out of
+// rotation or comes back.
+func (r *DefaultRegistry) Serial() uint32 {
+	defer r.lock("serial")()
+	return r.serial
+}
+
+// GetChanges returns the changes made to the registry after it had serial,
+// oldest first. ErrJournal is returned when these changes are no longer known.
+func (r *DefaultRegistry) GetChanges(serial uint32) ([]Change, error) {
+	defer r.lock("get-changes")()
+
+	changes, err := r.journal.since(serial, r.serial)
+	if err != nil {
+		return nil, err
+	}
+	copies := make([]Change, len(changes))
+	for i, c := range changes {
+		copies[i] = c
+		copies[i].Service = c.Service.Copy()
+	}
+	return copies, nil
+}
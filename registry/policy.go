@@ -0,0 +1,72 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package registry
+
+import (
+	"github.com/skynetservices/skydns/msg"
+	"strings"
+)
+
+// TTLRule is the TTL policy of the services in Environment named Name, either
+// may be empty to match all. Default is the TTL of services registered
+// without one, Min and Max bound the TTLs of all; zero leaves them alone.
+type TTLRule struct {
+	Environment string
+	Name        string
+	Default     uint32
+	Min, Max    uint32
+}
+
+func (r TTLRule) matches(s msg.Service) bool {
+	return (r.Environment == "" || strings.EqualFold(r.Environment, s.Environment)) &&
+		(r.Name == "" || strings.EqualFold(r.Name, s.Name))
+}
+
+// specificity orders the rules that match a service, a rule for a name beats
+// a rule for an environment, which beats a rule for all services.
+func (r TTLRule) specificity() int {
+	n := 0
+	if r.Name != "" {
+		n += 2
+	}
+	if r.Environment != "" {
+		n++
+	}
+	return n
+}
+
+// TTLPolicy holds the rules for the TTLs of services. Of the rules that match
+// a service, the most specific applies, and the first of those if there are
+// several.
+type TTLPolicy []TTLRule
+
+// rule returns the rule that applies to s.
+func (p TTLPolicy) rule(s msg.Service) (TTLRule, bool) {
+	best, found := TTLRule{}, false
+	for _, r := range p {
+		if r.matches(s) && (!found || r.specificity() > best.specificity()) {
+			best, found = r, true
+		}
+	}
+	return best, found
+}
+
+// TTL returns the TTL the policy allows s to have instead of ttl.
+func (p TTLPolicy) TTL(s msg.Service, ttl uint32) uint32 {
+	r, ok := p.rule(s)
+	if !ok {
+		return ttl
+	}
+	if ttl == 0 {
+		ttl = r.Default
+	}
+	if r.Min != 0 && ttl < r.Min {
+		ttl = r.Min
+	}
+	if r.Max != 0 && ttl > r.Max {
+		ttl = r.Max
+	}
+	return ttl
+}
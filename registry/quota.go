@@ -0,0 +1,95 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package registry
+
+import (
+	"fmt"
+	"github.com/skynetservices/skydns/msg"
+	"strings"
+)
+
+// Quotas limit the number of services registered in an environment, with a
+// name (in any environment) and from a source IP address. Zero means no limit.
+type Quotas struct {
+	Environment int
+	Name        int
+	Source      int
+}
+
+// QuotaError is returned when adding a service would exceed a quota.
+type QuotaError struct {
+	Quota string // environment, name or source
+	Key   string // the environment, name or source that is full
+	Limit int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("Quota of %d services for %s %s exceeded", e.Limit, e.Quota, e.Key)
+}
+
+// counts holds the number of services registered per environment, name and
+// source, the keys are lower cased.
+type counts struct {
+	environment map[string]int
+	name        map[string]int
+	source      map[string]int
+}
+
+func newCounts() counts {
+	return counts{environment: make(map[string]int), name: make(map[string]int), source: make(map[string]int)}
+}
+
+// add adds n, 1 or -1, to the counts of s.
+func (c counts) add(s msg.Service, n int) {
+	count(c.environment, s.Environment, n)
+	count(c.name, s.Name, n)
+	count(c.source, s.Source, n)
+}
+
+// count adds n to the count of k in m, empty keys aren't counted.
+func count(m map[string]int, k string, n int) {
+	if k == "" {
+		return
+	}
+	k = strings.ToLower(k)
+	if m[k] += n; m[k] <= 0 {
+		delete(m, k)
+	}
+}
+
+// check returns a QuotaError when there is no room for s, next to the services
+// in pending that are about to be added.
+func (c counts) check(q Quotas, s msg.Service, pending counts) error {
+	full := func(m, p map[string]int, k string, limit int) bool {
+		k = strings.ToLower(k)
+		return limit > 0 && m[k]+p[k] >= limit
+	}
+	switch {
+	case full(c.environment, pending.environment, s.Environment, q.Environment):
+		return &QuotaError{Quota: "environment", Key: s.Environment, Limit: q.Environment}
+	case full(c.name, pending.name, s.Name, q.Name):
+		return &QuotaError{Quota: "name", Key: s.Name, Limit: q.Name}
+	case s.Source != "" && full(c.source, pending.source, s.Source, q.Source):
+		return &QuotaError{Quota: "source", Key: s.Source, Limit: q.Source}
+	}
+	return nil
+}
+
+// CheckQuotas returns the error, or nil, of adding each of services while
+// holding them to q, the services that fit count against the ones after
+// them. Quotas are checked by the leader before it commits the services, the
+// registry adds whatever is committed.
+func (r *DefaultRegistry) CheckQuotas(q Quotas, services ...msg.Service) []error {
+	defer r.lock("check-quotas")()
+
+	pending := newCounts()
+	errs := make([]error, len(services))
+	for i, s := range services {
+		if errs[i] = r.counts.check(q, s, pending); errs[i] == nil {
+			pending.add(s, 1)
+		}
+	}
+	return errs
+}
@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"github.com/miekg/dns"
 	"github.com/skynetservices/skydns/msg"
-	"log"
+	"github.com/skynetservices/skydns/stats"
+	"log/slog"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -18,57 +20,151 @@ import (
 var (
 	ErrExists    = errors.New("Service already exists in registry")
 	ErrNotExists = errors.New("Service does not exist in registry")
+	ErrNoLease   = errors.New("Service has no lease")
 )
 
+// Registry stores services. The services it returns are copies, changing them
+// doesn't change the registry, nor do later changes to the registry show up in
+// them.
 type Registry interface {
 	Add(s msg.Service) error
+	AddBatch(services []msg.Service) []error
 	Get(domain string) ([]msg.Service, error)
 	GetUUID(uuid string) (msg.Service, error)
+	GetReverse(ip string) ([]msg.Service, error)
 	GetExpired() []string
+	GetExpiring(within time.Duration) []msg.Service
 	Remove(s msg.Service) error
 	RemoveUUID(uuid string) error
 	UpdateTTL(uuid string, ttl uint32, expires time.Time) error
+	SetHealth(uuid string, healthy bool) error
+	SetDrained(uuid string, drained bool) error
+	SetLease(uuid string, l msg.Lease) error
+	RenewLease(uuid string, renewed time.Time) error
 	AddCallback(s msg.Service, c msg.Callback) error
+	RemoveCallbacks(reply string, port uint16) int
+	CheckQuotas(q Quotas, services ...msg.Service) []error
+	AddAlias(a msg.Alias) error
+	RemoveAlias(name string) error
+	GetAlias(name string) (msg.Alias, error)
+	GetAliases() []msg.Alias
 	Len() int
+	TreeStats() TreeStats
+	Serial() uint32
+	GetChanges(serial uint32) ([]Change, error)
+	Watch(size int) (<-chan Event, func())
+	Snapshot() ([]byte, error)
+	Restore(b []byte) error
+	SetClock(now func() time.Time)
 }
 
 // New returns a new DefaultRegistry.
 func New() Registry {
 	return &DefaultRegistry{
-		tree:  newNode(),
-		nodes: make(map[string]*node),
+		tree:    newNode(),
+		nodes:   make(map[string]*node),
+		reverse: make(map[string]map[string]*node),
+		aliases: make(map[string]msg.Alias),
+		journal: newJournal(JournalSize),
+		counts:  newCounts(),
+		now:     time.Now,
 	}
 }
 
 // DefaultRegistry is a datastore for registered services.
 type DefaultRegistry struct {
-	tree  *node
-	nodes map[string]*node
-	mutex sync.Mutex
+	tree     *node
+	nodes    map[string]*node
+	reverse  map[string]map[string]*node // IP address -> UUID -> node
+	aliases  map[string]msg.Alias        // alias name -> alias
+	serial   uint32
+	journal  *journal
+	watchers watchers
+	counts   counts           // services per environment, name and source, for the quotas
+	now      func() time.Time // the clock services expire by
+	mutex    sync.Mutex
+}
+
+// SetClock makes the registry expire services by the clock now instead of the
+// system clock, tests use it to let TTLs run out without waiting for them.
+func (r *DefaultRegistry) SetClock(now func() time.Time) {
+	defer r.lock("set-clock")()
+	r.now = now
+}
+
+// lock acquires r.mutex for the operation op and returns the function that
+// releases it. The time spent waiting for and holding the lock is recorded.
+func (r *DefaultRegistry) lock(op string) func() {
+	start := time.Now()
+	r.mutex.Lock()
+	acquired := time.Now()
+	stats.RegistryLockWait(op, acquired.Sub(start))
+
+	return func() {
+		r.mutex.Unlock()
+		stats.RegistryLockHold(op, time.Since(acquired))
+	}
 }
 
 // Add adds a service to registry.
 func (r *DefaultRegistry) Add(s msg.Service) error {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	defer r.lock("add")()
+	return r.add(s)
+}
+
+// AddBatch adds services to the registry under a single lock, it returns the
+// error (or nil) of adding each service.
+func (r *DefaultRegistry) AddBatch(services []msg.Service) []error {
+	defer r.lock("add-batch")()
+
+	errs := make([]error, len(services))
+	for i, s := range services {
+		errs[i] = r.add(s)
+	}
+	return errs
+}
 
+// add adds a service to the registry while r.mutex is held.
+func (r *DefaultRegistry) add(s msg.Service) error {
 	// TODO: Validate service has correct values, and getRegistryKey returns a valid value
 	if _, ok := r.nodes[s.UUID]; ok {
 		return ErrExists
 	}
-
+	s = s.Copy()
 	k := getRegistryKey(s)
 	n, err := r.tree.add(strings.Split(k, "."), s)
 	if err == nil {
 		r.nodes[n.value.UUID] = n
+		r.addReverse(n)
+		r.counts.add(s, 1)
+		r.bump(s, false)
 	}
 	return err
 }
 
+// addReverse adds n to the reverse index under each of its IP addresses.
+func (r *DefaultRegistry) addReverse(n *node) {
+	for _, ip := range reverseKeys(n.value) {
+		if _, ok := r.reverse[ip]; !ok {
+			r.reverse[ip] = make(map[string]*node)
+		}
+		r.reverse[ip][n.value.UUID] = n
+	}
+}
+
+// removeReverse removes the service s from the reverse index.
+func (r *DefaultRegistry) removeReverse(s msg.Service) {
+	for _, ip := range reverseKeys(s) {
+		delete(r.reverse[ip], s.UUID)
+		if len(r.reverse[ip]) == 0 {
+			delete(r.reverse, ip)
+		}
+	}
+}
+
 // RemoveUUID removes a sErvice specified by an UUID.
 func (r *DefaultRegistry) RemoveUUID(uuid string) error {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	defer r.lock("remove")()
 
 	if n, ok := r.nodes[uuid]; ok {
 		return r.removeService(n.value)
@@ -79,12 +175,79 @@ func (r *DefaultRegistry) RemoveUUID(uuid string) error {
 // UpdateTTL updates the TTL of a service, as well as pushes the expiration time out TTL seconds from now.
 // This serves as a ping, for the service to keep SkyDNS aware of it's existence so that it is not expired, and purged.
 func (r *DefaultRegistry) UpdateTTL(uuid string, ttl uint32, expires time.Time) error {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	defer r.lock("update-ttl")()
 
 	if n, ok := r.nodes[uuid]; ok {
 		n.value.TTL = ttl
 		n.value.Expires = expires
+		// A heartbeat renews the lease of a leased service
+		if l := n.value.Lease; l != nil {
+			l.Renewed = expires.Add(-time.Duration(ttl) * time.Second)
+			n.value.Expires = l.Expires()
+		}
+		r.notify(Event{Type: EventUpdate, Serial: r.serial, Service: &n.value})
+		return nil
+	}
+	return ErrNotExists
+}
+
+// SetLease gives the service with the given uuid the lease l, which replaces
+// its TTL as the way it is kept alive.
+func (r *DefaultRegistry) SetLease(uuid string, l msg.Lease) error {
+	defer r.lock("set-lease")()
+
+	if n, ok := r.nodes[uuid]; ok {
+		n.value.Lease = &l
+		n.value.Expires = l.Expires()
+		r.notify(Event{Type: EventUpdate, Serial: r.serial, Service: &n.value})
+		return nil
+	}
+	return ErrNotExists
+}
+
+// RenewLease renews the lease of the service with the given uuid, renewed is
+// the time of the renewal.
+func (r *DefaultRegistry) RenewLease(uuid string, renewed time.Time) error {
+	defer r.lock("renew-lease")()
+
+	n, ok := r.nodes[uuid]
+	if !ok {
+		return ErrNotExists
+	}
+	if n.value.Lease == nil {
+		return ErrNoLease
+	}
+	n.value.Lease.Renewed = renewed
+	n.value.Expires = n.value.Lease.Expires()
+	r.notify(Event{Type: EventUpdate, Serial: r.serial, Service: &n.value})
+	return nil
+}
+
+// SetHealth marks the service with the given uuid healthy or unhealthy.
+func (r *DefaultRegistry) SetHealth(uuid string, healthy bool) error {
+	defer r.lock("set-health")()
+
+	if n, ok := r.nodes[uuid]; ok {
+		if n.value.Unhealthy != !healthy {
+			in := !n.value.Unhealthy && !n.value.Drained
+			n.value.Unhealthy = !healthy
+			r.bumpRotation(n.value, in, EventHealth)
+		}
+		return nil
+	}
+	return ErrNotExists
+}
+
+// SetDrained drains the service with the given uuid, or puts it back.
+func (r *DefaultRegistry) SetDrained(uuid string, drained bool) error {
+	defer r.lock("set-drained")()
+
+	if n, ok := r.nodes[uuid]; ok {
+		if n.value.Drained != drained {
+			in := !n.value.Unhealthy && !n.value.Drained
+			n.value.Drained = drained
+			r.bumpRotation(n.value, in, EventDrain)
+		}
 		return nil
 	}
 	return ErrNotExists
@@ -96,8 +259,10 @@ func (r *DefaultRegistry) removeService(s msg.Service) error {
 	// because this means, we just removed a bad service entry.
 	// Map deletion is also a no-op, if entry not found in map
 	delete(r.nodes, s.UUID)
+	r.removeReverse(s)
+	r.counts.add(s, -1)
 	// No matter what, call the callbacks
-	log.Println("Calling", len(s.Callback), "callback(s) for service", s.UUID)
+	slog.Debug("Calling callbacks", "uuid", s.UUID, "count", len(s.Callback))
 	for _, c := range s.Callback {
 		c.Call(s)
 	}
@@ -105,13 +270,16 @@ func (r *DefaultRegistry) removeService(s msg.Service) error {
 	// TODO: Validate service has correct values, and getRegistryKey returns a valid value
 	k := getRegistryKey(s)
 
-	return r.tree.remove(strings.Split(k, "."))
+	if err := r.tree.remove(strings.Split(k, ".")); err != nil {
+		return err
+	}
+	r.bump(s, true)
+	return nil
 }
 
 // Remove removes a service from registry.
 func (r *DefaultRegistry) Remove(s msg.Service) (err error) {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	defer r.lock("remove")()
 
 	if n, ok := r.nodes[s.UUID]; ok {
 		return r.removeService(n.value)
@@ -121,18 +289,35 @@ func (r *DefaultRegistry) Remove(s msg.Service) (err error) {
 
 // GetUUID retrieves a service based on its UUID.
 func (r *DefaultRegistry) GetUUID(uuid string) (s msg.Service, err error) {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	defer r.lock("get-uuid")()
 
-	if s, ok := r.nodes[uuid]; ok {
-		s.value.TTL = s.value.RemainingTTL()
+	if n, ok := r.nodes[uuid]; ok {
+		s = n.value.Copy()
+		s.UpdateTTL(r.now())
 
-		if s.value.TTL >= 1 {
-			return s.value, nil
+		if s.TTL >= 1 {
+			return s, nil
 		}
 	}
 
-	return s, ErrNotExists
+	return msg.Service{}, ErrNotExists
+}
+
+// GetReverse retrieves the services that are registered with the IP address ip
+// as their host.
+func (r *DefaultRegistry) GetReverse(ip string) (services []msg.Service, err error) {
+	defer r.lock("get-reverse")()
+
+	now := r.now()
+	for _, n := range r.reverse[reverseKey(ip)] {
+		if s, ok := n.live(now); ok {
+			services = append(services, s)
+		}
+	}
+	if len(services) == 0 {
+		return nil, ErrNotExists
+	}
+	return services, nil
 }
 
 // Get retrieves a list of services from the registry that matches the given domain pattern:
@@ -143,8 +328,7 @@ func (r *DefaultRegistry) GetUUID(uuid string) (s msg.Service, err error) {
 // and will assume "*" for all the ommited subdomain positions
 func (r *DefaultRegistry) Get(domain string) ([]msg.Service, error) {
 	// TODO: account for version wildcards
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	defer r.lock("get")()
 
 	// DNS queries have a trailing .
 	if strings.HasSuffix(domain, ".") {
@@ -164,15 +348,14 @@ func (r *DefaultRegistry) Get(domain string) ([]msg.Service, error) {
 
 		tree = append(t, tree...)
 	}
-	return r.tree.get(tree)
+	return r.tree.get(tree, r.now())
 }
 
 // GetExpired returns a slice of expired UUIDs.
 func (r *DefaultRegistry) GetExpired() (uuids []string) {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	defer r.lock("get-expired")()
 
-	now := time.Now()
+	now := r.now()
 
 	for _, n := range r.nodes {
 		if now.After(n.value.Expires) {
@@ -183,10 +366,27 @@ func (r *DefaultRegistry) GetExpired() (uuids []string) {
 	return
 }
 
+// GetExpiring returns the services that have not expired yet, but will within
+// the duration within unless they are renewed.
+func (r *DefaultRegistry) GetExpiring(within time.Duration) (services []msg.Service) {
+	defer r.lock("get-expiring")()
+
+	now := r.now()
+
+	for _, n := range r.nodes {
+		if !now.After(n.value.Expires) && n.value.Expires.Sub(now) <= within {
+			s := n.value.Copy()
+			s.UpdateTTL(now)
+			services = append(services, s)
+		}
+	}
+
+	return
+}
+
 // AddCallback adds callback c to the service s.
 func (r *DefaultRegistry) AddCallback(s msg.Service, c msg.Callback) error {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	defer r.lock("add-callback")()
 
 	if n, ok := r.nodes[s.UUID]; ok {
 		if n.value.Callback == nil {
@@ -198,6 +398,22 @@ func (r *DefaultRegistry) AddCallback(s msg.Service, c msg.Callback) error {
 	return ErrNotExists
 }
 
+// RemoveCallbacks removes the callbacks to the listener at reply and port from
+// all services, and returns how many there were.
+func (r *DefaultRegistry) RemoveCallbacks(reply string, port uint16) (n int) {
+	defer r.lock("remove-callbacks")()
+
+	for _, node := range r.nodes {
+		for uuid, c := range node.value.Callback {
+			if c.Reply == reply && c.Port == port {
+				delete(node.value.Callback, uuid)
+				n++
+			}
+		}
+	}
+	return n
+}
+
 // Len returns the size of the registry r.
 func (r *DefaultRegistry) Len() int {
 	return r.tree.size()
@@ -289,7 +505,15 @@ func (n *node) size() int {
 	return n.length
 }
 
-func (n *node) get(tree []string) (services []msg.Service, err error) {
+// live returns a copy of the service of n with its remaining TTL at now, and
+// false when that has (almost) run out.
+func (n *node) live(now time.Time) (msg.Service, bool) {
+	s := n.value.Copy()
+	s.UpdateTTL(now)
+	return s, s.TTL > 1
+}
+
+func (n *node) get(tree []string, now time.Time) (services []msg.Service, err error) {
 	// We've hit the bottom
 	if len(tree) == 1 {
 		switch tree[0] {
@@ -298,11 +522,9 @@ func (n *node) get(tree []string) (services []msg.Service, err error) {
 				return services, ErrNotExists
 			}
 
-			for _, s := range n.leaves {
-				s.value.UpdateTTL()
-
-				if s.value.TTL > 1 {
-					services = append(services, s.value)
+			for _, l := range n.leaves {
+				if s, ok := l.live(now); ok {
+					services = append(services, s)
 				}
 			}
 		default:
@@ -310,10 +532,8 @@ func (n *node) get(tree []string) (services []msg.Service, err error) {
 				return services, ErrNotExists
 			}
 
-			n.leaves[tree[0]].value.UpdateTTL()
-
-			if n.leaves[tree[0]].value.TTL > 1 {
-				services = append(services, n.leaves[tree[0]].value)
+			if s, ok := n.leaves[tree[0]].live(now); ok {
+				services = append(services, s)
 			}
 		}
 
@@ -330,7 +550,7 @@ func (n *node) get(tree []string) (services []msg.Service, err error) {
 
 		var success bool
 		for _, l := range n.leaves {
-			if s, e := l.get(tree[:len(tree)-1]); e == nil {
+			if s, e := l.get(tree[:len(tree)-1], now); e == nil {
 				services = append(services, s...)
 				success = true
 			}
@@ -344,11 +564,42 @@ func (n *node) get(tree []string) (services []msg.Service, err error) {
 			return services, ErrNotExists
 		}
 
-		return n.leaves[k].get(tree[:len(tree)-1])
+		return n.leaves[k].get(tree[:len(tree)-1], now)
 	}
 	return
 }
 
+// hostLabel turns a hostname or IP address into a single label.
+var hostLabel = strings.NewReplacer(".", "-", ":", "-")
+
+// Key returns the domain, relative to the SkyDNS domain, under which the
+// service s is registered.
+func Key(s msg.Service) string {
+	return getRegistryKey(s)
+}
+
 func getRegistryKey(s msg.Service) string {
-	return strings.ToLower(fmt.Sprintf("%s.%s.%s.%s.%s.%s", s.UUID, strings.Replace(s.Host, ".", "-", -1), s.Region, strings.Replace(s.Version, ".", "-", -1), s.Name, s.Environment))
+	return strings.ToLower(fmt.Sprintf("%s.%s.%s.%s.%s.%s", s.UUID, hostLabel.Replace(s.Host), s.Region, strings.Replace(s.Version, ".", "-", -1), s.Name, s.Environment))
+}
+
+// reverseKey returns the canonical form of the IP address in host, or the
+// empty string when host is not an IP address.
+func reverseKey(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// reverseKeys returns the keys of the reverse index for the addresses of s.
+func reverseKeys(s msg.Service) (keys []string) {
+	ip4, ip6 := s.Addresses()
+	if ip4 != nil {
+		keys = append(keys, ip4.String())
+	}
+	if ip6 != nil {
+		keys = append(keys, ip6.String())
+	}
+	return
 }
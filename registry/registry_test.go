@@ -6,6 +6,8 @@ package registry
 
 import (
 	"github.com/skynetservices/skydns/msg"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -90,6 +92,13 @@ func TestGetRegistryKey(t *testing.T) {
 	if key != "123.localhost.test.1-0-0.testservice.production" {
 		t.Fatal("Key incorrect. Received: ", key)
 	}
+
+	s.Host = "2001:db8::1"
+	key = getRegistryKey(s)
+
+	if key != "123.2001-db8--1.test.1-0-0.testservice.production" {
+		t.Fatal("Key incorrect. Received: ", key)
+	}
 }
 
 func TestRemove(t *testing.T) {
@@ -217,6 +226,59 @@ func TestGetUUID(t *testing.T) {
 	}
 }
 
+func TestGetReverse(t *testing.T) {
+	reg := New()
+
+	s := msg.Service{
+		UUID:        "999",
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Host:        "10.0.0.1",
+		Host6:       "2001:db8::1",
+		Environment: "Production",
+		Port:        9000,
+		TTL:         4,
+		Expires:     getExpirationTime(4),
+	}
+
+	if err := reg.Add(s); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range services {
+		if err := reg.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := reg.GetReverse("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].UUID != "999" {
+		t.Fatal("Failed to return correct services")
+	}
+
+	results, err = reg.GetReverse("2001:0db8::0001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].UUID != "999" {
+		t.Fatal("Failed to return correct services")
+	}
+
+	if _, err := reg.GetReverse("10.0.0.2"); err != ErrNotExists {
+		t.Fatal("Unknown address should not exist")
+	}
+
+	if err := reg.RemoveUUID("999"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.GetReverse("10.0.0.1"); err != ErrNotExists {
+		t.Fatal("Removed service should not be found by address")
+	}
+}
+
 func TestUpdateTTL(t *testing.T) {
 	reg := New()
 	r := reg.(*DefaultRegistry)
@@ -253,6 +315,101 @@ func TestUpdateTTL(t *testing.T) {
 	}
 }
 
+func TestSetHealth(t *testing.T) {
+	reg := New()
+	if err := reg.Add(services[0]); err != nil {
+		t.Fatal(err)
+	}
+	events, stop := reg.Watch(2)
+	defer stop()
+
+	if err := reg.SetHealth(services[0].UUID, false); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged health is no event
+	if err := reg.SetHealth(services[0].UUID, false); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := reg.GetUUID(services[0].UUID); !s.Unhealthy {
+		t.Fatal("Service should be unhealthy")
+	}
+	if err := reg.SetHealth(services[0].UUID, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, unhealthy := range []bool{true, false} {
+		if e := <-events; e.Type != EventHealth || e.Service.Unhealthy != unhealthy {
+			t.Fatalf("Expected a health event with Unhealthy %t, got %+v", unhealthy, e)
+		}
+	}
+	if err := reg.SetHealth("nosuchuuid", true); err != ErrNotExists {
+		t.Fatal("Expected ErrNotExists, got", err)
+	}
+}
+
+func TestGetChanges(t *testing.T) {
+	reg := New()
+
+	for _, s := range services {
+		if err := reg.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reg.RemoveUUID(services[0].UUID); err != nil {
+		t.Fatal(err)
+	}
+
+	if reg.Serial() != 3 {
+		t.Fatal("Serial should be bumped on every add and remove, got", reg.Serial())
+	}
+
+	changes, err := reg.GetChanges(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("Expected %d changes, received %d", 2, len(changes))
+	}
+	if changes[0].Serial != 2 || changes[0].Removed || changes[0].Service.UUID != services[1].UUID {
+		t.Fatal("First change should be the addition of", services[1].UUID)
+	}
+	if changes[1].Serial != 3 || !changes[1].Removed || changes[1].Service.UUID != services[0].UUID {
+		t.Fatal("Second change should be the removal of", services[0].UUID)
+	}
+
+	if changes, err := reg.GetChanges(3); err != nil || len(changes) != 0 {
+		t.Fatal("There should be no changes after the current serial")
+	}
+
+	r := reg.(*DefaultRegistry)
+	r.journal = newJournal(1)
+	reg.Add(services[0])
+	if _, err := reg.GetChanges(2); err != ErrJournal {
+		t.Fatal("Changes beyond the journal should not be returned")
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	reg := New()
+	now := time.Now()
+	reg.SetClock(func() time.Time { return now })
+
+	s := services[0]
+	s.Expires = now.Add(time.Duration(s.TTL) * time.Second)
+	reg.Add(s)
+	if got, err := reg.GetUUID(s.UUID); err != nil || got.TTL != s.TTL {
+		t.Fatalf("Service should have its full TTL of %d on the clock, got %d: %v", s.TTL, got.TTL, err)
+	}
+
+	now = now.Add(time.Duration(s.TTL-1) * time.Second)
+	if got, _ := reg.GetUUID(s.UUID); got.TTL != 1 {
+		t.Fatalf("Service should have 1s left on the clock, got %d", got.TTL)
+	}
+	now = now.Add(2 * time.Second)
+	if expired := reg.GetExpired(); len(expired) != 1 || expired[0] != s.UUID {
+		t.Fatalf("Service should have expired on the clock, got %v", expired)
+	}
+}
+
 func TestGetExpired(t *testing.T) {
 	reg := New()
 
@@ -294,6 +451,375 @@ func TestGetExpired(t *testing.T) {
 	}
 }
 
+func TestGetExpiring(t *testing.T) {
+	reg := New()
+
+	for i, ttl := range []uint32{500, 3, 0} {
+		reg.Add(msg.Service{
+			UUID:        strconv.Itoa(200 + i),
+			Name:        "TestService",
+			Version:     "1.0.0",
+			Region:      "Test",
+			Host:        "localhost",
+			Environment: "Production",
+			Port:        9000,
+			TTL:         ttl,
+			Expires:     getExpirationTime(ttl),
+		})
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	expiring := reg.GetExpiring(5 * time.Second)
+
+	if len(expiring) != 1 {
+		t.Fatalf("Expected %d expiring services, received %d", 1, len(expiring))
+	}
+
+	if expiring[0].UUID != "201" {
+		t.Fatal("Incorrect UUID returned for expiring entry")
+	}
+}
+
+func TestAliases(t *testing.T) {
+	reg := New()
+
+	reg.AddAlias(msg.Alias{Name: "DB.production", Target: "postgres-primary.production", TTL: 60})
+	reg.AddAlias(msg.Alias{Name: "cache.production", Target: "redis.production", TTL: 60})
+	reg.AddAlias(msg.Alias{Name: "db.production", Target: "postgres-replica.production", TTL: 60})
+
+	if a, err := reg.GetAlias("db.production."); err != nil || a.Target != "postgres-replica.production" {
+		t.Fatal("Alias should have been replaced", a, err)
+	}
+	if aliases := reg.GetAliases(); len(aliases) != 2 || aliases[0].Name != "cache.production" {
+		t.Fatal("Expected 2 aliases sorted by name", aliases)
+	}
+	// Replacing an alias removes the old one and adds the new one
+	if reg.Serial() != 4 {
+		t.Fatal("Expected serial 4, got", reg.Serial())
+	}
+
+	if err := reg.RemoveAlias("db.production"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.RemoveAlias("db.production"); err != ErrNotExists {
+		t.Fatal("Removing an unknown alias should return ErrNotExists")
+	}
+}
+
+func TestGetReturnsCopies(t *testing.T) {
+	reg := New()
+
+	s := services[0]
+	s.Expires = getExpirationTime(s.TTL)
+	s.Callback = map[string]msg.Callback{"1": msg.Callback{UUID: "1", Reply: "localhost"}}
+	if err := reg.Add(s); err != nil {
+		t.Fatal(err)
+	}
+	// Changing what was added doesn't change the registry
+	s.Callback["2"] = msg.Callback{UUID: "2"}
+
+	got, _ := reg.GetUUID(s.UUID)
+	got.Callback["3"] = msg.Callback{UUID: "3"}
+	got.Port = 1
+
+	listed, _ := reg.Get("*")
+	listed[0].Callback["4"] = msg.Callback{UUID: "4"}
+
+	got, _ = reg.GetUUID(s.UUID)
+	if len(got.Callback) != 1 || got.Port != s.Port {
+		t.Fatal("Registry state was changed through a returned service", got)
+	}
+}
+
+func TestGetCopiesRace(t *testing.T) {
+	reg := New()
+
+	s := services[0]
+	s.Expires = getExpirationTime(s.TTL)
+	if err := reg.Add(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run with -race: readers writing to their copies while callbacks are
+	// added must not touch shared state.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if got, err := reg.GetUUID(s.UUID); err == nil {
+					got.Callback = map[string]msg.Callback{}
+				}
+				if listed, err := reg.Get("*"); err == nil {
+					for k := range listed[0].Callback {
+						delete(listed[0].Callback, k)
+					}
+				}
+				reg.AddCallback(s, msg.Callback{UUID: strconv.Itoa(i*100 + j)})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got, _ := reg.GetUUID(s.UUID); len(got.Callback) != 400 {
+		t.Fatal("Expected 400 callbacks, got", len(got.Callback))
+	}
+}
+
+func TestRemoveCallbacks(t *testing.T) {
+	reg := New()
+
+	for _, s := range services[:2] {
+		s.Expires = getExpirationTime(s.TTL)
+		reg.Add(s)
+		reg.AddCallback(s, msg.Callback{UUID: "a" + s.UUID, Reply: "listener", Port: 9000})
+		reg.AddCallback(s, msg.Callback{UUID: "b" + s.UUID, Reply: "listener", Port: 9001})
+	}
+
+	if n := reg.RemoveCallbacks("listener", 9000); n != 2 {
+		t.Fatal("Expected 2 callbacks removed, got", n)
+	}
+	for _, s := range services[:2] {
+		got, _ := reg.GetUUID(s.UUID)
+		if _, ok := got.Callback["b"+s.UUID]; !ok || len(got.Callback) != 1 {
+			t.Fatal("Only the callbacks to port 9000 should be removed", got.Callback)
+		}
+	}
+}
+
+func TestTTLPolicy(t *testing.T) {
+	p := TTLPolicy{
+		{Environment: "Production", Default: 30, Min: 10, Max: 300},
+		{Name: "Billing", Default: 5, Max: 60},
+		{Default: 20},
+	}
+
+	for _, tc := range []struct {
+		s    msg.Service
+		ttl  uint32
+		want uint32
+	}{
+		{msg.Service{Name: "TestService", Environment: "Production"}, 0, 30},
+		{msg.Service{Name: "TestService", Environment: "production"}, 1, 10},
+		{msg.Service{Name: "TestService", Environment: "Production"}, 3600, 300},
+		{msg.Service{Name: "Billing", Environment: "Production"}, 120, 60},
+		{msg.Service{Name: "TestService", Environment: "Staging"}, 0, 20},
+		{msg.Service{Name: "TestService", Environment: "Staging"}, 1, 1},
+	} {
+		if got := p.TTL(tc.s, tc.ttl); got != tc.want {
+			t.Errorf("Service %s in %s with a TTL of %d should get %d, got %d", tc.s.Name, tc.s.Environment, tc.ttl, tc.want, got)
+		}
+	}
+	if got := TTLPolicy(nil).TTL(msg.Service{}, 7); got != 7 {
+		t.Errorf("Without rules the TTL should be left alone, got %d", got)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	reg := New()
+	q := Quotas{Environment: 3, Name: 2, Source: 2}
+
+	add := func(uuid, name, env, source string) error {
+		s := msg.Service{UUID: uuid, Name: name, Environment: env, Source: source, Host: "localhost", Port: 9000,
+			TTL: 4, Expires: getExpirationTime(4)}
+		if err := reg.CheckQuotas(q, s)[0]; err != nil {
+			return err
+		}
+		return reg.Add(s)
+	}
+	for _, tc := range []struct {
+		uuid, name, env, source string
+		quota                   string // the quota exceeded, if any
+	}{
+		{"1", "TestService", "Production", "10.0.0.1", ""},
+		{"2", "testservice", "Staging", "10.0.0.2", ""},
+		{"3", "TestService", "Production", "10.0.0.3", "name"},
+		{"4", "OtherService", "Production", "10.0.0.1", ""},
+		{"5", "ThirdService", "Production", "10.0.0.1", "source"},
+		{"6", "ThirdService", "production", "10.0.0.4", ""},
+		{"7", "FourthService", "Production", "", "environment"},
+	} {
+		err := add(tc.uuid, tc.name, tc.env, tc.source)
+		if tc.quota == "" {
+			if err != nil {
+				t.Fatalf("Service %s should be added, got %v", tc.uuid, err)
+			}
+			continue
+		}
+		if qe, ok := err.(*QuotaError); !ok || qe.Quota != tc.quota {
+			t.Fatalf("Service %s should exceed the %s quota, got %v", tc.uuid, tc.quota, err)
+		}
+	}
+
+	// Removing a service makes room again
+	reg.RemoveUUID("6")
+	if err := add("7", "FourthService", "Production", ""); err != nil {
+		t.Fatal("Service should be added after another one in its environment was removed, got", err)
+	}
+	if reg.Len() != 4 {
+		t.Fatal("Expected 4 services in the registry, got", reg.Len())
+	}
+
+	// The services of a batch count against the ones after them
+	errs := reg.CheckQuotas(Quotas{Name: 1},
+		msg.Service{Name: "FifthService", Environment: "Staging"},
+		msg.Service{Name: "fifthservice", Environment: "Staging"})
+	if errs[0] != nil || errs[1] == nil {
+		t.Fatalf("Only the second service of the batch should exceed the quota, got %v", errs)
+	}
+}
+
+func TestLease(t *testing.T) {
+	reg := New()
+
+	s := services[0]
+	s.Expires = getExpirationTime(s.TTL)
+	reg.Add(s)
+	if err := reg.RenewLease(s.UUID, time.Now()); err != ErrNoLease {
+		t.Fatal("Renewing a service without a lease should fail with ErrNoLease, got", err)
+	}
+
+	renewed := time.Now().Add(-25 * time.Second)
+	if err := reg.SetLease(s.UUID, msg.Lease{Interval: 10, Renewed: renewed}); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := reg.GetUUID(s.UUID)
+	if got.Lease.Missed(time.Now()) != 2 || got.TTL < 4 || got.TTL > 5 {
+		t.Fatalf("Lease should have missed 2 renewals and 5s left, got %d missed and %ds", got.Lease.Missed(time.Now()), got.TTL)
+	}
+
+	// A heartbeat renews the lease, and renewals push the expiry out by the
+	// interval times the grace
+	reg.UpdateTTL(s.UUID, 10, getExpirationTime(10))
+	if got, _ := reg.GetUUID(s.UUID); got.Lease.Missed(time.Now()) != 0 || got.TTL < 9 {
+		t.Fatal("Heartbeat should renew the lease")
+	}
+	reg.RenewLease(s.UUID, renewed)
+	if got := reg.GetExpired(); len(got) != 0 {
+		t.Fatal("Service should live for 30s after its last renewal", got)
+	}
+	reg.RenewLease(s.UUID, time.Now().Add(-31*time.Second))
+	if got := reg.GetExpired(); len(got) != 1 {
+		t.Fatal("Service should expire after 3 missed renewals")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	reg := New()
+
+	events, stop := reg.Watch(10)
+	s := services[0]
+	s.Expires = getExpirationTime(s.TTL)
+	reg.Add(s)
+	reg.UpdateTTL(s.UUID, 10, getExpirationTime(10))
+	reg.RemoveUUID(s.UUID)
+	s.Expires = time.Now().Add(-time.Second)
+	reg.Add(s)
+	reg.RemoveUUID(s.UUID)
+
+	for i, typ := range []string{EventAdd, EventUpdate, EventRemove, EventAdd, EventExpire} {
+		e := <-events
+		if e.Type != typ || e.Service == nil || e.Service.UUID != s.UUID {
+			t.Fatalf("Event %d should be %s of %s, got %+v", i, typ, s.UUID, e)
+		}
+	}
+
+	// A watcher that falls behind is closed
+	slow, _ := reg.Watch(1)
+	reg.AddAlias(msg.Alias{Name: "a.production", Target: "b.production"})
+	reg.AddAlias(msg.Alias{Name: "c.production", Target: "b.production"})
+	if e, ok := <-slow; !ok || e.Alias == nil || e.Alias.Name != "a.production" {
+		t.Fatal("Expected the first alias event", e)
+	}
+	if _, ok := <-slow; ok {
+		t.Fatal("Channel of a watcher that fell behind should be closed")
+	}
+
+	// Stopping closes the channel once the buffered events are read
+	stop()
+	n := 0
+	for _ = range events {
+		n++
+	}
+	if n != 2 {
+		t.Fatal("Expected the 2 alias events to be buffered, got", n)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	reg := New()
+	for _, s := range services {
+		reg.Add(s)
+	}
+	reg.AddAlias(msg.Alias{Name: "a.production", Target: "testservice.production"})
+	reg.RemoveUUID(services[0].UUID)
+	serial := reg.Serial()
+
+	b, err := reg.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := New()
+	restored.Add(services[0])
+	events, _ := restored.Watch(1)
+	if err := restored.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("Restoring should close the channels of watchers")
+	}
+	if restored.Len() != len(services)-1 || restored.Serial() != serial {
+		t.Fatalf("Expected %d services at serial %d, got %d at %d", len(services)-1, serial, restored.Len(), restored.Serial())
+	}
+	if _, err := restored.GetUUID(services[0].UUID); err != ErrNotExists {
+		t.Fatal("Removed service should stay removed")
+	}
+	if _, err := restored.GetUUID(services[1].UUID); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := restored.GetAlias("a.production"); err != nil || a.Target != "testservice.production" {
+		t.Fatal("Expected the alias to be restored", a, err)
+	}
+
+	// The journal is restored too
+	changes, err := restored.GetChanges(serial - 1)
+	if err != nil || len(changes) != 1 || !changes[0].Removed || changes[0].Service.UUID != services[0].UUID {
+		t.Fatal("Expected the removal from the journal", changes, err)
+	}
+}
+
 func getExpirationTime(ttl uint32) time.Time {
 	return time.Now().Add(time.Duration(ttl) * time.Second)
 }
+
+func TestTreeStats(t *testing.T) {
+	reg := New()
+
+	s := services[0]
+	s.Expires = getExpirationTime(500)
+	reg.Add(s)
+	reg.Add(services[1]) // expired, it has no Expires
+	reg.AddAlias(msg.Alias{Name: "db.production", Target: "testservice.production", TTL: 60})
+	_, stop := reg.Watch(1)
+	defer stop()
+
+	ts := reg.TreeStats()
+	if ts.Services != 2 || ts.Aliases != 1 || ts.Watchers != 1 || ts.Journal != 3 {
+		t.Fatalf("Expected 2 services, 1 alias, 1 watcher and 3 changes, got %+v", ts)
+	}
+	if ts.Expired != 1 {
+		t.Fatal("Expected 1 expired service, got", ts.Expired)
+	}
+	// environment, name, version, region, host, uuid
+	nodes := []int{1, 1, 2, 2, 2, 2}
+	if ts.Depth != len(nodes) {
+		t.Fatalf("Expected depth %d, got %d", len(nodes), ts.Depth)
+	}
+	for i, n := range nodes {
+		if ts.Nodes[i] != n {
+			t.Fatalf("Expected %d nodes at level %d, got %v", n, i, ts.Nodes)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package registry
+
+import (
+	"bytes"
+	"github.com/skynetservices/skydns/msg"
+	"strings"
+)
+
+// snapshot is the state of a registry, as saved by Snapshot.
+type snapshot struct {
+	Serial   uint32
+	Services []msg.Service
+	Aliases  []msg.Alias
+	Journal  []Change // oldest first
+}
+
+// Snapshot returns the state of the registry: its services, aliases, serial
+// and journal, encoded with msg.DefaultCodec.
+func (r *DefaultRegistry) Snapshot() ([]byte, error) {
+	defer r.lock("snapshot")()
+
+	snap := snapshot{Serial: r.serial}
+	for _, n := range r.nodes {
+		snap.Services = append(snap.Services, n.value)
+	}
+	for _, a := range r.aliases {
+		snap.Aliases = append(snap.Aliases, a)
+	}
+	if r.journal.full {
+		snap.Journal = append(snap.Journal, r.journal.changes[r.journal.next:]...)
+	}
+	snap.Journal = append(snap.Journal, r.journal.changes[:r.journal.next]...)
+
+	var b bytes.Buffer
+	if err := msg.DefaultCodec.Encode(&b, snap); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Restore replaces the state of the registry with a snapshot. The watchers
+// have their channels closed, they catch up with GetChanges.
+func (r *DefaultRegistry) Restore(b []byte) error {
+	var snap snapshot
+	if err := msg.DefaultCodec.Decode(bytes.NewReader(b), &snap); err != nil {
+		return err
+	}
+
+	defer r.lock("restore")()
+
+	r.tree = newNode()
+	r.nodes = make(map[string]*node)
+	r.reverse = make(map[string]map[string]*node)
+	r.counts = newCounts()
+	for _, s := range snap.Services {
+		n, err := r.tree.add(strings.Split(getRegistryKey(s), "."), s)
+		if err != nil {
+			return err
+		}
+		r.nodes[s.UUID] = n
+		r.addReverse(n)
+		r.counts.add(s, 1)
+	}
+	r.aliases = make(map[string]msg.Alias)
+	for _, a := range snap.Aliases {
+		r.aliases[a.Name] = a
+	}
+	r.serial = snap.Serial
+	r.journal = newJournal(len(r.journal.changes))
+	for _, c := range snap.Journal {
+		r.journal.add(c)
+	}
+
+	for id, c := range r.watchers.m {
+		delete(r.watchers.m, id)
+		close(c)
+	}
+	return nil
+}
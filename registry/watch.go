@@ -0,0 +1,86 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package registry
+
+import (
+	"github.com/skynetservices/skydns/msg"
+	"time"
+)
+
+// Types of events.
+const (
+	EventAdd    = "add"
+	EventRemove = "remove"
+	EventExpire = "expire" // a service was removed after its TTL ran out
+	EventUpdate = "update" // the TTL of a service was updated
+	EventHealth = "health" // a service became healthy or unhealthy
+	EventDrain  = "drain"  // a service was drained or put back
+)
+
+// Event is a change of the registry, as sent to watchers.
+type Event struct {
+	Type    string
+	Serial  uint32       // serial of the registry after the change
+	Service *msg.Service `json:",omitempty"`
+	Alias   *msg.Alias   `json:",omitempty"`
+}
+
+// watchers holds the channels events are sent on.
+type watchers struct {
+	next int
+	m    map[int]chan Event
+}
+
+// Watch returns a channel that receives the events of the registry from now
+// on, buffering up to size of them, and the function that stops the watch.
+// A watcher that falls more than size events behind has its channel closed,
+// it should watch again and catch up with GetChanges.
+func (r *DefaultRegistry) Watch(size int) (<-chan Event, func()) {
+	defer r.lock("watch")()
+
+	if r.watchers.m == nil {
+		r.watchers.m = make(map[int]chan Event)
+	}
+	id := r.watchers.next
+	r.watchers.next++
+	c := make(chan Event, size)
+	r.watchers.m[id] = c
+
+	return c, func() {
+		defer r.lock("unwatch")()
+		if c, ok := r.watchers.m[id]; ok {
+			delete(r.watchers.m, id)
+			close(c)
+		}
+	}
+}
+
+// notify sends e to the watchers while r.mutex is held.
+func (r *DefaultRegistry) notify(e Event) {
+	for id, c := range r.watchers.m {
+		if e.Service != nil {
+			s := e.Service.Copy()
+			e.Service = &s
+		}
+		select {
+		case c <- e:
+		default:
+			delete(r.watchers.m, id)
+			close(c)
+		}
+	}
+}
+
+// eventType returns the type of the event for a change of the service s at
+// now.
+func eventType(s msg.Service, removed bool, now time.Time) string {
+	switch {
+	case !removed:
+		return EventAdd
+	case now.After(s.Expires):
+		return EventExpire
+	}
+	return EventRemove
+}
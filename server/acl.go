@@ -0,0 +1,149 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The lists of an ACL file.
+const (
+	aclQuery     = "query"     // DNS queries
+	aclRecursion = "recursion" // DNS queries forwarded to the nameservers
+	aclAPI       = "api"       // HTTP API requests
+)
+
+// accessList allows the clients in allow, or everybody when allow is empty,
+// except for the clients in deny.
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// allowed returns true if ip may pass the list.
+func (a *accessList) allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil || containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+// acls holds the access lists loaded from file.
+type acls struct {
+	sync.RWMutex
+	file  string
+	lists map[string]*accessList
+}
+
+// loadACLs reads the access lists in file. Each line holds the name of a list
+// (query, recursion or api), allow or deny, and a comma separated list of
+// CIDR ranges. Lines starting with # are comments.
+func loadACLs(file string) (map[string]*accessList, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lists := make(map[string]*accessList)
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected a list, allow or deny, and CIDR ranges", file, i)
+		}
+		switch fields[0] {
+		case aclQuery, aclRecursion, aclAPI:
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown list %q", file, i, fields[0])
+		}
+		nets, err := parseCIDRs(strings.Join(fields[2:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, i, err)
+		}
+
+		l, ok := lists[fields[0]]
+		if !ok {
+			l = new(accessList)
+			lists[fields[0]] = l
+		}
+		switch fields[1] {
+		case "allow":
+			l.allow = append(l.allow, nets...)
+		case "deny":
+			l.deny = append(l.deny, nets...)
+		default:
+			return nil, fmt.Errorf("%s:%d: expected allow or deny, got %q", file, i, fields[1])
+		}
+	}
+	return lists, scanner.Err()
+}
+
+// EnableACL restricts the clients that may query, have queries forwarded and
+// use the HTTP API to the access lists in file.
+func (s *Server) EnableACL(file string) error {
+	lists, err := loadACLs(file)
+	if err != nil {
+		return err
+	}
+	s.acl = &acls{file: file, lists: lists}
+	return nil
+}
+
+// ReloadACL reloads the access lists, the current lists are kept when the
+// file can't be loaded.
+func (s *Server) ReloadACL() error {
+	if s.acl == nil {
+		return nil
+	}
+	lists, err := loadACLs(s.acl.file)
+	if err != nil {
+		return err
+	}
+	s.acl.Lock()
+	s.acl.lists = lists
+	s.acl.Unlock()
+	return nil
+}
+
+// allowed returns true if ip passes the access list named list.
+func (s *Server) allowed(list string, ip net.IP) bool {
+	if s.acl == nil {
+		return true
+	}
+	s.acl.RLock()
+	defer s.acl.RUnlock()
+	return s.acl.lists[list].allowed(ip)
+}
+
+// refuse answers req with REFUSED.
+func refuse(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	w.WriteMsg(m)
+}
+
+// httpRemoteIP returns the IP address of the client that sent req.
+func httpRemoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/goraft/raft"
+	"github.com/gorilla/mux"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/registry"
+	"net/http"
+	"strings"
+)
+
+// maxAliasChain is the number of aliases followed for a single query, to stop
+// loops.
+const maxAliasChain = 8
+
+// resolveAlias follows the aliases starting at name. It returns the CNAME
+// records for the aliases followed and the name they end at, which is name
+// itself when it is not an alias.
+func (s *Server) resolveAlias(name string) (records []dns.RR, target string) {
+	dom := dns.Fqdn(s.domain)
+	target = name
+	for i := 0; i < maxAliasChain; i++ {
+		a, err := s.registry.GetAlias(strings.TrimSuffix(strings.ToLower(target), "."+dom))
+		if err != nil {
+			break
+		}
+		rr := s.aliasRecord(a)
+		rr.Hdr.Name = target
+		records = append(records, rr)
+		target = rr.Target
+	}
+	return
+}
+
+// aliasRecord returns the CNAME record for the alias a.
+func (s *Server) aliasRecord(a msg.Alias) *dns.CNAME {
+	dom := dns.Fqdn(s.domain)
+	return &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: a.Name + "." + dom, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: a.TTL},
+		Target: a.Target + "." + dom,
+	}
+}
+
+// aliasEnvironment returns the environment an alias is in, its last label.
+func aliasEnvironment(name string) string {
+	labels := dns.SplitDomainName(name)
+	if len(labels) == 0 {
+		return ""
+	}
+	return labels[len(labels)-1]
+}
+
+// Handle API add alias requests
+func (s *Server) addAliasHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+
+	var a msg.Alias
+	if err := s.decodeBody(w, req, &a); err != nil {
+		logRequestError(req, err)
+		decodeError(w, err)
+		return
+	}
+	a.Name = name
+	if labels, ok := dns.IsDomainName(a.Name); !ok || labels > maxKeyLabels {
+		http.Error(w, "Alias must be a domain name of at most 6 labels", http.StatusBadRequest)
+		return
+	}
+	if a.Target == "" || strings.EqualFold(a.Target, a.Name) {
+		http.Error(w, "Target required and must differ from the alias", http.StatusBadRequest)
+		return
+	}
+	if env := aliasEnvironment(a.Name); !s.mayChange(req, env) {
+		forbidEnvironment(w, env)
+		return
+	}
+	if a.TTL == 0 {
+		a.TTL = 3600
+	}
+
+	if _, err := s.raftServer.Do(NewAddAliasCommand(a)); err != nil {
+		switch err {
+		case raft.NotLeaderError:
+			s.redirectToLeader(w, req)
+		default:
+			logRequestError(req, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Handle API remove alias requests
+func (s *Server) removeAliasHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	if env := aliasEnvironment(name); !s.mayChange(req, env) {
+		forbidEnvironment(w, env)
+		return
+	}
+
+	if _, err := s.raftServer.Do(NewRemoveAliasCommand(name)); err != nil {
+		switch err {
+		case registry.ErrNotExists:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case raft.NotLeaderError:
+			s.redirectToLeader(w, req)
+		default:
+			logRequestError(req, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Handle API get alias requests
+func (s *Server) getAliasHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	a, err := s.registry.GetAlias(mux.Vars(req)["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := msg.DefaultCodec.Encode(w, a); err != nil {
+		logRequestError(req, err)
+	}
+}
+
+// Handle API list aliases requests
+func (s *Server) getAliasesHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	if err := msg.DefaultCodec.Encode(w, s.registry.GetAliases()); err != nil {
+		logRequestError(req, err)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"time"
+)
+
+// EnableAnswerCache caches up to size answers for names in the SkyDNS domain,
+// so hot names aren't looked up in the registry for every query. Answers are
+// cached for as long as their TTLs allow, but not longer than maxTTL, and are
+// dropped when the registry changes or the configuration is reloaded. TTL
+// updates leave the cache alone, the cached TTLs count down as they would in
+// any resolver's cache.
+func (s *Server) EnableAnswerCache(size int, maxTTL time.Duration) {
+	s.answerCache = newCache(size, maxTTL)
+	s.registryCache(s.answerCache)
+}
+
+// registryCache makes c hold answers built from the registry: they are out of
+// date as soon as the serial of the registry changes, which TTL updates don't
+// do, and when the configuration is reloaded.
+func (s *Server) registryCache(c *cache) {
+	c.serial = s.registry.Serial
+	s.OnReload(func() error {
+		c.flush()
+		return nil
+	})
+}
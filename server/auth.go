@@ -0,0 +1,235 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/skynetservices/skydns/msg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSignatureSkew is how far the Date of a signed request may be off, which
+// limits the time a captured request can be replayed.
+const maxSignatureSkew = 5 * time.Minute
+
+var (
+	ErrForbidden        = errors.New("Forbidden")
+	ErrBadSignature     = errors.New("Invalid request signature")
+	ErrSignatureExpired = errors.New("Request signature expired")
+)
+
+// apiToken is a credential for the HTTP API, limited to environments.
+type apiToken struct {
+	name         string
+	secret       string
+	environments map[string]bool // nil allows all environments
+}
+
+// tokens holds the API tokens loaded from file.
+type tokens struct {
+	sync.RWMutex
+	file     string
+	byName   map[string]*apiToken
+	bySecret map[string]*apiToken
+}
+
+// loadTokens reads the tokens in file. Each line holds the name of a token,
+// its secret and a comma separated list of the environments it may register
+// services in, or * for all of them. Lines starting with # are comments.
+func loadTokens(file string) (byName, bySecret map[string]*apiToken, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	byName = make(map[string]*apiToken)
+	bySecret = make(map[string]*apiToken)
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, nil, fmt.Errorf("%s:%d: expected a name, a secret and environments", file, i)
+		}
+		t := &apiToken{name: fields[0], secret: fields[1]}
+		if fields[2] != "*" {
+			t.environments = make(map[string]bool)
+			for _, env := range strings.Split(fields[2], ",") {
+				t.environments[strings.ToLower(env)] = true
+			}
+		}
+		if byName[t.name] != nil || bySecret[t.secret] != nil {
+			return nil, nil, fmt.Errorf("%s:%d: duplicate token", file, i)
+		}
+		byName[t.name], bySecret[t.secret] = t, t
+	}
+	return byName, bySecret, scanner.Err()
+}
+
+// EnableTokens requires HTTP API requests to carry one of the tokens in file,
+// either as "Authorization: Bearer <secret>" or signed with the secret, see
+// msg.Signature. A token can only change services in its environments.
+func (s *Server) EnableTokens(file string) error {
+	byName, bySecret, err := loadTokens(file)
+	if err != nil {
+		return err
+	}
+	s.tokens = &tokens{file: file, byName: byName, bySecret: bySecret}
+	return nil
+}
+
+// ReloadTokens reloads the API tokens, the current tokens are kept when the
+// file can't be loaded.
+func (s *Server) ReloadTokens() error {
+	if s.tokens == nil {
+		return nil
+	}
+	byName, bySecret, err := loadTokens(s.tokens.file)
+	if err != nil {
+		return err
+	}
+	s.tokens.Lock()
+	s.tokens.byName, s.tokens.bySecret = byName, bySecret
+	s.tokens.Unlock()
+	return nil
+}
+
+// EnableAPITLS serves the HTTP API, and raft, over HTTPS with the certificate
+// and key in certFile and keyFile. The certificates of peers are verified with
+// the CA certificates in caFile, or the system roots if caFile is empty. The
+// certificate is reloaded on SIGHUP.
+func (s *Server) EnableAPITLS(certFile, keyFile, caFile string) error {
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.apiCert = cert
+	s.apiTLS = &tls.Config{GetCertificate: cert.get}
+	s.peerTLS = &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		s.peerTLS.RootCAs = x509.NewCertPool()
+		if !s.peerTLS.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("No certificates found in " + caFile)
+		}
+	}
+	return nil
+}
+
+// scheme returns the URL scheme of the HTTP API.
+func (s *Server) scheme() string {
+	if s.apiTLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// peerClient returns the HTTP client used to talk to other members.
+func (s *Server) peerClient() *http.Client {
+	if s.peerTLS == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: s.peerTLS}}
+}
+
+// authorization splits the Authorization header of req in its scheme and
+// credentials.
+func authorization(req *http.Request) (scheme, credentials string) {
+	h := strings.TrimSpace(req.Header.Get("Authorization"))
+	if i := strings.Index(h, " "); i > 0 {
+		return h[:i], strings.TrimSpace(h[i+1:])
+	}
+	return "", h
+}
+
+// requestToken returns the token req was made with, nil for the shared secret
+// or when req has no token.
+func (s *Server) requestToken(req *http.Request) *apiToken {
+	if s.tokens == nil {
+		return nil
+	}
+	s.tokens.RLock()
+	defer s.tokens.RUnlock()
+
+	switch scheme, cred := authorization(req); scheme {
+	case "Bearer":
+		return s.tokens.bySecret[cred]
+	case "HMAC":
+		return s.tokens.byName[strings.SplitN(cred, ":", 2)[0]]
+	}
+	return nil
+}
+
+// authenticateRequest checks the credentials of req against the shared secret
+// and the tokens.
+func (s *Server) authenticateRequest(req *http.Request) error {
+	scheme, cred := authorization(req)
+	if s.secret != "" && s.authenticate(req.Header.Get("Authorization")) == nil {
+		return nil
+	}
+	t := s.requestToken(req)
+	if t == nil {
+		return ErrForbidden
+	}
+	if scheme == "Bearer" {
+		return nil
+	}
+	parts := strings.SplitN(cred, ":", 2)
+	if len(parts) != 2 {
+		return ErrBadSignature
+	}
+
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil {
+		return ErrBadSignature
+	}
+	if d := time.Since(date); d > maxSignatureSkew || d < -maxSignatureSkew {
+		return ErrSignatureExpired
+	}
+	// Read the body to check its signature and put it back for the handler,
+	// oversized bodies are rejected when the handler decodes them.
+	var body []byte
+	if req.Body != nil {
+		if body, err = ioutil.ReadAll(io.LimitReader(req.Body, s.maxBody+1)); err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	sig := msg.Signature(t.secret, req.Method, req.URL.RequestURI(), req.Header.Get("Date"), body)
+	if !hmac.Equal([]byte(sig), []byte(parts[1])) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// mayChange reports whether req may change services in environment env.
+func (s *Server) mayChange(req *http.Request, env string) bool {
+	t := s.requestToken(req)
+	return t == nil || t.environments == nil || t.environments[strings.ToLower(env)]
+}
+
+// forbidEnvironment writes the reply for requests that may not change env.
+func forbidEnvironment(w http.ResponseWriter, env string) {
+	http.Error(w, "Forbidden for environment "+env, http.StatusForbidden)
+}
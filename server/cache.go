@@ -0,0 +1,205 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"container/list"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+	scope scope
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+	serial  uint32 // of the registry the message was built from
+}
+
+// cache is a LRU cache of DNS messages keyed by the (lower cased) name and
+// type of their question, and the scope (view and zone) they're for.
+type cache struct {
+	sync.Mutex
+	capacity int
+	maxTTL   time.Duration
+	entries  *list.List // front is most recently used
+	index    map[cacheKey]*list.Element
+
+	// serial returns the serial of the registry for caches of answers built
+	// from it, messages built at another serial are out of date.
+	serial func() uint32
+}
+
+// newCache returns a cache holding at most capacity messages for at most maxTTL.
+func newCache(capacity int, maxTTL time.Duration) *cache {
+	return &cache{
+		capacity: capacity,
+		maxTTL:   maxTTL,
+		entries:  list.New(),
+		index:    make(map[cacheKey]*list.Element),
+	}
+}
+
+// setMaxTTL changes how long messages are stored, messages in the cache keep
+// their expiry.
+func (c *cache) setMaxTTL(maxTTL time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.maxTTL = maxTTL
+}
+
+// limit returns how long messages are stored at most.
+func (c *cache) limit() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+	return c.maxTTL
+}
+
+func keyFor(q dns.Question, sc scope) cacheKey {
+	return cacheKey{strings.ToLower(q.Name), q.Qtype, sc}
+}
+
+// get returns the cached reply to req in scope sc, with the TTLs
+// lowered by the time it spent in the cache, or nil when there is none.
+func (c *cache) get(req *dns.Msg, sc scope) *dns.Msg {
+	k := keyFor(req.Question[0], sc)
+
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.index[k]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	now := time.Now()
+	if now.After(entry.expires) || (c.serial != nil && entry.serial != c.serial()) {
+		c.entries.Remove(e)
+		delete(c.index, k)
+		return nil
+	}
+	c.entries.MoveToFront(e)
+
+	m := entry.msg.Copy()
+	m.Id = req.Id
+	age := uint32(now.Sub(entry.stored).Seconds())
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > age {
+				rr.Header().Ttl -= age
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+// put stores m, built at the registry serial, for scope sc for as long as the
+// lowest TTL in it, but at most c.maxTTL.
+func (c *cache) put(m *dns.Msg, sc scope, serial uint32) {
+	if m.Truncated || len(m.Question) == 0 {
+		return
+	}
+	ttl := c.limit()
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.putTTL(m, sc, ttl, serial)
+}
+
+// putNegative stores the NXDOMAIN or NODATA answer m, built at the registry
+// serial, for scope sc for as long as the SOA record in its authority section
+// allows (RFC 2308), but at most c.maxTTL. Other answers, like SERVFAIL or
+// REFUSED, and negative answers without a SOA record aren't stored.
+func (c *cache) putNegative(m *dns.Msg, sc scope, serial uint32) {
+	if m.Truncated || len(m.Question) == 0 || len(m.Answer) > 0 {
+		return
+	}
+	if m.Rcode != dns.RcodeNameError && m.Rcode != dns.RcodeSuccess {
+		return
+	}
+	for _, rr := range m.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := time.Duration(soa.Minttl) * time.Second
+		if t := time.Duration(soa.Hdr.Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+		if max := c.limit(); ttl > max {
+			ttl = max
+		}
+		if ttl > 0 {
+			c.putTTL(m, sc, ttl, serial)
+		}
+		return
+	}
+}
+
+// putTTL stores m for scope sc for ttl. Messages built at an older serial of
+// the registry are dropped, the registry changed while they were built.
+func (c *cache) putTTL(m *dns.Msg, sc scope, ttl time.Duration, serial uint32) {
+	k := keyFor(m.Question[0], sc)
+	now := time.Now()
+	entry := &cacheEntry{key: k, msg: m.Copy(), stored: now, expires: now.Add(ttl), serial: serial}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.serial != nil && serial != c.serial() {
+		return
+	}
+
+	if e, ok := c.index[k]; ok {
+		e.Value = entry
+		c.entries.MoveToFront(e)
+		return
+	}
+	c.index[k] = c.entries.PushFront(entry)
+
+	for c.entries.Len() > c.capacity {
+		e := c.entries.Back()
+		c.entries.Remove(e)
+		delete(c.index, e.Value.(*cacheEntry).key)
+	}
+}
+
+// flush removes all messages from the cache.
+func (c *cache) flush() {
+	c.Lock()
+	defer c.Unlock()
+	c.entries.Init()
+	c.index = make(map[cacheKey]*list.Element)
+}
+
+// len returns the number of messages in the cache.
+func (c *cache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.entries.Len()
+}
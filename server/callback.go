@@ -1,13 +1,13 @@
 package server
 
 import (
-	"encoding/json"
 	"github.com/goraft/raft"
 	"github.com/gorilla/mux"
 	"github.com/skynetservices/skydns/msg"
 	"github.com/skynetservices/skydns/registry"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -25,9 +25,9 @@ func (s *Server) addCallbackHTTPHandler(w http.ResponseWriter, req *http.Request
 
 	var cb msg.Callback
 
-	if err := json.NewDecoder(req.Body).Decode(&cb); err != nil {
-		log.Println("Error: ", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := s.decodeBody(w, req, &cb); err != nil {
+		logRequestError(req, err)
+		decodeError(w, err)
 		return
 	}
 
@@ -38,10 +38,16 @@ func (s *Server) addCallbackHTTPHandler(w http.ResponseWriter, req *http.Request
 	key = strings.ToLower(key)
 	services, err := s.registry.Get(key)
 	if err != nil || len(services) == 0 {
-		log.Println("Service not found for callback", key)
-		http.Error(w, err.Error(), http.StatusNotFound)
+		slog.Debug("Service not found for callback", "key", key)
+		http.Error(w, registry.ErrNotExists.Error(), http.StatusNotFound)
 		return
 	}
+	for _, serv := range services {
+		if !s.mayChange(req, serv.Environment) {
+			forbidEnvironment(w, serv.Environment)
+			return
+		}
+	}
 	// Reset to save memory, only used so find the services(s).
 	cb.Name = ""
 	cb.Version = ""
@@ -60,7 +66,7 @@ func (s *Server) addCallbackHTTPHandler(w http.ResponseWriter, req *http.Request
 				s.redirectToLeader(w, req)
 				return
 			default:
-				log.Println("Error: ", err)
+				logRequestError(req, err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -72,3 +78,29 @@ func (s *Server) addCallbackHTTPHandler(w http.ResponseWriter, req *http.Request
 	}
 	w.WriteHeader(http.StatusCreated)
 }
+
+// Handle API remove callbacks requests, which remove the callbacks to the
+// listener at the reply and port parameters from all services.
+func (s *Server) removeCallbacksHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	reply := req.URL.Query().Get("reply")
+	port, err := strconv.ParseUint(req.URL.Query().Get("port"), 10, 16)
+	if reply == "" || err != nil {
+		http.Error(w, "Reply and Port required", http.StatusBadRequest)
+		return
+	}
+	// Callbacks of all environments are removed
+	if !s.mayChange(req, "") {
+		forbidEnvironment(w, "*")
+		return
+	}
+
+	if _, err := s.raftServer.Do(NewRemoveCallbacksCommand(reply, uint16(port))); err != nil {
+		switch err {
+		case raft.NotLeaderError:
+			s.redirectToLeader(w, req)
+		default:
+			logRequestError(req, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
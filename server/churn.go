@@ -0,0 +1,131 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EDNS0Churn is the (private use) EDNS0 option code a client sets to ask for
+// a caching hint. The reply carries the option back with 1 byte of data: the
+// estimated chance, in percent, that the answer changes before its TTL runs
+// out. Clients can cache answers with a low chance more aggressively.
+const EDNS0Churn = 65401
+
+// minChurnWindow is the shortest history a change rate is estimated over, so a
+// name seen for a few seconds doesn't look like it changes all the time.
+const minChurnWindow = time.Minute
+
+// churn is the history of the answers to a question.
+type churn struct {
+	hash    uint64    // of the last answer
+	first   time.Time // first seen
+	changes int       // times the answer changed since first
+}
+
+// churnTracker records how often the answers to questions change.
+type churnTracker struct {
+	sync.Mutex
+	capacity int
+	names    map[cacheKey]*churn
+}
+
+// EnableChurnHints tracks how often the answers for up to size questions
+// change, and hands clients that ask for it (with the EDNS0Churn option) the
+// chance the answer changes within its TTL.
+func (s *Server) EnableChurnHints(size int) {
+	s.churn = &churnTracker{capacity: size, names: make(map[cacheKey]*churn)}
+}
+
+// answerHash hashes the records in answer, ignoring their order and TTLs.
+func answerHash(answer []dns.RR) uint64 {
+	records := make([]string, len(answer))
+	for i, rr := range answer {
+		c := dns.Copy(rr)
+		c.Header().Ttl = 0
+		records[i] = c.String()
+	}
+	sort.Strings(records)
+
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(records, "\n")))
+	return h.Sum64()
+}
+
+// observe records answer as the answer to q in scope sc and returns the
+// chance, between 0 and 1, that it changes within ttl seconds.
+func (c *churnTracker) observe(q dns.Question, sc scope, answer []dns.RR, ttl uint32) float64 {
+	now := time.Now()
+	k := keyFor(q, sc)
+	h := answerHash(answer)
+
+	c.Lock()
+	defer c.Unlock()
+
+	n, ok := c.names[k]
+	if !ok {
+		if len(c.names) >= c.capacity {
+			for old := range c.names {
+				delete(c.names, old)
+				break
+			}
+		}
+		n = &churn{hash: h, first: now}
+		c.names[k] = n
+	}
+	if n.hash != h {
+		n.hash = h
+		n.changes++
+	}
+
+	window := now.Sub(n.first)
+	if window < minChurnWindow {
+		window = minChurnWindow
+	}
+	rate := float64(n.changes) / window.Seconds()
+	return 1 - math.Exp(-rate*float64(ttl))
+}
+
+// hasOption returns true if req carries the EDNS0 option code.
+func hasOption(req *dns.Msg, code uint16) bool {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// addOption adds the EDNS0 option o to m, adding an OPT record if needed.
+func addOption(m *dns.Msg, o dns.EDNS0) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, o)
+}
+
+// churnHint records the answer of m, the reply to req in scope sc, and adds
+// the EDNS0Churn option to m when the client asked for it.
+func (s *Server) churnHint(req, m *dns.Msg, sc scope) {
+	if s.churn == nil || len(m.Answer) == 0 {
+		return
+	}
+	p := s.churn.observe(req.Question[0], sc, m.Answer, minTTL(m))
+	if hasOption(req, EDNS0Churn) {
+		addOption(m, &dns.EDNS0_LOCAL{Code: EDNS0Churn, Data: []byte{byte(math.Ceil(p * 100))}})
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"github.com/goraft/raft"
 	"github.com/skynetservices/skydns/msg"
 	"github.com/skynetservices/skydns/registry"
-	"log"
+	"github.com/skynetservices/skydns/stats"
+	"io"
+	"log/slog"
 	"time"
 )
 
@@ -17,9 +19,10 @@ type AddServiceCommand struct {
 	Service msg.Service
 }
 
-// Creates a new AddServiceCommand
-func NewAddServiceCommand(s msg.Service) *AddServiceCommand {
-	s.Expires = getExpirationTime(s.TTL)
+// Creates a new AddServiceCommand for a service registered at now
+func NewAddServiceCommand(s msg.Service, now time.Time) *AddServiceCommand {
+	setExpirationTime(&s, now)
+	s.Unhealthy = false // until its check says otherwise
 
 	return &AddServiceCommand{s}
 }
@@ -27,27 +30,71 @@ func NewAddServiceCommand(s msg.Service) *AddServiceCommand {
 // Name of command
 func (c *AddServiceCommand) CommandName() string { return "add-service" }
 
+// Encode encodes the command for the raft log
+func (c *AddServiceCommand) Encode(w io.Writer) error { return msg.DefaultCodec.Encode(w, c) }
+
+// Decode decodes the command from the raft log
+func (c *AddServiceCommand) Decode(r io.Reader) error { return msg.DefaultCodec.Decode(r, c) }
+
 // Adds service to registry
 func (c *AddServiceCommand) Apply(server raft.Server) (interface{}, error) {
 	reg := server.Context().(registry.Registry)
 	err := reg.Add(c.Service)
 
 	if err == nil {
-		log.Println("Added Service:", c.Service)
+		slog.Info("Added service", "uuid", c.Service.UUID, "key", registry.Key(c.Service))
 	}
 
 	return c.Service, err
 }
 
+// Command for adding a batch of services to the registry in a single commit
+type AddServicesCommand struct {
+	Services []msg.Service
+}
+
+// Creates a new AddServicesCommand for services registered at now
+func NewAddServicesCommand(services []msg.Service, now time.Time) *AddServicesCommand {
+	for i := range services {
+		setExpirationTime(&services[i], now)
+		services[i].Unhealthy = false
+	}
+	return &AddServicesCommand{services}
+}
+
+// Name of command
+func (c *AddServicesCommand) CommandName() string { return "add-services" }
+
+// Encode encodes the command for the raft log
+func (c *AddServicesCommand) Encode(w io.Writer) error { return msg.DefaultCodec.Encode(w, c) }
+
+// Decode decodes the command from the raft log
+func (c *AddServicesCommand) Decode(r io.Reader) error { return msg.DefaultCodec.Decode(r, c) }
+
+// Adds the services to the registry, it returns the error of each service
+func (c *AddServicesCommand) Apply(server raft.Server) (interface{}, error) {
+	reg := server.Context().(registry.Registry)
+	errs := reg.AddBatch(c.Services)
+
+	for i, err := range errs {
+		if err == nil {
+			s := c.Services[i]
+			slog.Info("Added service", "uuid", s.UUID, "key", registry.Key(s))
+		}
+	}
+
+	return errs, nil
+}
+
 type UpdateTTLCommand struct {
 	UUID    string
 	TTL     uint32
 	Expires time.Time
 }
 
-// NewUpdateTTLCommands returns a new UpdateTTLCommand
-func NewUpdateTTLCommand(uuid string, ttl uint32) *UpdateTTLCommand {
-	return &UpdateTTLCommand{uuid, ttl, getExpirationTime(ttl)}
+// NewUpdateTTLCommands returns a new UpdateTTLCommand for a renewal at now
+func NewUpdateTTLCommand(uuid string, ttl uint32, now time.Time) *UpdateTTLCommand {
+	return &UpdateTTLCommand{uuid, ttl, expiresAt(now, ttl)}
 }
 
 // Name of command
@@ -59,7 +106,110 @@ func (c *UpdateTTLCommand) Apply(server raft.Server) (interface{}, error) {
 	err := reg.UpdateTTL(c.UUID, c.TTL, c.Expires)
 
 	if err == nil {
-		log.Println("Updated Service TTL:", c.UUID, c.TTL)
+		slog.Debug("Updated service TTL", "uuid", c.UUID, "ttl", c.TTL)
+	}
+
+	return c.UUID, err
+}
+
+type SetHealthCommand struct {
+	UUID    string
+	Healthy bool
+}
+
+// NewSetHealthCommand returns a new SetHealthCommand
+func NewSetHealthCommand(uuid string, healthy bool) *SetHealthCommand {
+	return &SetHealthCommand{uuid, healthy}
+}
+
+// Name of command
+func (c *SetHealthCommand) CommandName() string { return "set-health" }
+
+// Marks the service healthy or unhealthy in the registry
+func (c *SetHealthCommand) Apply(server raft.Server) (interface{}, error) {
+	reg := server.Context().(registry.Registry)
+	err := reg.SetHealth(c.UUID, c.Healthy)
+
+	if err == nil {
+		slog.Info("Updated service health", "uuid", c.UUID, "healthy", c.Healthy)
+	}
+
+	return c.UUID, err
+}
+
+type DrainCommand struct {
+	UUIDs   []string
+	Drained bool
+}
+
+// NewDrainCommand returns a new DrainCommand
+func NewDrainCommand(uuids []string, drained bool) *DrainCommand {
+	return &DrainCommand{uuids, drained}
+}
+
+// Name of command
+func (c *DrainCommand) CommandName() string { return "drain" }
+
+// Drains the services in the registry, or puts them back
+func (c *DrainCommand) Apply(server raft.Server) (interface{}, error) {
+	reg := server.Context().(registry.Registry)
+	for _, uuid := range c.UUIDs {
+		// Services may have expired since
+		if err := reg.SetDrained(uuid, c.Drained); err == nil {
+			slog.Info("Updated service drained", "uuid", uuid, "drained", c.Drained)
+		}
+	}
+
+	return c.UUIDs, nil
+}
+
+type SetLeaseCommand struct {
+	UUID  string
+	Lease msg.Lease
+}
+
+// NewSetLeaseCommand returns a new SetLeaseCommand, the lease counts as
+// renewed now
+func NewSetLeaseCommand(uuid string, l msg.Lease, now time.Time) *SetLeaseCommand {
+	l.Renewed = now
+	return &SetLeaseCommand{uuid, l}
+}
+
+// Name of command
+func (c *SetLeaseCommand) CommandName() string { return "set-lease" }
+
+// Gives the service in the registry a lease
+func (c *SetLeaseCommand) Apply(server raft.Server) (interface{}, error) {
+	reg := server.Context().(registry.Registry)
+	err := reg.SetLease(c.UUID, c.Lease)
+
+	if err == nil {
+		slog.Info("Set service lease", "uuid", c.UUID, "interval", c.Lease.Interval, "grace", c.Lease.Threshold())
+	}
+
+	return c.UUID, err
+}
+
+type RenewLeaseCommand struct {
+	UUID    string
+	Renewed time.Time
+}
+
+// NewRenewLeaseCommand returns a new RenewLeaseCommand for a renewal at now
+func NewRenewLeaseCommand(uuid string, now time.Time) *RenewLeaseCommand {
+	return &RenewLeaseCommand{uuid, now}
+}
+
+// Name of command
+func (c *RenewLeaseCommand) CommandName() string { return "renew-lease" }
+
+// Renews the lease of the service in the registry
+func (c *RenewLeaseCommand) Apply(server raft.Server) (interface{}, error) {
+	reg := server.Context().(registry.Registry)
+	err := reg.RenewLease(c.UUID, c.Renewed)
+
+	if err == nil {
+		slog.Debug("Renewed service lease", "uuid", c.UUID)
 	}
 
 	return c.UUID, err
@@ -84,14 +234,31 @@ func (c *RemoveServiceCommand) Apply(server raft.Server) (interface{}, error) {
 	err := reg.RemoveUUID(c.UUID)
 
 	if err == nil {
-		log.Println("Removed Service:", c.UUID)
+		slog.Info("Removed service", "uuid", c.UUID)
+		stats.Forget(c.UUID)
 	}
 
 	return c.UUID, err
 }
 
-func getExpirationTime(ttl uint32) time.Time {
-	return time.Now().Add(time.Duration(ttl) * time.Second)
+// expiresAt returns when a service renewed at now with ttl expires.
+func expiresAt(now time.Time, ttl uint32) time.Time {
+	return now.Add(time.Duration(ttl) * time.Second)
+}
+
+// setExpirationTime sets when a service that is registered now expires. A
+// leased service counts as renewed now, its TTL defaults to the interval.
+func setExpirationTime(s *msg.Service, now time.Time) {
+	if s.Lease == nil {
+		s.Expires = expiresAt(now, s.TTL)
+		return
+	}
+	l := *s.Lease
+	l.Renewed = now
+	s.Lease, s.Expires = &l, l.Expires()
+	if s.TTL == 0 {
+		s.TTL = l.Interval
+	}
 }
 
 type AddCallbackCommand struct {
@@ -105,11 +272,71 @@ func NewAddCallbackCommand(s msg.Service, c msg.Callback) *AddCallbackCommand {
 
 func (c *AddCallbackCommand) CommandName() string { return "add-callback" }
 
+func (c *AddCallbackCommand) Encode(w io.Writer) error { return msg.DefaultCodec.Encode(w, c) }
+
+func (c *AddCallbackCommand) Decode(r io.Reader) error { return msg.DefaultCodec.Decode(r, c) }
+
 func (c *AddCallbackCommand) Apply(server raft.Server) (interface{}, error) {
 	reg := server.Context().(registry.Registry)
 	err := reg.AddCallback(c.Service, c.Callback)
 	if err == nil {
-		log.Println("Added Callback:", c.Service, c.Callback)
+		slog.Info("Added callback", "uuid", c.Callback.UUID, "service", c.Service.UUID, "reply", c.Callback.Reply, "port", c.Callback.Port)
 	}
 	return c.Service, err
 }
+
+type RemoveCallbacksCommand struct {
+	Reply string
+	Port  uint16
+}
+
+func NewRemoveCallbacksCommand(reply string, port uint16) *RemoveCallbacksCommand {
+	return &RemoveCallbacksCommand{reply, port}
+}
+
+func (c *RemoveCallbacksCommand) CommandName() string { return "remove-callbacks" }
+
+func (c *RemoveCallbacksCommand) Apply(server raft.Server) (interface{}, error) {
+	reg := server.Context().(registry.Registry)
+	n := reg.RemoveCallbacks(c.Reply, c.Port)
+	slog.Info("Removed callbacks", "reply", c.Reply, "port", c.Port, "count", n)
+	return n, nil
+}
+
+type AddAliasCommand struct {
+	Alias msg.Alias
+}
+
+func NewAddAliasCommand(a msg.Alias) *AddAliasCommand {
+	return &AddAliasCommand{a}
+}
+
+func (c *AddAliasCommand) CommandName() string { return "add-alias" }
+
+func (c *AddAliasCommand) Apply(server raft.Server) (interface{}, error) {
+	reg := server.Context().(registry.Registry)
+	err := reg.AddAlias(c.Alias)
+	if err == nil {
+		slog.Info("Added alias", "name", c.Alias.Name, "target", c.Alias.Target)
+	}
+	return c.Alias, err
+}
+
+type RemoveAliasCommand struct {
+	Name string
+}
+
+func NewRemoveAliasCommand(name string) *RemoveAliasCommand {
+	return &RemoveAliasCommand{name}
+}
+
+func (c *RemoveAliasCommand) CommandName() string { return "remove-alias" }
+
+func (c *RemoveAliasCommand) Apply(server raft.Server) (interface{}, error) {
+	reg := server.Context().(registry.Registry)
+	err := reg.RemoveAlias(c.Name)
+	if err == nil {
+		slog.Info("Removed alias", "name", c.Name)
+	}
+	return c.Name, err
+}
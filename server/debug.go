@@ -0,0 +1,179 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EDNS0Debug is the (private use) EDNS0 option code a client sets to request
+// verbose logging of its queries. The option data is an optional 4 byte, big
+// endian, number of seconds the logging should stay enabled. The reply carries
+// the option back with the number of seconds actually granted.
+const EDNS0Debug = 65400
+
+// parseCIDRs parses a comma separated list of CIDR ranges, a plain IP address
+// is taken to be a single host.
+func parseCIDRs(list string) (nets []*net.IPNet, err error) {
+	for _, c := range strings.Split(list, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+// containsIP returns true if ip falls in one of the networks.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of the client behind w.
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// debugClients keeps track of the clients that asked for verbose logging.
+type debugClients struct {
+	sync.Mutex
+	acl    []*net.IPNet
+	window time.Duration
+	until  map[string]time.Time
+}
+
+func newDebugClients(acl []*net.IPNet, window time.Duration) *debugClients {
+	return &debugClients{acl: acl, window: window, until: make(map[string]time.Time)}
+}
+
+// request enables verbose logging for ip for the requested number of seconds,
+// capped at the configured window. It returns the number of seconds granted,
+// which is zero when ip is not allowed to ask for it.
+func (d *debugClients) request(ip net.IP, secs uint32) uint32 {
+	if ip == nil || !containsIP(d.acl, ip) {
+		return 0
+	}
+	dur := time.Duration(secs) * time.Second
+	if dur == 0 || dur > d.window {
+		dur = d.window
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.until[ip.String()] = time.Now().Add(dur)
+	return uint32(dur.Seconds())
+}
+
+// enabled returns true if verbose logging is active for ip.
+func (d *debugClients) enabled(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	d.Lock()
+	defer d.Unlock()
+
+	k := ip.String()
+	t, ok := d.until[k]
+	if !ok {
+		return false
+	}
+	if time.Now().After(t) {
+		delete(d.until, k)
+		return false
+	}
+	return true
+}
+
+// debugOption returns the EDNS0Debug option from req if it is present.
+func debugOption(req *dns.Msg) *dns.EDNS0_LOCAL {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == EDNS0Debug {
+			return l
+		}
+	}
+	return nil
+}
+
+// debugWriter logs the request and every message written through it in full.
+type debugWriter struct {
+	dns.ResponseWriter
+	req     *dns.Msg
+	verbose bool   // whether to log the exchange
+	echo    bool   // whether to put the EDNS0Debug option in the reply
+	expire  uint32 // seconds of verbose logging granted
+}
+
+// WriteMsg logs the request and reply and writes the reply.
+func (d *debugWriter) WriteMsg(m *dns.Msg) error {
+	if d.echo {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, d.expire)
+		addOption(m, &dns.EDNS0_LOCAL{Code: EDNS0Debug, Data: b})
+	}
+	if d.verbose {
+		slog.Info("Debug query", "client", d.RemoteAddr().String(), "request", d.req.String(), "reply", m.String())
+	}
+	return d.ResponseWriter.WriteMsg(m)
+}
+
+// debugResponseWriter returns a ResponseWriter that logs the exchange when the
+// client behind w has verbose logging enabled, either by an EDNS0Debug option
+// in req or from an earlier query. Otherwise w is returned unchanged.
+func (s *Server) debugResponseWriter(w dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	if s.debug == nil {
+		return w
+	}
+
+	ip := remoteIP(w)
+	if o := debugOption(req); o != nil {
+		var secs uint32
+		if len(o.Data) == 4 {
+			secs = binary.BigEndian.Uint32(o.Data)
+		}
+		granted := s.debug.request(ip, secs)
+		if granted > 0 {
+			slog.Info("Enabled verbose logging", "client", ip.String(), "seconds", granted)
+		}
+		return &debugWriter{ResponseWriter: w, req: req, verbose: granted > 0, echo: true, expire: granted}
+	}
+
+	if s.debug.enabled(ip) {
+		return &debugWriter{ResponseWriter: w, req: req, verbose: true}
+	}
+	return w
+}
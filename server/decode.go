@@ -0,0 +1,135 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/skynetservices/skydns/msg"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrBodyTooLarge = errors.New("Request body too large")
+	ErrTooDeep      = errors.New("Request body nested too deeply")
+)
+
+// SetRequestLimits limits the size in bytes and the nesting depth of the JSON
+// bodies of API requests. When strict is true, bodies with fields SkyDNS
+// doesn't know are rejected instead of kept.
+func (s *Server) SetRequestLimits(maxBody int64, maxDepth int, strict bool) {
+	s.maxBody = maxBody
+	s.maxDepth = maxDepth
+	s.strictJSON = strict
+}
+
+// decodeBody decodes the JSON body of req into v, enforcing the limits set
+// with SetRequestLimits.
+func (s *Server) decodeBody(w http.ResponseWriter, req *http.Request, v interface{}) error {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, s.maxBody))
+	if err != nil {
+		return ErrBodyTooLarge
+	}
+	if jsonDepth(b) > s.maxDepth {
+		return ErrTooDeep
+	}
+	if err := msg.DefaultCodec.Decode(bytes.NewReader(b), v); err != nil {
+		return err
+	}
+	if s.strictJSON {
+		if f := unknownFields(b, v); len(f) > 0 {
+			return errors.New("Unknown field(s): " + strings.Join(f, ", "))
+		}
+	}
+	return nil
+}
+
+// decodeError writes the HTTP error for an error returned by decodeBody.
+func decodeError(w http.ResponseWriter, err error) {
+	if err == ErrBodyTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// jsonDepth returns the maximum nesting depth of objects and arrays in b.
+func jsonDepth(b []byte) (max int) {
+	var depth int
+	var str, esc bool
+	for _, c := range b {
+		switch {
+		case esc:
+			esc = false
+		case str && c == '\\':
+			esc = true
+		case c == '"':
+			str = !str
+		case str:
+		case c == '{' || c == '[':
+			depth++
+			if depth > max {
+				max = depth
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return
+}
+
+// unknownFields returns the top level fields in the JSON object b that are not
+// fields of v. Values that know their unknown fields, like msg.Service, are
+// asked, for a slice of them the fields unknown to any element are returned.
+func unknownFields(b []byte, v interface{}) []string {
+	type unknowner interface {
+		UnknownFields() []string
+	}
+	if u, ok := v.(unknowner); ok {
+		return u.UnknownFields()
+	}
+	if rv := reflect.Indirect(reflect.ValueOf(v)); rv.Kind() == reflect.Slice {
+		var unknown []string
+		for i := 0; i < rv.Len(); i++ {
+			if u, ok := rv.Index(i).Addr().Interface().(unknowner); ok {
+				unknown = append(unknown, u.UnknownFields()...)
+			}
+		}
+		return unknown
+	}
+
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	known := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+			name = tag
+		}
+		known[strings.ToLower(name)] = true
+	}
+
+	var all map[string]interface{}
+	if err := msg.DefaultCodec.Decode(bytes.NewReader(b), &all); err != nil {
+		return nil
+	}
+	var unknown []string
+	for k := range all {
+		if !known[strings.ToLower(k)] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/goraft/raft"
+	"github.com/skynetservices/skydns/registry"
+	"net/http"
+	"sort"
+)
+
+// drainFilters are the query parameters that select the services to drain.
+var drainFilters = []string{"uuid", "host", "region", "version", "name", "environment"}
+
+// Handle API drain requests, PUT drains the services selected by the query
+// parameters and DELETE puts them back. Drained services stay in the registry
+// but are left out of DNS answers. The UUIDs of the services are returned.
+func (s *Server) drainHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	v := req.URL.Query()
+	selected := false
+	for _, f := range drainFilters {
+		if v.Get(f) != "" {
+			selected = true
+		}
+	}
+	if !selected {
+		http.Error(w, "One of uuid, host, region, version, name or environment required", http.StatusBadRequest)
+		return
+	}
+
+	services, err := s.registry.Get(filterQuery(v))
+	if err != nil {
+		switch err {
+		case registry.ErrNotExists:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			logRequestError(req, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	uuids := make([]string, 0, len(services))
+	for _, serv := range services {
+		if !s.mayChange(req, serv.Environment) {
+			forbidEnvironment(w, serv.Environment)
+			return
+		}
+		uuids = append(uuids, serv.UUID)
+	}
+	sort.Strings(uuids)
+
+	if _, err := s.raftServer.Do(NewDrainCommand(uuids, req.Method == "PUT")); err != nil {
+		switch err {
+		case raft.NotLeaderError:
+			s.redirectToLeader(w, req)
+		default:
+			logRequestError(req, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(uuids); err != nil {
+		logRequestError(req, err)
+	}
+}
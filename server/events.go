@@ -0,0 +1,135 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/skynetservices/skydns/registry"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// eventBuffer is the number of events a stream may fall behind.
+	eventBuffer = 256
+	// eventKeepalive is the interval of comments sent on idle streams, which
+	// keeps proxies from closing them.
+	eventKeepalive = 15 * time.Second
+)
+
+// changeEvent returns the event for a change from the journal, replayed at
+// now.
+func changeEvent(c registry.Change, now time.Time) registry.Event {
+	e := registry.Event{Type: registry.EventAdd, Serial: c.Serial, Alias: c.Alias}
+	switch {
+	case c.Type != "":
+		e.Type = c.Type
+	case c.Removed && c.Alias == nil && now.After(c.Service.Expires):
+		e.Type = registry.EventExpire
+	case c.Removed:
+		e.Type = registry.EventRemove
+	}
+	if c.Alias == nil {
+		e.Service = &c.Service
+	}
+	return e
+}
+
+// replayed reports whether e was replayed from the journal up to serial last
+// already. Updates of the TTL, and of the health and draining that leave the
+// rotation of a service alone, aren't in the journal.
+func replayed(e registry.Event, last uint32) bool {
+	switch e.Type {
+	case registry.EventUpdate, registry.EventHealth, registry.EventDrain:
+		return false
+	}
+	return e.Serial <= last
+}
+
+// writeEvent writes e to w in the Server-Sent Events format, the serial is the
+// event ID clients resume from.
+func writeEvent(w http.ResponseWriter, e registry.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Serial, e.Type, b)
+	return err
+}
+
+// Handle API event stream requests, which stream the changes of the registry
+// as Server-Sent Events. A client reconnecting with a Last-Event-ID header
+// first gets the changes it missed, as far as they're in the journal.
+func (s *Server) getEventsHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, stop := s.registry.Watch(eventBuffer)
+	defer stop()
+
+	var missed []registry.Change
+	if id := req.Header.Get("Last-Event-ID"); id != "" {
+		serial, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID: "+id, http.StatusBadRequest)
+			return
+		}
+		if missed, err = s.registry.GetChanges(uint32(serial)); err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+	}
+
+	// The stream outlives the write timeout of the API
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		logRequestError(req, err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var last uint32
+	for _, c := range missed {
+		if err := writeEvent(w, changeEvent(c, s.now())); err != nil {
+			return
+		}
+		last = c.Serial
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-s.shuttingDown:
+			return
+		case e, ok := <-events:
+			if !ok {
+				// Fell behind, the client reconnects with Last-Event-ID
+				return
+			}
+			if replayed(e, last) {
+				continue
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
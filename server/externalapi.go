@@ -6,9 +6,21 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/goraft/raft"
+	"github.com/gorilla/mux"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/msg"
 	"github.com/skynetservices/skydns/registry"
-	"log"
+	"github.com/skynetservices/skydns/stats"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 func (s *Server) getRegionsHTTPHandler(w http.ResponseWriter, req *http.Request) {
@@ -18,7 +30,7 @@ func (s *Server) getRegionsHTTPHandler(w http.ResponseWriter, req *http.Request)
 		case registry.ErrNotExists:
 			w.Write([]byte("{}"))
 		default:
-			log.Println("Error: ", err)
+			logRequestError(req, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 		return
@@ -36,7 +48,7 @@ func (s *Server) getRegionsHTTPHandler(w http.ResponseWriter, req *http.Request)
 	}
 
 	if err := json.NewEncoder(w).Encode(regions); err != nil {
-		log.Println("Error: ", err)
+		logRequestError(req, err)
 	}
 }
 
@@ -47,7 +59,7 @@ func (s *Server) getEnvironmentsHTTPHandler(w http.ResponseWriter, req *http.Req
 		case registry.ErrNotExists:
 			w.Write([]byte("{}"))
 		default:
-			log.Println("Error: ", err)
+			logRequestError(req, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 		return
@@ -65,22 +77,94 @@ func (s *Server) getEnvironmentsHTTPHandler(w http.ResponseWriter, req *http.Req
 	}
 
 	if err := json.NewEncoder(w).Encode(environments); err != nil {
-		log.Println("Error: ", err)
+		logRequestError(req, err)
 	}
 }
 
-func (s *Server) getServicesHTTPHandler(w http.ResponseWriter, req *http.Request) {
-	log.Println(req.URL.Path)
-	log.Println(s.raftServer.Leader())
+func (s *Server) getClusterHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	cluster := struct {
+		Leader  string
+		Members []string
+	}{s.Leader(), append([]string{s.HTTPAddr()}, s.Members()...)}
+
+	if err := json.NewEncoder(w).Encode(cluster); err != nil {
+		logRequestError(req, err)
+	}
+}
+
+// filterQuery returns the registry query for the uuid, host, region, version,
+// name and environment parameters in v, the ones missing match anything.
+func filterQuery(v url.Values) string {
+	get := func(k string) string {
+		if x := v.Get(k); x != "" {
+			return x
+		}
+		return "*"
+	}
+	return registry.Key(msg.Service{
+		UUID:        get("uuid"),
+		Host:        get("host"),
+		Region:      get("region"),
+		Version:     get("version"),
+		Name:        get("name"),
+		Environment: get("environment"),
+	})
+}
+
+// paginate returns the services selected by the offset and limit parameters in v.
+func paginate(services []msg.Service, v url.Values) ([]msg.Service, error) {
+	offset, limit := 0, len(services)
+	if x := v.Get("offset"); x != "" {
+		n, err := strconv.Atoi(x)
+		if err != nil || n < 0 {
+			return nil, errors.New("Invalid offset: " + x)
+		}
+		offset = n
+	}
+	if x := v.Get("limit"); x != "" {
+		n, err := strconv.Atoi(x)
+		if err != nil || n < 0 {
+			return nil, errors.New("Invalid limit: " + x)
+		}
+		limit = n
+	}
+	if offset > len(services) {
+		offset = len(services)
+	}
+	if limit > len(services)-offset {
+		limit = len(services) - offset
+	}
+	return services[offset : offset+limit], nil
+}
 
+type servicesByKey []msg.Service
+
+func (s servicesByKey) Len() int           { return len(s) }
+func (s servicesByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s servicesByKey) Less(i, j int) bool { return registry.Key(s[i]) < registry.Key(s[j]) }
+
+func (s *Server) getExpiringHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	services := s.registry.GetExpiring(s.expiryWarning)
+	if services == nil {
+		services = []msg.Service{}
+	}
+
+	if err := msg.DefaultCodec.Encode(w, services); err != nil {
+		logRequestError(req, err)
+	}
+}
+
+func (s *Server) getServicesHTTPHandler(w http.ResponseWriter, req *http.Request) {
 	var q string
 
 	if q = req.URL.Query().Get("query"); q == "" {
-		q = "*"
+		q = filterQuery(req.URL.Query())
 	}
 
-	log.Println("Retrieving All Services for query", q)
+	slog.Debug("Retrieving all services", "query", q)
 
+	// The serial replicas resume following the changes from
+	w.Header().Set("X-Skydns-Serial", strconv.FormatUint(uint64(s.registry.Serial()), 10))
 	srv, err := s.registry.Get(q)
 
 	if err != nil {
@@ -88,14 +172,139 @@ func (s *Server) getServicesHTTPHandler(w http.ResponseWriter, req *http.Request
 		case registry.ErrNotExists:
 			http.Error(w, err.Error(), http.StatusNotFound)
 		default:
-			log.Println("Error: ", err)
+			logRequestError(req, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(srv); err != nil {
-		log.Println("Error: ", err)
+	sort.Sort(servicesByKey(srv))
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(srv)))
+	if srv, err = paginate(srv, req.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if f := req.URL.Query().Get("fields"); f != "" {
+		sparse, err := project(srv, strings.Split(f, ","))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(sparse); err != nil {
+			logRequestError(req, err)
+		}
+		return
+	}
+
+	if err := msg.DefaultCodec.Encode(w, srv); err != nil {
+		logRequestError(req, err)
+	}
+}
+
+func (s *Server) getLockStatsHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	if err := json.NewEncoder(w).Encode(stats.RegistryLockStats()); err != nil {
+		logRequestError(req, err)
+	}
+}
+
+// updateGauges sets the gauges of the size of the registry and the raft state.
+func (s *Server) updateGauges() {
+	stats.RegistrySize.Update(int64(s.registry.Len()))
+	switch s.raftServer.State() {
+	case raft.Leader:
+		stats.RaftState.Update(stats.RaftStateLeader)
+	case raft.Candidate:
+		stats.RaftState.Update(stats.RaftStateCandidate)
+	case raft.Follower:
+		stats.RaftState.Update(stats.RaftStateFollower)
+	default:
+		stats.RaftState.Update(stats.RaftStateStopped)
+	}
+}
+
+func (s *Server) getMetricsHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	s.updateGauges()
+	stats.PrometheusHandler(w, req)
+}
+
+// project returns the services with only the named fields, field names are
+// matched case insensitively.
+func project(services []msg.Service, fields []string) ([]map[string]interface{}, error) {
+	var idx []serviceField
+	for _, f := range fields {
+		sf, ok := serviceFields[strings.ToLower(strings.TrimSpace(f))]
+		if !ok {
+			return nil, errors.New("Unknown field: " + f)
+		}
+		idx = append(idx, sf)
+	}
+
+	sparse := make([]map[string]interface{}, 0, len(services))
+	for _, serv := range services {
+		v := reflect.ValueOf(serv)
+		p := make(map[string]interface{}, len(idx))
+		for _, sf := range idx {
+			p[sf.name] = v.Field(sf.index).Interface()
+		}
+		sparse = append(sparse, p)
+	}
+	return sparse, nil
+}
+
+type serviceField struct {
+	name  string // name in JSON
+	index int
+}
+
+// serviceFields maps the lower cased JSON field names of msg.Service to the fields.
+var serviceFields = func() map[string]serviceField {
+	fields := make(map[string]serviceField)
+	t := reflect.TypeOf(msg.Service{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		name := t.Field(i).Name
+		if tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields[strings.ToLower(name)] = serviceField{name, i}
+	}
+	return fields
+}()
+
+// countQuery counts an answered query for name from the client ip under the
+// service name in it, names without one (or with a wildcard) aren't counted.
+func (s *Server) countQuery(name string, ip net.IP) {
+	key := strings.TrimSuffix(strings.ToLower(name), "."+dns.Fqdn(s.domain))
+	labels := dns.SplitDomainName(key)
+	if len(labels) < 2 || labels[len(labels)-2] == "*" || ip == nil {
+		return
+	}
+	stats.Queried(labels[len(labels)-2], clientSubnet(ip))
+}
+
+// clientSubnet returns the /24 (IPv4) or /56 (IPv6) subnet of ip, the unit
+// clients are counted in.
+func clientSubnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(56, 128)), Mask: net.CIDRMask(56, 128)}).String()
+}
+
+func (s *Server) getNameStatsHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	queries := struct {
+		Name    string
+		Windows []stats.QueryWindow
+	}{name, stats.NameQueries(name)}
+
+	if err := json.NewEncoder(w).Encode(queries); err != nil {
+		logRequestError(req, err)
 	}
 }
@@ -0,0 +1,104 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// forwardedHeader marks requests a follower forwarded to the leader, they are
+// never forwarded again.
+const forwardedHeader = "X-Skydns-Forwarded"
+
+// forwardTimeout is how long a follower waits for the leader to answer a
+// forwarded request.
+const forwardTimeout = 10 * time.Second
+
+// EnableForwarding makes followers forward API writes to the leader and
+// return its reply, instead of redirecting the client to the leader.
+func (s *Server) EnableForwarding() {
+	s.forward = true
+}
+
+// forwardWrapper forwards the request to the leader when forwarding is
+// enabled and this server is a follower that knows the leader. Credentials
+// are checked here first, and again by the leader. Replicas refuse writes, as
+// do members serving stale answers: there is no leader to commit them.
+func (s *Server) forwardWrapper(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.replica != nil {
+			http.Error(w, ErrReadOnly.Error(), http.StatusForbidden)
+			return
+		}
+		if s.stale != nil && s.staleFor() > 0 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, ErrDegraded.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		leader := s.raftServer.Leader()
+		if !s.forward || s.IsLeader() || leader == "" || leader == s.raftServer.Name() || req.Header.Get(forwardedHeader) != "" {
+			handler(w, req)
+			return
+		}
+		s.forwardToLeader(w, req, leader)
+	}
+}
+
+// forwardToLeader sends req to the leader and copies its reply to w.
+func (s *Server) forwardToLeader(w http.ResponseWriter, req *http.Request, leader string) {
+	out, err := http.NewRequest(req.Method, s.scheme()+"://"+leader+req.URL.RequestURI(), req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out.Header = make(http.Header)
+	for k, v := range req.Header {
+		out.Header[k] = v
+	}
+	out.Header.Set(forwardedHeader, s.raftServer.Name())
+	out.Header.Set(clientHeader, s.registrant(req))
+	out.ContentLength = req.ContentLength
+
+	c := *s.peerClient()
+	c.Timeout = forwardTimeout
+	c.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := c.Do(out)
+	if err != nil {
+		slog.Error("Forwarding to leader", "leader", leader, "path", req.URL.Path, "err", err)
+		http.Error(w, "Leader unreachable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// Handle API leader requests, which tell clients where to send writes
+func (s *Server) getLeaderHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	leader := s.raftServer.Leader()
+	if s.IsLeader() {
+		leader = s.raftServer.Name()
+	}
+	if leader == "" {
+		http.Error(w, "Leader unknown", http.StatusServiceUnavailable)
+		return
+	}
+	reply := struct {
+		Leader   string
+		IsLeader bool // whether the server answering is the leader
+	}{leader, leader == s.raftServer.Name()}
+
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		logRequestError(req, err)
+	}
+}
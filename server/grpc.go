@@ -0,0 +1,284 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"github.com/goraft/raft"
+	"github.com/skynetservices/skydns/logging"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/registry"
+	"github.com/skynetservices/skydns/rpc"
+	"github.com/skynetservices/skydns/stats"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// EnableGRPC serves the gRPC API (see rpc/skydns.proto) on addr. It uses the
+// certificate of the HTTPS API when that is enabled, and the same credentials
+// as the HTTP API, sent as the authorization metadata.
+func (s *Server) EnableGRPC(addr string) {
+	var opts []grpc.ServerOption
+	if s.apiTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.apiTLS)))
+	}
+	s.grpcAddr = addr
+	s.grpcServer = grpc.NewServer(opts...)
+	rpc.RegisterSkyDNSServer(s.grpcServer, &grpcServer{s: s})
+}
+
+// listenAndServeGRPC starts the gRPC listener when it is enabled.
+func (s *Server) listenAndServeGRPC() {
+	if s.grpcServer == nil {
+		return
+	}
+	go func() {
+		l, err := net.Listen("tcp", s.grpcAddr)
+		if err == nil {
+			err = s.grpcServer.Serve(l)
+		}
+		if err != nil {
+			logging.Fatal("Starting listener", "net", "grpc", "addr", s.grpcAddr, "err", err)
+		}
+	}()
+}
+
+// grpcServer implements rpc.SkyDNSServer on top of the raft commands, like
+// the HTTP API handlers.
+type grpcServer struct {
+	rpc.UnimplementedSkyDNSServer
+	s *Server
+}
+
+// authorize checks the credentials of the call in ctx like authHTTPWrapper
+// and returns the request they would have been sent in, to check which
+// environments they may change.
+func (g *grpcServer) authorize(ctx context.Context) (*http.Request, error) {
+	req := &http.Request{Header: make(http.Header), URL: &url.URL{}}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, v := range md["authorization"] {
+			req.Header.Add("Authorization", v)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+	}
+
+	if !g.s.allowed(aclAPI, httpRemoteIP(req)) {
+		return nil, status.Error(codes.PermissionDenied, "Forbidden by ACL")
+	}
+	if g.s.secret != "" || g.s.tokens != nil {
+		// Signatures cover the HTTP request, gRPC takes the secret or a bearer token
+		if scheme, _ := authorization(req); scheme == "HMAC" {
+			return nil, status.Error(codes.Unauthenticated, ErrForbidden.Error())
+		}
+		if err := g.s.authenticateRequest(req); err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+	}
+	return req, nil
+}
+
+// grpcError returns the gRPC status for an error of a raft command.
+func (g *grpcServer) grpcError(err error) error {
+	switch err {
+	case registry.ErrExists:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case registry.ErrNotExists:
+		return status.Error(codes.NotFound, err.Error())
+	case raft.NotLeaderError:
+		return status.Error(codes.Unavailable, "Not the leader, the leader is "+g.s.Leader())
+	}
+	slog.Error("gRPC request failed", "err", err)
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (g *grpcServer) Register(ctx context.Context, in *rpc.RegisterRequest) (*rpc.RegisterResponse, error) {
+	req, err := g.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if g.s.replica != nil {
+		return nil, status.Error(codes.FailedPrecondition, ErrReadOnly.Error())
+	}
+	stats.AddServiceCount.Inc(1)
+
+	serv := fromProto(in.GetService())
+	if err := validateService(serv); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if serv.UUID == "" {
+		return nil, status.Error(codes.InvalidArgument, "UUID required")
+	}
+	if !g.s.mayChange(req, serv.Environment) {
+		return nil, status.Error(codes.PermissionDenied, "Forbidden for environment "+serv.Environment)
+	}
+	serv.Source = g.s.registrant(req)
+	if err := g.s.checkQuotas(serv)[0]; err != nil {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	stats.Registered(serv.UUID, time.Now())
+	cmd := NewAddServiceCommand(serv, g.s.now())
+	g.s.enforceTTL(&cmd.Service)
+	if _, err := g.s.raftServer.Do(cmd); err != nil {
+		stats.Forget(serv.UUID)
+		return nil, g.grpcError(err)
+	}
+	return &rpc.RegisterResponse{}, nil
+}
+
+func (g *grpcServer) Deregister(ctx context.Context, in *rpc.DeregisterRequest) (*rpc.DeregisterResponse, error) {
+	req, err := g.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if g.s.replica != nil {
+		return nil, status.Error(codes.FailedPrecondition, ErrReadOnly.Error())
+	}
+	stats.RemoveServiceCount.Inc(1)
+
+	if serv, err := g.s.registry.GetUUID(in.GetUuid()); err == nil && !g.s.mayChange(req, serv.Environment) {
+		return nil, status.Error(codes.PermissionDenied, "Forbidden for environment "+serv.Environment)
+	}
+	if _, err := g.s.raftServer.Do(NewRemoveServiceCommand(in.GetUuid())); err != nil {
+		return nil, g.grpcError(err)
+	}
+	return &rpc.DeregisterResponse{}, nil
+}
+
+func (g *grpcServer) Heartbeat(stream rpc.SkyDNS_HeartbeatServer) error {
+	req, err := g.authorize(stream.Context())
+	if err != nil {
+		return err
+	}
+	if g.s.replica != nil {
+		return status.Error(codes.FailedPrecondition, ErrReadOnly.Error())
+	}
+	for {
+		in, err := stream.Recv()
+		if err != nil {
+			// io.EOF when the client closes the stream
+			return nil
+		}
+		stats.UpdateTTLCount.Inc(1)
+
+		serv, err := g.s.registry.GetUUID(in.GetUuid())
+		if err == nil && !g.s.mayChange(req, serv.Environment) {
+			return status.Error(codes.PermissionDenied, "Forbidden for environment "+serv.Environment)
+		}
+		serv.UUID = in.GetUuid()
+		if _, err := g.s.raftServer.Do(g.s.updateTTLCommand(serv, in.GetTtl())); err != nil {
+			return g.grpcError(err)
+		}
+		if err := stream.Send(&rpc.HeartbeatResponse{Uuid: in.GetUuid()}); err != nil {
+			return err
+		}
+	}
+}
+
+func (g *grpcServer) Resolve(ctx context.Context, in *rpc.ResolveRequest) (*rpc.ResolveResponse, error) {
+	if _, err := g.authorize(ctx); err != nil {
+		return nil, err
+	}
+	stats.GetServiceCount.Inc(1)
+
+	services, err := g.s.registry.Get(strings.ToLower(in.GetQuery()))
+	if err != nil && err != registry.ErrNotExists {
+		return nil, g.grpcError(err)
+	}
+	out := &rpc.ResolveResponse{}
+	for _, serv := range services {
+		out.Services = append(out.Services, toProto(serv))
+	}
+	return out, nil
+}
+
+func (g *grpcServer) Watch(in *rpc.WatchRequest, stream rpc.SkyDNS_WatchServer) error {
+	if _, err := g.authorize(stream.Context()); err != nil {
+		return err
+	}
+
+	events, stop := g.s.registry.Watch(eventBuffer)
+	defer stop()
+
+	var last uint32
+	if in.GetSince() != 0 {
+		missed, err := g.s.registry.GetChanges(in.GetSince())
+		if err != nil {
+			return status.Error(codes.OutOfRange, err.Error())
+		}
+		for _, c := range missed {
+			if err := sendEvent(stream, changeEvent(c, g.s.now())); err != nil {
+				return err
+			}
+			last = c.Serial
+		}
+	}
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "Watch fell behind")
+			}
+			if replayed(e, last) {
+				continue
+			}
+			if err := sendEvent(stream, e); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// sendEvent sends e on stream, events of aliases are skipped.
+func sendEvent(stream rpc.SkyDNS_WatchServer, e registry.Event) error {
+	if e.Service == nil {
+		return nil
+	}
+	return stream.Send(&rpc.Event{Type: e.Type, Serial: e.Serial, Service: toProto(*e.Service)})
+}
+
+func toProto(s msg.Service) *rpc.Service {
+	return &rpc.Service{
+		Uuid:        s.UUID,
+		Name:        s.Name,
+		Version:     s.Version,
+		Environment: s.Environment,
+		Region:      s.Region,
+		Host:        s.Host,
+		Host6:       s.Host6,
+		Port:        uint32(s.Port),
+		Ttl:         s.TTL,
+		Labels:      s.Labels,
+	}
+}
+
+func fromProto(s *rpc.Service) msg.Service {
+	return msg.Service{
+		UUID:        s.GetUuid(),
+		Name:        s.GetName(),
+		Version:     s.GetVersion(),
+		Environment: s.GetEnvironment(),
+		Region:      s.GetRegion(),
+		Host:        s.GetHost(),
+		Host6:       s.GetHost6(),
+		Port:        uint16(s.GetPort()),
+		TTL:         s.GetTtl(),
+		Labels:      s.GetLabels(),
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/stats"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+)
+
+// maxKeyLabels is the number of labels of a registry key,
+// uuid.host.region.version.service.environment. Names with more labels below
+// the SkyDNS domain don't exist, and aliases can't have more either.
+const maxKeyLabels = 6
+
+// checkQuery returns the rcode to answer req with when it is not a well
+// formed query, or dns.RcodeSuccess when it is. A query is a single question
+// for a valid domain name; the server's accept function already enforces
+// most of this, but DNS-over-HTTPS requests don't pass through it.
+func checkQuery(req *dns.Msg) int {
+	switch {
+	case req.Response || len(req.Question) != 1:
+		return dns.RcodeFormatError
+	case req.Opcode != dns.OpcodeQuery:
+		return dns.RcodeNotImplemented
+	case len(req.Answer) > 0 || len(req.Ns) > 1:
+		// IXFR queries carry the SOA of the secondary in the authority section
+		return dns.RcodeFormatError
+	}
+	if _, ok := dns.IsDomainName(req.Question[0].Name); !ok || !dns.IsFqdn(req.Question[0].Name) {
+		return dns.RcodeFormatError
+	}
+	return dns.RcodeSuccess
+}
+
+// tooDeep returns true if name, in the SkyDNS domain dom, has more labels
+// below dom than a registry key. It is checked before the registry is asked.
+func tooDeep(name, dom string) bool {
+	key := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(name), strings.ToLower(dns.Fqdn(dom))), ".")
+	return dns.CountLabel(key) > maxKeyLabels
+}
+
+// refuseQuery answers req with rcode, without looking at its question.
+func refuseQuery(w dns.ResponseWriter, req *dns.Msg, rcode int) {
+	stats.MalformedQueryCount.Inc(1)
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	w.WriteMsg(m)
+}
+
+// recoverDNS answers req with SERVFAIL when answering it panicked, so one bad
+// query doesn't take down the server. It must be deferred with the
+// ResponseWriter the server handed in, the writers wrapped around it may be
+// what panicked.
+func recoverDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if r := recover(); r != nil {
+		servfailPanic(w, req, r)
+	}
+}
+
+// servfailPanic logs the panic r while answering req and answers it with
+// SERVFAIL.
+func servfailPanic(w dns.ResponseWriter, req *dns.Msg, r interface{}) {
+	stats.PanicCount.Inc(1)
+	slog.Error("Panic answering DNS request", "err", r, "client", w.RemoteAddr().String(), "request", req.String(), "stack", string(debug.Stack()))
+
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+}
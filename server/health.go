@@ -0,0 +1,167 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/registry"
+	"github.com/skynetservices/skydns/stats"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultCheckWorkers is the number of health checks run at the same time.
+const DefaultCheckWorkers = 16
+
+// checkState is the state of the health check of one service.
+type checkState struct {
+	next     time.Time // when the check is due
+	failures int       // failures in a row
+	running  bool
+}
+
+// healthChecker runs the health checks of the services on a pool of workers.
+// Only the leader runs checks, it records the outcome in the registry with
+// raft commands so all members exclude the same services.
+type healthChecker struct {
+	sync.Mutex
+	state map[string]*checkState // UUID -> state
+	jobs  chan msg.Service
+}
+
+// EnableHealthChecks runs the health checks of the services that have one,
+// at most workers at the same time. Services that fail their check are left
+// out of DNS answers, the API still lists them.
+func (s *Server) EnableHealthChecks(workers int) {
+	s.health = &healthChecker{state: make(map[string]*checkState), jobs: make(chan msg.Service, workers)}
+	for i := 0; i < workers; i++ {
+		go s.checkWorker()
+	}
+}
+
+// scheduleChecks starts the checks that are due, it is called every second
+// on the leader.
+func (s *Server) scheduleChecks() {
+	services, _ := s.registry.Get("*")
+	now := time.Now()
+
+	h := s.health
+	h.Lock()
+	defer h.Unlock()
+
+	seen := make(map[string]bool, len(services))
+	for _, serv := range services {
+		if serv.Check == nil {
+			continue
+		}
+		seen[serv.UUID] = true
+		st, ok := h.state[serv.UUID]
+		if !ok {
+			st = &checkState{next: now}
+			h.state[serv.UUID] = st
+		}
+		if st.running || now.Before(st.next) {
+			continue
+		}
+		select {
+		case h.jobs <- serv:
+			st.running = true
+		default:
+			// All workers are busy, try again next time
+		}
+	}
+	for uuid, st := range h.state {
+		if !seen[uuid] && !st.running {
+			delete(h.state, uuid)
+		}
+	}
+}
+
+func (s *Server) checkWorker() {
+	for serv := range s.health.jobs {
+		// Services restored from an older snapshot may have any target
+		err := serv.Check.Validate(&serv)
+		if err == nil {
+			err = serv.Check.Run()
+		}
+		if err != nil {
+			stats.HealthCheckFailCount.Inc(1)
+		}
+
+		s.health.Lock()
+		st := s.health.state[serv.UUID]
+		st.running = false
+		st.next = time.Now().Add(serv.Check.Every())
+		if err == nil {
+			st.failures = 0
+		} else {
+			st.failures++
+		}
+		failures := st.failures
+		s.health.Unlock()
+
+		switch {
+		case err == nil && serv.Unhealthy:
+			slog.Info("Service passed its health check", "uuid", serv.UUID)
+			s.setHealth(serv.UUID, true)
+		case err != nil && !serv.Unhealthy && failures >= serv.Check.Threshold():
+			slog.Warn("Service failed its health check", "uuid", serv.UUID, "failures", failures, "err", err)
+			s.setHealth(serv.UUID, false)
+		}
+	}
+}
+
+func (s *Server) setHealth(uuid string, healthy bool) {
+	if _, err := s.raftServer.Do(NewSetHealthCommand(uuid, healthy)); err != nil && err != registry.ErrNotExists {
+		slog.Error("Recording service health", "uuid", uuid, "err", err)
+	}
+}
+
+// inRotation returns the services that don't fail their health check and
+// aren't drained.
+func inRotation(services []msg.Service) []msg.Service {
+	h := services[:0]
+	for _, serv := range services {
+		if !serv.Unhealthy && !serv.Drained {
+			h = append(h, serv)
+		}
+	}
+	return h
+}
+
+// lookup returns the services matching key that are in rotation and in the
+// zone of sc, as they're used in DNS answers for clients in the view of sc.
+// If none are the name doesn't exist.
+func (s *Server) lookup(key string, sc scope) ([]msg.Service, error) {
+	services, err := s.registry.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if services = inZone(inRotation(services), sc.zone); len(services) == 0 {
+		return nil, registry.ErrNotExists
+	}
+	return inView(services, sc.view), nil
+}
+
+// lookupHost is lookup, but a key of one label that matches no services is
+// looked up as a UUID. The target of an SRV record for a service with an IP
+// address is <uuid>.<domain>, see srvRecord.
+func (s *Server) lookupHost(key string, sc scope) ([]msg.Service, error) {
+	services, err := s.lookup(key, sc)
+	labels := dns.SplitDomainName(key)
+	if err != registry.ErrNotExists || len(labels) != 1 {
+		return services, err
+	}
+	serv, err := s.registry.GetUUID(labels[0])
+	if err != nil {
+		return nil, err
+	}
+	if services = inZone(inRotation([]msg.Service{serv}), sc.zone); len(services) == 0 {
+		return nil, registry.ErrNotExists
+	}
+	return inView(services, sc.view), nil
+}
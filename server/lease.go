@@ -0,0 +1,89 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/goraft/raft"
+	"github.com/gorilla/mux"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/registry"
+	"net/http"
+	"time"
+)
+
+// LeaseStatus is the state of the lease of a service.
+type LeaseStatus struct {
+	msg.Lease
+	Missed  uint32    // renewals missed in a row
+	Expires time.Time // unless the lease is renewed
+}
+
+// Handle API set lease requests, which give a registered service a lease
+func (s *Server) setLeaseHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	uuid := mux.Vars(req)["uuid"]
+
+	var l msg.Lease
+	if err := s.decodeBody(w, req, &l); err != nil {
+		decodeError(w, err)
+		return
+	}
+	if err := l.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if serv, err := s.registry.GetUUID(uuid); err == nil && !s.mayChange(req, serv.Environment) {
+		forbidEnvironment(w, serv.Environment)
+		return
+	}
+
+	s.doLease(w, req, NewSetLeaseCommand(uuid, l, s.now()))
+}
+
+// Handle API renew lease requests
+func (s *Server) renewLeaseHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	uuid := mux.Vars(req)["uuid"]
+	if serv, err := s.registry.GetUUID(uuid); err == nil && !s.mayChange(req, serv.Environment) {
+		forbidEnvironment(w, serv.Environment)
+		return
+	}
+
+	s.doLease(w, req, NewRenewLeaseCommand(uuid, s.now()))
+}
+
+// doLease commits a lease command and replies with the state of the lease.
+func (s *Server) doLease(w http.ResponseWriter, req *http.Request, c raft.Command) {
+	if _, err := s.raftServer.Do(c); err != nil {
+		switch err {
+		case registry.ErrNotExists, registry.ErrNoLease:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case raft.NotLeaderError:
+			s.redirectToLeader(w, req)
+		default:
+			logRequestError(req, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	s.getLeaseHTTPHandler(w, req)
+}
+
+// Handle API get lease requests
+func (s *Server) getLeaseHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	serv, err := s.registry.GetUUID(mux.Vars(req)["uuid"])
+	if err == nil && serv.Lease == nil {
+		err = registry.ErrNoLease
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	l := *serv.Lease
+	l.Grace = l.Threshold()
+	if err := json.NewEncoder(w).Encode(LeaseStatus{l, l.Missed(s.now()), serv.Expires}); err != nil {
+		logRequestError(req, err)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// EDNS0MaxAnswers is the (private use) EDNS0 option code a client sets to
+// limit the number of answers it gets. The option data is a 2 byte, big
+// endian, number of answers. A limit above the server's own is ignored.
+const EDNS0MaxAnswers = 65402
+
+// SetMaxAnswers limits the number of records in an answer to n, a sample of
+// n by priority and weight is returned for names that have more. 0 means no
+// limit.
+func (s *Server) SetMaxAnswers(n int) {
+	s.maxAnswers = n
+}
+
+// SetGlue sets whether the A and AAAA records of SRV targets are put in the
+// additional section. Without them clients look up the targets themselves.
+func (s *Server) SetGlue(glue bool) {
+	s.noGlue = !glue
+}
+
+// answerLimit returns the number of answers the reply to req may have, the
+// lower of the server's limit and the client's, 0 when there is none.
+func (s *Server) answerLimit(req *dns.Msg) int {
+	n := s.maxAnswers
+	opt := req.IsEdns0()
+	if opt == nil {
+		return n
+	}
+	for _, o := range opt.Option {
+		l, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || l.Code != EDNS0MaxAnswers || len(l.Data) != 2 {
+			continue
+		}
+		if c := int(binary.BigEndian.Uint16(l.Data)); c > 0 && (n == 0 || c < n) {
+			n = c
+		}
+	}
+	return n
+}
+
+// limitAnswers trims m, the reply to req, to the answer limit and drops the
+// glue when that's disabled. CNAME records (of aliases) are always kept, the
+// other answers are picked like a client picks SRV records (RFC 2782): by
+// lowest priority first, and by weight within a priority. They are kept in
+// their original order, and the glue of the SRV records that were dropped
+// goes with them.
+func (s *Server) limitAnswers(req, m *dns.Msg) {
+	if s.noGlue {
+		extra := m.Extra[:0]
+		for _, rr := range m.Extra {
+			if t := rr.Header().Rrtype; t != dns.TypeA && t != dns.TypeAAAA {
+				extra = append(extra, rr)
+			}
+		}
+		m.Extra = extra
+	}
+
+	n := s.answerLimit(req)
+	var sample []candidate
+	for i, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+		case *dns.SRV:
+			sample = append(sample, candidate{i: i, priority: rr.Priority, weight: rr.Weight})
+		default:
+			sample = append(sample, candidate{i: i})
+		}
+	}
+	if n == 0 || len(sample) <= n {
+		return
+	}
+	drop := make(map[int]bool)
+	for _, c := range sample {
+		drop[c.i] = true
+	}
+	for _, i := range pickAnswers(sample, n) {
+		delete(drop, i)
+	}
+
+	kept, targets := make(map[string]bool), make(map[string]bool)
+	answer := m.Answer[:0]
+	for i, rr := range m.Answer {
+		srv, isSRV := rr.(*dns.SRV)
+		if drop[i] {
+			if isSRV {
+				targets[strings.ToLower(srv.Target)] = true
+			}
+			continue
+		}
+		if isSRV {
+			kept[strings.ToLower(srv.Target)] = true
+		}
+		answer = append(answer, rr)
+	}
+	m.Answer = answer
+
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		name := strings.ToLower(rr.Header().Name)
+		if t := rr.Header().Rrtype; (t == dns.TypeA || t == dns.TypeAAAA) && targets[name] && !kept[name] {
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	m.Extra = extra
+}
+
+// candidate is an answer limitAnswers may drop, with the priority and weight
+// of its SRV record. Other records have neither.
+type candidate struct {
+	i                int // index in the answer section
+	priority, weight uint16
+}
+
+// pickAnswers returns the indices of n of the candidates. The tiers of
+// candidates with the same priority are taken from the lowest priority up,
+// the next tier only when the one before it is exhausted. Within the tier
+// that doesn't fit, candidates are drawn with a chance proportional to their
+// weight, as in RFC 2782.
+func pickAnswers(candidates []candidate, n int) []int {
+	c := append([]candidate(nil), candidates...)
+	// RFC 2782 puts the records with weight 0 first, they are drawn only
+	// when the running sum is 0. They are shuffled first, so the one drawn
+	// is any of them and not always the first.
+	rand.Shuffle(len(c), func(i, j int) { c[i], c[j] = c[j], c[i] })
+	sort.SliceStable(c, func(i, j int) bool {
+		if c[i].priority != c[j].priority {
+			return c[i].priority < c[j].priority
+		}
+		return c[i].weight == 0 && c[j].weight != 0
+	})
+
+	picked := make([]int, 0, n)
+	for len(c) > 0 && len(picked) < n {
+		end := 1
+		for end < len(c) && c[end].priority == c[0].priority {
+			end++
+		}
+		tier := c[:end]
+		c = c[end:]
+		for len(tier) > 0 && len(picked) < n {
+			total := 0
+			for _, t := range tier {
+				total += int(t.weight)
+			}
+			r, k := rand.Intn(total+1), 0
+			for sum := int(tier[0].weight); sum < r; sum += int(tier[k].weight) {
+				k++
+			}
+			picked = append(picked, tier[k].i)
+			tier = append(tier[:k], tier[k+1:]...)
+		}
+	}
+	return picked
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/logging"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// logRequestError logs err, which failed the API request req.
+func logRequestError(req *http.Request, err error) {
+	slog.Error("API request failed", "method", req.Method, "path", req.URL.Path, "err", err)
+}
+
+// queryLog logs the answers to DNS queries, one record per query.
+type queryLog struct {
+	logger   *slog.Logger
+	sample   float64 // fraction of queries logged
+	failures bool    // if set, answers other than NOERROR and NXDOMAIN are always logged
+}
+
+// EnableQueryLog logs the client, name, type, response code, latency and the
+// source of the answer of a sample of the DNS queries to w, as JSON if json
+// is set. Sample is the fraction of queries logged, between 0 and 1. If
+// failures is set, queries that fail (SERVFAIL, REFUSED and the like) are
+// logged whether they're sampled or not.
+func (s *Server) EnableQueryLog(w io.Writer, json bool, sample float64, failures bool) {
+	s.queryLog = &queryLog{logger: logging.NewLogger(w, slog.LevelInfo, json), sample: sample, failures: failures}
+}
+
+// log logs the answer r to a query for name of type qtype.
+func (q *queryLog) log(w dns.ResponseWriter, name string, qtype uint16, r *dns.Msg, source string, d time.Duration) {
+	sampled := q.sample >= 1 || rand.Float64() < q.sample
+	failed := r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError
+	if !sampled && !(q.failures && failed) {
+		return
+	}
+	proto := "udp"
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		proto = "tcp"
+	}
+	q.logger.Info("Query",
+		"client", remoteIP(w).String(),
+		"proto", proto,
+		"name", name,
+		"type", dns.Type(qtype).String(),
+		"rcode", dns.RcodeToString[r.Rcode],
+		"answers", len(r.Answer),
+		"source", source,
+		"latency_ms", float64(d)/float64(time.Millisecond),
+	)
+}
@@ -0,0 +1,369 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/registry"
+	"github.com/skynetservices/skydns/stats"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+const (
+	// mdnsAddr is the multicast group and port of multicast DNS (RFC 6762).
+	mdnsAddr = "224.0.0.251:5353"
+	// mdnsTTL is the TTL of the records announced over multicast DNS.
+	mdnsTTL = 120
+	// mdnsServices is the name DNS-SD (RFC 6763) browsers enumerate the
+	// service types with.
+	mdnsServices = "_services._dns-sd._udp.local."
+	// mdnsCacheFlush is the bit in the class of unique records that tells
+	// receivers to drop what they have cached for the name.
+	mdnsCacheFlush = 1 << 15
+	// mdnsMaxQuestions is the most questions answered in one query, queries
+	// with more are dropped.
+	mdnsMaxQuestions = 32
+)
+
+// mdnsResponder answers multicast DNS queries on the local segment, from an
+// index of the records of the services it announced.
+type mdnsResponder struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+	done  chan struct{} // closed when the server stops
+
+	sync.RWMutex
+	records map[string][]dns.RR        // records of the announced services by UUID
+	names   map[string]map[string]bool // UUIDs of the services by the lower cased names of their records
+	types   map[string]int             // number of announced instances by service type
+}
+
+func newMDNSResponder(conn *net.UDPConn, group *net.UDPAddr) *mdnsResponder {
+	return &mdnsResponder{
+		conn:    conn,
+		group:   group,
+		done:    make(chan struct{}),
+		records: make(map[string][]dns.RR),
+		names:   make(map[string]map[string]bool),
+		types:   make(map[string]int),
+	}
+}
+
+// EnableMDNS announces the services over multicast DNS on the network
+// interface iface, or the system's default multicast interface when iface is
+// empty. Each service is a DNS-SD instance <uuid>._<name>._tcp.local with its
+// SRV record, its metadata in a TXT record and, for a Host that is an IP
+// address, the address as <uuid>.local. Services are announced when they're
+// added and withdrawn when they go, and queries for them are answered. Only
+// the services in the SkyDNS domain are announced, not those in other zones.
+func (s *Server) EnableMDNS(iface string) error {
+	var ifi *net.Interface
+	if iface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(iface); err != nil {
+			return err
+		}
+	}
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		return err
+	}
+
+	s.mdns = newMDNSResponder(conn, group)
+	events, stop := s.registry.Watch(eventBuffer)
+	go s.serveMDNS()
+	go s.announceMDNS(events, stop)
+	return nil
+}
+
+// serveMDNS answers the queries for the records of the services, until the
+// server stops.
+func (s *Server) serveMDNS() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := s.mdns.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.mdns.done:
+				return
+			default:
+			}
+			slog.Warn("Reading multicast DNS query", "err", err)
+			continue
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf[:n]); err != nil || req.Response || len(req.Question) > mdnsMaxQuestions {
+			continue
+		}
+		s.answerMDNS(req, from)
+	}
+}
+
+// answerMDNS answers the multicast DNS query req from from. A panic answering
+// it is logged, the query is dropped and the responder keeps running.
+func (s *Server) answerMDNS(req *dns.Msg, from *net.UDPAddr) {
+	defer func() {
+		if r := recover(); r != nil {
+			stats.PanicCount.Inc(1)
+			slog.Error("Panic answering multicast DNS query", "err", r, "client", from.String(), "request", req.String(), "stack", string(debug.Stack()))
+		}
+	}()
+
+	m := new(dns.Msg)
+	m.Response, m.Authoritative = true, true
+	unicast := from.Port != 5353 // a legacy resolver, not a multicast DNS one
+	for _, q := range req.Question {
+		answer, extra := s.mdns.lookup(q.Name, q.Qtype)
+		m.Answer = append(m.Answer, answer...)
+		m.Extra = append(m.Extra, extra...)
+		unicast = unicast || q.Qclass&mdnsCacheFlush != 0 // the QU bit
+	}
+	if len(m.Answer) == 0 {
+		return
+	}
+	to := s.mdns.group
+	if unicast {
+		to = from
+	}
+	if from.Port != 5353 {
+		m.Id, m.Question = req.Id, req.Question
+	}
+	s.sendMDNS(m, to)
+}
+
+// announceMDNS announces the services that are added or come back, and
+// withdraws those that go, until the server stops.
+func (s *Server) announceMDNS(events <-chan registry.Event, stop func()) {
+	defer func() { stop() }()
+
+	if services, err := s.registry.Get("*"); err == nil {
+		for _, serv := range inZone(inRotation(services), "") {
+			s.announceService(serv)
+		}
+	}
+	for {
+		var e registry.Event
+		var ok bool
+		select {
+		case <-s.mdns.done:
+			return
+		case e, ok = <-events:
+		}
+		if !ok {
+			events, stop = s.registry.Watch(eventBuffer)
+			continue
+		}
+		s.mdnsEvent(e)
+	}
+}
+
+// mdnsEvent announces or withdraws the service of the registry event e.
+func (s *Server) mdnsEvent(e registry.Event) {
+	if e.Service == nil || e.Service.Zone != "" || e.Type == registry.EventUpdate {
+		return
+	}
+	if e.Type == registry.EventRemove || e.Type == registry.EventExpire || e.Service.Unhealthy || e.Service.Drained {
+		s.withdrawService(e.Service.UUID)
+		return
+	}
+	s.announceService(*e.Service)
+}
+
+// announceService indexes the records of serv and multicasts them.
+func (s *Server) announceService(serv msg.Service) {
+	m := new(dns.Msg)
+	m.Response, m.Authoritative = true, true
+	m.Answer = s.mdns.add(serv)
+	s.sendMDNS(m, s.mdns.group)
+}
+
+// withdrawService drops the records of the service with uuid from the index
+// and multicasts goodbyes for them. The service type is withdrawn only with
+// its last instance.
+func (s *Server) withdrawService(uuid string) {
+	records, last := s.mdns.remove(uuid)
+	if len(records) == 0 {
+		return
+	}
+	if !last {
+		records = records[1:]
+	}
+	m := new(dns.Msg)
+	m.Response, m.Authoritative = true, true
+	for _, rr := range records {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0 // a goodbye, the records are deleted
+		m.Answer = append(m.Answer, rr)
+	}
+	s.sendMDNS(m, s.mdns.group)
+}
+
+// stopMDNS withdraws all services and stops the responder.
+func (s *Server) stopMDNS() {
+	close(s.mdns.done)
+	s.mdns.RLock()
+	uuids := make([]string, 0, len(s.mdns.records))
+	for uuid := range s.mdns.records {
+		uuids = append(uuids, uuid)
+	}
+	s.mdns.RUnlock()
+	for _, uuid := range uuids {
+		s.withdrawService(uuid)
+	}
+	s.mdns.conn.Close()
+}
+
+// sendMDNS sends m to addr.
+func (s *Server) sendMDNS(m *dns.Msg, addr *net.UDPAddr) {
+	b, err := m.Pack()
+	if err != nil {
+		slog.Error("Packing multicast DNS reply", "err", err)
+		return
+	}
+	if _, err := s.mdns.conn.WriteToUDP(b, addr); err != nil {
+		slog.Warn("Sending multicast DNS reply", "addr", addr.String(), "err", err)
+	}
+}
+
+// add indexes the records of serv, replacing those of the service with the
+// same UUID, and returns them.
+func (r *mdnsResponder) add(serv msg.Service) []dns.RR {
+	r.Lock()
+	defer r.Unlock()
+
+	r.drop(serv.UUID)
+	records := mdnsServiceRecords(serv)
+	r.records[serv.UUID] = records
+	r.types[records[0].(*dns.PTR).Ptr]++
+	for _, rr := range records[1:] {
+		name := strings.ToLower(rr.Header().Name)
+		if r.names[name] == nil {
+			r.names[name] = make(map[string]bool)
+		}
+		r.names[name][serv.UUID] = true
+	}
+	return records
+}
+
+// remove drops the records of the service with uuid from the index and
+// returns them, last is true if it was the last instance of its type.
+func (r *mdnsResponder) remove(uuid string) (records []dns.RR, last bool) {
+	r.Lock()
+	defer r.Unlock()
+	return r.drop(uuid)
+}
+
+// drop is remove with the lock held.
+func (r *mdnsResponder) drop(uuid string) (records []dns.RR, last bool) {
+	records, ok := r.records[uuid]
+	if !ok {
+		return nil, false
+	}
+	delete(r.records, uuid)
+	typ := records[0].(*dns.PTR).Ptr
+	if r.types[typ]--; r.types[typ] == 0 {
+		delete(r.types, typ)
+		last = true
+	}
+	for _, rr := range records[1:] {
+		name := strings.ToLower(rr.Header().Name)
+		if delete(r.names[name], uuid); len(r.names[name]) == 0 {
+			delete(r.names, name)
+		}
+	}
+	return records, last
+}
+
+// lookup returns the records of the announced services with name and qtype,
+// and the other records of those services for the additional section.
+func (r *mdnsResponder) lookup(name string, qtype uint16) (answer []dns.RR, extra []dns.RR) {
+	r.RLock()
+	defer r.RUnlock()
+
+	name = strings.ToLower(name)
+	if name == mdnsServices {
+		if qtype == dns.TypePTR || qtype == dns.TypeANY {
+			for typ := range r.types {
+				answer = append(answer, &dns.PTR{Hdr: dns.RR_Header{Name: mdnsServices, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: mdnsTTL}, Ptr: typ})
+			}
+		}
+		return
+	}
+	matches := func(rr dns.RR) bool {
+		return strings.ToLower(rr.Header().Name) == name && (qtype == dns.TypeANY || rr.Header().Rrtype == qtype)
+	}
+	seen := make(map[string]bool)
+	for uuid := range r.names[name] {
+		records := r.records[uuid][1:]
+		match := false
+		for _, rr := range records {
+			match = match || matches(rr)
+		}
+		if !match {
+			continue
+		}
+		for _, rr := range records {
+			if seen[rr.String()] {
+				continue
+			}
+			seen[rr.String()] = true
+			if matches(rr) {
+				answer = append(answer, rr)
+			} else {
+				extra = append(extra, rr)
+			}
+		}
+	}
+	return
+}
+
+// mdnsServiceRecords returns the DNS-SD records of serv: the PTR records of
+// its type and instance, the SRV and TXT records of the instance and the
+// addresses of its target.
+func mdnsServiceRecords(serv msg.Service) []dns.RR {
+	typ := "_" + mdnsLabel(serv.Name) + "._tcp.local."
+	instance := mdnsLabel(serv.UUID) + "." + typ
+	target := dns.Fqdn(serv.Host)
+
+	var addrs []dns.RR
+	ip4, ip6 := serv.Addresses()
+	if ip4 != nil || ip6 != nil {
+		target = mdnsLabel(serv.UUID) + ".local."
+		addrs = append(addressRecords(target, dns.TypeANY, ip4, mdnsTTL), addressRecords(target, dns.TypeANY, ip6, mdnsTTL)...)
+	}
+
+	records := []dns.RR{
+		&dns.PTR{Hdr: dns.RR_Header{Name: mdnsServices, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: mdnsTTL}, Ptr: typ},
+		&dns.PTR{Hdr: dns.RR_Header{Name: typ, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: mdnsTTL}, Ptr: instance},
+		&dns.SRV{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV, Class: dns.ClassINET | mdnsCacheFlush, Ttl: mdnsTTL},
+			Port: serv.Port, Target: target},
+		&dns.TXT{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT, Class: dns.ClassINET | mdnsCacheFlush, Ttl: mdnsTTL},
+			Txt: metadataStrings(serv)},
+	}
+	for _, rr := range addrs {
+		rr.Header().Class |= mdnsCacheFlush
+	}
+	return append(records, addrs...)
+}
+
+// mdnsLabel returns s as a DNS label: lower cased, with dots and white space
+// replaced by dashes.
+func mdnsLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == ' ' || r == '\t' {
+			return '-'
+		}
+		return r
+	}, strings.ToLower(s))
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/stats"
+	"time"
+)
+
+// measureWriter records the latency and response code of the answer to a
+// query, and where the answer came from, and logs it in the query log.
+type measureWriter struct {
+	dns.ResponseWriter
+	start  time.Time
+	name   string
+	qtype  uint16
+	source string
+	log    *queryLog // nil if the query log is off
+}
+
+func (m *measureWriter) WriteMsg(r *dns.Msg) error {
+	err := m.ResponseWriter.WriteMsg(r)
+	d := time.Since(m.start)
+	stats.DNSAnswered(qtypeName(m.qtype), m.source, dns.RcodeToString[r.Rcode], d)
+	if m.log != nil {
+		m.log.log(m.ResponseWriter, m.name, m.qtype, r, m.source, d)
+	}
+	return err
+}
+
+// measureResponseWriter returns a ResponseWriter that measures the answer to
+// req, which is assumed to come from the registry until answeredFrom says
+// otherwise. The answer is logged to log unless it is nil. req may be
+// malformed, without a question.
+func measureResponseWriter(w dns.ResponseWriter, req *dns.Msg, log *queryLog) dns.ResponseWriter {
+	m := &measureWriter{ResponseWriter: w, start: time.Now(), source: stats.SourceRegistry, log: log}
+	if len(req.Question) > 0 {
+		m.name, m.qtype = req.Question[0].Name, req.Question[0].Qtype
+	}
+	return m
+}
+
+// answeredFrom records that the answer written to w comes from source. The
+// writers wrapped around the measureWriter later in ServeDNS are looked through.
+func answeredFrom(w dns.ResponseWriter, source string) {
+	switch m := w.(type) {
+	case *measureWriter:
+		m.source = source
+	case *debugWriter:
+		answeredFrom(m.ResponseWriter, source)
+	case *rewriteWriter:
+		answeredFrom(m.ResponseWriter, source)
+	case *zoneWriter:
+		answeredFrom(m.ResponseWriter, source)
+	case *staleWriter:
+		answeredFrom(m.ResponseWriter, source)
+	case *subnetWriter:
+		answeredFrom(m.ResponseWriter, source)
+	}
+}
+
+// qtypeName returns the name of the query type t, or "other" for types that
+// don't have one, to limit the number of metrics.
+func qtypeName(t uint16) string {
+	if n, ok := dns.TypeToString[t]; ok {
+		return n
+	}
+	return "other"
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/stats"
+	"strings"
+)
+
+// getNAPTRRecords returns the NAPTR records of the services matching q. The
+// records are the same for all instances of a service, each is returned
+// once. Replacements in the SkyDNS domain are resolved for the additional
+// section: SRV records (and their glue) for flag S, addresses for flag A, in
+// scope sc.
+func (s *Server) getNAPTRRecords(q dns.Question, sc scope) (records []dns.RR, extra []dns.RR, err error) {
+	services, err := s.lookup(strings.TrimSuffix(q.Name, s.domain+"."), sc)
+	if err != nil {
+		return
+	}
+
+	seen := make(map[msg.NAPTR]*dns.NAPTR)
+	for _, serv := range services {
+		stats.Resolved(serv.UUID)
+		for _, n := range serv.NAPTR {
+			if rr, ok := seen[n]; ok {
+				if serv.TTL < rr.Hdr.Ttl {
+					rr.Hdr.Ttl = serv.TTL
+				}
+				continue
+			}
+			rr := &dns.NAPTR{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNAPTR, Class: dns.ClassINET, Ttl: serv.TTL},
+				Order: n.Order, Preference: n.Preference, Flags: n.Flags, Service: n.Service, Regexp: n.Regexp,
+				Replacement: s.naptrReplacement(n.Replacement)}
+			seen[n] = rr
+			records = append(records, rr)
+		}
+	}
+
+	for _, rr := range records {
+		extra = append(extra, s.naptrExtra(rr.(*dns.NAPTR), sc)...)
+	}
+	return
+}
+
+// naptrReplacement returns the replacement r as a fully qualified name, names
+// without a trailing dot are relative to the SkyDNS domain.
+func (s *Server) naptrReplacement(r string) string {
+	switch {
+	case r == "" || r == ".":
+		return "."
+	case strings.HasSuffix(r, "."):
+		return r
+	}
+	return r + "." + dns.Fqdn(s.domain)
+}
+
+// naptrExtra returns the records of the replacement of rr for the additional
+// section, if it is in the SkyDNS domain.
+func (s *Server) naptrExtra(rr *dns.NAPTR, sc scope) (extra []dns.RR) {
+	if !strings.HasSuffix(strings.ToLower(rr.Replacement), "."+dns.Fqdn(s.domain)) {
+		return nil
+	}
+	switch strings.ToUpper(rr.Flags) {
+	case "S":
+		records, glue, err := s.getSRVRecords(dns.Question{Name: rr.Replacement, Qtype: dns.TypeSRV, Qclass: dns.ClassINET}, sc)
+		if err == nil {
+			extra = append(append(extra, records...), glue...)
+		}
+	case "A":
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if records, err := s.getARecords(dns.Question{Name: rr.Replacement, Qtype: qtype, Qclass: dns.ClassINET}, sc); err == nil {
+				extra = append(extra, records...)
+			}
+		}
+	}
+	return extra
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+)
+
+// nodePrefix starts the names the cluster members have in the domain.
+const nodePrefix = "skydns-"
+
+// node is a member of the cluster as it appears in the domain.
+type node struct {
+	name string // e.g. skydns-10-0-0-1-8080.skydns.local.
+	ip   net.IP
+}
+
+// nodeName returns the name of the member with the address addr in domain.
+// The label is derived from the address so every member comes up with the
+// same name for it, without having to agree on one.
+func nodeName(addr, domain string) string {
+	label := strings.Map(func(r rune) rune {
+		if r == '.' || r == ':' {
+			return '-'
+		}
+		return r
+	}, strings.NewReplacer("[", "", "]", "").Replace(strings.ToLower(addr)))
+	return nodePrefix + label + "." + dns.Fqdn(domain)
+}
+
+// nodes returns the current members of the cluster, this server included,
+// sorted by name. Members without an IP address are left out, as are members
+// bound to the unspecified address (0.0.0.0 or ::), which isn't an address
+// anybody can reach them at.
+func (s *Server) nodes() (nodes []node) {
+	seen := make(map[string]bool)
+	for _, addr := range append([]string{s.raftServer.Name()}, s.Members()...) {
+		h, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(h)
+		if ip == nil || ip.IsUnspecified() || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		nodes = append(nodes, node{name: nodeName(addr, s.domain), ip: ip})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].name < nodes[j].name })
+	return
+}
+
+// nodeAddress returns the records for name when it is the name of a member
+// of the cluster, ok is false when it isn't.
+func (s *Server) nodeAddress(name string, qtype uint16) (records []dns.RR, ok bool) {
+	if !strings.HasPrefix(strings.ToLower(name), nodePrefix) {
+		return nil, false
+	}
+	for _, n := range s.nodes() {
+		if strings.EqualFold(n.name, dns.Fqdn(name)) {
+			return addressRecords(n.name, qtype, n.ip, 15), true
+		}
+	}
+	return nil, false
+}
+
+// nameServers returns the NS records of the domain, one for each member of the
+// cluster, and the addresses of the members as glue.
+func (s *Server) nameServers() (ns []dns.RR, glue []dns.RR) {
+	dom := dns.Fqdn(s.domain)
+	for _, n := range s.nodes() {
+		ns = append(ns, &dns.NS{Hdr: dns.RR_Header{Name: dom, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 15}, Ns: n.name})
+		glue = append(glue, addressRecords(n.name, dns.TypeANY, n.ip, 15)...)
+	}
+	return
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/skynetservices/skydns/registry"
+	"github.com/skynetservices/skydns/stats"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// RegistryDebug is the reply to /skydns/debug/registry.
+type RegistryDebug struct {
+	registry.TreeStats
+	Expiring    int // services that expire within the expiry warning, 0 if it is off
+	Locks       map[string]stats.LockStats
+	Goroutines  int
+	HeapAlloc   uint64 // bytes of allocated heap objects
+	HeapObjects uint64
+}
+
+// EnableProfiling serves the pprof profiles under /debug/pprof/ and the
+// internals of the registry on /skydns/debug/registry, both behind the
+// authentication of the API.
+func (s *Server) EnableProfiling() {
+	auth := s.authHTTPWrapper
+
+	s.router.HandleFunc("/skydns/debug/registry", auth(s.getRegistryDebugHTTPHandler)).Methods("GET")
+
+	s.router.HandleFunc("/debug/pprof/cmdline", auth(pprof.Cmdline))
+	s.router.HandleFunc("/debug/pprof/profile", auth(pprof.Profile))
+	s.router.HandleFunc("/debug/pprof/symbol", auth(pprof.Symbol))
+	s.router.HandleFunc("/debug/pprof/trace", auth(pprof.Trace))
+	// The index serves the named profiles too, e.g. /debug/pprof/heap
+	s.router.PathPrefix("/debug/pprof/").HandlerFunc(auth(pprof.Index))
+}
+
+// Handle API registry debug requests
+func (s *Server) getRegistryDebugHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	reply := RegistryDebug{
+		TreeStats:   s.registry.TreeStats(),
+		Locks:       stats.RegistryLockStats(),
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   m.HeapAlloc,
+		HeapObjects: m.HeapObjects,
+	}
+	if s.expiryWarning > 0 {
+		reply.Expiring = len(s.registry.GetExpiring(s.expiryWarning))
+	}
+
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		logRequestError(req, err)
+	}
+}
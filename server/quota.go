@@ -0,0 +1,65 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/registry"
+	"github.com/skynetservices/skydns/stats"
+	"net"
+	"net/http"
+)
+
+// clientHeader carries the IP address of the client of a request a follower
+// forwarded to the leader.
+const clientHeader = "X-Skydns-Client"
+
+// SetQuotas limits the number of services registered per environment, per
+// name and per source IP address, 0 means no limit. Registrations over a
+// quota are refused with 429 Too Many Requests. The leader checks the quotas
+// before it commits a registration, every member of the cluster should have
+// the same quotas for them to hold after an election.
+func (s *Server) SetQuotas(environment, name, source int) {
+	s.quotas = registry.Quotas{Environment: environment, Name: name, Source: source}
+}
+
+// checkQuotas returns the error, or nil, of registering each of services.
+func (s *Server) checkQuotas(services ...msg.Service) []error {
+	errs := s.registry.CheckQuotas(s.quotas, services...)
+	for _, err := range errs {
+		if err != nil {
+			stats.QuotaExceededCount.Inc(1)
+		}
+	}
+	return errs
+}
+
+// registrant returns the IP address of the client that registers services
+// with req, that of the client of the follower for requests a peer forwarded.
+func (s *Server) registrant(req *http.Request) string {
+	if req.Header.Get(forwardedHeader) != "" && s.fromPeer(req) {
+		if ip := net.ParseIP(req.Header.Get(clientHeader)); ip != nil {
+			return ip.String()
+		}
+	}
+	if ip := httpRemoteIP(req); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// fromPeer reports whether req, already authenticated by authHTTPWrapper or
+// the gRPC authorize, comes from a member of the cluster: it carries the
+// shared secret or a token, or a verified client certificate. Anyone else
+// could set the forwarding headers to register services for another client.
+func (s *Server) fromPeer(req *http.Request) bool {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if s.secret != "" && s.authenticate(req.Header.Get("Authorization")) == nil {
+		return true
+	}
+	return s.requestToken(req) != nil
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"container/list"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/stats"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxBuckets is the number of clients the rate limiter tracks, past it the
+// least recently seen client is forgotten.
+const maxBuckets = 100000
+
+// pruneBuckets is the number of least recently seen clients checked for full
+// buckets on every query, so quiet clients are forgotten a few at a time.
+const pruneBuckets = 2
+
+// bucket is a token bucket of a client.
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+	drops  int // queries dropped, for the slip
+}
+
+// rateLimiter limits the queries per second of clients, grouped in subnets.
+type rateLimiter struct {
+	sync.Mutex
+	qps     float64
+	burst   float64
+	slip    int // every slip'th dropped UDP query gets a truncated reply, 0 never
+	mask4   net.IPMask
+	mask6   net.IPMask
+	buckets map[string]*list.Element
+	recent  *list.List // of buckets, front is most recently seen
+}
+
+// EnableRateLimit limits every client to qps queries per second, with bursts
+// of up to burst queries. Clients are grouped by the prefix4 (IPv4) and
+// prefix6 (IPv6) bit subnets they are in. Of the queries over the limit, every
+// slip'th query over UDP is answered with an empty, truncated, reply so real
+// clients retry over TCP. The others are dropped, over TCP they are refused.
+func (s *Server) EnableRateLimit(qps float64, burst, prefix4, prefix6, slip int) {
+	s.rateLimit = &rateLimiter{
+		qps:     qps,
+		burst:   float64(burst),
+		slip:    slip,
+		mask4:   net.CIDRMask(prefix4, 32),
+		mask6:   net.CIDRMask(prefix6, 128),
+		buckets: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+// key returns the subnet ip is grouped in.
+func (r *rateLimiter) key(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(r.mask4).String()
+	}
+	return ip.Mask(r.mask6).String()
+}
+
+// allow takes a token from the bucket of ip. If there is none it returns
+// false, and whether this drop is a slip.
+func (r *rateLimiter) allow(ip net.IP) (ok, slip bool) {
+	now := time.Now()
+	k := r.key(ip)
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.prune(now)
+	var b *bucket
+	if e, found := r.buckets[k]; found {
+		b = e.Value.(*bucket)
+		r.recent.MoveToFront(e)
+	} else {
+		if r.recent.Len() >= maxBuckets {
+			r.forget(r.recent.Back())
+		}
+		b = &bucket{key: k, tokens: r.burst, last: now}
+		r.buckets[k] = r.recent.PushFront(b)
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * r.qps
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, false
+	}
+	b.drops++
+	return false, r.slip > 0 && b.drops%r.slip == 0
+}
+
+// prune forgets the least recently seen clients whose buckets would be full
+// again, it checks at most pruneBuckets of them.
+func (r *rateLimiter) prune(now time.Time) {
+	for i := 0; i < pruneBuckets; i++ {
+		e := r.recent.Back()
+		if e == nil {
+			return
+		}
+		if b := e.Value.(*bucket); b.tokens+now.Sub(b.last).Seconds()*r.qps < r.burst {
+			return
+		}
+		r.forget(e)
+	}
+}
+
+// forget removes the bucket in e.
+func (r *rateLimiter) forget(e *list.Element) {
+	r.recent.Remove(e)
+	delete(r.buckets, e.Value.(*bucket).key)
+}
+
+// rateLimited returns true if the query req from the client behind w is over
+// its rate limit, in which case it has been dealt with.
+func (s *Server) rateLimited(w dns.ResponseWriter, req *dns.Msg) bool {
+	if s.rateLimit == nil {
+		return false
+	}
+	ip := remoteIP(w)
+	if ip == nil {
+		return false
+	}
+	ok, slip := s.rateLimit.allow(ip)
+	if ok {
+		return false
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if _, tcp := w.RemoteAddr().(*net.TCPAddr); tcp {
+		stats.RateLimitDropCount.Inc(1)
+		m.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return true
+	}
+	if slip {
+		stats.RateLimitSlipCount.Inc(1)
+		m.Truncated = true
+		w.WriteMsg(m)
+		return true
+	}
+	stats.RateLimitDropCount.Inc(1)
+	return true
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"sync"
+)
+
+// certificate is a certificate that can be reloaded while it is served.
+type certificate struct {
+	sync.RWMutex
+	certFile, keyFile string
+	cert              *tls.Certificate
+}
+
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	return c, c.reload()
+}
+
+// reload loads the certificate again, the current one is kept when the files
+// can't be loaded.
+func (c *certificate) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.cert = &cert
+	c.Unlock()
+	return nil
+}
+
+// get is the GetCertificate of the tls.Config the certificate is served with.
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+// ReloadTLS reloads the certificates of the HTTPS API and of DNS-over-TLS and
+// DNS-over-HTTPS. Connections made after the reload get the new certificates.
+func (s *Server) ReloadTLS() error {
+	for _, c := range []*certificate{s.apiCert, s.dnsCert} {
+		if c == nil {
+			continue
+		}
+		if err := c.reload(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnReload adds f to the functions Reload calls, e.g. to reload settings of
+// the command line.
+func (s *Server) OnReload(f func() error) {
+	s.reloadHooks = append(s.reloadHooks, f)
+}
+
+// Reload reloads the rewrite rules, access lists, record templates, views,
+// zones, TTL rules, API tokens and certificates, and calls the functions added
+// with OnReload. It is called on SIGHUP and leaves the registry alone.
+// Whatever fails to reload is logged and keeps its current settings.
+func (s *Server) Reload() {
+	slog.Info("Reloading configuration")
+	if err := s.ReloadRewrite(); err != nil {
+		slog.Error("Reloading rewrite rules", "err", err)
+	}
+	if err := s.ReloadACL(); err != nil {
+		slog.Error("Reloading ACLs", "err", err)
+	}
+	if err := s.ReloadTemplates(); err != nil {
+		slog.Error("Reloading record templates", "err", err)
+	}
+	if err := s.ReloadViews(); err != nil {
+		slog.Error("Reloading views", "err", err)
+	}
+	if err := s.ReloadZones(); err != nil {
+		slog.Error("Reloading zones", "err", err)
+	}
+	if err := s.ReloadTTLPolicy(); err != nil {
+		slog.Error("Reloading TTL rules", "err", err)
+	}
+	if err := s.ReloadTokens(); err != nil {
+		slog.Error("Reloading API tokens", "err", err)
+	}
+	if err := s.ReloadTLS(); err != nil {
+		slog.Error("Reloading certificates", "err", err)
+	}
+	for _, f := range s.reloadHooks {
+		if err := f(); err != nil {
+			slog.Error("Reloading", "err", err)
+		}
+	}
+}
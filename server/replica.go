@@ -0,0 +1,265 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/registry"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replicaRetry is the time between attempts to follow a member.
+	replicaRetry = time.Second
+	// replicaIdle is how long a stream may be silent, members send a
+	// keepalive every eventKeepalive.
+	replicaIdle = 3 * eventKeepalive
+)
+
+// ErrReadOnly is returned for writes to a read-only replica.
+var ErrReadOnly = errors.New("Read-only replica, send writes to a member of the cluster")
+
+// replica is the state of a read-only replica.
+type replica struct {
+	members []string // HTTP addresses of the members to follow
+	serial  uint32   // serial of the cluster the registry is at
+	synced  bool     // the registry was copied and serial can be resumed from
+	stop    chan bool
+
+	keyName, key string // if set, requests to the members are signed with key
+
+	following int32 // 1 while the events of a member are followed, accessed atomically
+}
+
+// EnableReplica makes the server a read-only replica of the cluster with the
+// given members. A replica doesn't take part in raft, it copies the registry
+// from one of the members and follows its changes with the event stream, to
+// serve DNS queries without adding to the quorum. API writes are refused.
+func (s *Server) EnableReplica(members []string) {
+	s.replica = &replica{members: members, stop: make(chan bool)}
+}
+
+// SetReplicaToken makes a replica sign its requests to the members with the
+// secret of the API token name, as client.SetSigningKey does, instead of
+// sending the shared secret.
+func (s *Server) SetReplicaToken(name, key string) {
+	s.replica.keyName, s.replica.key = name, key
+}
+
+// replicate follows the members, moving on to the next member when the one
+// it follows fails, until the server stops.
+func (s *Server) replicate() {
+	for i := 0; ; i++ {
+		m := s.replica.members[i%len(s.replica.members)]
+		if err := s.follow(m); err != nil {
+			slog.Error("Replicating", "member", m, "err", err)
+		}
+		select {
+		case <-s.replica.stop:
+			return
+		case <-time.After(replicaRetry):
+		}
+	}
+}
+
+// follow applies the events of member, after copying its registry when the
+// replica can't resume from where it was.
+func (s *Server) follow(member string) error {
+	if !s.replica.synced {
+		if err := s.copyRegistry(member); err != nil {
+			return err
+		}
+	}
+
+	req, err := s.replicaRequest(member, "/skydns/events")
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(uint64(s.replica.serial), 10))
+	resp, err := s.peerClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		// The member no longer has the changes since serial
+		s.replica.synced = false
+		return fmt.Errorf("changes since %d are gone, copying the registry again", s.replica.serial)
+	default:
+		return fmt.Errorf("%s returned %s", member, resp.Status)
+	}
+	atomic.StoreInt32(&s.replica.following, 1)
+	defer atomic.StoreInt32(&s.replica.following, 0)
+
+	// Close the stream when the member goes quiet, or the server stops
+	idle := time.AfterFunc(replicaIdle, func() { resp.Body.Close() })
+	defer idle.Stop()
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-s.replica.stop:
+			resp.Body.Close()
+		case <-done:
+		}
+	}()
+
+	r := bufio.NewReader(resp.Body)
+	var data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		idle.Reset(replicaIdle)
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "data: "):
+			data = line[len("data: "):]
+		case line == "" && data != "":
+			var e registry.Event
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				return err
+			}
+			s.applyEvent(e)
+			data = ""
+		}
+	}
+}
+
+// applyEvent applies an event of the cluster to the registry.
+func (s *Server) applyEvent(e registry.Event) {
+	switch {
+	case e.Alias != nil:
+		s.registry.RemoveAlias(e.Alias.Name)
+		if e.Type == registry.EventAdd {
+			s.registry.AddAlias(*e.Alias)
+		}
+	case e.Service == nil:
+	case e.Type == registry.EventAdd:
+		s.registry.RemoveUUID(e.Service.UUID)
+		s.registry.Add(*e.Service)
+	case e.Type == registry.EventRemove, e.Type == registry.EventExpire:
+		s.registry.RemoveUUID(e.Service.UUID)
+	case e.Type == registry.EventUpdate && e.Service.Lease != nil:
+		s.registry.SetLease(e.Service.UUID, *e.Service.Lease)
+	case e.Type == registry.EventUpdate:
+		s.registry.UpdateTTL(e.Service.UUID, e.Service.TTL, e.Service.Expires)
+	case e.Type == registry.EventHealth:
+		s.registry.SetHealth(e.Service.UUID, !e.Service.Unhealthy)
+	case e.Type == registry.EventDrain:
+		s.registry.SetDrained(e.Service.UUID, e.Service.Drained)
+	}
+	if e.Serial > s.replica.serial {
+		s.replica.serial = e.Serial
+	}
+}
+
+// copyRegistry makes the registry a copy of the one of member. Services that
+// didn't change are left alone, so they stay in DNS answers meanwhile.
+func (s *Server) copyRegistry(member string) error {
+	var services []msg.Service
+	serial, err := s.replicaGet(member, "/skydns/services/", &services)
+	if err != nil {
+		return err
+	}
+	var aliases []msg.Alias
+	if _, err := s.replicaGet(member, "/skydns/aliases/", &aliases); err != nil {
+		return err
+	}
+
+	current, _ := s.registry.Get("*")
+	gone := make(map[string]bool, len(current))
+	for _, serv := range current {
+		gone[serv.UUID] = true
+	}
+	for _, serv := range services {
+		delete(gone, serv.UUID)
+		if old, err := s.registry.GetUUID(serv.UUID); err == nil {
+			if reflect.DeepEqual(old, serv) {
+				continue
+			}
+			s.registry.RemoveUUID(serv.UUID)
+		}
+		if err := s.registry.Add(serv); err != nil {
+			slog.Error("Copying service", "uuid", serv.UUID, "err", err)
+		}
+	}
+	for uuid := range gone {
+		s.registry.RemoveUUID(uuid)
+	}
+
+	names := make(map[string]bool, len(aliases))
+	for _, a := range aliases {
+		names[a.Name] = true
+		if old, err := s.registry.GetAlias(a.Name); err == nil && old == a {
+			continue
+		}
+		s.registry.RemoveAlias(a.Name)
+		s.registry.AddAlias(a)
+	}
+	for _, a := range s.registry.GetAliases() {
+		if !names[a.Name] {
+			s.registry.RemoveAlias(a.Name)
+		}
+	}
+
+	slog.Info("Copied registry", "services", len(services), "aliases", len(aliases), "serial", serial, "member", member)
+	s.replica.serial, s.replica.synced = serial, true
+	return nil
+}
+
+// replicaGet decodes the reply of member to a GET of path into v, and returns
+// the serial of the registry the reply is from. Not found is an empty reply.
+func (s *Server) replicaGet(member, path string, v interface{}) (uint32, error) {
+	req, err := s.replicaRequest(member, path)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.peerClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	serial, _ := strconv.ParseUint(resp.Header.Get("X-Skydns-Serial"), 10, 32)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return uint32(serial), msg.DefaultCodec.Decode(resp.Body, v)
+	case http.StatusNotFound:
+		return uint32(serial), nil
+	}
+	return 0, fmt.Errorf("%s returned %s for %s", member, resp.Status, path)
+}
+
+// replicaRequest returns a request of the API of member, signed with the token
+// of the replica or with the secret of the cluster.
+func (s *Server) replicaRequest(member, path string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", s.scheme()+"://"+member+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case s.replica.key != "":
+		date := time.Now().UTC().Format(http.TimeFormat)
+		req.Header.Set("Date", date)
+		req.Header.Set("Authorization", "HMAC "+s.replica.keyName+":"+msg.Signature(s.replica.key, "GET", req.URL.RequestURI(), date, nil))
+	case s.secret != "":
+		req.Header.Set("Authorization", s.secret)
+	}
+	return req, nil
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/miekg/dns"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// rewriteRule maps the query names matching re onto replacement, which may
+// refer to submatches as $1, $2, ...
+type rewriteRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// rewriter holds the rewrite rules loaded from file.
+type rewriter struct {
+	sync.RWMutex
+	file  string
+	rules []rewriteRule
+}
+
+// loadRewriteRules reads the rules in file. Each line holds a regular
+// expression and its replacement separated by white space, lines starting
+// with # are comments.
+func loadRewriteRules(file string) (rules []rewriteRule, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a regular expression and a replacement", file, i)
+		}
+		re, err := regexp.Compile("(?i)" + fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, i, err)
+		}
+		rules = append(rules, rewriteRule{re, fields[1]})
+	}
+	return rules, scanner.Err()
+}
+
+// rewrite returns the name the first matching rule maps name onto.
+func (r *rewriter) rewrite(name string) (string, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, rule := range r.rules {
+		if rule.re.MatchString(name) {
+			return rule.re.ReplaceAllString(name, rule.replacement), true
+		}
+	}
+	return name, false
+}
+
+// EnableRewrite rewrites query names with the rules in file before they are
+// resolved. A replacement without a trailing dot is relative to the SkyDNS
+// domain, e.g. the rule
+//
+//	^(.*)\.legacy\.local\.$ $1
+//
+// maps db.production.legacy.local onto db.production.skydns.local.
+func (s *Server) EnableRewrite(file string) error {
+	rules, err := loadRewriteRules(file)
+	if err != nil {
+		return err
+	}
+	s.rewriter = &rewriter{file: file, rules: rules}
+	return nil
+}
+
+// ReloadRewrite reloads the rewrite rules, the current rules are kept when
+// the file can't be loaded.
+func (s *Server) ReloadRewrite() error {
+	if s.rewriter == nil {
+		return nil
+	}
+	rules, err := loadRewriteRules(s.rewriter.file)
+	if err != nil {
+		return err
+	}
+	s.rewriter.Lock()
+	s.rewriter.rules = rules
+	s.rewriter.Unlock()
+	return nil
+}
+
+// rewriteRequest returns the request with its query name rewritten, and a
+// ResponseWriter that puts the original name back in the reply. When no rule
+// matches, w and req are returned unchanged.
+func (s *Server) rewriteRequest(w dns.ResponseWriter, req *dns.Msg) (dns.ResponseWriter, *dns.Msg) {
+	if s.rewriter == nil {
+		return w, req
+	}
+	name, ok := s.rewriter.rewrite(req.Question[0].Name)
+	if !ok {
+		return w, req
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "." + dns.Fqdn(s.domain)
+	}
+
+	r := req.Copy()
+	r.Question[0].Name = name
+	return &rewriteWriter{ResponseWriter: w, original: req.Question[0].Name, name: name}, r
+}
+
+// rewriteWriter renames the records for the rewritten name back to the name
+// that was queried.
+type rewriteWriter struct {
+	dns.ResponseWriter
+	original string // name in the query
+	name     string // name it was rewritten to
+}
+
+// WriteMsg restores the original name in m and writes it.
+func (r *rewriteWriter) WriteMsg(m *dns.Msg) error {
+	for i := range m.Question {
+		if strings.EqualFold(m.Question[i].Name, r.name) {
+			m.Question[i].Name = r.original
+		}
+	}
+	for _, rr := range m.Answer {
+		if strings.EqualFold(rr.Header().Name, r.name) {
+			rr.Header().Name = r.original
+		}
+	}
+	return r.ResponseWriter.WriteMsg(m)
+}
@@ -6,16 +6,19 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/goraft/raft"
 	"github.com/gorilla/mux"
 	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/logging"
 	"github.com/skynetservices/skydns/msg"
 	"github.com/skynetservices/skydns/registry"
 	"github.com/skynetservices/skydns/stats"
-	"log"
+	"google.golang.org/grpc"
+	"log/slog"
 	"math"
 	"net"
 	"net/http"
@@ -24,6 +27,8 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -39,14 +44,22 @@ import (
 func init() {
 	// Register Raft Commands
 	raft.RegisterCommand(&AddServiceCommand{})
+	raft.RegisterCommand(&AddServicesCommand{})
 	raft.RegisterCommand(&UpdateTTLCommand{})
+	raft.RegisterCommand(&SetHealthCommand{})
+	raft.RegisterCommand(&DrainCommand{})
+	raft.RegisterCommand(&SetLeaseCommand{})
+	raft.RegisterCommand(&RenewLeaseCommand{})
 	raft.RegisterCommand(&RemoveServiceCommand{})
 	raft.RegisterCommand(&AddCallbackCommand{})
+	raft.RegisterCommand(&RemoveCallbacksCommand{})
+	raft.RegisterCommand(&AddAliasCommand{})
+	raft.RegisterCommand(&RemoveAliasCommand{})
 }
 
 type Server struct {
 	members      []string // initial members to join with
-	nameservers  []string // nameservers to forward to
+	upstreams    *upstreams
 	domain       string
 	dnsAddr      string
 	httpAddr     string
@@ -58,14 +71,70 @@ type Server struct {
 
 	dnsUDPServer *dns.Server
 	dnsTCPServer *dns.Server
+	dnsTLSServer *dns.Server // DNS-over-TLS, if enabled
 	dnsHandler   *dns.ServeMux
 
 	httpServer *http.Server
+	dohServer  *http.Server // DNS-over-HTTPS, if enabled
 	router     *mux.Router
 
+	grpcServer *grpc.Server // gRPC API, if enabled
+	grpcAddr   string
+
 	raftServer raft.Server
 	dataDir    string
 	secret     string
+
+	minTTL        uint32          // TTL of negative answers
+	debug         *debugClients   // clients allowed to ask for verbose logging
+	forwardCache  *cache          // replies from the nameservers we forward to
+	negativeCache *cache          // NXDOMAIN and NODATA answers
+	answerCache   *cache          // answers for names in our domain
+	transfer      *transfer       // zone transfer settings
+	rewriter      *rewriter       // query name rewrite rules
+	templates     *templates      // synthetic names computed from the registry
+	views         *views          // client networks of the split-horizon views
+	zones         *zones          // domains served besides the SkyDNS domain
+	ttlPolicy     *ttlPolicy      // TTL rules of services, reloaded on SIGHUP
+	quotas        registry.Quotas // services allowed per environment, name and source
+	rateLimit     *rateLimiter    // per client query limits
+	acl           *acls           // clients allowed to query and use the API
+	subnetACL     []*net.IPNet    // resolvers trusted to send the client subnet
+	tokens        *tokens         // credentials for the API
+	apiTLS        *tls.Config     // if set, the API is served over HTTPS
+	apiCert       *certificate    // of the HTTPS API
+	dnsCert       *certificate    // of DNS-over-TLS and DNS-over-HTTPS
+	peerTLS       *tls.Config     // verifies the certificates of other members
+	churn         *churnTracker   // how often answers change
+
+	queryLog *queryLog      // if set, answers to queries are logged
+	webhooks *webhooks      // if set, removals of services are posted to them
+	mdns     *mdnsResponder // if set, services are announced over multicast DNS
+	health   *healthChecker // active health checks of services
+	forward  bool           // followers forward API writes to the leader
+	replica  *replica       // if set, a read-only replica of another cluster
+	stale    *staleness     // if set, answers are served while the cluster is down
+
+	raftHeartbeat time.Duration // if set, overrides the raft heartbeat interval
+	raftElection  time.Duration // if set, overrides the raft election timeout
+
+	maxAnswers int  // records in an answer, 0 means no limit
+	noGlue     bool // leave the addresses of SRV targets out of the additional section
+
+	shutdownTimeout time.Duration  // how long Shutdown waits for requests in flight
+	shuttingDown    chan struct{}  // closed by Shutdown, ends the event streams
+	reloadHooks     []func() error // called on SIGHUP
+
+	snapshotEntries uint64 // log entries between snapshots, 0 disables them
+	snapshotIndex   uint64 // commit index of the last snapshot
+
+	maxBody    int64 // maximum size of request bodies
+	maxDepth   int   // maximum nesting of JSON in request bodies
+	strictJSON bool  // reject unknown fields in request bodies
+
+	expiryWarning time.Duration        // warn about services expiring this soon
+	warned        map[string]time.Time // UUID -> expiry warned about
+	now           func() time.Time     // the clock services expire by
 }
 
 // Newserver returns a new Server.
@@ -83,11 +152,17 @@ func NewServer(members []string, domain string, dnsAddr string, httpAddr string,
 		dnsHandler:   dns.NewServeMux(),
 		waiter:       new(sync.WaitGroup),
 		secret:       secret,
-		nameservers:  nameservers,
+		upstreams:    newUpstreams(nameservers),
+		minTTL:       60,
+		maxBody:      1 << 20,
+		maxDepth:     16,
+		warned:       make(map[string]time.Time),
+		now:          time.Now,
+		shuttingDown: make(chan struct{}),
 	}
 
 	if _, err := os.Stat(s.dataDir); os.IsNotExist(err) {
-		log.Fatal("Data directory does not exist: ", dataDir)
+		logging.Fatal("Data directory does not exist", "dir", dataDir)
 		return
 	}
 
@@ -95,29 +170,136 @@ func NewServer(members []string, domain string, dnsAddr string, httpAddr string,
 	s.dnsHandler.Handle(".", s)
 
 	authWrapper := s.authHTTPWrapper
+	writeWrapper := func(h http.HandlerFunc) http.HandlerFunc { return authWrapper(s.forwardWrapper(h)) }
 
 	// API Routes
-	s.router.HandleFunc("/skydns/services/{uuid}", authWrapper(s.addServiceHTTPHandler)).Methods("PUT")
+	s.router.HandleFunc("/skydns/services/batch", writeWrapper(s.addServicesHTTPHandler)).Methods("POST")
+	s.router.HandleFunc("/skydns/services/{name}/stats", authWrapper(s.getNameStatsHTTPHandler)).Methods("GET")
+	s.router.HandleFunc("/skydns/services/{uuid}", writeWrapper(s.addServiceHTTPHandler)).Methods("PUT")
 	s.router.HandleFunc("/skydns/services/{uuid}", authWrapper(s.getServiceHTTPHandler)).Methods("GET")
-	s.router.HandleFunc("/skydns/services/{uuid}", authWrapper(s.removeServiceHTTPHandler)).Methods("DELETE")
-	s.router.HandleFunc("/skydns/services/{uuid}", authWrapper(s.updateServiceHTTPHandler)).Methods("PATCH")
+	s.router.HandleFunc("/skydns/services/{uuid}", writeWrapper(s.removeServiceHTTPHandler)).Methods("DELETE")
+	s.router.HandleFunc("/skydns/services/{uuid}", writeWrapper(s.updateServiceHTTPHandler)).Methods("PATCH")
+	s.router.HandleFunc("/skydns/services/{uuid}/lease", writeWrapper(s.setLeaseHTTPHandler)).Methods("PUT")
+	s.router.HandleFunc("/skydns/services/{uuid}/lease", writeWrapper(s.renewLeaseHTTPHandler)).Methods("POST")
+	s.router.HandleFunc("/skydns/services/{uuid}/lease", authWrapper(s.getLeaseHTTPHandler)).Methods("GET")
+
+	s.router.HandleFunc("/skydns/callbacks/{uuid}", writeWrapper(s.addCallbackHTTPHandler)).Methods("PUT")
+	s.router.HandleFunc("/skydns/callbacks/", writeWrapper(s.removeCallbacksHTTPHandler)).Methods("DELETE")
 
-	s.router.HandleFunc("/skydns/callbacks/{uuid}", authWrapper(s.addCallbackHTTPHandler)).Methods("PUT")
+	s.router.HandleFunc("/skydns/aliases/", authWrapper(s.getAliasesHTTPHandler)).Methods("GET")
+	s.router.HandleFunc("/skydns/aliases/{name}", writeWrapper(s.addAliasHTTPHandler)).Methods("PUT")
+	s.router.HandleFunc("/skydns/aliases/{name}", authWrapper(s.getAliasHTTPHandler)).Methods("GET")
+	s.router.HandleFunc("/skydns/aliases/{name}", writeWrapper(s.removeAliasHTTPHandler)).Methods("DELETE")
 
 	// External API Routes
 	// /skydns/services #list all services
 	s.router.HandleFunc("/skydns/services/", authWrapper(s.getServicesHTTPHandler)).Methods("GET")
+	s.router.HandleFunc("/skydns/services", authWrapper(s.getServicesHTTPHandler)).Methods("GET")
 	// /skydns/regions #list all regions
 	s.router.HandleFunc("/skydns/regions/", authWrapper(s.getRegionsHTTPHandler)).Methods("GET")
 	// /skydns/environnments #list all environments
 	s.router.HandleFunc("/skydns/environments/", authWrapper(s.getEnvironmentsHTTPHandler)).Methods("GET")
 
+	// /skydns/cluster #leader and members of the cluster
+	s.router.HandleFunc("/skydns/cluster", authWrapper(s.getClusterHTTPHandler)).Methods("GET")
+
+	// /skydns/leader #where to send writes
+	s.router.HandleFunc("/skydns/leader", authWrapper(s.getLeaderHTTPHandler)).Methods("GET")
+
+	// /skydns/drain #take services out of DNS answers, or put them back
+	s.router.HandleFunc("/skydns/drain", writeWrapper(s.drainHTTPHandler)).Methods("PUT", "DELETE")
+
+	// /skydns/events #stream of registry changes
+	s.router.HandleFunc("/skydns/events", authWrapper(s.getEventsHTTPHandler)).Methods("GET")
+
+	// /skydns/expiring #list services about to expire
+	s.router.HandleFunc("/skydns/expiring/", authWrapper(s.getExpiringHTTPHandler)).Methods("GET")
+
+	// /skydns/upstreams #health of the nameservers queries are forwarded to
+	s.router.HandleFunc("/skydns/upstreams", authWrapper(s.getUpstreamsHTTPHandler)).Methods("GET")
+
+	// /skydns/debug/locks #registry lock contention per operation
+	s.router.HandleFunc("/skydns/debug/locks", authWrapper(s.getLockStatsHTTPHandler)).Methods("GET")
+
+	// /metrics #all metrics for Prometheus
+	s.router.HandleFunc("/metrics", authWrapper(s.getMetricsHTTPHandler)).Methods("GET")
+
 	// Raft Routes
 	s.router.HandleFunc("/raft/join", s.joinHandler).Methods("POST")
 
 	return
 }
 
+// EnableDebug allows clients in the comma separated list of CIDR ranges acl to
+// enable verbose logging of their queries with the EDNS0Debug option, for at
+// most window.
+func (s *Server) EnableDebug(acl string, window time.Duration) error {
+	nets, err := parseCIDRs(acl)
+	if err != nil {
+		return err
+	}
+	s.debug = newDebugClients(nets, window)
+	return nil
+}
+
+// EnableForwardCache caches up to size replies of the nameservers queries are
+// forwarded to. Replies are cached for as long as their TTLs allow, but not
+// longer than maxTTL.
+func (s *Server) EnableForwardCache(size int, maxTTL time.Duration) {
+	s.forwardCache = newCache(size, maxTTL)
+}
+
+// SetCacheTTLs changes the maximum TTLs of the forward, negative and answer
+// caches, for the replies they store from now on. Caches that aren't enabled
+// stay disabled. It may be called while the server runs.
+func (s *Server) SetCacheTTLs(forward, negative, answer time.Duration) {
+	for _, c := range []struct {
+		cache  *cache
+		maxTTL time.Duration
+	}{{s.forwardCache, forward}, {s.negativeCache, negative}, {s.answerCache, answer}} {
+		if c.cache != nil {
+			c.cache.setMaxTTL(c.maxTTL)
+		}
+	}
+}
+
+// SetMinTTL sets the minimum TTL of the SOA record, which is the time
+// resolvers cache NXDOMAIN and NODATA answers. It may be called while the
+// server runs.
+func (s *Server) SetMinTTL(ttl uint32) {
+	atomic.StoreUint32(&s.minTTL, ttl)
+}
+
+// EnableNegativeCache caches up to size NXDOMAIN and NODATA answers for as
+// long as the minimum TTL of their SOA record, but at most ttl, so clients
+// hammering names that don't exist don't all hit the registry. The cache is
+// emptied when services are added or change, and on reloads.
+func (s *Server) EnableNegativeCache(size int, ttl time.Duration) {
+	s.negativeCache = newCache(size, ttl)
+	s.registryCache(s.negativeCache)
+}
+
+// SetExpiryWarning makes the leader warn about services that will expire within
+// d without having been renewed. Zero disables the warnings.
+func (s *Server) SetExpiryWarning(d time.Duration) {
+	s.expiryWarning = d
+}
+
+// SetClock makes the server, and its registry, expire services by the clock now
+// instead of the system clock, so tests can let TTLs run out without waiting
+// for them. It must be called before Start.
+func (s *Server) SetClock(now func() time.Time) {
+	s.now = now
+	s.registry.SetClock(now)
+}
+
+// SetRaftTimeouts sets the raft heartbeat interval and election timeout, which
+// is mostly useful to elect leaders quickly in tests.
+func (s *Server) SetRaftTimeouts(heartbeat, election time.Duration) {
+	s.raftHeartbeat = heartbeat
+	s.raftElection = election
+}
+
 // DNSAddr returns IP:Port of a DNS Server.
 func (s *Server) DNSAddr() string { return s.dnsAddr }
 
@@ -127,47 +309,23 @@ func (s *Server) HTTPAddr() string { return s.httpAddr }
 // Start starts a DNS server and blocks waiting to be killed.
 func (s *Server) Start() (*sync.WaitGroup, error) {
 	var err error
-	log.Printf("Initializing Server. DNS Addr: %q, HTTP Addr: %q, Data Dir: %q, Forwarders: %q", s.dnsAddr, s.httpAddr, s.dataDir, s.nameservers)
+	slog.Info("Initializing server", "dns", s.dnsAddr, "http", s.httpAddr, "data", s.dataDir, "forwarders", s.upstreams.addrs())
 
 	// Initialize and start Raft server.
 	transporter := raft.NewHTTPTransporter("/raft")
-	s.raftServer, err = raft.NewServer(s.HTTPAddr(), s.dataDir, transporter, nil, s.registry, "")
+	if s.peerTLS != nil {
+		transporter.Transport.TLSClientConfig = s.peerTLS
+	}
+	s.raftServer, err = raft.NewServer(s.HTTPAddr(), s.dataDir, transporter, stateMachine{s.registry}, s.registry, "")
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Creating raft server", "err", err)
 	}
-	transporter.Install(s.raftServer, s)
-	s.raftServer.Start()
-
-	// Join to leader if specified.
-	if len(s.members) > 0 {
-		log.Println("Joining cluster:", strings.Join(s.members, ","))
-
-		if !s.raftServer.IsLogEmpty() {
-			log.Fatal("Cannot join with an existing log")
-		}
-
-		if err := s.Join(s.members); err != nil {
-			return nil, err
-		}
-
-		log.Println("Joined cluster")
-
-		// Initialize the server by joining itself.
-	} else if s.raftServer.IsLogEmpty() {
-		log.Println("Initializing new cluster")
-
-		_, err := s.raftServer.Do(&raft.DefaultJoinCommand{
-			Name:             s.raftServer.Name(),
-			ConnectionString: s.connectionString(),
-		})
-
-		if err != nil {
-			log.Fatal(err)
-			return nil, err
-		}
-
-	} else {
-		log.Println("Recovered from log")
+	if s.replica != nil {
+		// Replicas don't take part in raft, they follow the members instead
+		slog.Info("Replicating cluster", "members", s.replica.members)
+		go s.replicate()
+	} else if err := s.startRaft(transporter); err != nil {
+		return nil, err
 	}
 
 	s.dnsTCPServer = &dns.Server{
@@ -193,6 +351,7 @@ func (s *Server) Start() (*sync.WaitGroup, error) {
 		ReadTimeout:    s.readTimeout,
 		WriteTimeout:   s.writeTimeout,
 		MaxHeaderBytes: 1 << 20,
+		TLSConfig:      s.apiTLS,
 	}
 
 	go s.listenAndServe()
@@ -203,14 +362,80 @@ func (s *Server) Start() (*sync.WaitGroup, error) {
 	return s.waiter, nil
 }
 
+// startRaft starts the raft server, and bootstraps or joins the cluster.
+func (s *Server) startRaft(transporter *raft.HTTPTransporter) error {
+	transporter.Install(s.raftServer, s)
+	if s.raftHeartbeat > 0 {
+		s.raftServer.SetHeartbeatInterval(s.raftHeartbeat)
+	}
+	if s.raftElection > 0 {
+		s.raftServer.SetElectionTimeout(s.raftElection)
+	}
+	if s.snapshotEntries > 0 {
+		s.loadSnapshot()
+	}
+	s.raftServer.Start()
+
+	// Join to leader if specified.
+	if len(s.members) > 0 {
+		slog.Info("Joining cluster", "members", s.members)
+
+		if !s.raftServer.IsLogEmpty() {
+			logging.Fatal("Cannot join with an existing log", "data", s.dataDir)
+		}
+
+		if err := s.Join(s.members); err != nil {
+			return err
+		}
+
+		slog.Info("Joined cluster")
+
+		// Initialize the server by joining itself.
+	} else if s.raftServer.IsLogEmpty() {
+		slog.Info("Initializing new cluster")
+
+		_, err := s.raftServer.Do(&raft.DefaultJoinCommand{
+			Name:             s.raftServer.Name(),
+			ConnectionString: s.connectionString(),
+		})
+
+		if err != nil {
+			logging.Fatal("Initializing cluster", "err", err)
+			return err
+		}
+
+	} else {
+		slog.Info("Recovered from log")
+	}
+	return nil
+}
+
 // Stop stops a server.
 func (s *Server) Stop() {
-	log.Println("Stopping server")
+	slog.Info("Stopping server")
+	if s.raftServer != nil && s.raftServer.Running() {
+		s.raftServer.Stop()
+	}
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+	if s.replica != nil {
+		close(s.replica.stop)
+	}
+	if s.webhooks != nil {
+		close(s.webhooks.done)
+	}
+	if s.mdns != nil {
+		s.stopMDNS()
+	}
 	s.waiter.Done()
 }
 
 // Leader returns the current leader.
 func (s *Server) Leader() string {
+	if s.replica != nil {
+		return ""
+	}
 	l := s.raftServer.Leader()
 	if l == "" {
 		// We are a single node cluster, we are the leader
@@ -229,22 +454,33 @@ func (s *Server) Members() (members []string) {
 	peers := s.raftServer.Peers()
 
 	for _, p := range peers {
-		members = append(members, strings.TrimPrefix(p.ConnectionString, "http://"))
+		members = append(members, strings.TrimPrefix(strings.TrimPrefix(p.ConnectionString, "http://"), "https://"))
 	}
 
 	return
 }
 
 func (s *Server) run() {
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
 	tick := time.Tick(1 * time.Second)
+	var check <-chan time.Time
+	if s.upstreams.interval > 0 {
+		check = time.Tick(s.upstreams.interval)
+	}
 
 run:
 	for {
 		select {
 		case <-tick:
+			s.updateGauges()
+			if s.replica == nil {
+				s.snapshot()
+			}
+
 			// We are the leader, we are responsible for managing TTLs
 			if s.IsLeader() {
 				expired := s.registry.GetExpired()
@@ -256,12 +492,20 @@ run:
 					stats.ExpiredCount.Inc(1)
 					s.raftServer.Do(NewRemoveServiceCommand(uuid))
 				}
+				s.warnExpiring()
+				if s.health != nil {
+					s.scheduleChecks()
+				}
 			}
+		case <-check:
+			go s.upstreams.check()
+		case <-hup:
+			s.Reload()
 		case <-sig:
 			break run
 		}
 	}
-	s.Stop()
+	s.Shutdown()
 }
 
 // Join joins an existing SkyDNS cluster.
@@ -275,10 +519,10 @@ func (s *Server) Join(members []string) error {
 	json.NewEncoder(&b).Encode(command)
 
 	for _, m := range members {
-		log.Println("Attempting to connect to:", m)
+		slog.Info("Attempting to connect", "member", m)
 
-		resp, err := http.Post(fmt.Sprintf("http://%s/raft/join", strings.TrimSpace(m)), "application/json", &b)
-		log.Println("Post returned")
+		resp, err := s.peerClient().Post(fmt.Sprintf("%s://%s/raft/join", s.scheme(), strings.TrimSpace(m)), "application/json", &b)
+		slog.Debug("Join request returned", "member", m)
 
 		if err != nil {
 			if _, ok := err.(*url.Error); ok {
@@ -303,22 +547,22 @@ func (s *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *h
 
 // Handles incoming RAFT joins.
 func (s *Server) joinHandler(w http.ResponseWriter, req *http.Request) {
-	log.Println("Processing incoming join")
+	slog.Info("Processing incoming join")
 	command := &raft.DefaultJoinCommand{}
 
-	if err := json.NewDecoder(req.Body).Decode(&command); err != nil {
-		log.Println("Error decoding json message:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := s.decodeBody(w, req, &command); err != nil {
+		slog.Error("Decoding join request", "err", err)
+		decodeError(w, err)
 		return
 	}
 
 	if _, err := s.raftServer.Do(command); err != nil {
 		switch err {
 		case raft.NotLeaderError:
-			log.Println("Redirecting to leader")
+			slog.Info("Redirecting join to leader", "leader", s.Leader())
 			s.redirectToLeader(w, req)
 		default:
-			log.Println("Error processing join:", err)
+			slog.Error("Processing join", "err", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	}
@@ -327,31 +571,164 @@ func (s *Server) joinHandler(w http.ResponseWriter, req *http.Request) {
 // ServeDNS is the handler for DNS requests, responsible for parsing DNS request, possibly forwarding
 // it to a real dns server and returning a response.
 func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	raw, original := w, req
+	defer recoverDNS(raw, original)
 	stats.RequestCount.Inc(1)
+	// Malformed, rate limited and refused queries are measured too
+	w = measureResponseWriter(w, req, s.queryLog)
+	if rcode := checkQuery(req); rcode != dns.RcodeSuccess {
+		refuseQuery(w, req, rcode)
+		return
+	}
+	if s.rateLimited(w, req) {
+		return
+	}
+	if !s.allowed(aclQuery, remoteIP(w)) {
+		refuse(w, req)
+		return
+	}
+	w = s.debugResponseWriter(w, req)
+	w, req = s.rewriteRequest(w, req)
 
 	q := req.Question[0]
-	log.Printf("Received DNS Request for %q from %q", q.Name, w.RemoteAddr())
+	slog.Debug("Received DNS request", "name", q.Name, "type", qtypeName(q.Qtype), "client", w.RemoteAddr().String())
+
+	// Reverse lookups of registered addresses are answered from the registry
+	if q.Qtype == dns.TypePTR && reverseIP(q.Name) != nil {
+		s.ServeDNSReverse(w, req)
+		return
+	}
+
+	if (q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR) && s.zoneApex(q.Name) {
+		s.ServeDNSTransfer(w, req)
+		return
+	}
+
+	// Names in the other zones are answered as if they were in s.domain
+	w, req, zone := s.zoneRequest(w, req)
+	q = req.Question[0]
 
 	// If the query does not fall in our s.domain, forward it
 	if !strings.HasSuffix(q.Name, dns.Fqdn(s.domain)) {
 		s.ServeDNSForward(w, req)
 		return
 	}
+	w, expired := s.staleResponseWriter(w)
+	if expired {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+	// Names deeper than a registry key can't exist, don't bother the registry
+	if tooDeep(q.Name, s.domain) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeNameError)
+		m.Authoritative = true
+		m.Ns = s.createSOA()
+		w.WriteMsg(m)
+		return
+	}
+	w = s.subnetResponseWriter(w, req)
+	sc := scope{view: s.viewOf(s.clientIP(w, req)), zone: zone}
+	if s.negativeCache != nil {
+		if m := s.negativeCache.get(req, sc); m != nil {
+			stats.NegativeCacheHitCount.Inc(1)
+			answeredFrom(w, stats.SourceCache)
+			w.WriteMsg(m)
+			return
+		}
+	}
+	if s.answerCache != nil {
+		if m := s.answerCache.get(req, sc); m != nil {
+			stats.AnswerCacheHitCount.Inc(1)
+			answeredFrom(w, stats.SourceCache)
+			s.countQuery(q.Name, remoteIP(w))
+			s.churnHint(req, m, sc)
+			s.limitAnswers(req, m)
+			fit(m, udpSize(w, req))
+			w.WriteMsg(m)
+			stats.Answered(s.fresh())
+			return
+		}
+		stats.AnswerCacheMissCount.Inc(1)
+	}
+
+	// A change of the registry while m is built keeps it out of the caches
+	var serial uint32
+	if s.negativeCache != nil || s.answerCache != nil {
+		serial = s.registry.Serial()
+	}
 	m := new(dns.Msg)
 	m.SetReply(req)
 	m.Authoritative = true
 	m.RecursionAvailable = true
 	m.Answer = make([]dns.RR, 0, 10)
-	defer w.WriteMsg(m)
+	defer func() {
+		// A panic building m leaves it half done, it's not cached or sent
+		if r := recover(); r != nil {
+			servfailPanic(raw, original, r)
+			return
+		}
+		// NXDOMAIN and NODATA are cached to absorb clients retrying them
+		if s.negativeCache != nil && len(m.Answer) == 0 {
+			s.negativeCache.putNegative(m, sc, serial)
+		}
+		if s.answerCache != nil && len(m.Answer) > 0 && m.Rcode == dns.RcodeSuccess {
+			s.answerCache.put(m, sc, serial)
+		}
+		if len(m.Answer) > 0 {
+			s.countQuery(q.Name, remoteIP(w))
+		}
+		s.churnHint(req, m, sc)
+		s.limitAnswers(req, m)
+		fit(m, udpSize(w, req))
+		w.WriteMsg(m)
+	}()
+
+	// The apex has the SOA and NS records of the zone
+	if strings.EqualFold(q.Name, dns.Fqdn(s.domain)) && (q.Qtype == dns.TypeSOA || q.Qtype == dns.TypeNS) {
+		if q.Qtype == dns.TypeSOA {
+			m.Answer = append(m.Answer, s.createSOA()...)
+		} else {
+			ns, glue := s.nameServers()
+			m.Answer = append(m.Answer, ns...)
+			m.Extra = append(m.Extra, glue...)
+		}
+		return
+	}
+
+	// An alias is answered with a CNAME record and the records of its target
+	if records, target := s.resolveAlias(q.Name); len(records) > 0 && sc.zone == "" {
+		m.Answer = append(m.Answer, records...)
+		q.Name = target
+	}
+
+	if t := s.lookupTemplate(q.Name); t != nil {
+		records, extra, err := s.templateRecords(q, t, sc)
+		if err != nil {
+			m.SetRcode(req, dns.RcodeServerFailure)
+			slog.Error("Computing template records", "name", q.Name, "err", err)
+			return
+		}
+		m.Answer = append(m.Answer, records...)
+		m.Extra = append(m.Extra, extra...)
+		if len(m.Answer) == 0 { // Send back a NODATA response
+			m.Ns = s.createSOA()
+			return
+		}
+		stats.Answered(s.fresh())
+		return
+	}
 
 	if q.Qtype == dns.TypeANY || q.Qtype == dns.TypeSRV {
-		records, extra, err := s.getSRVRecords(q)
+		records, extra, err := s.getSRVRecords(q, sc)
 
 		if err != nil {
 			// We are authoritative for this name, but it does not exist: NXDOMAIN
 			m.SetRcode(req, dns.RcodeNameError)
 			m.Ns = s.createSOA()
-			log.Println("Error: ", err)
+			slog.Debug("Name not found", "name", q.Name, "type", "SRV", "err", err)
 			return
 		}
 
@@ -360,33 +737,93 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	}
 
 	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
-		records, err := s.getARecords(q)
+		records, err := s.getARecords(q, sc)
+
+		if err != nil {
+			m.SetRcode(req, dns.RcodeNameError)
+			m.Ns = s.createSOA()
+			slog.Debug("Name not found", "name", q.Name, "type", qtypeName(q.Qtype), "err", err)
+			return
+		}
+		m.Answer = append(m.Answer, records...)
+	}
+
+	if q.Qtype == dns.TypeNAPTR {
+		records, extra, err := s.getNAPTRRecords(q, sc)
 
 		if err != nil {
 			m.SetRcode(req, dns.RcodeNameError)
 			m.Ns = s.createSOA()
-			log.Println("Error: ", err)
+			slog.Debug("Name not found", "name", q.Name, "type", "NAPTR", "err", err)
+			return
+		}
+		m.Answer = append(m.Answer, records...)
+		m.Extra = append(m.Extra, extra...)
+	}
+
+	if q.Qtype == dns.TypeANY || q.Qtype == dns.TypeTXT {
+		records, err := s.getTXTRecords(q, sc)
+
+		if err != nil {
+			m.SetRcode(req, dns.RcodeNameError)
+			m.Ns = s.createSOA()
+			slog.Debug("Name not found", "name", q.Name, "type", "TXT", "err", err)
 			return
 		}
 		m.Answer = append(m.Answer, records...)
 	}
 	if len(m.Answer) == 0 { // Send back a NODATA response
 		m.Ns = s.createSOA()
+		return
 	}
+	stats.Answered(s.fresh())
+}
+
+// ServeDNSReverse is the handler for PTR requests, answering those for
+// addresses of registered services and forwarding all others.
+func (s *Server) ServeDNSReverse(w dns.ResponseWriter, req *dns.Msg) {
+	records, err := s.getPTRRecords(req.Question[0])
+	if err != nil {
+		s.ServeDNSForward(w, req)
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Answer = records
+	w.WriteMsg(m)
+	stats.Answered(s.fresh())
 }
 
 // ServeDNSForward forwards a request to a nameservers and returns the response.
 func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) {
-	if len(s.nameservers) == 0 {
-		log.Printf("Error: Failure to Forward DNS Request %q", dns.ErrServ)
+	answeredFrom(w, stats.SourceForward)
+	if !s.allowed(aclRecursion, remoteIP(w)) {
+		refuse(w, req)
+		return
+	}
+	if s.upstreams.len() == 0 {
+		slog.Error("Forwarding DNS request", "name", req.Question[0].Name, "err", "no nameservers")
 		m := new(dns.Msg)
 		m.SetReply(req)
 		m.SetRcode(req, dns.RcodeServerFailure)
-		m.Authoritative = false // no matter what set to false
+		m.Authoritative = false     // no matter what set to false
 		m.RecursionAvailable = true // and this is still true
 		w.WriteMsg(m)
 		return
 	}
+	if s.forwardCache != nil {
+		if m := s.forwardCache.get(req, scope{subnet: subnetKey(req)}); m != nil {
+			stats.ForwardCacheHitCount.Inc(1)
+			answeredFrom(w, stats.SourceCache)
+			w.WriteMsg(m)
+			return
+		}
+		stats.ForwardCacheMissCount.Inc(1)
+	}
+
 	network := "udp"
 	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
 		network = "tcp"
@@ -394,33 +831,45 @@ func (s *Server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) {
 	// TODO(miek): client timeouts? Slightly larger because we are recursing?
 	c := &dns.Client{Net: network}
 
-	// Use request Id for "random" nameserver selection
-	nsid := int(req.Id) % len(s.nameservers)
-	try := 0
-Redo:
-	r, _, err := c.Exchange(req, s.nameservers[nsid])
-	if err == nil {
-		log.Printf("Forwarded DNS Request %q to %q", req.Question[0].Name, s.nameservers[nsid])
+	// Try the healthiest nameserver first, failing over to the others when a
+	// nameserver can't be reached or fails the query
+	var r *dns.Msg
+	for _, ns := range s.upstreams.order() {
+		var (
+			rtt time.Duration
+			err error
+		)
+		r, rtt, err = c.Exchange(req, ns)
+		if err != nil {
+			s.upstreams.observe(ns, rtt, false)
+			slog.Warn("Forwarding DNS request", "name", req.Question[0].Name, "nameserver", ns, "err", err)
+			continue
+		}
+		s.upstreams.observe(ns, rtt, r.Rcode != dns.RcodeServerFailure)
+		if r.Rcode == dns.RcodeServerFailure {
+			continue
+		}
+		slog.Debug("Forwarded DNS request", "name", req.Question[0].Name, "nameserver", ns)
+		if s.forwardCache != nil && (r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError) {
+			s.forwardCache.put(r, scope{subnet: subnetKey(req)}, 0)
+		}
 		w.WriteMsg(r)
 		return
 	}
-	// Seen an error, this can only mean, "server not reached", try again
-	// but only if we have not exausted our nameservers
-	if try < len(s.nameservers) {
-		log.Printf("Error: Failure to Forward DNS Request %q", err)
-		try++
-		nsid = (nsid + 1) % len(s.nameservers)
-		goto Redo
+	if r != nil {
+		// All nameservers failed the query, pass on the last failure
+		w.WriteMsg(r)
+		return
 	}
 
-	log.Printf("Error: Failure to Forward DNS Request %q", err)
+	slog.Error("Forwarding DNS request", "name", req.Question[0].Name, "err", "all nameservers failed")
 	m := new(dns.Msg)
 	m.SetReply(req)
 	m.SetRcode(req, dns.RcodeServerFailure)
 	w.WriteMsg(m)
 }
 
-func (s *Server) getARecords(q dns.Question) (records []dns.RR, err error) {
+func (s *Server) getARecords(q dns.Question, sc scope) (records []dns.RR, err error) {
 	var h string
 	name := strings.TrimSuffix(q.Name, ".")
 
@@ -431,20 +880,19 @@ func (s *Server) getARecords(q dns.Question) (records []dns.RR, err error) {
 			if err != nil {
 				return
 			}
-			if q.Qtype == dns.TypeA {
-				records = append(records, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 15}, A: net.ParseIP(h)})
-			}
+			records = append(records, addressRecords(q.Name, q.Qtype, net.ParseIP(h), 15)...)
 		}
 	}
+	if rr, ok := s.nodeAddress(q.Name, q.Qtype); ok {
+		return rr, nil
+	}
 	// Leader should always be listed
 	if name == "leader."+s.domain || name == "master."+s.domain || name == s.domain {
 		h, _, err = net.SplitHostPort(s.Leader())
 		if err != nil {
 			return
 		}
-		if q.Qtype == dns.TypeA {
-			records = append(records, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 15}, A: net.ParseIP(h)})
-		}
+		records = append(records, addressRecords(q.Name, q.Qtype, net.ParseIP(h), 15)...)
 		return
 	}
 
@@ -453,31 +901,59 @@ func (s *Server) getARecords(q dns.Question) (records []dns.RR, err error) {
 		key      = strings.TrimSuffix(q.Name, s.domain+".")
 	)
 
-	services, err = s.registry.Get(key)
+	services, err = s.lookupHost(key, sc)
 	if err != nil {
 		return
 	}
 
 	for _, serv := range services {
-		ip := net.ParseIP(serv.Host)
-		switch {
-		case ip == nil:
-			continue
-		case ip.To4() != nil && q.Qtype == dns.TypeA:
-			records = append(records, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: serv.TTL}, A: ip.To4()})
-		case ip.To4() == nil && q.Qtype == dns.TypeAAAA:
-			records = append(records, &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: serv.TTL}, AAAA: ip.To16()})
+		ip4, ip6 := serv.Addresses()
+		rr := addressRecords(q.Name, q.Qtype, ip4, serv.TTL)
+		rr = append(rr, addressRecords(q.Name, q.Qtype, ip6, serv.TTL)...)
+		if len(rr) > 0 {
+			records = append(records, rr...)
+			stats.Resolved(serv.UUID)
 		}
 	}
 	return
 }
 
-func (s *Server) getSRVRecords(q dns.Question) (records []dns.RR, extra []dns.RR, err error) {
+// addressRecords returns an A or AAAA record, depending on qtype, for ip with
+// the given name and ttl. Nothing is returned when the type of ip doesn't
+// match qtype, or ip is nil.
+func addressRecords(name string, qtype uint16, ip net.IP, ttl uint32) []dns.RR {
+	switch {
+	case ip == nil:
+		return nil
+	case ip.To4() != nil && (qtype == dns.TypeA || qtype == dns.TypeANY):
+		return []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: ip.To4()}}
+	case ip.To4() == nil && (qtype == dns.TypeAAAA || qtype == dns.TypeANY):
+		return []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}, AAAA: ip.To16()}}
+	}
+	return nil
+}
+
+func (s *Server) getPTRRecords(q dns.Question) (records []dns.RR, err error) {
+	services, err := s.registry.GetReverse(reverseIP(q.Name).String())
+	if err != nil {
+		return
+	}
+	services = inRotation(services)
+
+	for _, serv := range services {
+		stats.Resolved(serv.UUID)
+		records = append(records, &dns.PTR{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: serv.TTL},
+			Ptr: registry.Key(serv) + "." + dns.Fqdn(s.origin(serv))})
+	}
+	return
+}
+
+func (s *Server) getSRVRecords(q dns.Question, sc scope) (records []dns.RR, extra []dns.RR, err error) {
 	var weight uint16
 	services := make([]msg.Service, 0)
 
 	key := strings.TrimSuffix(q.Name, s.domain+".")
-	services, err = s.registry.Get(key)
+	services, err = s.lookup(key, sc)
 
 	if err != nil {
 		return
@@ -490,27 +966,10 @@ func (s *Server) getSRVRecords(q dns.Question) (records []dns.RR, extra []dns.RR
 
 	for _, serv := range services {
 		// TODO: Dynamically set weight
-		// a Service may have an IP as its Host"name", in this case
-		// substitute UUID + "." + s.domain+"." an add an A record
-		// with the name and IP in the additional section.
-		// TODO(miek): check if resolvers actually grok this
-		ip := net.ParseIP(serv.Host)
-		switch {
-		case ip == nil:
-			records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
-				Priority: 10, Weight: weight, Port: serv.Port, Target: serv.Host + "."})
-			continue
-		case ip.To4() != nil:
-			extra = append(extra, &dns.A{Hdr: dns.RR_Header{Name: serv.UUID + "." + s.domain + ".", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: serv.TTL}, A: ip.To4()})
-			records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
-				Priority: 10, Weight: weight, Port: serv.Port, Target: serv.UUID + "." + s.domain + "."})
-		case ip.To16() != nil:
-			extra = append(extra, &dns.AAAA{Hdr: dns.RR_Header{Name: serv.UUID + "." + s.domain + ".", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: serv.TTL}, AAAA: ip.To16()})
-			records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
-				Priority: 10, Weight: weight, Port: serv.Port, Target: serv.UUID + "." + s.domain + "."})
-		default:
-			panic("skydns: internal error")
-		}
+		srv, glue := s.srvRecord(q, serv, 10, weight)
+		stats.Resolved(serv.UUID)
+		records = append(records, srv)
+		extra = append(extra, glue...)
 	}
 
 	// Append matching entries in different region than requested with a higher priority
@@ -521,9 +980,8 @@ func (s *Server) getSRVRecords(q dns.Question) (records []dns.RR, extra []dns.RR
 		region := labels[pos]
 		labels[pos] = "*"
 
-		// TODO: This is pretty much a copy of the above, and should be abstracted
 		additionalServices := make([]msg.Service, len(services))
-		additionalServices, err = s.registry.Get(strings.Join(labels, "."))
+		additionalServices, err = s.lookup(strings.Join(labels, "."), sc)
 
 		if err != nil {
 			return
@@ -541,32 +999,64 @@ func (s *Server) getSRVRecords(q dns.Question) (records []dns.RR, extra []dns.RR
 				continue
 			}
 			// TODO: Dynamically set priority and weight
-			// TODO(miek): same as above: abstract away
-			ip := net.ParseIP(serv.Host)
-			switch {
-			case ip == nil:
-				records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
-					Priority: 20, Weight: weight, Port: serv.Port, Target: serv.Host + "."})
-				continue
-			case ip.To4() != nil:
-				extra = append(extra, &dns.A{Hdr: dns.RR_Header{Name: serv.UUID + "." + s.domain + ".", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: serv.TTL}, A: ip.To4()})
-				records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
-					Priority: 20, Weight: weight, Port: serv.Port, Target: serv.UUID + "." + s.domain + "."})
-			case ip.To16() != nil:
-				extra = append(extra, &dns.AAAA{Hdr: dns.RR_Header{Name: serv.UUID + "." + s.domain + ".", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: serv.TTL}, AAAA: ip.To16()})
-				records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
-					Priority: 20, Weight: weight, Port: serv.Port, Target: serv.UUID + "." + s.domain + "."})
-			default:
-				panic("skydns: internal error")
-			}
+			srv, glue := s.srvRecord(q, serv, 20, weight)
+			stats.Resolved(serv.UUID)
+			records = append(records, srv)
+			extra = append(extra, glue...)
 		}
 	}
 	return
 }
 
+// srvRecord returns the SRV record for serv in reply to q. A service may have
+// IP addresses as its Host"name", in this case UUID + "." + s.domain + "."
+// is substituted as the target and the A and AAAA records for it are returned
+// for the additional section.
+// TODO(miek): check if resolvers actually grok this
+func (s *Server) srvRecord(q dns.Question, serv msg.Service, priority, weight uint16) (srv dns.RR, extra []dns.RR) {
+	target := serv.Host + "."
+	ip4, ip6 := serv.Addresses()
+	if ip4 != nil || ip6 != nil {
+		target = serv.UUID + "." + s.domain + "."
+		extra = append(extra, addressRecords(target, dns.TypeANY, ip4, serv.TTL)...)
+		extra = append(extra, addressRecords(target, dns.TypeANY, ip6, serv.TTL)...)
+	}
+
+	srv = &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.TTL},
+		Priority: priority, Weight: weight, Port: serv.Port, Target: target}
+	return
+}
+
+// warnExpiring logs a warning, once, for every service that will expire within
+// s.expiryWarning without having been renewed.
+func (s *Server) warnExpiring() {
+	if s.expiryWarning == 0 {
+		return
+	}
+	expiring := s.registry.GetExpiring(s.expiryWarning)
+	stats.AtRiskServices.Update(int64(len(expiring)))
+
+	seen := make(map[string]bool, len(expiring))
+	for _, serv := range expiring {
+		seen[serv.UUID] = true
+		// A renewal moves Expires, so a renewed service is warned about again.
+		if s.warned[serv.UUID].Equal(serv.Expires) {
+			continue
+		}
+		s.warned[serv.UUID] = serv.Expires
+		stats.ExpiringCount.Inc(1)
+		slog.Warn("Service expires and has not been renewed", "uuid", serv.UUID, "key", registry.Key(serv), "ttl", serv.TTL)
+	}
+	for uuid := range s.warned {
+		if !seen[uuid] {
+			delete(s.warned, uuid)
+		}
+	}
+}
+
 // Returns the connection string.
 func (s *Server) connectionString() string {
-	return fmt.Sprintf("http://%s", s.httpAddr)
+	return fmt.Sprintf("%s://%s", s.scheme(), s.httpAddr)
 }
 
 // Binds to DNS and HTTP ports and starts accepting connections
@@ -574,30 +1064,38 @@ func (s *Server) listenAndServe() {
 	go func() {
 		err := s.dnsTCPServer.ListenAndServe()
 		if err != nil {
-			log.Fatalf("Start %s listener on %s failed:%s", s.dnsTCPServer.Net, s.dnsTCPServer.Addr, err.Error())
+			logging.Fatal("Starting listener", "net", s.dnsTCPServer.Net, "addr", s.dnsTCPServer.Addr, "err", err)
 		}
 	}()
 
 	go func() {
 		err := s.dnsUDPServer.ListenAndServe()
 		if err != nil {
-			log.Fatalf("Start %s listener on %s failed:%s", s.dnsUDPServer.Net, s.dnsUDPServer.Addr, err.Error())
+			logging.Fatal("Starting listener", "net", s.dnsUDPServer.Net, "addr", s.dnsUDPServer.Addr, "err", err)
 		}
 	}()
 
 	go func() {
-		err := s.httpServer.ListenAndServe()
-		if err != nil {
-			log.Fatalf("Start http listener on %s failed:%s", s.httpServer.Addr, err.Error())
+		var err error
+		if s.apiTLS != nil {
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = s.httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logging.Fatal("Starting listener", "net", "http", "addr", s.httpServer.Addr, "err", err)
 		}
 	}()
+
+	s.listenAndServeTLS()
+	s.listenAndServeGRPC()
 }
 
 func (s *Server) redirectToLeader(w http.ResponseWriter, req *http.Request) {
 	if s.Leader() != "" {
-		http.Redirect(w, req, "http://"+s.Leader()+req.URL.Path, http.StatusMovedPermanently)
+		http.Redirect(w, req, s.scheme()+"://"+s.Leader()+req.URL.Path, http.StatusMovedPermanently)
 	} else {
-		log.Println("Error: Leader Unknown")
+		slog.Error("Leader unknown", "path", req.URL.Path)
 		http.Error(w, "Leader unknown", http.StatusInternalServerError)
 	}
 }
@@ -625,26 +1123,41 @@ func (s *Server) addServiceHTTPHandler(w http.ResponseWriter, req *http.Request)
 
 	var serv msg.Service
 
-	if err := json.NewDecoder(req.Body).Decode(&serv); err != nil {
-		log.Println("Error: ", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := s.decodeBody(w, req, &serv); err != nil {
+		logRequestError(req, err)
+		decodeError(w, err)
 		return
 	}
-	if serv.Host == "" || serv.Port == 0 {
-		http.Error(w, "Host and Port required", http.StatusBadRequest)
+	if err := validateService(serv); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	serv.UUID = uuid
+	serv.Source = s.registrant(req)
+	if !s.mayChange(req, serv.Environment) {
+		forbidEnvironment(w, serv.Environment)
+		return
+	}
+	if err := s.checkQuotas(serv)[0]; err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
 
-	if _, err := s.raftServer.Do(NewAddServiceCommand(serv)); err != nil {
-		switch err {
-		case registry.ErrExists:
+	// The registration latency is measured on the member that accepted the
+	// service, the others only see it when it is applied, or replayed.
+	stats.Registered(uuid, time.Now())
+	cmd := NewAddServiceCommand(serv, s.now())
+	s.enforceTTL(&cmd.Service)
+	if _, err := s.raftServer.Do(cmd); err != nil {
+		stats.Forget(uuid)
+		switch {
+		case err == registry.ErrExists:
 			http.Error(w, err.Error(), http.StatusConflict)
-		case raft.NotLeaderError:
+		case err == raft.NotLeaderError:
 			s.redirectToLeader(w, req)
 		default:
-			log.Println("Error: ", err)
+			logRequestError(req, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 
@@ -654,6 +1167,142 @@ func (s *Server) addServiceHTTPHandler(w http.ResponseWriter, req *http.Request)
 	w.WriteHeader(http.StatusCreated)
 }
 
+// validateService checks the fields of a service that is registered.
+func validateService(serv msg.Service) error {
+	if serv.Host == "" || serv.Port == 0 {
+		return errors.New("Host and Port required")
+	}
+	if serv.Host6 != "" {
+		ip4, ip6 := serv.Addresses()
+		if ip4 == nil || ip6 == nil {
+			return errors.New("Host6 must be an IPv6 address and requires Host to be an IPv4 address")
+		}
+	}
+	for k, v := range serv.Metadata {
+		if k == "" || strings.Contains(k, "=") || len(k)+1+len(v) > maxTXTString {
+			return errors.New("Metadata keys must be non-empty without =, and key=value at most 255 bytes")
+		}
+	}
+	for _, n := range serv.NAPTR {
+		if err := n.Validate(); err != nil {
+			return err
+		}
+	}
+	for name, v := range serv.Views {
+		if name == "" || v.Host == "" {
+			return errors.New("Views must be named and have a Host")
+		}
+	}
+	if serv.Lease != nil {
+		if err := serv.Lease.Validate(); err != nil {
+			return err
+		}
+	}
+	if serv.Check != nil {
+		return serv.Check.Validate(&serv)
+	}
+	return nil
+}
+
+// BatchResult is the outcome of registering one service of a batch.
+type BatchResult struct {
+	UUID   string
+	Status int    // HTTP status code, as if the service had been registered alone
+	Error  string `json:",omitempty"`
+}
+
+// Handle API add services requests, which register many services in a
+// single raft commit
+func (s *Server) addServicesHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	var services []msg.Service
+
+	if err := s.decodeBody(w, req, &services); err != nil {
+		logRequestError(req, err)
+		decodeError(w, err)
+		return
+	}
+	stats.AddServiceCount.Inc(int64(len(services)))
+
+	results := make([]BatchResult, len(services))
+	valid := make([]msg.Service, 0, len(services))
+	index := make([]int, 0, len(services)) // index in services of each valid service
+	for i, serv := range services {
+		results[i] = BatchResult{UUID: serv.UUID, Status: http.StatusCreated}
+		err := validateService(serv)
+		if err == nil && serv.UUID == "" {
+			err = errors.New("UUID required")
+		}
+		if err != nil {
+			results[i].Status, results[i].Error = http.StatusBadRequest, err.Error()
+			continue
+		}
+		if !s.mayChange(req, serv.Environment) {
+			results[i].Status, results[i].Error = http.StatusForbidden, "Forbidden for environment "+serv.Environment
+			continue
+		}
+		serv.Source = s.registrant(req)
+		valid = append(valid, serv)
+		index = append(index, i)
+	}
+
+	// Drop the services over a quota, the ones before them in the batch count
+	errs := s.checkQuotas(valid...)
+	n := 0
+	for j, err := range errs {
+		if err != nil {
+			r := &results[index[j]]
+			r.Status, r.Error = http.StatusTooManyRequests, err.Error()
+			continue
+		}
+		valid[n], index[n] = valid[j], index[j]
+		n++
+	}
+	valid, index = valid[:n], index[:n]
+
+	if len(valid) > 0 {
+		now := time.Now()
+		for _, serv := range valid {
+			stats.Registered(serv.UUID, now)
+		}
+		cmd := NewAddServicesCommand(valid, s.now())
+		for i := range cmd.Services {
+			s.enforceTTL(&cmd.Services[i])
+		}
+		v, err := s.raftServer.Do(cmd)
+		if err != nil {
+			for _, serv := range valid {
+				stats.Forget(serv.UUID)
+			}
+			switch err {
+			case raft.NotLeaderError:
+				s.redirectToLeader(w, req)
+			default:
+				logRequestError(req, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		errs, _ := v.([]error)
+		for j, err := range errs {
+			r := &results[index[j]]
+			if err != nil {
+				stats.Forget(valid[j].UUID)
+			}
+			switch {
+			case err == nil:
+			case err == registry.ErrExists:
+				r.Status, r.Error = http.StatusConflict, err.Error()
+			default:
+				r.Status, r.Error = http.StatusInternalServerError, err.Error()
+			}
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		logRequestError(req, err)
+	}
+}
+
 // Handle API remove service requests
 func (s *Server) removeServiceHTTPHandler(w http.ResponseWriter, req *http.Request) {
 	stats.RemoveServiceCount.Inc(1)
@@ -666,6 +1315,10 @@ func (s *Server) removeServiceHTTPHandler(w http.ResponseWriter, req *http.Reque
 		http.Error(w, "UUID required", http.StatusBadRequest)
 		return
 	}
+	if serv, err := s.registry.GetUUID(uuid); err == nil && !s.mayChange(req, serv.Environment) {
+		forbidEnvironment(w, serv.Environment)
+		return
+	}
 
 	if _, err := s.raftServer.Do(NewRemoveServiceCommand(uuid)); err != nil {
 
@@ -675,7 +1328,7 @@ func (s *Server) removeServiceHTTPHandler(w http.ResponseWriter, req *http.Reque
 		case raft.NotLeaderError:
 			s.redirectToLeader(w, req)
 		default:
-			log.Println("Error: ", err)
+			logRequestError(req, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	}
@@ -695,19 +1348,25 @@ func (s *Server) updateServiceHTTPHandler(w http.ResponseWriter, req *http.Reque
 	}
 
 	var serv msg.Service
-	if err := json.NewDecoder(req.Body).Decode(&serv); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := s.decodeBody(w, req, &serv); err != nil {
+		decodeError(w, err)
+		return
+	}
+	old, err := s.registry.GetUUID(uuid)
+	if err == nil && !s.mayChange(req, old.Environment) {
+		forbidEnvironment(w, old.Environment)
 		return
 	}
+	old.UUID = uuid
 
-	if _, err := s.raftServer.Do(NewUpdateTTLCommand(uuid, serv.TTL)); err != nil {
+	if _, err := s.raftServer.Do(s.updateTTLCommand(old, serv.TTL)); err != nil {
 		switch err {
 		case registry.ErrNotExists:
 			http.Error(w, err.Error(), http.StatusNotFound)
 		case raft.NotLeaderError:
 			s.redirectToLeader(w, req)
 		default:
-			log.Println("Error: ", err)
+			logRequestError(req, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	}
@@ -726,7 +1385,7 @@ func (s *Server) getServiceHTTPHandler(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	log.Println("Retrieving Service ", uuid)
+	slog.Debug("Retrieving service", "uuid", uuid)
 	serv, err := s.registry.GetUUID(uuid)
 
 	if err != nil {
@@ -734,47 +1393,88 @@ func (s *Server) getServiceHTTPHandler(w http.ResponseWriter, req *http.Request)
 		case registry.ErrNotExists:
 			http.Error(w, err.Error(), http.StatusNotFound)
 		default:
-			log.Println("Error: ", err)
+			logRequestError(req, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(serv); err != nil {
-		log.Println("Error: ", err)
+	if err := msg.DefaultCodec.Encode(w, serv); err != nil {
+		logRequestError(req, err)
 	}
 }
 
 // secrethttphandlerwrapper will wrap a standard handler
 // if the secret is specified for the server
 func (s *Server) authHTTPWrapper(handler http.HandlerFunc) http.HandlerFunc {
-	if s.secret != "" {
-		return func(w http.ResponseWriter, req *http.Request) {
-			//read the authorization header to get the secret.
-			secret := req.Header.Get("Authorization")
-
-			if err := s.authenticate(secret); err != nil {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !s.allowed(aclAPI, httpRemoteIP(req)) {
+			http.Error(w, "Forbidden by ACL", http.StatusForbidden)
+			return
+		}
+		if s.secret != "" || s.tokens != nil {
+			if err := s.authenticateRequest(req); err != nil {
 				http.Error(w, err.Error(), http.StatusForbidden)
 				return
 			}
-			handler(w, req)
 		}
+		handler(w, req)
 	}
-	return handler
 }
 
-// Return a SOA record for this SkyDNS instance
+// Return a SOA record for this SkyDNS instance, for the authority section of
+// negative answers its TTL is the minimum TTL (RFC 2308)
 func (s *Server) createSOA() []dns.RR {
+	return []dns.RR{s.soa(s.registry.Serial())}
+}
+
+// soa returns the SOA record of the zone with the given serial.
+func (s *Server) soa(serial uint32) *dns.SOA {
 	dom := dns.Fqdn(s.domain)
-	soa := &dns.SOA{Hdr: dns.RR_Header{Name: dom, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+	ttl := atomic.LoadUint32(&s.minTTL)
+	return &dns.SOA{Hdr: dns.RR_Header{Name: dom, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
 		Ns:      "master." + dom,
 		Mbox:    "hostmaster." + dom,
-		Serial:  uint32(time.Now().Unix()),
+		Serial:  serial,
 		Refresh: 28800,
 		Retry:   7200,
 		Expire:  604800,
-		Minttl:  3600,
+		Minttl:  ttl,
+	}
+}
+
+// reverseIP returns the IP address encoded in an in-addr.arpa. or ip6.arpa.
+// name, or nil if name is not such a name.
+func reverseIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		if len(labels) != 4 {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		if len(labels) != 32 {
+			return nil
+		}
+		var b bytes.Buffer
+		for i := len(labels) - 1; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return nil
+			}
+			b.WriteString(labels[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteByte(':')
+			}
+		}
+		return net.ParseIP(b.String())
 	}
-	return []dns.RR{soa}
+	return nil
 }
@@ -5,16 +5,32 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"github.com/miekg/dns"
 	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/registry"
+	"github.com/skynetservices/skydns/rpc"
+	"github.com/skynetservices/skydns/stats"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -60,6 +76,164 @@ func TestAddService(t *testing.T) {
 	}
 }
 
+func TestTTLPolicy(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	f, _ := ioutil.TempFile("", "skydns-ttlpolicy-")
+	defer os.Remove(f.Name())
+	f.WriteString("# environment name default min max\nproduction * 30s 10s 5m\n")
+	f.Close()
+	if err := s.EnableTTLPolicy(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := json.Marshal(msg.Service{Name: "TestService", Version: "1.0.0", Region: "Test", Host: "localhost", Environment: "Production", Port: 9000})
+	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Failed to add service: %d", resp.Code)
+	}
+
+	serv, err := s.registry.GetUUID("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serv.TTL < 29 || serv.TTL > 30 {
+		t.Fatalf("Service registered without a TTL should get 30s, got %d", serv.TTL)
+	}
+
+	// Renewals are held to the rules as well
+	req, _ = http.NewRequest("PATCH", "/skydns/services/123", strings.NewReader(`{"TTL":3600}`))
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if serv, _ = s.registry.GetUUID("123"); serv.TTL > 300 || time.Until(serv.Expires) > 300*time.Second {
+		t.Fatalf("Renewed service should get at most 5m, got %d expiring at %s", serv.TTL, serv.Expires)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("production * 30s 40s 20s\n"), 0644)
+	if err := s.ReloadTTLPolicy(); err == nil {
+		t.Fatal("A minimum above the maximum should not load")
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+	s.SetQuotas(0, 0, 1)
+
+	for i, code := range []int{http.StatusCreated, http.StatusTooManyRequests} {
+		b, _ := json.Marshal(msg.Service{Name: "TestService", Version: "1.0.0", Region: "Test", Host: "localhost", Environment: "Production", Port: 9000, TTL: 4})
+		req, _ := http.NewRequest("PUT", "/skydns/services/"+strconv.Itoa(i), bytes.NewBuffer(b))
+		req.RemoteAddr = "10.0.0.1:1234"
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		if resp.Code != code {
+			t.Fatalf("Registration %d should get %d, got %d", i, code, resp.Code)
+		}
+	}
+	if serv, _ := s.registry.GetUUID("0"); serv.Source != "10.0.0.1" {
+		t.Fatalf("Service should have the source 10.0.0.1, got %q", serv.Source)
+	}
+
+	b := `[{"UUID":"2","Name":"TestService","Version":"1.0.0","Region":"Test","Host":"server2","Environment":"Production","Port":9000,"TTL":4}]`
+	req, _ := http.NewRequest("POST", "/skydns/services/batch", bytes.NewBufferString(b))
+	req.RemoteAddr = "10.0.0.2:1234"
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	var results []BatchResult
+	if err := json.Unmarshal(resp.Body.Bytes(), &results); err != nil || len(results) != 1 || results[0].Status != http.StatusCreated {
+		t.Fatalf("Service from another source should be added, got %s", resp.Body.String())
+	}
+
+	// The client of a forwarded request is only taken from members of the cluster
+	for i, secret := range []string{"", "sekrit"} {
+		s.secret = secret
+		uuid := strconv.Itoa(3 + i)
+		b, _ := json.Marshal(msg.Service{Name: "TestService", Version: "1.0.0", Region: "Test", Host: "localhost", Environment: "Production", Port: 9000, TTL: 4})
+		req, _ := http.NewRequest("PUT", "/skydns/services/"+uuid, bytes.NewBuffer(b))
+		req.RemoteAddr = "10.0.0." + uuid + ":1234"
+		req.Header.Set("Authorization", secret)
+		req.Header.Set(forwardedHeader, "follower")
+		req.Header.Set(clientHeader, "10.0.1.1")
+		s.router.ServeHTTP(httptest.NewRecorder(), req)
+
+		want := "10.0.0." + uuid
+		if secret != "" {
+			want = "10.0.1.1"
+		}
+		if serv, _ := s.registry.GetUUID(uuid); serv.Source != want {
+			t.Errorf("Service %s should have the source %s, got %q", uuid, want, serv.Source)
+		}
+	}
+}
+
+func TestLease(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	b, _ := json.Marshal(msg.Service{Name: "TestService", Version: "1.0.0", Region: "Test", Host: "localhost", Environment: "Production", Port: 9000,
+		Lease: &msg.Lease{Interval: 10, Grace: 2}})
+	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Failed to add service: %d", resp.Code)
+	}
+
+	req, _ = http.NewRequest("POST", "/skydns/services/123/lease", nil)
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	var l LeaseStatus
+	if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		t.Fatal(err)
+	}
+	if l.Interval != 10 || l.Grace != 2 || l.Missed != 0 || l.Expires.Sub(l.Renewed) != 20*time.Second {
+		t.Fatalf("Unexpected lease %+v", l)
+	}
+	if serv, _ := s.registry.GetUUID("123"); serv.TTL > 10 {
+		t.Fatalf("Leased service should be cached for at most its interval, got a TTL of %d", serv.TTL)
+	}
+
+	req, _ = http.NewRequest("PUT", "/skydns/services/123/lease", strings.NewReader(`{"Grace":2}`))
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("Lease without an interval should be rejected, got %d", resp.Code)
+	}
+}
+
+func TestAddServices(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	s.registry.Add(msg.Service{UUID: "102", Name: "TestService", Version: "1.0.0", Region: "Test", Host: "server2", Environment: "Production", Port: 9000, TTL: 4, Expires: getExpirationTime(4)})
+
+	b := `[{"UUID":"100","Name":"TestService","Version":"1.0.0","Region":"Test","Host":"server0","Environment":"Production","Port":9000,"TTL":4},
+		{"UUID":"101","Name":"TestService","Version":"1.0.0","Region":"Test","Host":"server1","Environment":"Production","TTL":4},
+		{"UUID":"102","Name":"TestService","Version":"1.0.0","Region":"Test","Host":"server2","Environment":"Production","Port":9000,"TTL":4}]`
+	req, _ := http.NewRequest("POST", "/skydns/services/batch", bytes.NewBufferString(b))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatal("Failed to add services", resp.Code)
+	}
+	var results []BatchResult
+	if err := json.Unmarshal(resp.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	for i, code := range []int{http.StatusCreated, http.StatusBadRequest, http.StatusConflict} {
+		if results[i].Status != code {
+			t.Errorf("Service %d should have status %d, got %d", i, code, results[i].Status)
+		}
+	}
+	if s.registry.Len() != 2 {
+		t.Fatal("Expected 2 services in the registry, got", s.registry.Len())
+	}
+}
+
 func TestAddServiceDuplicate(t *testing.T) {
 	s := newTestServer("", "", "")
 	defer s.Stop()
@@ -261,6 +435,82 @@ func TestGetService(t *testing.T) {
 	}
 }
 
+func TestServiceUnknownFields(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	b := []byte(`{"SchemaVersion":2,"Name":"TestService","Version":"1.0.0","Environment":"Production","Region":"Test","Host":"localhost","Port":9000,"TTL":4,"Weight":5}`)
+	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusCreated {
+		t.Fatal("Failed to add service")
+	}
+
+	req, _ = http.NewRequest("GET", "/skydns/services/123", nil)
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	var returned map[string]interface{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &returned); err != nil {
+		t.Fatal(err)
+	}
+	if returned["Weight"] != 5.0 {
+		t.Fatalf("Unknown field should be preserved, got %s", resp.Body.String())
+	}
+	if returned["SchemaVersion"] != float64(msg.SchemaVersion) {
+		t.Fatalf("Service should carry the schema version, got %s", resp.Body.String())
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	posts := make(chan registry.Event, 2)
+	failed := false
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get("X-SkyDNS-Signature") != msg.Signature("secret", "POST", "/hook", req.Header.Get("Date"), body) {
+			t.Error("Webhook should be signed")
+		}
+		// The first post fails and is retried
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e registry.Event
+		json.Unmarshal(body, &e)
+		posts <- e
+	}))
+	defer hook.Close()
+
+	if err := s.EnableWebhooks([]string{hook.URL + "/hook"}, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.raftServer.Do(NewAddServiceCommand(services[0], time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.raftServer.Do(NewRemoveServiceCommand(services[0].UUID)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-posts:
+		if e.Type != registry.EventRemove || e.Service == nil || e.Service.UUID != services[0].UUID {
+			t.Fatalf("Unexpected webhook event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Removal should be posted to the webhook")
+	}
+	select {
+	case e := <-posts:
+		t.Fatalf("Only the removal should be posted, got %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
 func TestGetEnvironments(t *testing.T) {
 	s := newTestServer("", "", "")
 	defer s.Stop()
@@ -313,490 +563,3109 @@ func TestGetRegions(t *testing.T) {
 	}
 }
 
-func TestAuthenticationFailure(t *testing.T) {
-	s := newTestServer("", "supersecretpassword", "")
+func TestGetExpiring(t *testing.T) {
+	s := newTestServer("", "", "")
 	defer s.Stop()
 
-	m := msg.Service{
-		Name:        "TestService",
-		Version:     "1.0.0",
-		Region:      "Test",
-		Host:        "localhost",
-		Environment: "Production",
-		Port:        9000,
-		TTL:         4,
+	s.SetExpiryWarning(5 * time.Second)
+	for _, m := range services[:2] {
+		s.registry.Add(m)
 	}
+	m := services[0]
+	m.UUID = "200"
+	m.Host = "server9"
+	m.TTL = 3
+	m.Expires = getExpirationTime(3)
+	s.registry.Add(m)
 
-	b, err := json.Marshal(m)
+	req, _ := http.NewRequest("GET", "/skydns/expiring/", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
 
-	if err != nil {
+	if resp.Code != http.StatusOK {
+		t.Fatal("Failed to retrieve expiring services")
+	}
+	var expiring []msg.Service
+	if err := json.Unmarshal(resp.Body.Bytes(), &expiring); err != nil {
 		t.Fatal(err)
 	}
-
-	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
-	resp := httptest.NewRecorder()
-
-	s.router.ServeHTTP(resp, req)
-	if resp.Code != 403 {
-		t.Fatal("Authentication should have failed and it worked.")
+	if len(expiring) != 1 || expiring[0].UUID != "200" {
+		t.Fatalf("Expected service 200 to be expiring, got %s", resp.Body.String())
 	}
 }
 
-func TestAuthenticationSuccess(t *testing.T) {
-	secret := "myimportantsecret"
-	s := newTestServer("", secret, "")
+func TestEvents(t *testing.T) {
+	s := newTestServer("", "", "")
 	defer s.Stop()
 
-	m := msg.Service{
-		Name:        "TestService",
-		Version:     "1.0.0",
-		Region:      "Test",
-		Host:        "localhost",
-		Environment: "Production",
-		Port:        9000,
-		TTL:         4,
-	}
-
-	b, err := json.Marshal(m)
+	s.registry.Add(services[0])
+	serial := s.registry.Serial()
+	s.registry.Add(services[1])
 
+	// Resuming after the first service replays the second
+	req, _ := http.NewRequest("GET", "http://"+s.HTTPAddr()+"/skydns/events", nil)
+	req.Header.Set("Last-Event-ID", strconv.Itoa(int(serial)))
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatal("Expected an event stream, got", ct)
+	}
 
-	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
-	req.Header.Set("Authorization", secret)
-	resp := httptest.NewRecorder()
-
-	s.router.ServeHTTP(resp, req)
-	if resp.Code != 201 {
-		t.Fatal("Auth Should have worked and it failed")
+	go s.registry.RemoveUUID(services[1].UUID)
+
+	r := bufio.NewReader(resp.Body)
+	for i, want := range []struct {
+		typ, uuid string
+	}{{"add", services[1].UUID}, {"remove", services[1].UUID}} {
+		var typ, data string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				break
+			}
+			if strings.HasPrefix(line, "event: ") {
+				typ = strings.TrimSpace(line[7:])
+			}
+			if strings.HasPrefix(line, "data: ") {
+				data = line[6:]
+			}
+		}
+		var e struct{ Service msg.Service }
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatal(err)
+		}
+		if typ != want.typ || e.Service.UUID != want.uuid {
+			t.Fatalf("Event %d should be %s of %s, got %s %s", i, want.typ, want.uuid, typ, data)
+		}
 	}
 }
 
-func TestHostFailure(t *testing.T) {
+func TestEventsHTTP2(t *testing.T) {
 	s := newTestServer("", "", "")
 	defer s.Stop()
 
-	m := msg.Service{
-		Name:        "TestService",
-		Version:     "1.0.0",
-		Region:      "Test",
-		Environment: "Production",
-		Port:        9000,
-		TTL:         4,
-	}
+	ts := httptest.NewUnstartedServer(s.router)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
 
-	b, err := json.Marshal(m)
+	resp, err := ts.Client().Get(ts.URL + "/skydns/events")
 	if err != nil {
 		t.Fatal(err)
 	}
-	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
-	resp := httptest.NewRecorder()
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected an event stream over HTTP/2, got %s %s", resp.Proto, resp.Status)
+	}
 
-	s.router.ServeHTTP(resp, req)
-	if resp.Code != http.StatusBadRequest {
-		t.Fatal("Failed to detect empty Host.")
+	go s.registry.Add(services[0])
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			if !strings.Contains(line, services[0].UUID) {
+				t.Fatalf("Expected the event of %s, got %s", services[0].UUID, line)
+			}
+			break
+		}
 	}
 }
 
-func TestCallback(t *testing.T) {
+func TestReplica(t *testing.T) {
 	s := newTestServer("", "", "")
 	defer s.Stop()
+	s.registry.Add(services[0])
 
-	m := msg.Service{
-		Name:        "TestService",
-		Version:     "1.0.0",
-		Region:      "Test",
-		Environment: "Production",
-		Host:        "localhost",
-		Port:        9000,
-		TTL:         4,
-	}
-	b, err := json.Marshal(m)
-	if err != nil {
-		t.Fatal(err)
+	p, _ := ioutil.TempDir("", "skydns-test-")
+	defer os.RemoveAll(p)
+	Port += 10
+	r := NewServer(nil, "skydns.local", net.JoinHostPort("127.0.0.1", strconv.Itoa(Port)), net.JoinHostPort("127.0.0.1", strconv.Itoa(Port+1)), p, 1*time.Second, 1*time.Second, "", nil)
+	r.EnableReplica([]string{s.HTTPAddr()})
+	r.Start()
+	defer r.Stop()
+
+	has := func(uuid string) bool {
+		_, err := r.registry.GetUUID(uuid)
+		return err == nil
 	}
-	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
-	resp := httptest.NewRecorder()
-	s.router.ServeHTTP(resp, req)
-
-	c := msg.Callback{
-		Name:        "TestService",
-		Version:     "1.0.0",
-		Region:      "Test",
-		Environment: "Production",
-		Host:        "localhost",
-		Reply:       "localhost",
-		Port:        9650,
+	wait := func(f func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if f() {
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
 	}
-	b, err = json.Marshal(c)
-	if err != nil {
-		t.Fatal(err)
+	if !wait(func() bool { return has(services[0].UUID) }) {
+		t.Fatal("Replica should copy the registry")
 	}
-	req, _ = http.NewRequest("PUT", "/skydns/callbacks/101", bytes.NewBuffer(b))
-	resp = httptest.NewRecorder()
 
-	s.router.ServeHTTP(resp, req)
-	if resp.Code != http.StatusCreated {
-		t.Fatalf("Failed to perform callback: %d", resp.Code)
+	// Changes are followed
+	s.registry.Add(services[1])
+	s.registry.SetDrained(services[0].UUID, true)
+	s.registry.RemoveUUID(services[0].UUID)
+	if !wait(func() bool { return has(services[1].UUID) && !has(services[0].UUID) }) {
+		t.Fatal("Replica should follow the changes of the registry")
 	}
-	req, _ = http.NewRequest("DELETE", "/skydns/services/123", nil)
-	resp = httptest.NewRecorder()
-	s.router.ServeHTTP(resp, req)
-	if resp.Code != http.StatusOK {
-		t.Fatal("Failed to remove service")
-		// TODO(miek): check for the callback to be performed
+
+	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBufferString(`{"Name":"TestService","Version":"1.0.0","Environment":"Production","Region":"Test","Host":"localhost","Port":9000,"TTL":30}`))
+	resp := httptest.NewRecorder()
+	r.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("Replica should refuse writes, got %d", resp.Code)
 	}
 }
 
-func TestCallbackFailure(t *testing.T) {
+func TestReplicaToken(t *testing.T) {
 	s := newTestServer("", "", "")
 	defer s.Stop()
+	s.registry.Add(services[0])
 
-	m := msg.Service{
-		Name:        "TestService",
-		Version:     "1.0.0",
-		Region:      "Test",
-		Environment: "Production",
-		Host:        "localhost",
-		Port:        9000,
-		TTL:         4,
+	f, _ := ioutil.TempFile("", "skydns-tokens-")
+	defer os.Remove(f.Name())
+	f.WriteString("replica s1 *\n")
+	f.Close()
+	if err := s.EnableTokens(f.Name()); err != nil {
+		t.Fatal(err)
 	}
-	b, err := json.Marshal(m)
+
+	// Requests of a replica are signed with its token
+	r := &Server{replica: &replica{}}
+	r.SetReplicaToken("replica", "s1")
+	req, err := r.replicaRequest(s.HTTPAddr(), "/skydns/services/")
 	if err != nil {
 		t.Fatal(err)
 	}
-	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
-	resp := httptest.NewRecorder()
-	s.router.ServeHTTP(resp, req)
-
+	if scheme, _ := authorization(req); scheme != "HMAC" {
+		t.Fatalf("Replica should sign its requests, got %q", req.Header.Get("Authorization"))
+	}
+	if err := s.authenticateRequest(req); err != nil {
+		t.Fatalf("Member should accept the signed request of the replica, got %s", err)
+	}
+
+	r.SetReplicaToken("replica", "s2")
+	req, _ = r.replicaRequest(s.HTTPAddr(), "/skydns/services/")
+	if err := s.authenticateRequest(req); err == nil {
+		t.Fatal("Member should refuse a request signed with the wrong secret")
+	}
+
+	// A replica with the token follows the member
+	p, _ := ioutil.TempDir("", "skydns-test-")
+	defer os.RemoveAll(p)
+	Port += 10
+	r = NewServer(nil, "skydns.local", net.JoinHostPort("127.0.0.1", strconv.Itoa(Port)), net.JoinHostPort("127.0.0.1", strconv.Itoa(Port+1)), p, 1*time.Second, 1*time.Second, "", nil)
+	r.EnableReplica([]string{s.HTTPAddr()})
+	r.SetReplicaToken("replica", "s1")
+	r.Start()
+	defer r.Stop()
+	for i := 0; i < 100; i++ {
+		if _, err := r.registry.GetUUID(services[0].UUID); err == nil {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("Replica should copy the registry with its token")
+}
+
+func TestSnapshot(t *testing.T) {
+	p, _ := ioutil.TempDir("", "skydns-test-")
+	defer os.RemoveAll(p)
+	start := func() *Server {
+		Port += 10
+		s := NewServer(nil, "skydns.local", net.JoinHostPort("127.0.0.1", strconv.Itoa(Port)), net.JoinHostPort("127.0.0.1", strconv.Itoa(Port+1)), p, 1*time.Second, 1*time.Second, "", nil)
+		s.EnableSnapshots(2)
+		s.Start()
+		return s
+	}
+	snapshots := func() []string {
+		names, _ := filepath.Glob(filepath.Join(p, "snapshot", "*"))
+		return names
+	}
+
+	// Without a snapshot a member starts empty
+	s := start()
+	if s.snapshotIndex != 0 || s.registry.Len() != 0 {
+		t.Fatalf("Member without a snapshot should start empty, got index %d and %d services", s.snapshotIndex, s.registry.Len())
+	}
+	for _, uuid := range []string{"1", "2"} {
+		req, _ := http.NewRequest("PUT", "/skydns/services/"+uuid, bytes.NewBufferString(`{"Name":"TestService","Version":"1.0.0","Environment":"Production","Region":"Test","Host":"localhost","Port":9000,"TTL":30}`))
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusCreated {
+			t.Fatalf("Failed to add service: %d", resp.Code)
+		}
+	}
+	for i := 0; i < 100 && len(snapshots()) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	s.Stop()
+	if len(snapshots()) != 1 || s.snapshotIndex == 0 {
+		t.Fatalf("Snapshot should be taken after 2 entries, got %v at index %d", snapshots(), s.snapshotIndex)
+	}
+	index := s.snapshotIndex
+
+	// A restarted member recovers the registry from the snapshot
+	s = start()
+	if s.snapshotIndex != index {
+		t.Fatalf("Snapshot should be loaded at index %d, got %d", index, s.snapshotIndex)
+	}
+	for _, uuid := range []string{"1", "2"} {
+		if serv, err := s.registry.GetUUID(uuid); err != nil || serv.Host != "localhost" || serv.Port != 9000 {
+			t.Fatalf("Service %s should be recovered from the snapshot, got %v, %v", uuid, serv, err)
+		}
+	}
+	s.Stop()
+
+	// A corrupt snapshot isn't loaded, the member starts anyway
+	if err := ioutil.WriteFile(snapshots()[0], []byte("00000000\n{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s = start()
+	defer s.Stop()
+	if s.snapshotIndex != 0 || !s.raftServer.Running() {
+		t.Fatalf("Member should start without the corrupt snapshot, got index %d", s.snapshotIndex)
+	}
+}
+
+func TestStale(t *testing.T) {
+	// A replica of a cluster that can't be reached is stale from the start
+	p, _ := ioutil.TempDir("", "skydns-test-")
+	defer os.RemoveAll(p)
+	Port += 10
+	r := NewServer(nil, "skydns.local", net.JoinHostPort("127.0.0.1", strconv.Itoa(Port)), net.JoinHostPort("127.0.0.1", strconv.Itoa(Port+1)), p, 1*time.Second, 1*time.Second, "", nil)
+	r.EnableReplica([]string{"127.0.0.1:1"})
+	r.EnableStale(500*time.Millisecond, 5)
+	r.registry.Add(services[0])
+	r.Start()
+	defer r.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion("testservice.development.skydns.local.", dns.TypeSRV)
+	resp, _, err := c.Exchange(m, r.DNSAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Stale answer should have 1 record, got %d", len(resp.Answer))
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 5 {
+		t.Fatalf("Stale answer should have a TTL of 5, got %d", ttl)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	resp, _, err = c.Exchange(m, r.DNSAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Answer stale for longer than the maximum should be SERVFAIL, got %s", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	g := grpc.NewServer()
+	rpc.RegisterSkyDNSServer(g, &grpcServer{s: s})
+	defer g.Stop()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.Serve(l)
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := rpc.NewSkyDNSClient(conn)
+	ctx := context.Background()
+
+	// Resuming after the first service replays the second, once it is
+	// received the watch is running
+	s.registry.Add(services[0])
+	serial := s.registry.Serial()
+	s.registry.Add(services[1])
+	watch, err := c.Watch(ctx, &rpc.WatchRequest{Since: serial})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := watch.Recv(); err != nil || e.Type != "add" || e.Service.GetUuid() != services[1].UUID {
+		t.Fatal("Expected the add of the second service to be replayed, got", e, err)
+	}
+
+	m := &rpc.Service{Uuid: "900", Name: "GRPCService", Version: "1.0.0", Environment: "Production", Region: "Test", Host: "localhost", Port: 9000, Ttl: 30}
+	if _, err := c.Register(ctx, &rpc.RegisterRequest{Service: m}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Register(ctx, &rpc.RegisterRequest{Service: m}); status.Code(err) != codes.AlreadyExists {
+		t.Fatal("Registering twice should fail with AlreadyExists, got", err)
+	}
+
+	reply, err := c.Resolve(ctx, &rpc.ResolveRequest{Query: "grpcservice.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Services) != 1 || reply.Services[0].Uuid != "900" || reply.Services[0].Port != 9000 {
+		t.Fatal("Expected to resolve service 900, got", reply.Services)
+	}
+
+	hb, err := c.Heartbeat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hb.Send(&rpc.HeartbeatRequest{Uuid: "900", Ttl: 60}); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := hb.Recv(); err != nil || ack.Uuid != "900" {
+		t.Fatal("Expected the heartbeat of 900 to be acknowledged, got", ack, err)
+	}
+	hb.CloseSend()
+	if serv, _ := s.registry.GetUUID("900"); serv.TTL <= 30 {
+		t.Fatal("Expected the heartbeat to update the TTL to 60, got", serv.TTL)
+	}
+
+	if _, err := c.Deregister(ctx, &rpc.DeregisterRequest{Uuid: "900"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Deregister(ctx, &rpc.DeregisterRequest{Uuid: "900"}); status.Code(err) != codes.NotFound {
+		t.Fatal("Deregistering twice should fail with NotFound, got", err)
+	}
+
+	for _, want := range []string{"add", "update", "remove"} {
+		e, err := watch.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != want || e.Service.GetUuid() != "900" {
+			t.Fatalf("Expected %s of 900, got %s of %s", want, e.Type, e.Service.GetUuid())
+		}
+	}
+}
+
+func TestCheckTargets(t *testing.T) {
+	for _, c := range []struct {
+		check msg.Check
+		ok    bool
+	}{
+		{msg.Check{TCP: "web1.site.com:80"}, true},
+		{msg.Check{TCP: "WEB1.site.com.:80"}, true},
+		{msg.Check{HTTP: "http://web1.site.com/health"}, true},
+		{msg.Check{HTTP: "https://web1.site.com:80/health"}, true},
+		{msg.Check{HTTP: "https://web1.site.com/health"}, false},
+		{msg.Check{TCP: "web1.site.com:22"}, false},
+		{msg.Check{TCP: "169.254.169.254:80"}, false},
+		{msg.Check{HTTP: "http://localhost/admin"}, false},
+		{msg.Check{HTTP: "file:///etc/passwd"}, false},
+		{msg.Check{}, false},
+	} {
+		serv := msg.Service{Host: "web1.site.com", Port: 80, Check: &c.check}
+		if err := validateService(serv); (err == nil) != c.ok {
+			t.Errorf("Check %+v of %s:%d should be allowed: %t, got %v", c.check, serv.Host, serv.Port, c.ok, err)
+		}
+	}
+	// Either address of a service can be checked
+	serv := msg.Service{Host: "10.0.0.1", Host6: "2001:db8::1", Port: 80, Check: &msg.Check{TCP: "[2001:db8::1]:80"}}
+	if err := validateService(serv); err != nil {
+		t.Errorf("Check of the IPv6 address should be allowed, got %v", err)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+	s.EnableHealthChecks(2)
+
+	// A port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	m := services[0]
+	m.UUID = "700"
+	m.Name = "CheckedService"
+	m.Host = "127.0.0.1"
+	m.Port = uint16(l.Addr().(*net.TCPAddr).Port)
+	m.Check = &msg.Check{TCP: addr, Interval: 1, Failures: 1}
+	if err := validateService(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.raftServer.Do(NewAddServiceCommand(m, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+
+	waitHealth := func(unhealthy bool) {
+		for i := 0; i < 50; i++ {
+			if serv, _ := s.registry.GetUUID("700"); serv.Unhealthy == unhealthy {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("Service should have become unhealthy: %t", unhealthy)
+	}
+	waitHealth(true)
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("checkedservice.development.skydns.local.", dns.TypeSRV)
+	resp, _, err := c.Exchange(q, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Fatal("Unhealthy service should not be answered, got", resp)
+	}
+	if services, err := s.registry.Get("checkedservice.*"); err != nil || len(services) != 1 {
+		t.Fatal("Unhealthy service should still be in the registry")
+	}
+
+	if l, err = net.Listen("tcp", addr); err != nil {
+		t.Skip("Can't listen on", addr, err)
+	}
+	defer l.Close()
+	waitHealth(false)
+
+	if resp, _, err = c.Exchange(q, "127.0.0.1:"+StrPort); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatal("Healthy service should be answered, got", resp)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	for _, m := range services[:2] {
+		s.registry.Add(m)
+	}
+	srv := func() int {
+		c := new(dns.Client)
+		q := new(dns.Msg)
+		q.SetQuestion("testservice.*.skydns.local.", dns.TypeSRV)
+		resp, _, err := c.Exchange(q, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(resp.Answer)
+	}
+	drain := func(method, query string) []string {
+		req, _ := http.NewRequest(method, "/skydns/drain?"+query, nil)
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Drain %s returned %d: %s", query, resp.Code, resp.Body.String())
+		}
+		var uuids []string
+		if err := json.Unmarshal(resp.Body.Bytes(), &uuids); err != nil {
+			t.Fatal(err)
+		}
+		return uuids
+	}
+
+	if n := srv(); n != 2 {
+		t.Fatal("Expected 2 answers before draining, got", n)
+	}
+	if uuids := drain("PUT", "host=server1"); len(uuids) != 1 || uuids[0] != "100" {
+		t.Fatal("Expected service 100 to be drained, got", uuids)
+	}
+	if n := srv(); n != 1 {
+		t.Fatal("Expected 1 answer after draining, got", n)
+	}
+	if serv, _ := s.registry.GetUUID("100"); !serv.Drained {
+		t.Fatal("Drained service should still be in the registry")
+	}
+
+	drain("PUT", "name=testservice")
+	if n := srv(); n != 0 {
+		t.Fatal("Expected no answers with all services drained, got", n)
+	}
+	drain("DELETE", "name=testservice")
+	if n := srv(); n != 2 {
+		t.Fatal("Expected 2 answers after putting the services back, got", n)
+	}
+
+	req, _ := http.NewRequest("PUT", "/skydns/drain", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatal("Draining without a selection should fail, got", resp.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	s.registry.Add(services[0])
+	stats.RequestCount.Inc(1)
+
+	resp, err := http.Get("http://" + s.HTTPAddr() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+
+	for _, want := range []string{
+		"# TYPE skydns_requests_total counter\nskydns_requests_total ",
+		"# TYPE skydns_registry_services gauge\nskydns_registry_services 1\n",
+		"skydns_raft_state 3\n",
+		"# TYPE skydns_registration_to_resolvable_seconds summary\n",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("Expected metrics to contain %q, got %s", want, b)
+		}
+	}
+}
+
+func TestDNSMetrics(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	m := services[0]
+	m.Name = "MetricsService"
+	s.registry.Add(m)
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	for _, name := range []string{"metricsservice.development.skydns.local.", "nosuchservice.development.skydns.local."} {
+		q.SetQuestion(name, dns.TypeSRV)
+		if _, _, err := c.Exchange(q, "127.0.0.1:"+StrPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Malformed queries are answered before they're looked at, but measured
+	// all the same
+	malformed := new(dns.Msg)
+	malformed.Question = []dns.Question{{Name: "a.skydns.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, {Name: "b.skydns.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+	s.ServeDNS(&dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}}, malformed)
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	for _, want := range []string{
+		"# TYPE skydns_dns_latency_registry_srv_seconds summary\n",
+		"# TYPE skydns_dns_rcode_noerror_total counter\n",
+		"# TYPE skydns_dns_rcode_nxdomain_total counter\n",
+		"# TYPE skydns_dns_rcode_formerr_total counter\n",
+	} {
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got %s", want, resp.Body.String())
+		}
+	}
+}
+
+func TestQueryLog(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	r, w := io.Pipe()
+	defer r.Close()
+	s.EnableQueryLog(w, true, 1, true)
+
+	m := services[0]
+	m.Name = "QueryLogService"
+	s.registry.Add(m)
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("querylogservice.development.skydns.local.", dns.TypeSRV)
+	go c.Exchange(q, "127.0.0.1:"+StrPort)
+
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry struct {
+		Msg, Client, Proto, Name, Type, Rcode, Source string
+		Answers                                       int
+	}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Msg != "Query" || entry.Client != "127.0.0.1" || entry.Proto != "udp" || entry.Name != q.Question[0].Name ||
+		entry.Type != "SRV" || entry.Rcode != "NOERROR" || entry.Answers != 1 || entry.Source != stats.SourceRegistry {
+		t.Fatalf("Unexpected query log entry %s", line)
+	}
+}
+
+func TestNameStats(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	m := services[0]
+	m.Name = "StatsService"
+	s.registry.Add(m)
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	for _, name := range []string{"statsservice.development.skydns.local.", "1-0-0.statsservice.development.skydns.local.", "nosuchservice.development.skydns.local."} {
+		q.SetQuestion(name, dns.TypeSRV)
+		if _, _, err := c.Exchange(q, "127.0.0.1:"+StrPort); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/skydns/services/StatsService/stats", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	var queries struct {
+		Windows []stats.QueryWindow
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &queries); err != nil {
+		t.Fatal(err)
+	}
+	if len(queries.Windows) != 3 {
+		t.Fatal("Expected 3 windows, got", resp.Body.String())
+	}
+	for _, w := range queries.Windows {
+		if w.Queries != 2 || w.Clients["127.0.0.0/24"] != 2 {
+			t.Errorf("Expected 2 queries from 127.0.0.0/24 in the %s window, got %+v", w.Window, w)
+		}
+	}
+}
+
+func TestGetCluster(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	req, _ := http.NewRequest("GET", "/skydns/cluster", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	var cluster struct {
+		Leader  string
+		Members []string
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &cluster); err != nil {
+		t.Fatal(err)
+	}
+	if cluster.Leader != s.HTTPAddr() || len(cluster.Members) != 1 || cluster.Members[0] != s.HTTPAddr() {
+		t.Fatalf("Single node should be leader and only member, got %s", resp.Body.String())
+	}
+}
+
+func TestGetLeader(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+	s.EnableForwarding()
+
+	req, _ := http.NewRequest("GET", "/skydns/leader", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	var leader struct {
+		Leader   string
+		IsLeader bool
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &leader); err != nil {
+		t.Fatal(err)
+	}
+	if leader.Leader != s.HTTPAddr() || !leader.IsLeader {
+		t.Fatalf("Single node should be the leader, got %s", resp.Body.String())
+	}
+
+	// The leader handles writes itself
+	req, _ = http.NewRequest("PUT", "/skydns/services/123", bytes.NewBufferString(`{"Name":"TestService","Version":"1.0.0","Environment":"Production","Region":"Test","Host":"localhost","Port":9000,"TTL":30}`))
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Leader should register the service, got %d: %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestGetLockStats(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	for _, m := range services {
+		s.registry.Add(m)
+	}
+	s.registry.Get("*")
+
+	req, _ := http.NewRequest("GET", "/skydns/debug/locks", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatal("Failed to retrieve lock statistics")
+	}
+
+	var returned map[string]stats.LockStats
+	if err := json.Unmarshal(resp.Body.Bytes(), &returned); err != nil {
+		t.Fatal(err)
+	}
+	if returned["add"].Wait.Count < int64(len(services)) || returned["get"].Hold.Count < 1 {
+		t.Fatalf("Lock statistics should count registry operations, got %s", resp.Body.String())
+	}
+}
+
+func TestProfiling(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	req, _ := http.NewRequest("GET", "/skydns/debug/registry", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code == http.StatusOK {
+		t.Fatal("Registry internals should only be served with profiling enabled")
+	}
+
+	s.EnableProfiling()
+	for _, m := range services {
+		s.registry.Add(m)
+	}
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatal("Failed to retrieve registry internals")
+	}
+	var returned RegistryDebug
+	if err := json.Unmarshal(resp.Body.Bytes(), &returned); err != nil {
+		t.Fatal(err)
+	}
+	if returned.Services != len(services) || returned.Depth != 6 || returned.Locks["add"].Hold.Count < 1 {
+		t.Fatalf("Registry internals should describe the registry, got %s", resp.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/debug/pprof/heap", nil)
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatal("Failed to retrieve heap profile", resp.Code)
+	}
+}
+
+func TestAuthenticationFailure(t *testing.T) {
+	s := newTestServer("", "supersecretpassword", "")
+	defer s.Stop()
+
+	m := msg.Service{
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Host:        "localhost",
+		Environment: "Production",
+		Port:        9000,
+		TTL:         4,
+	}
+
+	b, err := json.Marshal(m)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
+	resp := httptest.NewRecorder()
+
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != 403 {
+		t.Fatal("Authentication should have failed and it worked.")
+	}
+}
+
+func TestAuthenticationSuccess(t *testing.T) {
+	secret := "myimportantsecret"
+	s := newTestServer("", secret, "")
+	defer s.Stop()
+
+	m := msg.Service{
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Host:        "localhost",
+		Environment: "Production",
+		Port:        9000,
+		TTL:         4,
+	}
+
+	b, err := json.Marshal(m)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
+	req.Header.Set("Authorization", secret)
+	resp := httptest.NewRecorder()
+
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != 201 {
+		t.Fatal("Auth Should have worked and it failed")
+	}
+}
+
+func TestHostFailure(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	m := msg.Service{
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Environment: "Production",
+		Port:        9000,
+		TTL:         4,
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
+	resp := httptest.NewRecorder()
+
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatal("Failed to detect empty Host.")
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	s.SetRequestLimits(256, 2, true)
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"Name":"TestService","Host":"localhost","Port":9000,"TTL":4}`, http.StatusCreated},
+		{`{"Name":"TestService","Host":"localhost","Port":9000,"TTL":4,"Weight":5}`, http.StatusBadRequest},
+		{`{"Name":"TestService","Host":"localhost","Port":9000,"TTL":4,"Extra":{"a":[[1]]}}`, http.StatusBadRequest},
+		{`{"Name":"` + strings.Repeat("x", 256) + `","Host":"localhost","Port":9000,"TTL":4}`, http.StatusRequestEntityTooLarge},
+		{`{"Name":`, http.StatusBadRequest},
+	}
+	for i, tc := range tests {
+		req, _ := http.NewRequest("PUT", "/skydns/services/"+strconv.Itoa(200+i), bytes.NewBufferString(tc.body))
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		if resp.Code != tc.code {
+			t.Errorf("Request %d should return %d, got %d", i, tc.code, resp.Code)
+		}
+	}
+}
+
+func TestJSONDepth(t *testing.T) {
+	tests := map[string]int{
+		`{}`:                    1,
+		`{"a":[1,{"b":2}]}`:     3,
+		`{"a":"[[[{{{"}`:        1,
+		`{"a":"\"[[","b":[[]]}`: 3,
+	}
+	for b, depth := range tests {
+		if d := jsonDepth([]byte(b)); d != depth {
+			t.Errorf("Depth of %s should be %d, got %d", b, depth, d)
+		}
+	}
+}
+
+func TestCallback(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	m := msg.Service{
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Environment: "Production",
+		Host:        "localhost",
+		Port:        9000,
+		TTL:         4,
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
+	c := msg.Callback{
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Environment: "Production",
+		Host:        "localhost",
+		Reply:       "localhost",
+		Port:        9650,
+	}
+	b, err = json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("PUT", "/skydns/callbacks/101", bytes.NewBuffer(b))
+	resp = httptest.NewRecorder()
+
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Failed to perform callback: %d", resp.Code)
+	}
+	req, _ = http.NewRequest("DELETE", "/skydns/services/123", nil)
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatal("Failed to remove service")
+		// TODO(miek): check for the callback to be performed
+	}
+}
+
+func TestCallbackFailure(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	m := msg.Service{
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Environment: "Production",
+		Host:        "localhost",
+		Port:        9000,
+		TTL:         4,
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+
 	c := msg.Callback{
 		Name:        "TestService",
 		Version:     "1.0.0",
 		Region:      "Test",
-		Environment: "Testing", // should result in notFound
-		Host:        "localhost",
-		Reply:       "localhost",
-		Port:        9650,
+		Environment: "Testing", // should result in notFound
+		Host:        "localhost",
+		Reply:       "localhost",
+		Port:        9650,
+	}
+	b, err = json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("PUT", "/skydns/callbacks/101", bytes.NewBuffer(b))
+	resp = httptest.NewRecorder()
+
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Fatal("Callback should result in service not found.")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := newTestServer("", "", "")
+
+	s.registry.Add(msg.Service{UUID: "123", Name: "TestService", Version: "1.0.0", Region: "Test", Environment: "Production", Host: "localhost", Port: 9000, TTL: 30, Expires: getExpirationTime(30)})
+	host, port, _ := net.SplitHostPort(s.HTTPAddr())
+	for i, reply := range []string{host, "elsewhere"} {
+		b, _ := json.Marshal(msg.Callback{Name: "TestService", Version: "1.0.0", Region: "Test", Environment: "Production", Host: "localhost", Reply: reply, Port: uint16(Port + 1)})
+		req, _ := http.NewRequest("PUT", "/skydns/callbacks/"+strconv.Itoa(i), bytes.NewBuffer(b))
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusCreated {
+			t.Fatalf("Failed to add callback: %d", resp.Code)
+		}
+	}
+
+	s.Shutdown()
+
+	serv, err := s.registry.GetUUID("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := serv.Callback["0"]; ok || len(serv.Callback) != 1 {
+		t.Fatalf("Only the callback to %s:%s should be removed, got %v", host, port, serv.Callback)
+	}
+	if _, err := http.Get("http://" + s.HTTPAddr() + "/skydns/leader"); err == nil {
+		t.Fatal("HTTP API should be shut down")
+	}
+}
+
+func TestReload(t *testing.T) {
+	s := newTestServer("", "", "8.8.8.8:53")
+	defer s.Stop()
+
+	s.EnableForwardCache(10, time.Hour)
+	s.EnableAnswerCache(10, time.Minute)
+	s.EnableStale(time.Hour, 10)
+	s.upstreams.observe("8.8.8.8:53", 20*time.Millisecond, true)
+	reloaded := false
+	s.OnReload(func() error {
+		s.SetNameservers([]string{"8.8.4.4:53", "8.8.8.8:53"})
+		s.SetMinTTL(30)
+		s.SetCacheTTLs(time.Minute, time.Second, 30*time.Second)
+		s.SetStaleTTL(5)
+		reloaded = true
+		return nil
+	})
+	s.Reload()
+	if !reloaded {
+		t.Fatal("Reload should call the OnReload functions")
+	}
+
+	if len(s.upstreams.list) != 2 || s.upstreams.list[0].addr != "8.8.4.4:53" {
+		t.Fatalf("Nameservers not replaced: %v", s.upstreams.order())
+	}
+	if rtt := s.upstreams.list[1].rtt; rtt != 20*time.Millisecond {
+		t.Fatalf("Nameserver that stays should keep its health, got rtt %s", rtt)
+	}
+	if ttl := s.soa(1).Minttl; ttl != 30 {
+		t.Fatalf("Minimum TTL should be 30, got %d", ttl)
+	}
+	if s.forwardCache.limit() != time.Minute || s.answerCache.limit() != 30*time.Second || s.negativeCache != nil {
+		t.Fatalf("Cache TTLs not changed: forward %s, answer %s", s.forwardCache.limit(), s.answerCache.limit())
+	}
+	if s.stale.ttl != 5 {
+		t.Fatalf("Stale TTL should be 5, got %d", s.stale.ttl)
+	}
+	if addrs := s.upstreams.addrs(); len(addrs) != 2 || addrs[0] != "8.8.4.4:53" {
+		t.Fatalf("Nameservers should be listed in the order they were set, got %v", addrs)
+	}
+
+	// The registry is left alone
+	s.registry.Add(services[0])
+	s.Reload()
+	if s.registry.Len() != 1 {
+		t.Fatal("Reload should keep the registry")
+	}
+}
+
+var services = []msg.Service{
+	{
+		UUID:        "100",
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Region1",
+		Host:        "server1",
+		Environment: "Development",
+		Port:        9000,
+		TTL:         30,
+		Expires:     getExpirationTime(30),
+	},
+	{
+		UUID:        "101",
+		Name:        "TestService",
+		Version:     "1.0.1",
+		Region:      "Region1",
+		Host:        "server2",
+		Environment: "Production",
+		Port:        9001,
+		TTL:         31,
+		Expires:     getExpirationTime(31),
+	},
+	{
+		UUID:        "102",
+		Name:        "OtherService",
+		Version:     "1.0.0",
+		Region:      "Region2",
+		Host:        "server3",
+		Environment: "Production",
+		Port:        9002,
+		TTL:         32,
+		Expires:     getExpirationTime(32),
+	},
+	{
+		UUID:        "103",
+		Name:        "TestService",
+		Version:     "1.0.1",
+		Region:      "Region1",
+		Host:        "server4",
+		Environment: "Development",
+		Port:        9003,
+		TTL:         33,
+		Expires:     getExpirationTime(33),
+	},
+	{
+		UUID:        "104",
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Region3",
+		Host:        "server5",
+		Environment: "Production",
+		Port:        9004,
+		TTL:         34,
+		Expires:     getExpirationTime(34),
+	},
+	{
+		UUID:        "105",
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Region3",
+		Host:        "server6",
+		Environment: "Production",
+		Port:        9005,
+		TTL:         35,
+		Expires:     getExpirationTime(35),
+	},
+	{
+		UUID:        "106",
+		Name:        "OtherService",
+		Version:     "1.0.0",
+		Region:      "Region2",
+		Host:        "server7",
+		Environment: "Production",
+		Port:        9006,
+		TTL:         36,
+		Expires:     getExpirationTime(36),
+	},
+}
+
+type dnsTestCase struct {
+	Question string
+	Answer   []dns.SRV
+}
+
+var dnsTestCases = []dnsTestCase{
+	// Generic Test
+	{
+		Question: "testservice.production.skydns.local.",
+		Answer: []dns.SRV{
+			{
+				Hdr: dns.RR_Header{
+					Name:   "testservice.production.skydns.local.",
+					Ttl:    30,
+					Rrtype: dns.TypeSRV,
+				},
+				Priority: 10,
+				Weight:   33,
+				Target:   "server2.",
+				Port:     9001,
+			},
+			{
+				Hdr: dns.RR_Header{
+					Name:   "testservice.production.skydns.local.",
+					Ttl:    33,
+					Rrtype: dns.TypeSRV,
+				},
+				Priority: 10,
+				Weight:   33,
+				Target:   "server5.",
+				Port:     9004,
+			},
+			{
+				Hdr: dns.RR_Header{
+					Name:   "testservice.production.skydns.local.",
+					Ttl:    34,
+					Rrtype: dns.TypeSRV,
+				},
+				Priority: 10,
+				Weight:   33,
+				Target:   "server6.",
+				Port:     9005,
+			},
+		},
+	},
+
+	// Region Priority Test
+	{
+		Question: "region1.*.testservice.production.skydns.local.",
+		Answer: []dns.SRV{
+			{
+				Hdr: dns.RR_Header{
+					Name:   "region1.*.testservice.production.skydns.local.",
+					Ttl:    30,
+					Rrtype: dns.TypeSRV,
+				},
+				Priority: 10,
+				Weight:   100,
+				Target:   "server2.",
+				Port:     9001,
+			},
+			{
+				Hdr: dns.RR_Header{
+					Name:   "region1.*.testservice.production.skydns.local.",
+					Ttl:    33,
+					Rrtype: dns.TypeSRV,
+				},
+				Priority: 20,
+				Weight:   50,
+				Target:   "server5.",
+				Port:     9004,
+			},
+			{
+				Hdr: dns.RR_Header{
+					Name:   "region1.*.testservice.production.skydns.local.",
+					Ttl:    34,
+					Rrtype: dns.TypeSRV,
+				},
+				Priority: 20,
+				Weight:   50,
+				Target:   "server6.",
+				Port:     9005,
+			},
+		},
+	},
+}
+
+type servicesTest struct {
+	query string
+	count int
+}
+
+var serviceTestArray []servicesTest = []servicesTest{
+	{"*", 7},
+	{"production", 5},
+	{"testservice.production", 3},
+	{"region1.*.*.production", 1},
+	{"region1.*.testservice.production", 1},
+}
+
+func TestGetServicesWithQueries(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	for _, m := range services {
+		s.registry.Add(m)
+	}
+
+	for _, st := range serviceTestArray {
+		req, _ := http.NewRequest("GET", "/skydns/services/?query="+st.query, nil)
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatal("Failed To Retrieve Services")
+		}
+		var returnedServices []msg.Service
+		err := json.Unmarshal(resp.Body.Bytes(), &returnedServices)
+		if err != nil {
+			t.Fatal("Failed to unmarshal response from server")
+		}
+		if len(returnedServices) != st.count {
+			t.Fatal("Expected ", st.count, " got %d services", len(returnedServices))
+		}
+
+	}
+
+}
+
+func TestGetServicesWithFields(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	for _, m := range services {
+		s.registry.Add(m)
+	}
+
+	req, _ := http.NewRequest("GET", "/skydns/services/?query=otherservice.production&fields=uuid,HOST,port", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatal("Failed To Retrieve Services")
+	}
+	var returned []map[string]interface{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &returned); err != nil {
+		t.Fatal("Failed to unmarshal response from server")
+	}
+	if len(returned) != 2 {
+		t.Fatalf("Expected 2 services, got %d", len(returned))
+	}
+	for _, r := range returned {
+		if len(r) != 3 || r["UUID"] == nil || r["Host"] == nil || r["Port"] == nil {
+			t.Fatalf("Expected only UUID, Host and Port, got %v", r)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/skydns/services/?fields=uuid,nosuchfield", nil)
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatal("Unknown fields should be rejected")
+	}
+}
+
+func TestGetServicesFiltered(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	for _, m := range services {
+		s.registry.Add(m)
+	}
+
+	var all []msg.Service
+	for _, m := range services {
+		if m.Name == "TestService" && m.Environment == "Production" {
+			all = append(all, m)
+		}
+	}
+	sort.Sort(servicesByKey(all))
+
+	var paged []msg.Service
+	for offset := 0; offset < len(all); offset += 2 {
+		req, _ := http.NewRequest("GET", "/skydns/services?name=testservice&environment=production&limit=2&offset="+strconv.Itoa(offset), nil)
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatal("Failed To Retrieve Services")
+		}
+		if total := resp.Header().Get("X-Total-Count"); total != strconv.Itoa(len(all)) {
+			t.Fatalf("Expected a total of %d services, got %s", len(all), total)
+		}
+		var page []msg.Service
+		if err := json.Unmarshal(resp.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > 2 {
+			t.Fatalf("Expected at most 2 services, got %d", len(page))
+		}
+		paged = append(paged, page...)
+	}
+	if len(paged) != len(all) {
+		t.Fatalf("Expected %d services over all pages, got %d", len(all), len(paged))
+	}
+	for i := range all {
+		if paged[i].UUID != all[i].UUID {
+			t.Fatalf("Service %d should be %s, got %s", i, all[i].UUID, paged[i].UUID)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/skydns/services?limit=x", nil)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatal("Invalid limit should be rejected")
+	}
+
+	// Huge offsets and limits must not overflow
+	for _, c := range []struct {
+		query string
+		want  int
+	}{
+		{"limit=" + strconv.Itoa(math.MaxInt), len(all)},
+		{"offset=1&limit=" + strconv.Itoa(math.MaxInt), len(all) - 1},
+		{"offset=" + strconv.Itoa(math.MaxInt) + "&limit=" + strconv.Itoa(math.MaxInt), 0},
+	} {
+		req, _ := http.NewRequest("GET", "/skydns/services?name=testservice&environment=production&"+c.query, nil)
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		var page []msg.Service
+		if err := json.Unmarshal(resp.Body.Bytes(), &page); resp.Code != http.StatusOK || err != nil || len(page) != c.want {
+			t.Fatalf("Expected %d services for %s, got %d: %s", c.want, c.query, resp.Code, resp.Body.String())
+		}
+	}
+}
+
+func TestDNS(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	for _, m := range services {
+		s.registry.Add(m)
+	}
+	c := new(dns.Client)
+	for _, tc := range dnsTestCases {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.Question, dns.TypeSRV)
+		resp, _, err := c.Exchange(m, "localhost:"+StrPort)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Answer) != len(tc.Answer) {
+			t.Fatalf("Response for %q contained %d results, %d expected", tc.Question, len(resp.Answer), len(tc.Answer))
+		}
+
+		for i, a := range resp.Answer {
+			srv := a.(*dns.SRV)
+
+			// Validate Header
+			if srv.Hdr.Name != tc.Answer[i].Hdr.Name {
+				t.Errorf("Answer %d should have a Header Name of %q, but has %q", i, tc.Answer[i].Hdr.Name, srv.Hdr.Name)
+			}
+
+			if srv.Hdr.Ttl != tc.Answer[i].Hdr.Ttl {
+				t.Errorf("Answer %d should have a Header TTL of %d, but has %d", i, tc.Answer[i].Hdr.Ttl, srv.Hdr.Ttl)
+			}
+
+			if srv.Hdr.Rrtype != tc.Answer[i].Hdr.Rrtype {
+				t.Errorf("Answer %d should have a Header Response Type of %d, but has %d", i, tc.Answer[i].Hdr.Rrtype, srv.Hdr.Rrtype)
+			}
+
+			// Validate Record
+			if srv.Priority != tc.Answer[i].Priority {
+				t.Errorf("Answer %d should have a Priority of %d, but has %d", i, tc.Answer[i].Priority, srv.Priority)
+			}
+
+			if srv.Weight != tc.Answer[i].Weight {
+				t.Errorf("Answer %d should have a Weight of %d, but has %d", i, tc.Answer[i].Weight, srv.Weight)
+			}
+
+			if srv.Port != tc.Answer[i].Port {
+				t.Errorf("Answer %d should have a Port of %d, but has %d", i, tc.Answer[i].Port, srv.Port)
+			}
+
+			if srv.Target != tc.Answer[i].Target {
+				t.Errorf("Answer %d should have a Target of %q, but has %q", i, tc.Answer[i].Target, srv.Target)
+			}
+		}
+	}
+}
+
+func TestDNSARecords(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion("skydns.local.", dns.TypeA)
+	resp, _, err := c.Exchange(m, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatal("Answer expected to have 2 A records but has", len(resp.Answer))
+	}
+}
+
+func TestDNSTXT(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	m := services[0]
+	m.Name, m.Host, m.Metadata = "TXTService", "10.0.0.1", map[string]string{"owner": "payments", "docs": "https://wiki/txt"}
+	s.registry.Add(m)
+
+	c := new(dns.Client)
+	want := []string{"uuid=" + m.UUID, "version=" + m.Version, "docs=https://wiki/txt", "owner=payments"}
+	for _, name := range []string{"txtservice.development.skydns.local.", m.UUID + ".skydns.local."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeTXT)
+		resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Fatalf("Answer for %s expected to have 1 TXT record but has %d", name, len(resp.Answer))
+		}
+		txt, ok := resp.Answer[0].(*dns.TXT)
+		if !ok || strings.Join(txt.Txt, " ") != strings.Join(want, " ") {
+			t.Fatalf("TXT record for %s should hold %v, got %v", name, want, resp.Answer[0])
+		}
+	}
+}
+
+func TestDNSNAPTR(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	naptr := []msg.NAPTR{{Order: 10, Preference: 50, Flags: "S", Service: "SIP+D2U", Replacement: "sipproxy.production"}}
+	for i, uuid := range []string{"301", "302"} {
+		s.registry.Add(msg.Service{UUID: uuid, Name: "SIPDomain", Version: "1.0.0", Region: "Test", Environment: "Production",
+			Host: "sip" + strconv.Itoa(i), Port: 5060, TTL: 30, Expires: getExpirationTime(30), NAPTR: naptr})
+	}
+	s.registry.Add(msg.Service{UUID: "303", Name: "SIPProxy", Version: "1.0.0", Region: "Test", Environment: "Production",
+		Host: "10.0.0.3", Port: 5060, TTL: 30, Expires: getExpirationTime(30)})
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("sipdomain.production.skydns.local.", dns.TypeNAPTR)
+	resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatal("Answer expected to have 1 NAPTR record but has", len(resp.Answer))
+	}
+	rr, ok := resp.Answer[0].(*dns.NAPTR)
+	if !ok || rr.Replacement != "sipproxy.production.skydns.local." || rr.Service != "SIP+D2U" {
+		t.Fatalf("Unexpected NAPTR record %v", resp.Answer[0])
+	}
+	var srv, a int
+	for _, rr := range resp.Extra {
+		switch rr.(type) {
+		case *dns.SRV:
+			srv++
+		case *dns.A:
+			a++
+		}
+	}
+	if srv != 1 || a != 1 {
+		t.Fatalf("Extra expected to have the SRV and A record of the proxy, got %v", resp.Extra)
+	}
+
+	if err := validateService(msg.Service{Host: "sip", Port: 5060, NAPTR: []msg.NAPTR{{Flags: "S"}}}); err == nil {
+		t.Fatal("NAPTR without a Regexp or Replacement should be invalid")
+	}
+}
+
+func TestViews(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	f, err := ioutil.TempFile("", "skydns-views-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# local clients\ninternal 127.0.0.0/8,::1/128\nexternal 0.0.0.0/0\n")
+	f.Close()
+	if err := s.EnableViews(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	s.registry.Add(msg.Service{UUID: "401", Name: "WebService", Version: "1.0.0", Region: "Test", Environment: "Production",
+		Host: "192.0.2.1", Port: 80, TTL: 30, Expires: getExpirationTime(30),
+		Views: map[string]msg.View{"Internal": {Host: "10.0.0.9", Port: 8080}}})
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("webservice.production.skydns.local.", dns.TypeSRV)
+	resp, _, err := c.Exchange(q, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.SRV).Port != 8080 {
+		t.Fatalf("Answer expected to have the internal SRV record, got %v", resp.Answer)
+	}
+	if len(resp.Extra) != 1 || !resp.Extra[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.9")) {
+		t.Fatalf("Extra expected to have the internal address, got %v", resp.Extra)
+	}
+
+	if v := s.viewOf(net.ParseIP("192.0.2.200")); v != "external" {
+		t.Fatalf("Expected view external, got %q", v)
+	}
+	if services := inView([]msg.Service{{Host: "192.0.2.1", Port: 80}}, "external"); services[0].Host != "192.0.2.1" {
+		t.Fatalf("Services without the view should keep their Host, got %v", services[0])
+	}
+
+	if err := validateService(msg.Service{Host: "web", Port: 80, Views: map[string]msg.View{"internal": {Port: 80}}}); err == nil {
+		t.Fatal("Views without a Host should be invalid")
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	f, err := ioutil.TempFile("", "skydns-views-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("internal 127.0.0.0/8\nexternal 0.0.0.0/0\n")
+	f.Close()
+	if err := s.EnableViews(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableClientSubnet("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.registry.Add(msg.Service{UUID: "402", Name: "WebService", Version: "1.0.0", Region: "Test", Environment: "Production",
+		Host: "192.0.2.1", Port: 80, TTL: 30, Expires: getExpirationTime(30),
+		Views: map[string]msg.View{"Internal": {Host: "10.0.0.9", Port: 8080}}})
+
+	query := func(subnet *dns.EDNS0_SUBNET) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("webservice.production.skydns.local.", dns.TypeSRV)
+		q.SetEdns0(4096, false)
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, subnet)
+		resp, _, err := new(dns.Client).Exchange(q, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// The resolver is internal, its client is not
+	resp := query(&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()})
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.SRV).Port != 80 {
+		t.Fatalf("Answer expected to have the external SRV record, got %v", resp.Answer)
+	}
+	// The subnet picked the view, the scope of the echo is the source prefix
+	// length, which ecsOption rejects in queries
+	var e *dns.EDNS0_SUBNET
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o, ok := o.(*dns.EDNS0_SUBNET); ok {
+				e = o
+			}
+		}
+	}
+	if e == nil || e.SourceNetmask != 24 || e.SourceScope != 24 || !e.Address.Equal(net.ParseIP("192.0.2.0")) {
+		t.Fatalf("Reply expected to echo the client subnet, got %v", resp.Extra)
+	}
+
+	// A client subnet with a scope prefix length is ignored
+	resp = query(&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 24, Address: net.ParseIP("192.0.2.0").To4()})
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.SRV).Port != 8080 {
+		t.Fatalf("Answer expected to have the internal SRV record, got %v", resp.Answer)
+	}
+
+	m := new(dns.Msg)
+	m.SetEdns0(4096, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 16, Address: net.ParseIP("192.0.2.0").To4()})
+	if ecsOption(m) != nil {
+		t.Fatal("Client subnet with address bits beyond its prefix should be ignored")
+	}
+}
+
+func TestZones(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	f, err := ioutil.TempFile("", "skydns-zones-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# development\ndev.local\n")
+	f.Close()
+	if err := s.EnableZones(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	s.registry.Add(msg.Service{UUID: "701", Name: "ZoneService", Version: "1.0.0", Region: "Test", Environment: "Production",
+		Host: "10.0.0.7", Port: 80, TTL: 30, Expires: getExpirationTime(30), Zone: "dev.local"})
+	s.registry.Add(msg.Service{UUID: "702", Name: "ZoneService", Version: "1.0.0", Region: "Test", Environment: "Production",
+		Host: "10.0.0.8", Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+
+	c := new(dns.Client)
+	for name, host := range map[string]string{"zoneservice.production.dev.local.": "10.0.0.7", "zoneservice.production.skydns.local.": "10.0.0.8"} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeSRV)
+		resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || len(resp.Extra) != 1 || resp.Question[0].Name != name {
+			t.Fatalf("Expected 1 SRV record and its glue for %s, got %v", name, resp)
+		}
+		srv, a := resp.Answer[0].(*dns.SRV), resp.Extra[0].(*dns.A)
+		if srv.Hdr.Name != name || !strings.HasSuffix(srv.Target, name[strings.Index(name, ".production")+len(".production"):]) {
+			t.Fatalf("SRV record %v should be in the zone of %s", srv, name)
+		}
+		if a.Hdr.Name != srv.Target || a.A.String() != host {
+			t.Fatalf("Expected glue for %s with %s, got %v", srv.Target, host, a)
+		}
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("dev.local.", dns.TypeSOA)
+	resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "dev.local." || resp.Answer[0].(*dns.SOA).Ns != "master.dev.local." {
+		t.Fatalf("Expected the SOA record of dev.local, got %v", resp.Answer)
+	}
+
+	q.SetQuestion("nosuchservice.production.dev.local.", dns.TypeA)
+	resp, _, err = c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 || resp.Ns[0].Header().Name != "dev.local." {
+		t.Fatalf("Expected NXDOMAIN with the SOA record of dev.local, got %v", resp)
+	}
+
+	// The PTR record points at the name of the service in its zone
+	q.SetQuestion("7.0.0.10.in-addr.arpa.", dns.TypePTR)
+	resp, _, err = c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || !strings.HasPrefix(resp.Answer[0].(*dns.PTR).Ptr, "701.") || !strings.HasSuffix(resp.Answer[0].(*dns.PTR).Ptr, ".dev.local.") {
+		t.Fatalf("Expected the PTR record of 701 in dev.local, got %v", resp.Answer)
+	}
+
+	// Each zone transfers its own services only
+	if err := s.EnableTransfer("127.0.0.1", true); err != nil {
+		t.Fatal(err)
+	}
+	for zone, uuid := range map[string]string{"dev.local.": "701.", "skydns.local.": "702."} {
+		q := new(dns.Msg)
+		q.SetAxfr(zone)
+		env, err := new(dns.Transfer).In(q, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var srvs []*dns.SRV
+		for e := range env {
+			if e.Error != nil {
+				t.Fatal(e.Error)
+			}
+			for _, rr := range e.RR {
+				if !strings.HasSuffix(rr.Header().Name, zone) {
+					t.Fatalf("Transfer of %s has a record outside of it: %v", zone, rr)
+				}
+				if srv, ok := rr.(*dns.SRV); ok {
+					srvs = append(srvs, srv)
+				}
+			}
+		}
+		if len(srvs) != 1 || !strings.HasPrefix(srvs[0].Hdr.Name, uuid) {
+			t.Fatalf("Transfer of %s should have the SRV record of %s only, got %v", zone, uuid, srvs)
+		}
+	}
+}
+
+func TestNameServers(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	node := "skydns-127-0-0-1-" + strconv.Itoa(Port+1) + ".skydns.local."
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("skydns.local.", dns.TypeNS)
+	resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.NS).Ns != node {
+		t.Fatalf("Expected the NS record of %s, got %v", node, resp.Answer)
+	}
+	if len(resp.Extra) != 1 || resp.Extra[0].Header().Name != node || resp.Extra[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Fatalf("Expected glue for %s, got %v", node, resp.Extra)
+	}
+
+	q.SetQuestion(node, dns.TypeA)
+	resp, _, err = c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Fatalf("Expected the address of %s, got %v", node, resp.Answer)
+	}
+
+	q.SetQuestion("skydns-10-9-9-9-8080.skydns.local.", dns.TypeA)
+	resp, _, err = c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected NXDOMAIN for a name of no member, got %v", resp)
+	}
+
+	// A member bound to all addresses isn't published
+	p, _ := ioutil.TempDir("", "skydns-test-")
+	defer os.RemoveAll(p)
+	Port += 10
+	wild := NewServer(nil, "skydns.local", net.JoinHostPort("127.0.0.1", strconv.Itoa(Port)), net.JoinHostPort("0.0.0.0", strconv.Itoa(Port+1)), p, 1*time.Second, 1*time.Second, "", nil)
+	wild.Start()
+	defer wild.Stop()
+	if ns, glue := wild.nameServers(); len(ns) != 0 || len(glue) != 0 {
+		t.Fatalf("Expected no NS records or glue for 0.0.0.0, got %v and %v", ns, glue)
+	}
+	if _, ok := wild.nodeAddress("skydns-0-0-0-0-"+strconv.Itoa(Port+1)+".skydns.local.", dns.TypeA); ok {
+		t.Fatal("Expected no address for a member bound to 0.0.0.0")
+	}
+}
+
+func TestMDNSRecords(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	// The announcements go to sink instead of the multicast group
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	s.mdns = newMDNSResponder(conn, sink.LocalAddr().(*net.UDPAddr))
+	announced := func() *dns.Msg {
+		sink.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 9000)
+		n, err := sink.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	hasTypePTR := func(m *dns.Msg) bool {
+		for _, rr := range m.Answer {
+			if rr.Header().Name == mdnsServices {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, serv := range []msg.Service{
+		{UUID: "801", Name: "Printer", Host: "10.0.0.80", Port: 631},
+		{UUID: "802", Name: "Printer", Host: "10.0.0.81", Port: 631, Zone: "dev.local"},
+		{UUID: "803", Name: "Printer", Host: "10.0.0.82", Port: 631},
+	} {
+		serv := serv
+		s.mdnsEvent(registry.Event{Type: registry.EventAdd, Service: &serv})
+		if serv.Zone == "" {
+			if m := announced(); !hasTypePTR(m) {
+				t.Fatalf("Expected the service type in the announcement, got %v", m)
+			}
+		}
+	}
+
+	answer, extra := s.mdns.lookup("_printer._tcp.local.", dns.TypePTR)
+	if len(answer) != 2 || len(extra) != 6 {
+		t.Fatalf("Expected the PTR records of the instances in the SkyDNS domain, got %v", answer)
+	}
+	answer, extra = s.mdns.lookup("801._printer._tcp.local.", dns.TypeSRV)
+	if len(answer) != 1 || len(extra) != 3 {
+		t.Fatalf("Expected the SRV record of the instance, got %v", answer)
+	}
+	var a *dns.A
+	for _, rr := range extra {
+		if rr, ok := rr.(*dns.A); ok {
+			a = rr
+		}
+	}
+	if srv := answer[0].(*dns.SRV); srv.Port != 631 || srv.Target != "801.local." || a == nil || a.A.String() != "10.0.0.80" {
+		t.Fatalf("Expected the SRV record and address of the instance, got %v %v", answer, extra)
+	}
+	answer, _ = s.mdns.lookup("801._printer._tcp.local.", dns.TypeTXT)
+	if len(answer) != 1 || answer[0].(*dns.TXT).Txt[0] != "uuid=801" {
+		t.Fatalf("Expected the TXT record of the instance, got %v", answer)
+	}
+	if answer, _ = s.mdns.lookup("_scanner._tcp.local.", dns.TypePTR); len(answer) != 0 {
+		t.Fatalf("Expected no records for an unknown type, got %v", answer)
+	}
+	if answer, _ = s.mdns.lookup(mdnsServices, dns.TypePTR); len(answer) != 1 || answer[0].(*dns.PTR).Ptr != "_printer._tcp.local." {
+		t.Fatalf("Expected the service type once, got %v", answer)
+	}
+
+	// The service type stays while an instance is left
+	s.mdnsEvent(registry.Event{Type: registry.EventRemove, Service: &msg.Service{UUID: "801", Name: "Printer"}})
+	if m := announced(); hasTypePTR(m) || len(m.Answer) == 0 || m.Answer[0].Header().Ttl != 0 {
+		t.Fatalf("Expected goodbyes for the instance only, got %v", m)
+	}
+	if answer, _ = s.mdns.lookup("801._printer._tcp.local.", dns.TypeANY); len(answer) != 0 {
+		t.Fatalf("Expected no records for a withdrawn instance, got %v", answer)
+	}
+	if answer, _ = s.mdns.lookup(mdnsServices, dns.TypePTR); len(answer) != 1 {
+		t.Fatalf("Expected the service type of the instance left, got %v", answer)
+	}
+
+	// Stopping says goodbye to the last instance and its type
+	s.stopMDNS()
+	s.mdns = nil
+	if m := announced(); !hasTypePTR(m) || m.Answer[0].Header().Ttl != 0 {
+		t.Fatalf("Expected goodbyes for the last instance and its type, got %v", m)
+	}
+}
+
+func TestMaxAnswers(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	s.SetMaxAnswers(3)
+	for i := 1; i <= 5; i++ {
+		s.registry.Add(msg.Service{UUID: "60" + strconv.Itoa(i), Name: "WideService", Version: "1.0.0", Region: "Test", Environment: "Production",
+			Host: "10.0.0." + strconv.Itoa(i), Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+	}
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("wideservice.production.skydns.local.", dns.TypeSRV)
+	resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 3 || len(resp.Extra) != 3 {
+		t.Fatalf("Expected 3 SRV records and their glue, got %v and %v", resp.Answer, resp.Extra)
+	}
+	for _, rr := range resp.Extra {
+		found := false
+		for _, a := range resp.Answer {
+			found = found || a.(*dns.SRV).Target == rr.Header().Name
+		}
+		if !found {
+			t.Fatalf("Glue %v should belong to an SRV record in the answer", rr)
+		}
+	}
+
+	q.SetEdns0(4096, false)
+	o := q.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: EDNS0MaxAnswers, Data: []byte{0, 2}})
+	s.SetGlue(false)
+	resp, _, err = c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 2 {
+		t.Fatalf("Expected the 2 SRV records the client asked for, got %v", resp.Answer)
+	}
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			t.Fatalf("Expected no glue, got %v", rr)
+		}
+	}
+
+	// Services in the region asked for have priority 10, the others 20: the
+	// limit takes the whole first tier before anything of the second
+	for i, region := range []string{"Test", "Test", "Other", "Other", "Other"} {
+		s.registry.Add(msg.Service{UUID: "61" + strconv.Itoa(i), Name: "TierService", Version: "1.0.0", Region: region, Environment: "Production",
+			Host: "10.0.1." + strconv.Itoa(i), Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+	}
+	for _, tc := range []struct{ max, first, second int }{{1, 1, 0}, {2, 2, 0}, {3, 2, 1}} {
+		q := new(dns.Msg)
+		q.SetQuestion("test.*.tierservice.production.skydns.local.", dns.TypeSRV)
+		q.SetEdns0(4096, false)
+		o := q.IsEdns0()
+		o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: EDNS0MaxAnswers, Data: []byte{0, byte(tc.max)}})
+		resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, second := 0, 0
+		for _, rr := range resp.Answer {
+			switch rr.(*dns.SRV).Priority {
+			case 10:
+				first++
+			case 20:
+				second++
+			}
+		}
+		if first != tc.first || second != tc.second {
+			t.Fatalf("Limit %d: expected %d records of priority 10 and %d of 20, got %v", tc.max, tc.first, tc.second, resp.Answer)
+		}
+	}
+
+	// Within a priority the weight decides, a weight of 0 is drawn only
+	// when the running sum is 0
+	heavy := 0
+	for i := 0; i < 100; i++ {
+		picked := pickAnswers([]candidate{{i: 0, priority: 10, weight: 0}, {i: 1, priority: 10, weight: 100}, {i: 2, priority: 20, weight: 100}}, 1)
+		if len(picked) != 1 || picked[0] == 2 {
+			t.Fatalf("Expected one record of priority 10, got %v", picked)
+		}
+		if picked[0] == 1 {
+			heavy++
+		}
+	}
+	if heavy < 80 {
+		t.Fatalf("Expected the record with weight 100 most of the time, got it %d times out of 100", heavy)
+	}
+
+	// Without weights any subset can come back
+	subsets := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		picked := pickAnswers([]candidate{{i: 0, priority: 10}, {i: 1, priority: 10}, {i: 2, priority: 10}, {i: 3, priority: 10}}, 2)
+		if len(picked) != 2 {
+			t.Fatalf("Expected two records, got %v", picked)
+		}
+		sort.Ints(picked)
+		subsets[fmt.Sprint(picked)] = true
+	}
+	if len(subsets) < 2 {
+		t.Fatalf("Expected different records with weight 0 to be picked, got only %v", subsets)
+	}
+}
+
+func TestDNSForward(t *testing.T) {
+	s := newTestServer("", "", "8.8.8.8:53")
+	defer s.Stop()
+
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	resp, _, err := c.Exchange(m, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) == 0 || resp.Rcode != dns.RcodeSuccess {
+		t.Fatal("Answer expected to have A records or rcode not equal to RcodeSuccess")
+	}
+	// TCP
+	c.Net = "tcp"
+	resp, _, err = c.Exchange(m, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) == 0 || resp.Rcode != dns.RcodeSuccess {
+		t.Fatal("Answer expected to have A records or rcode not equal to RcodeSuccess")
+	}
+	// TODO(miek): DNSSEC DO query
+}
+
+func TestDNSReverse(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	m := msg.Service{
+		UUID:        "123",
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Host:        "10.0.0.1",
+		Environment: "Production",
+		Port:        9000,
+		TTL:         30,
+		Expires:     getExpirationTime(30),
+	}
+	s.registry.Add(m)
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatal("Answer expected to have 1 PTR record but has", len(resp.Answer))
+	}
+	ptr, ok := resp.Answer[0].(*dns.PTR)
+	if !ok {
+		t.Fatal("Answer should be a PTR record")
+	}
+	if ptr.Ptr != "123.10-0-0-1.test.1-0-0.testservice.production.skydns.local." {
+		t.Fatalf("PTR record points to %q", ptr.Ptr)
+	}
+}
+
+func TestDNSAlias(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	m := msg.Service{
+		UUID:        "123",
+		Name:        "Postgres-Primary",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Host:        "10.0.0.1",
+		Environment: "Production",
+		Port:        5432,
+		TTL:         30,
+		Expires:     getExpirationTime(30),
+	}
+	s.registry.Add(m)
+
+	req, _ := http.NewRequest("PUT", "/skydns/aliases/db.production", bytes.NewBufferString(`{"Target":"postgres-primary.production","TTL":60}`))
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusCreated {
+		t.Fatal("Failed to add alias", resp.Code)
+	}
+
+	c := new(dns.Client)
+	for _, qtype := range []uint16{dns.TypeSRV, dns.TypeA} {
+		q := new(dns.Msg)
+		q.SetQuestion("db.production.skydns.local.", qtype)
+		r, _, err := c.Exchange(q, "localhost:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 2 {
+			t.Fatalf("Answer expected to have a CNAME and its target, has %d records", len(r.Answer))
+		}
+		cname, ok := r.Answer[0].(*dns.CNAME)
+		if !ok || cname.Target != "postgres-primary.production.skydns.local." || cname.Hdr.Ttl != 60 {
+			t.Fatalf("Answer should start with the CNAME record, got %s", r.Answer[0])
+		}
+		if r.Answer[1].Header().Name != cname.Target || r.Answer[1].Header().Rrtype != qtype {
+			t.Fatalf("Answer should contain the record of the target, got %s", r.Answer[1])
+		}
+	}
+
+	req, _ = http.NewRequest("DELETE", "/skydns/aliases/db.production", nil)
+	resp = httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	if _, err := s.registry.GetAlias("db.production"); err == nil {
+		t.Fatal("Failed to remove alias")
+	}
+}
+
+func TestDNSRewrite(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	for _, m := range services[:2] {
+		s.registry.Add(m)
+	}
+
+	f, _ := ioutil.TempFile("", "skydns-rewrite-")
+	defer os.Remove(f.Name())
+	f.WriteString("# legacy names\n^db\\.legacy\\.local\\.$ testservice.production\n")
+	f.Close()
+	if err := s.EnableRewrite(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("db.legacy.local.", dns.TypeSRV)
+	resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "db.legacy.local." {
+		t.Fatalf("Answer expected to have 1 SRV record for db.legacy.local., got %v", resp.Answer)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("^db\\.legacy\\.local\\.$ testservice.development\n"), 0644)
+	if err := s.ReloadRewrite(); err != nil {
+		t.Fatal(err)
+	}
+	resp, _, err = c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.SRV).Port != 9000 {
+		t.Fatalf("Answer expected to have the SRV record of the development service, got %v", resp.Answer)
+	}
+}
+
+func TestDNSTemplate(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	for i, m := range services[:3] {
+		if i == 1 {
+			m.Labels = map[string]string{"role": "primary"}
+		}
+		s.registry.Add(m)
+	}
+
+	f, _ := ioutil.TempFile("", "skydns-templates-")
+	defer os.Remove(f.Name())
+	f.WriteString("leader.testservice SRV testservice.* role=primary\ncount.production TXT production\n")
+	f.Close()
+	if err := s.EnableTemplates(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("leader.testservice.skydns.local.", dns.TypeSRV)
+	resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.SRV).Port != 9001 {
+		t.Fatalf("Answer expected to have the SRV record of the primary, got %v", resp.Answer)
+	}
+
+	q.SetQuestion("count.production.skydns.local.", dns.TypeTXT)
+	resp, _, err = c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.TXT).Txt[0] != "2" {
+		t.Fatalf("Answer expected to have a TXT record with the count 2, got %v", resp.Answer)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte(`count.production TXT production role=primary "{{range .}}{{.Host}}{{end}}"`+"\n"), 0644)
+	if err := s.ReloadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	resp, _, err = c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.TXT).Txt[0] != "server2" {
+		t.Fatalf("Answer expected to have a TXT record with the host server2, got %v", resp.Answer)
+	}
+
+	// Output longer than a TXT string is split in strings of at most 255 bytes
+	var hosts string
+	for i := 0; i < 20; i++ {
+		host := fmt.Sprintf("server%014d", i)
+		hosts += host
+		s.registry.Add(msg.Service{UUID: "wide" + strconv.Itoa(i), Name: "WideService", Version: "1.0.0", Region: "Test",
+			Environment: "Wide", Host: host, Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+	}
+	ioutil.WriteFile(f.Name(), []byte(`hosts.wide TXT wideservice.wide "{{range .}}{{.Host}}{{end}}"`+"\n"), 0644)
+	if err := s.ReloadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	q.SetQuestion("hosts.wide.skydns.local.", dns.TypeTXT)
+	resp, _, err = c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Answer expected to have a TXT record, got %v", resp.Answer)
+	}
+	txt := resp.Answer[0].(*dns.TXT).Txt
+	if len(txt) != 2 || len(txt[0]) != 255 || len(strings.Join(txt, "")) != len(hosts) {
+		t.Fatalf("TXT record expected to hold the %d bytes of the hosts in 2 strings, got %q", len(hosts), txt)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	s.EnableRateLimit(0.001, 2, 24, 56, 2)
+
+	c := new(dns.Client)
+	c.ReadTimeout = 200 * time.Millisecond
+	q := new(dns.Msg)
+	q.SetQuestion("testservice.production.skydns.local.", dns.TypeSRV)
+
+	// The burst is answered, then every second query slips
+	for i := 0; i < 2; i++ {
+		if resp, _, err := c.Exchange(q, "127.0.0.1:"+StrPort); err != nil || resp.Truncated {
+			t.Fatalf("Query %d should be answered: %v", i, err)
+		}
+	}
+	if _, _, err := c.Exchange(q, "127.0.0.1:"+StrPort); err == nil {
+		t.Fatal("Query over the rate limit should be dropped")
+	}
+	if resp, _, err := c.Exchange(q, "127.0.0.1:"+StrPort); err != nil || !resp.Truncated {
+		t.Fatal("Query over the rate limit should slip with a truncated reply", err)
+	}
+
+	// Other subnets have their own bucket
+	if ok, _ := s.rateLimit.allow(net.ParseIP("10.0.1.1")); !ok {
+		t.Fatal("Query from another subnet should be allowed")
+	}
+	if ok, _ := s.rateLimit.allow(net.ParseIP("127.0.0.2")); ok {
+		t.Fatal("Query from the same subnet should be limited")
+	}
+}
+
+func TestRateLimitBuckets(t *testing.T) {
+	s := new(Server)
+	s.EnableRateLimit(0.001, 2, 32, 128, 0)
+	r := s.rateLimit
+	ip := func(i int) net.IP { return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)) }
+
+	// Past maxBuckets the least recently seen client is forgotten
+	for i := 0; i < maxBuckets+10; i++ {
+		r.allow(ip(i))
+	}
+	r.allow(ip(10))
+	r.allow(ip(maxBuckets + 10))
+	if len(r.buckets) != maxBuckets || r.recent.Len() != maxBuckets {
+		t.Fatalf("Expected %d clients, got %d", maxBuckets, len(r.buckets))
+	}
+	if _, ok := r.buckets[r.key(ip(11))]; ok {
+		t.Fatal("Least recently seen client should be forgotten")
+	}
+	if _, ok := r.buckets[r.key(ip(10))]; !ok {
+		t.Fatal("Recently seen client should be kept")
+	}
+
+	// Quiet clients are forgotten a few at a time
+	s.EnableRateLimit(1000, 2, 32, 128, 0)
+	r = s.rateLimit
+	for i := 0; i < 10; i++ {
+		r.allow(ip(i))
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 10/pruneBuckets; i++ {
+		r.allow(ip(100))
+	}
+	if len(r.buckets) != 1 {
+		t.Fatalf("Quiet clients should be forgotten, %d clients left", len(r.buckets))
+	}
+}
+
+func TestACL(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	f, _ := ioutil.TempFile("", "skydns-acl-")
+	defer os.Remove(f.Name())
+	f.WriteString("query allow 10.0.0.0/8\napi allow 10.1.0.0/24\napi deny 10.1.0.66\n")
+	f.Close()
+	if err := s.EnableACL(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("testservice.production.skydns.local.", dns.TypeSRV)
+	resp, _, err := c.Exchange(q, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
 	}
-	b, err = json.Marshal(c)
+	if resp.Rcode != dns.RcodeRefused {
+		t.Fatal("Query from a client not in the ACL should be refused")
+	}
+
+	for addr, code := range map[string]int{"10.1.0.5:1234": http.StatusOK, "10.1.0.66:1234": http.StatusForbidden, "10.2.0.5:1234": http.StatusForbidden} {
+		req, _ := http.NewRequest("GET", "/skydns/regions/", nil)
+		req.RemoteAddr = addr
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		if resp.Code != code {
+			t.Errorf("API request from %s should return %d, got %d", addr, code, resp.Code)
+		}
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("query allow 127.0.0.1\n"), 0644)
+	if err := s.ReloadACL(); err != nil {
+		t.Fatal(err)
+	}
+	resp, _, err = c.Exchange(q, "127.0.0.1:"+StrPort)
 	if err != nil {
 		t.Fatal(err)
 	}
-	req, _ = http.NewRequest("PUT", "/skydns/callbacks/101", bytes.NewBuffer(b))
-	resp = httptest.NewRecorder()
+	if resp.Rcode == dns.RcodeRefused {
+		t.Fatal("Query from a client allowed after the reload should not be refused")
+	}
+}
 
-	s.router.ServeHTTP(resp, req)
-	if resp.Code != http.StatusNotFound {
-		t.Fatal("Callback should result in service not found.")
+func TestUpstreams(t *testing.T) {
+	u := newUpstreams([]string{"a", "b", "c"})
+	u.observe("a", 50*time.Millisecond, true)
+	u.observe("b", 10*time.Millisecond, true)
+	u.observe("c", 1*time.Millisecond, true)
+	for i := 0; i < DefaultUpstreamFailures; i++ {
+		u.observe("c", 0, false)
+	}
+	if order := u.order(); strings.Join(order, ",") != "b,a,c" {
+		t.Fatal("Expected the fastest first and the failed nameserver last, got", order)
+	}
+
+	u.observe("c", 1*time.Millisecond, true)
+	if order := u.order(); order[2] == "c" {
+		t.Fatal("Recovered nameserver should no longer be last, got", order)
 	}
 }
 
-var services = []msg.Service{
-	{
-		UUID:        "100",
-		Name:        "TestService",
-		Version:     "1.0.0",
-		Region:      "Region1",
-		Host:        "server1",
-		Environment: "Development",
-		Port:        9000,
-		TTL:         30,
-		Expires:     getExpirationTime(30),
-	},
-	{
-		UUID:        "101",
-		Name:        "TestService",
-		Version:     "1.0.1",
-		Region:      "Region1",
-		Host:        "server2",
-		Environment: "Production",
-		Port:        9001,
-		TTL:         31,
-		Expires:     getExpirationTime(31),
-	},
-	{
-		UUID:        "102",
-		Name:        "OtherService",
-		Version:     "1.0.0",
-		Region:      "Region2",
-		Host:        "server3",
-		Environment: "Production",
-		Port:        9002,
-		TTL:         32,
-		Expires:     getExpirationTime(32),
-	},
-	{
-		UUID:        "103",
-		Name:        "TestService",
-		Version:     "1.0.1",
-		Region:      "Region1",
-		Host:        "server4",
-		Environment: "Development",
-		Port:        9003,
-		TTL:         33,
-		Expires:     getExpirationTime(33),
-	},
-	{
-		UUID:        "104",
-		Name:        "TestService",
-		Version:     "1.0.0",
-		Region:      "Region3",
-		Host:        "server5",
-		Environment: "Production",
-		Port:        9004,
-		TTL:         34,
-		Expires:     getExpirationTime(34),
-	},
-	{
-		UUID:        "105",
-		Name:        "TestService",
-		Version:     "1.0.0",
-		Region:      "Region3",
-		Host:        "server6",
-		Environment: "Production",
-		Port:        9005,
-		TTL:         35,
-		Expires:     getExpirationTime(35),
-	},
-	{
-		UUID:        "106",
-		Name:        "OtherService",
-		Version:     "1.0.0",
-		Region:      "Region2",
-		Host:        "server7",
-		Environment: "Production",
-		Port:        9006,
-		TTL:         36,
-		Expires:     getExpirationTime(36),
-	},
+func TestDNSForwardFailover(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.0.0.1")}}
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	// Nothing listens on the first nameserver
+	dead, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+
+	s := newTestServer("", "", deadAddr)
+	defer s.Stop()
+	s.upstreams = newUpstreams([]string{deadAddr, pc.LocalAddr().String()})
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Query should have been answered by the live nameserver, got %v", resp)
+	}
+	if order := s.upstreams.order(); order[0] != pc.LocalAddr().String() {
+		t.Fatal("Live nameserver should be tried first after the failure, got", order)
+	}
 }
 
-type dnsTestCase struct {
-	Question string
-	Answer   []dns.SRV
+func TestTokens(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	f, _ := ioutil.TempFile("", "skydns-tokens-")
+	defer os.Remove(f.Name())
+	f.WriteString("# name secret environments\nstaging s1 staging,development\nadmin s2 *\n")
+	f.Close()
+	if err := s.EnableTokens(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Now().UTC().Format(http.TimeFormat)
+	body := `{"Name":"TestService","Version":"1.0.0","Environment":"Production","Region":"Test","Host":"server1","Port":9000,"TTL":30}`
+	sign := func(key string) string {
+		return msg.Signature(key, "PUT", "/skydns/services/3", date, []byte(body))
+	}
+	callback := `{"Name":"TestService","Version":"1.0.0","Environment":"Production","Region":"Test","Reply":"localhost","Port":9650}`
+
+	for i, tc := range []struct {
+		method, path, body, auth string
+		code                     int
+	}{
+		{"GET", "/skydns/regions/", "", "", http.StatusForbidden},
+		{"GET", "/skydns/regions/", "", "Bearer s1", http.StatusOK},
+		{"PUT", "/skydns/services/1", strings.Replace(body, "Production", "Staging", 1), "Bearer s1", http.StatusCreated},
+		{"PUT", "/skydns/services/2", body, "Bearer s1", http.StatusForbidden},
+		{"PUT", "/skydns/services/3", body, "HMAC admin:" + sign("s1"), http.StatusForbidden},
+		{"PUT", "/skydns/services/3", body, "HMAC admin:" + sign("s2"), http.StatusCreated},
+		{"DELETE", "/skydns/services/3", "", "Bearer s1", http.StatusForbidden},
+		{"PUT", "/skydns/callbacks/4", callback, "Bearer s1", http.StatusForbidden},
+		{"PUT", "/skydns/callbacks/4", strings.Replace(callback, "Production", "Staging", 1), "Bearer s1", http.StatusCreated},
+		{"PUT", "/skydns/callbacks/4", strings.Replace(callback, "Production", "Development", 1), "Bearer s1", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Date", date)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		resp := httptest.NewRecorder()
+		s.router.ServeHTTP(resp, req)
+		if resp.Code != tc.code {
+			t.Errorf("Request %d: %s %s should return %d, got %d", i, tc.method, tc.path, tc.code, resp.Code)
+		}
+	}
+	if _, err := s.registry.GetUUID("3"); err != nil {
+		t.Fatal("Service 3 should not have been removed")
+	}
 }
 
-var dnsTestCases = []dnsTestCase{
-	// Generic Test
-	{
-		Question: "testservice.production.skydns.local.",
-		Answer: []dns.SRV{
-			{
-				Hdr: dns.RR_Header{
-					Name:   "testservice.production.skydns.local.",
-					Ttl:    30,
-					Rrtype: dns.TypeSRV,
-				},
-				Priority: 10,
-				Weight:   33,
-				Target:   "server2.",
-				Port:     9001,
-			},
-			{
-				Hdr: dns.RR_Header{
-					Name:   "testservice.production.skydns.local.",
-					Ttl:    33,
-					Rrtype: dns.TypeSRV,
-				},
-				Priority: 10,
-				Weight:   33,
-				Target:   "server5.",
-				Port:     9004,
-			},
-			{
-				Hdr: dns.RR_Header{
-					Name:   "testservice.production.skydns.local.",
-					Ttl:    34,
-					Rrtype: dns.TypeSRV,
-				},
-				Priority: 10,
-				Weight:   33,
-				Target:   "server6.",
-				Port:     9005,
-			},
-		},
-	},
+func TestFit(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("testservice.production.skydns.local.", dns.TypeSRV)
+	// Backups first, so keeping the first answers would hide the primaries
+	for i := 0; i < 40; i++ {
+		priority := uint16(20)
+		if i >= 30 {
+			priority = 10
+		}
+		target := "server" + strconv.Itoa(i) + ".skydns.local."
+		m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 30}, Priority: priority, Weight: 10, Port: 9000, Target: target})
+		m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30}, A: net.ParseIP("10.0.0.1")})
+	}
 
-	// Region Priority Test
-	{
-		Question: "region1.*.testservice.production.skydns.local.",
-		Answer: []dns.SRV{
-			{
-				Hdr: dns.RR_Header{
-					Name:   "region1.*.testservice.production.skydns.local.",
-					Ttl:    30,
-					Rrtype: dns.TypeSRV,
-				},
-				Priority: 10,
-				Weight:   100,
-				Target:   "server2.",
-				Port:     9001,
-			},
-			{
-				Hdr: dns.RR_Header{
-					Name:   "region1.*.testservice.production.skydns.local.",
-					Ttl:    33,
-					Rrtype: dns.TypeSRV,
-				},
-				Priority: 20,
-				Weight:   50,
-				Target:   "server5.",
-				Port:     9004,
-			},
-			{
-				Hdr: dns.RR_Header{
-					Name:   "region1.*.testservice.production.skydns.local.",
-					Ttl:    34,
-					Rrtype: dns.TypeSRV,
-				},
-				Priority: 20,
-				Weight:   50,
-				Target:   "server6.",
-				Port:     9005,
-			},
-		},
-	},
+	fit(m, dns.MinMsgSize)
+	if m.Len() > dns.MinMsgSize {
+		t.Fatalf("Reply should fit in %d bytes, is %d", dns.MinMsgSize, m.Len())
+	}
+	if !m.Truncated || len(m.Extra) != 0 {
+		t.Fatal("Reply should be truncated, without additional section")
+	}
+	for i, rr := range m.Answer {
+		if rr.(*dns.SRV).Priority != 10 {
+			t.Fatalf("Answer %d should be a primary, the primaries fit", i)
+		}
+	}
+}
+
+func TestChurnHint(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	s.EnableChurnHints(100)
+	s.registry.Add(services[1])
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("testservice.production.skydns.local.", dns.TypeSRV)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: EDNS0Churn})
+
+	hint := func() byte {
+		resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opt := resp.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == EDNS0Churn && len(l.Data) == 1 {
+					return l.Data[0]
+				}
+			}
+		}
+		t.Fatal("Reply should carry the churn hint")
+		return 0
+	}
+
+	if h := hint(); h != 0 {
+		t.Fatalf("Stable answer should have a hint of 0, got %d", h)
+	}
+	// The answer changes every query
+	for i := 0; i < 3; i++ {
+		m := services[1]
+		m.UUID = strconv.Itoa(300 + i)
+		m.Host = "churn" + m.UUID
+		s.registry.Add(m)
+		hint()
+	}
+	if h := hint(); h == 0 {
+		t.Fatal("Changing answer should have a hint above 0")
+	}
+}
+
+func TestReverseIP(t *testing.T) {
+	tests := map[string]string{
+		"1.0.0.10.in-addr.arpa.": "10.0.0.1",
+		"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.": "4321:0:1:2:3:4:567:89ab",
+		"0.0.10.in-addr.arpa.": "",
+		"www.example.com.":     "",
+	}
+	for name, expected := range tests {
+		ip := reverseIP(name)
+		if expected == "" {
+			if ip != nil {
+				t.Errorf("%q should not be a reverse name, got %s", name, ip)
+			}
+			continue
+		}
+		if ip == nil || ip.String() != expected {
+			t.Errorf("%q should be %s, got %s", name, expected, ip)
+		}
+	}
 }
 
-type servicesTest struct {
-	query string
-	count int
+func TestDNSIPv6(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	m := msg.Service{
+		UUID:        "123",
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Host:        "10.0.0.1",
+		Host6:       "2001:db8::1",
+		Environment: "Production",
+		Port:        9000,
+		TTL:         30,
+		Expires:     getExpirationTime(30),
+	}
+	s.registry.Add(m)
+
+	c := new(dns.Client)
+	q := new(dns.Msg)
+	q.SetQuestion("testservice.production.skydns.local.", dns.TypeAAAA)
+	resp, _, err := c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatal("Answer expected to have 1 AAAA record but has", len(resp.Answer))
+	}
+	if aaaa, ok := resp.Answer[0].(*dns.AAAA); !ok || aaaa.AAAA.String() != "2001:db8::1" {
+		t.Fatal("Answer should be the AAAA record of the service")
+	}
+
+	q.SetQuestion("testservice.production.skydns.local.", dns.TypeSRV)
+	resp, _, err = c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || len(resp.Extra) != 2 {
+		t.Fatalf("Answer expected to have 1 SRV record and 2 additional records but has %d and %d", len(resp.Answer), len(resp.Extra))
+	}
+	if resp.Answer[0].(*dns.SRV).Target != "123.skydns.local." {
+		t.Fatal("SRV record should target the UUID of the service")
+	}
+
+	// The target of the SRV record resolves as well.
+	q.SetQuestion("123.skydns.local.", dns.TypeAAAA)
+	resp, _, err = c.Exchange(q, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatal("Answer expected to have 1 AAAA record but has", len(resp.Answer))
+	}
 }
 
-var serviceTestArray []servicesTest = []servicesTest{
-	{"*", 7},
-	{"production", 5},
-	{"testservice.production", 3},
-	{"region1.*.*.production", 1},
-	{"region1.*.testservice.production", 1},
+func TestHost6Failure(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	m := msg.Service{
+		Name:        "TestService",
+		Version:     "1.0.0",
+		Region:      "Test",
+		Host:        "localhost",
+		Host6:       "2001:db8::1",
+		Environment: "Production",
+		Port:        9000,
+		TTL:         4,
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PUT", "/skydns/services/123", bytes.NewBuffer(b))
+	resp := httptest.NewRecorder()
+
+	s.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatal("Failed to detect Host6 without IPv4 Host.")
+	}
 }
 
-func TestGetServicesWithQueries(t *testing.T) {
+func TestDoH(t *testing.T) {
 	s := newTestServer("", "", "")
 	defer s.Stop()
 
-	for _, m := range services {
+	for _, m := range services[:2] {
 		s.registry.Add(m)
 	}
 
-	for _, st := range serviceTestArray {
-		req, _ := http.NewRequest("GET", "/skydns/services/?query="+st.query, nil)
+	m := new(dns.Msg)
+	m.SetQuestion("testservice.production.skydns.local.", dns.TypeSRV)
+	buf, _ := m.Pack()
+
+	get, _ := http.NewRequest("GET", DoHPath+"?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	post, _ := http.NewRequest("POST", DoHPath, bytes.NewReader(buf))
+	post.Header.Set("Content-Type", "application/dns-message")
+
+	for _, req := range []*http.Request{get, post} {
+		req.RemoteAddr = "127.0.0.1:5353"
 		resp := httptest.NewRecorder()
-		s.router.ServeHTTP(resp, req)
+		s.dohHTTPHandler(resp, req)
 		if resp.Code != http.StatusOK {
-			t.Fatal("Failed To Retrieve Services")
+			t.Fatalf("%s should return %d, got %d", req.Method, http.StatusOK, resp.Code)
 		}
-		var returnedServices []msg.Service
-		err := json.Unmarshal(resp.Body.Bytes(), &returnedServices)
-		if err != nil {
-			t.Fatal("Failed to unmarshal response from server")
+		if ct := resp.Header().Get("Content-Type"); ct != "application/dns-message" {
+			t.Fatalf("%s should return content type application/dns-message, got %q", req.Method, ct)
 		}
-		if len(returnedServices) != st.count {
-			t.Fatal("Expected ", st.count, " got %d services", len(returnedServices))
+		r := new(dns.Msg)
+		if err := r.Unpack(resp.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != m.Id || len(r.Answer) != 1 {
+			t.Fatalf("%s should return 1 answer, got %d", req.Method, len(r.Answer))
 		}
-
 	}
 
+	req, _ := http.NewRequest("GET", DoHPath+"?dns=invalid", nil)
+	resp := httptest.NewRecorder()
+	s.dohHTTPHandler(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid query should return %d, got %d", http.StatusBadRequest, resp.Code)
+	}
 }
 
-func TestDNS(t *testing.T) {
+func TestDNSTransfer(t *testing.T) {
 	s := newTestServer("", "", "")
 	defer s.Stop()
 
-	for _, m := range services {
+	for _, m := range services[:2] {
 		s.registry.Add(m)
 	}
+
+	m := new(dns.Msg)
+	m.SetAxfr("skydns.local.")
 	c := new(dns.Client)
-	for _, tc := range dnsTestCases {
-		m := new(dns.Msg)
-		m.SetQuestion(tc.Question, dns.TypeSRV)
-		resp, _, err := c.Exchange(m, "localhost:"+StrPort)
+	c.Net = "tcp"
+	resp, _, err := c.Exchange(m, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeRefused {
+		t.Fatal("Zone transfer should be refused when not enabled")
+	}
 
-		if err != nil {
-			t.Fatal(err)
+	if err := s.EnableTransfer("127.0.0.1", true); err != nil {
+		t.Fatal(err)
+	}
+	tr := new(dns.Transfer)
+	env, err := tr.In(m, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			t.Fatal(e.Error)
 		}
+		records = append(records, e.RR...)
+	}
+	// SOA, NS and A for the node, A for master and 2 SRV records, SOA
+	if len(records) != 7 {
+		t.Fatalf("Zone should have 7 records, has %d", len(records))
+	}
+	if soa, ok := records[0].(*dns.SOA); !ok || soa.Serial != 2 {
+		t.Fatal("Zone should start with the SOA record with serial 2")
+	}
 
-		if len(resp.Answer) != len(tc.Answer) {
-			t.Fatalf("Response for %q contained %d results, %d expected", tc.Question, len(resp.Answer), len(tc.Answer))
+	s.registry.Add(services[2])
+	m.SetIxfr("skydns.local.", 2, "master.skydns.local.", "hostmaster.skydns.local.")
+	tr = new(dns.Transfer)
+	env, err = tr.In(m, "127.0.0.1:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records = nil
+	for e := range env {
+		if e.Error != nil {
+			t.Fatal(e.Error)
 		}
+		records = append(records, e.RR...)
+	}
+	// SOA 3, SOA 2, SOA 3, SRV, SOA 3
+	if len(records) != 5 {
+		t.Fatalf("Incremental transfer should have 5 records, has %d", len(records))
+	}
+	if srv, ok := records[3].(*dns.SRV); !ok || srv.Target != "server3." {
+		t.Fatal("Incremental transfer should add the new service")
+	}
 
-		for i, a := range resp.Answer {
-			srv := a.(*dns.SRV)
-
-			// Validate Header
-			if srv.Hdr.Name != tc.Answer[i].Hdr.Name {
-				t.Errorf("Answer %d should have a Header Name of %q, but has %q", i, tc.Answer[i].Hdr.Name, srv.Hdr.Name)
-			}
-
-			if srv.Hdr.Ttl != tc.Answer[i].Hdr.Ttl {
-				t.Errorf("Answer %d should have a Header TTL of %d, but has %d", i, tc.Answer[i].Hdr.Ttl, srv.Hdr.Ttl)
-			}
-
-			if srv.Hdr.Rrtype != tc.Answer[i].Hdr.Rrtype {
-				t.Errorf("Answer %d should have a Header Response Type of %d, but has %d", i, tc.Answer[i].Hdr.Rrtype, srv.Hdr.Rrtype)
-			}
-
-			// Validate Record
-			if srv.Priority != tc.Answer[i].Priority {
-				t.Errorf("Answer %d should have a Priority of %d, but has %d", i, tc.Answer[i].Priority, srv.Priority)
+	transfer := func(m *dns.Msg) []dns.RR {
+		env, err := new(dns.Transfer).In(m, "127.0.0.1:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []dns.RR
+		for e := range env {
+			if e.Error != nil {
+				t.Fatal(e.Error)
 			}
+			records = append(records, e.RR...)
+		}
+		return records
+	}
 
-			if srv.Weight != tc.Answer[i].Weight {
-				t.Errorf("Answer %d should have a Weight of %d, but has %d", i, tc.Answer[i].Weight, srv.Weight)
-			}
+	// Draining takes the service out of the zone, and bumps the serial
+	s.registry.SetDrained(services[2].UUID, true)
+	m.SetIxfr("skydns.local.", 3, "master.skydns.local.", "hostmaster.skydns.local.")
+	records = transfer(m)
+	// SOA 4, SOA 3, SRV, SOA 4, SOA 4
+	if len(records) != 5 {
+		t.Fatalf("Incremental transfer should have 5 records, has %d", len(records))
+	}
+	if srv, ok := records[2].(*dns.SRV); !ok || srv.Target != "server3." {
+		t.Fatal("Incremental transfer should remove the drained service")
+	}
+	m.SetAxfr("skydns.local.")
+	if records = transfer(m); len(records) != 7 {
+		t.Fatalf("Zone should have 7 records without the drained service, has %d", len(records))
+	}
 
-			if srv.Port != tc.Answer[i].Port {
-				t.Errorf("Answer %d should have a Port of %d, but has %d", i, tc.Answer[i].Port, srv.Port)
-			}
+	// Draining it again changes nothing, putting it back adds it again
+	s.registry.SetDrained(services[2].UUID, true)
+	s.registry.SetDrained(services[2].UUID, false)
+	m.SetIxfr("skydns.local.", 4, "master.skydns.local.", "hostmaster.skydns.local.")
+	records = transfer(m)
+	if soa, ok := records[0].(*dns.SOA); !ok || soa.Serial != 5 || len(records) != 5 {
+		t.Fatalf("Incremental transfer should bring the zone to serial 5 in 5 records, got %v", records)
+	}
+	if srv, ok := records[3].(*dns.SRV); !ok || srv.Target != "server3." {
+		t.Fatal("Incremental transfer should add the service that was put back")
+	}
 
-			if srv.Target != tc.Answer[i].Target {
-				t.Errorf("Answer %d should have a Target of %q, but has %q", i, tc.Answer[i].Target, srv.Target)
-			}
-		}
+	// A failing health check takes it out as well, unless it is out already
+	s.registry.SetHealth(services[2].UUID, false)
+	m.SetAxfr("skydns.local.")
+	if records = transfer(m); len(records) != 7 {
+		t.Fatalf("Zone should have 7 records without the unhealthy service, has %d", len(records))
+	}
+	if soa := records[0].(*dns.SOA); soa.Serial != 6 {
+		t.Fatalf("Health check failure should bump the serial to 6, got %d", soa.Serial)
+	}
+	s.registry.SetDrained(services[2].UUID, true)
+	s.registry.SetHealth(services[2].UUID, true)
+	if serial := s.registry.Serial(); serial != 6 {
+		t.Fatalf("Changes of a service out of rotation should keep the serial at 6, got %d", serial)
+	}
+	m.SetIxfr("skydns.local.", 5, "master.skydns.local.", "hostmaster.skydns.local.")
+	records = transfer(m)
+	// SOA 6, SOA 5, SRV, SOA 6, SOA 6
+	if srv, ok := records[2].(*dns.SRV); !ok || srv.Target != "server3." || len(records) != 5 {
+		t.Fatalf("Incremental transfer should remove the unhealthy service, got %v", records)
 	}
 }
 
-func TestDNSARecords(t *testing.T) {
+func TestDNSDebug(t *testing.T) {
 	s := newTestServer("", "", "")
 	defer s.Stop()
 
+	if err := s.EnableDebug("127.0.0.1", 1*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
 	c := new(dns.Client)
 	m := new(dns.Msg)
 	m.SetQuestion("skydns.local.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	o := m.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: EDNS0Debug, Data: []byte{0, 0, 0x0e, 0x10}}) // 3600s
 	resp, _, err := c.Exchange(m, "localhost:"+StrPort)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(resp.Answer) != 1 {
-		t.Fatal("Answer expected to have 2 A records but has", len(resp.Answer))
+
+	o = resp.IsEdns0()
+	if o == nil {
+		t.Fatal("Reply should have an OPT record")
+	}
+	l, ok := o.Option[len(o.Option)-1].(*dns.EDNS0_LOCAL)
+	if !ok || l.Code != EDNS0Debug {
+		t.Fatal("Reply should carry the debug option")
+	}
+	// The requested 3600s should be capped to the window of 60s.
+	if !bytes.Equal(l.Data, []byte{0, 0, 0, 60}) {
+		t.Fatalf("Debug option should grant 60s, got %v", l.Data)
+	}
+	if !s.debug.enabled(net.ParseIP("127.0.0.1")) {
+		t.Fatal("Verbose logging should be enabled for 127.0.0.1")
+	}
+	if s.debug.enabled(net.ParseIP("127.0.0.2")) {
+		t.Fatal("Verbose logging should not be enabled for 127.0.0.2")
 	}
 }
 
-func TestDNSForward(t *testing.T) {
-	s := newTestServer("", "", "8.8.8.8:53")
+func TestDNSNegative(t *testing.T) {
+	s := newTestServer("", "", "")
 	defer s.Stop()
 
+	s.SetMinTTL(30)
+	s.EnableNegativeCache(10, 1*time.Minute)
+
 	c := new(dns.Client)
 	m := new(dns.Msg)
-	m.SetQuestion("www.example.com.", dns.TypeA)
+	m.SetQuestion("nosuchservice.production.skydns.local.", dns.TypeSRV)
 	resp, _, err := c.Exchange(m, "localhost:"+StrPort)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(resp.Answer) == 0 || resp.Rcode != dns.RcodeSuccess {
-		t.Fatal("Answer expected to have A records or rcode not equal to RcodeSuccess")
+	if resp.Rcode != dns.RcodeNameError {
+		t.Fatal("Answer should be NXDOMAIN")
 	}
-	// TCP
-	c.Net = "tcp"
+	if len(resp.Ns) != 1 {
+		t.Fatal("Answer should have a SOA record in the authority section")
+	}
+	soa, ok := resp.Ns[0].(*dns.SOA)
+	if !ok || soa.Hdr.Ttl != 30 || soa.Minttl != 30 {
+		t.Fatal("SOA record should have the minimum TTL")
+	}
+	if s.negativeCache.len() != 1 {
+		t.Fatal("NXDOMAIN should be cached")
+	}
+
 	resp, _, err = c.Exchange(m, "localhost:"+StrPort)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(resp.Answer) == 0 || resp.Rcode != dns.RcodeSuccess {
-		t.Fatal("Answer expected to have A records or rcode not equal to RcodeSuccess")
+	if resp.Rcode != dns.RcodeNameError || resp.Id != m.Id {
+		t.Fatal("Cached answer should be NXDOMAIN with the id of the query")
+	}
+
+	// Cached for the minimum TTL of the SOA record, not the cache's maximum
+	s.negativeCache.Lock()
+	for e := s.negativeCache.entries.Front(); e != nil; e = e.Next() {
+		if entry := e.Value.(*cacheEntry); entry.expires.Sub(entry.stored) != 30*time.Second {
+			t.Fatalf("NXDOMAIN should be cached for 30s, got %s", entry.expires.Sub(entry.stored))
+		}
+	}
+	s.negativeCache.Unlock()
+
+	// Registering the name outdates the cache, the service is found at once
+	s.registry.Add(msg.Service{UUID: "701", Name: "NoSuchService", Version: "1.0.0", Region: "Test", Environment: "Production",
+		Host: "10.0.0.1", Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+	resp, _, err = c.Exchange(m, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("Answer expected to have the added service, got %v", resp)
+	}
+
+	// Only NXDOMAIN and NODATA with a SOA record are cached
+	for _, rcode := range []int{dns.RcodeServerFailure, dns.RcodeRefused, dns.RcodeNameError} {
+		r := new(dns.Msg)
+		r.SetQuestion("failing.skydns.local.", dns.TypeA)
+		r.Rcode = rcode
+		if rcode != dns.RcodeNameError {
+			r.Ns = s.createSOA()
+		}
+		s.negativeCache.putNegative(r, scope{}, s.registry.Serial())
+	}
+	if s.negativeCache.len() != 0 {
+		t.Fatal("Failures and answers without a SOA record should not be cached")
+	}
+}
+
+func TestAnswerCache(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	s.EnableAnswerCache(10, 1*time.Minute)
+	s.registry.Add(msg.Service{UUID: "501", Name: "HotService", Version: "1.0.0", Region: "Test", Environment: "Production",
+		Host: "10.0.0.1", Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion("hotservice.production.skydns.local.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		resp, _, err := c.Exchange(m, "localhost:"+StrPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Id != m.Id {
+			t.Fatalf("Answer expected to have 1 A record with the id of the query, got %v", resp)
+		}
+	}
+	if s.answerCache.len() != 1 {
+		t.Fatal("Answer should be cached")
+	}
+
+	s.registry.UpdateTTL("501", 60, getExpirationTime(60))
+	if s.answerCache.get(m, scope{}) == nil {
+		t.Fatal("TTL updates should leave the answer cache alone")
+	}
+
+	// An answer built before a change isn't cached after it
+	serial := s.registry.Serial()
+	s.registry.Add(msg.Service{UUID: "502", Name: "HotService", Version: "1.0.0", Region: "Test", Environment: "Production",
+		Host: "10.0.0.2", Port: 80, TTL: 30, Expires: getExpirationTime(30)})
+	resp, _, err := c.Exchange(m, "localhost:"+StrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 2 {
+		t.Fatalf("Answer expected to have 2 A records after the change, got %v", resp.Answer)
+	}
+	stale := resp.Copy()
+	stale.Answer = stale.Answer[:1]
+	s.answerCache.put(stale, scope{}, serial)
+	if cached := s.answerCache.get(m, scope{}); cached == nil || len(cached.Answer) != 2 {
+		t.Fatalf("Answer from before the change should be dropped, got %v", cached)
+	}
+}
+
+func TestForwardCache(t *testing.T) {
+	c := newCache(2, 1*time.Minute)
+
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP("10.0.0.1")}}
+		c.put(m, scope{}, 0)
+	}
+	if c.len() != 2 {
+		t.Fatal("Cache should hold at most 2 replies, holds", c.len())
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("A.example.com.", dns.TypeA)
+	if c.get(req, scope{}) != nil {
+		t.Fatal("Least recently used reply should have been evicted")
+	}
+
+	req.SetQuestion("C.example.com.", dns.TypeA)
+	m := c.get(req, scope{})
+	if m == nil {
+		t.Fatal("Reply should be cached")
+	}
+	if m.Id != req.Id {
+		t.Fatal("Cached reply should get the id of the request")
+	}
+
+	req.SetQuestion("c.example.com.", dns.TypeAAAA)
+	if c.get(req, scope{}) != nil {
+		t.Fatal("Reply should be cached per type")
+	}
+
+	// A zero TTL is never cached.
+	m = new(dns.Msg)
+	m.SetQuestion("d.example.com.", dns.TypeA)
+	m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "d.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0}, A: net.ParseIP("10.0.0.1")}}
+	c.put(m, scope{}, 0)
+	if c.get(m, scope{}) != nil {
+		t.Fatal("Reply with zero TTL should not be cached")
 	}
-	// TODO(miek): DNSSEC DO query
+}
+
+func TestMalformedQueries(t *testing.T) {
+	s := newTestServer("", "", "")
+	defer s.Stop()
+
+	serve := func(req *dns.Msg) *dns.Msg {
+		w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}}
+		s.ServeDNS(w, req)
+		if w.msg == nil {
+			t.Fatalf("No reply to %v", req)
+		}
+		return w.msg
+	}
+
+	m := new(dns.Msg)
+	if r := serve(m); r.Rcode != dns.RcodeFormatError {
+		t.Fatalf("Query without a question should get FORMERR, got %s", dns.RcodeToString[r.Rcode])
+	}
+	m.SetQuestion("testservice.production.skydns.local.", dns.TypeSRV)
+	m.Question = append(m.Question, m.Question[0])
+	if r := serve(m); r.Rcode != dns.RcodeFormatError {
+		t.Fatalf("Query with two questions should get FORMERR, got %s", dns.RcodeToString[r.Rcode])
+	}
+	m.SetUpdate("skydns.local.")
+	if r := serve(m); r.Rcode != dns.RcodeNotImplemented {
+		t.Fatalf("Update should get NOTIMP, got %s", dns.RcodeToString[r.Rcode])
+	}
+	m = new(dns.Msg)
+	m.SetQuestion("a.b.c.d.e.f.g.skydns.local.", dns.TypeSRV)
+	if r := serve(m); r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 {
+		t.Fatalf("Name deeper than a registry key should get NXDOMAIN, got %s", dns.RcodeToString[r.Rcode])
+	}
+
+	w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}}
+	func() {
+		defer recoverDNS(w, m)
+		panic("bad query")
+	}()
+	if w.msg == nil || w.msg.Rcode != dns.RcodeServerFailure {
+		t.Fatal("Panic should be answered with SERVFAIL")
+	}
+}
+
+func FuzzServeDNS(f *testing.F) {
+	// The fuzzing workers are processes of their own that start a server as
+	// well, their ports must not collide with those of the others
+	Port += 10 * (os.Getpid() % 4000)
+	s := newTestServer("", "", "")
+	defer s.Stop()
+	for _, m := range services {
+		s.registry.Add(m)
+	}
+
+	for _, name := range []string{"skydns.local.", "testservice.production.skydns.local.", "region1.*.testservice.production.skydns.local.", "100.skydns.local.", "1.0.0.10.in-addr.arpa.", "a.b.c.d.e.f.g.skydns.local."} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypeTXT, dns.TypeNAPTR, dns.TypePTR, dns.TypeANY} {
+			m := new(dns.Msg)
+			m.SetQuestion(name, qtype)
+			m.SetEdns0(4096, false)
+			b, _ := m.Pack()
+			f.Add(b)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req := new(dns.Msg)
+		if err := req.Unpack(b); err != nil {
+			return
+		}
+		panics := stats.PanicCount.Count()
+		w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}}
+		s.ServeDNS(w, req)
+		if stats.PanicCount.Count() != panics {
+			t.Fatalf("Answering %v panicked", req)
+		}
+		if w.msg != nil {
+			if _, err := w.msg.Pack(); err != nil {
+				t.Fatalf("Reply to %v doesn't pack: %s", req, err)
+			}
+		}
+	})
 }
 
 func newTestServer(leader string, secret, nameserver string) *Server {
@@ -816,3 +3685,8 @@ func newTestServer(leader string, secret, nameserver string) *Server {
 	server.Start()
 	return server
 }
+
+// getExpirationTime returns when a service registered now with ttl expires.
+func getExpirationTime(ttl uint32) time.Time {
+	return expiresAt(time.Now(), ttl)
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/goraft/raft"
+	"github.com/miekg/dns"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DefaultShutdownTimeout is how long Shutdown waits for requests in flight.
+const DefaultShutdownTimeout = 10 * time.Second
+
+// SetShutdownTimeout sets how long Shutdown waits for the DNS, HTTP and gRPC
+// requests in flight to finish.
+func (s *Server) SetShutdownTimeout(d time.Duration) {
+	s.shutdownTimeout = d
+}
+
+// Shutdown stops accepting queries and API requests, waits for the ones in
+// flight to finish, removes the callbacks to the listener of this server and
+// then stops it. It is called on SIGTERM and interrupts.
+func (s *Server) Shutdown() {
+	timeout := s.shutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	slog.Info("Shutting down, waiting for requests in flight", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// First, raft needs the HTTP listener to commit the removal
+	if s.replica == nil {
+		if err := s.removeOwnCallbacks(); err != nil {
+			slog.Error("Removing callbacks", "err", err)
+		}
+	}
+
+	for _, d := range []*dns.Server{s.dnsUDPServer, s.dnsTCPServer, s.dnsTLSServer} {
+		if d == nil {
+			continue
+		}
+		if err := d.ShutdownContext(ctx); err != nil {
+			slog.Error("Shutting down listener", "net", d.Net, "addr", d.Addr, "err", err)
+		}
+	}
+	// Event streams don't finish by themselves
+	close(s.shuttingDown)
+	for _, h := range []*http.Server{s.httpServer, s.dohServer} {
+		if h == nil {
+			continue
+		}
+		if err := h.Shutdown(ctx); err != nil {
+			slog.Error("Shutting down listener", "net", "http", "addr", h.Addr, "err", err)
+		}
+	}
+	if s.grpcServer != nil {
+		done := make(chan bool)
+		go func() {
+			s.grpcServer.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			// Stop below cuts off the calls that are left
+		}
+	}
+	s.Stop()
+}
+
+// removeOwnCallbacks removes the callbacks to the listener at the HTTP address
+// of this server, followers ask the leader to.
+func (s *Server) removeOwnCallbacks() error {
+	host, p, err := net.SplitHostPort(s.httpAddr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.raftServer.Do(NewRemoveCallbacksCommand(host, uint16(port)))
+	if err != raft.NotLeaderError {
+		return err
+	}
+	leader := s.raftServer.Leader()
+	if leader == "" {
+		return errors.New("Leader unknown")
+	}
+	q := url.Values{"reply": {host}, "port": {p}}
+	req, err := http.NewRequest("DELETE", s.scheme()+"://"+leader+"/skydns/callbacks/?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if s.secret != "" {
+		req.Header.Set("Authorization", s.secret)
+	}
+	c := *s.peerClient()
+	c.Timeout = forwardTimeout
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", leader, resp.Status)
+	}
+	return nil
+}
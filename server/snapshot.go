@@ -0,0 +1,57 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/skynetservices/skydns/registry"
+	"log/slog"
+	"os"
+)
+
+// DefaultSnapshotEntries is the number of raft log entries committed between
+// snapshots of the registry.
+const DefaultSnapshotEntries = 10000
+
+// stateMachine lets raft save and recover the registry.
+type stateMachine struct {
+	registry registry.Registry
+}
+
+func (m stateMachine) Save() ([]byte, error)   { return m.registry.Snapshot() }
+func (m stateMachine) Recovery(b []byte) error { return m.registry.Restore(b) }
+
+// EnableSnapshots snapshots the registry every time entries log entries were
+// committed since the last snapshot, and compacts the raft log up to it. A
+// restarting member loads its latest snapshot and only replays the log after
+// it, members that fall behind the compacted log are sent the snapshot.
+func (s *Server) EnableSnapshots(entries uint64) {
+	s.snapshotEntries = entries
+}
+
+// loadSnapshot recovers the registry from the latest snapshot, if any.
+func (s *Server) loadSnapshot() {
+	if err := s.raftServer.LoadSnapshot(); err != nil && !os.IsNotExist(err) {
+		slog.Error("Loading snapshot", "err", err)
+		return
+	}
+	s.snapshotIndex = s.raftServer.CommitIndex()
+	if s.snapshotIndex > 0 {
+		slog.Info("Loaded snapshot", "services", s.registry.Len(), "index", s.snapshotIndex)
+	}
+}
+
+// snapshot takes a snapshot when it is due, it is called every second.
+func (s *Server) snapshot() {
+	index := s.raftServer.CommitIndex()
+	if s.snapshotEntries == 0 || index-s.snapshotIndex < s.snapshotEntries {
+		return
+	}
+	if err := s.raftServer.TakeSnapshot(); err != nil {
+		slog.Error("Taking snapshot", "err", err)
+		return
+	}
+	s.snapshotIndex = index
+	slog.Info("Took snapshot", "services", s.registry.Len(), "index", index)
+}
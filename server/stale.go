@@ -0,0 +1,109 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/stats"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDegraded is returned for writes while the cluster has no leader, or a
+// replica can't follow any member.
+var ErrDegraded = errors.New("Cluster unavailable, registrations are refused until it recovers")
+
+// staleness is the state of stale serving.
+type staleness struct {
+	maxStale time.Duration // how long stale answers are served, 0 is forever
+	ttl      uint32        // maximum TTL of stale answers, 0 leaves TTLs alone, accessed atomically
+	since    int64         // unix nanoseconds the registry went stale, 0 if it is fresh
+}
+
+// EnableStale keeps answering queries from the registry as it was when the
+// cluster lost its leader, or a replica lost the members it follows, for at
+// most maxStale (0 is no limit). Stale answers have TTLs of at most ttl, so
+// clients come back soon, and API writes are refused with 503 Service
+// Unavailable. Queries after maxStale are answered with SERVFAIL.
+func (s *Server) EnableStale(maxStale time.Duration, ttl uint32) {
+	s.stale = &staleness{maxStale: maxStale, ttl: ttl}
+}
+
+// SetStaleTTL changes the maximum TTL of stale answers, it may be called while
+// the server runs. Without stale serving it does nothing.
+func (s *Server) SetStaleTTL(ttl uint32) {
+	if s.stale != nil {
+		atomic.StoreUint32(&s.stale.ttl, ttl)
+	}
+}
+
+// fresh returns true if the registry follows the cluster: a member knows the
+// leader, a replica follows a member.
+func (s *Server) fresh() bool {
+	if s.replica != nil {
+		return atomic.LoadInt32(&s.replica.following) == 1
+	}
+	return s.raftServer.Leader() != ""
+}
+
+// staleFor returns how long the registry has been stale, 0 if it is fresh.
+func (s *Server) staleFor() time.Duration {
+	if s.fresh() {
+		if atomic.SwapInt64(&s.stale.since, 0) != 0 {
+			slog.Info("Registry is fresh again, serving normally")
+		}
+		return 0
+	}
+	now := time.Now().UnixNano()
+	if atomic.CompareAndSwapInt64(&s.stale.since, 0, now) {
+		slog.Warn("Registry is stale, serving the last known services", "maxstale", s.stale.maxStale, "ttl", atomic.LoadUint32(&s.stale.ttl))
+		return time.Nanosecond
+	}
+	return time.Duration(now - atomic.LoadInt64(&s.stale.since))
+}
+
+// staleResponseWriter returns a ResponseWriter that lowers the TTLs of the
+// answers to queries while the registry is stale, and true if the registry has
+// been stale for too long to answer at all. Without stale serving w is
+// returned as is.
+func (s *Server) staleResponseWriter(w dns.ResponseWriter) (dns.ResponseWriter, bool) {
+	if s.stale == nil {
+		return w, false
+	}
+	d := s.staleFor()
+	switch {
+	case d == 0:
+		return w, false
+	case s.stale.maxStale > 0 && d > s.stale.maxStale:
+		stats.StaleRefusedCount.Inc(1)
+		return w, true
+	}
+	ttl := atomic.LoadUint32(&s.stale.ttl)
+	if ttl == 0 {
+		return w, false
+	}
+	return &staleWriter{ResponseWriter: w, ttl: ttl}, false
+}
+
+// staleWriter caps the TTLs of the records it writes.
+type staleWriter struct {
+	dns.ResponseWriter
+	ttl uint32
+}
+
+func (s *staleWriter) WriteMsg(m *dns.Msg) error {
+	// m may be in a cache, the TTLs are lowered in a copy
+	m = m.Copy()
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT && h.Ttl > s.ttl {
+				h.Ttl = s.ttl
+			}
+		}
+	}
+	return s.ResponseWriter.WriteMsg(m)
+}
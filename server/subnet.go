@@ -0,0 +1,107 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+)
+
+// EnableClientSubnet trusts the EDNS0 Client Subnet option (RFC 7871) in
+// queries from the resolvers in the comma separated list of CIDR ranges acl:
+// the view of their clients is picked by the address of the subnet in the
+// option instead of the address of the resolver.
+func (s *Server) EnableClientSubnet(acl string) error {
+	nets, err := parseCIDRs(acl)
+	if err != nil {
+		return err
+	}
+	s.subnetACL = nets
+	return nil
+}
+
+// ecsOption returns the EDNS0 Client Subnet option of req, or nil when it
+// has none or the option is malformed. A query must have a scope prefix
+// length of 0, and no address bits beyond its source prefix length.
+func ecsOption(req *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		e, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		bits := 32
+		if e.Family == 2 {
+			bits = 128
+		}
+		switch {
+		case e.Family != 1 && e.Family != 2:
+			return nil
+		case e.SourceScope != 0 || int(e.SourceNetmask) > bits:
+			return nil
+		case e.Address == nil || !e.Address.Equal(e.Address.Mask(net.CIDRMask(int(e.SourceNetmask), bits))):
+			return nil
+		}
+		return e
+	}
+	return nil
+}
+
+// clientIP returns the address of the client the answer to req is for: the
+// address of its client subnet when the resolver behind w is trusted to send
+// one, otherwise the address of the resolver.
+func (s *Server) clientIP(w dns.ResponseWriter, req *dns.Msg) net.IP {
+	ip := remoteIP(w)
+	if s.subnetACL == nil || !containsIP(s.subnetACL, ip) {
+		return ip
+	}
+	if e := ecsOption(req); e != nil {
+		return e.Address
+	}
+	return ip
+}
+
+// subnetKey returns the client subnet of req as a string, to keep the cached
+// replies for different subnets apart. It's empty when req has none.
+func subnetKey(req *dns.Msg) string {
+	e := ecsOption(req)
+	if e == nil {
+		return ""
+	}
+	return e.Address.String() + "/" + strconv.Itoa(int(e.SourceNetmask))
+}
+
+// subnetWriter echoes the client subnet option of the query in the reply.
+type subnetWriter struct {
+	dns.ResponseWriter
+	subnet *dns.EDNS0_SUBNET
+}
+
+// WriteMsg adds the client subnet option to m and writes it.
+func (s *subnetWriter) WriteMsg(m *dns.Msg) error {
+	addOption(m, s.subnet)
+	return s.ResponseWriter.WriteMsg(m)
+}
+
+// subnetResponseWriter returns a ResponseWriter that echoes the client subnet
+// option of req, as RFC 7871 requires of answers to queries that have one.
+// The scope prefix length is the source prefix length when the subnet picked
+// the view of the answer, and 0 (the answer is the same for everyone)
+// otherwise. Without the option w is returned unchanged.
+func (s *Server) subnetResponseWriter(w dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	e := ecsOption(req)
+	if e == nil {
+		return w
+	}
+	echo := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: e.Family, SourceNetmask: e.SourceNetmask, Address: e.Address}
+	if s.views != nil && s.subnetACL != nil && containsIP(s.subnetACL, remoteIP(w)) {
+		echo.SourceScope = e.SourceNetmask
+	}
+	return &subnetWriter{ResponseWriter: w, subnet: echo}
+}
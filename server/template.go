@@ -0,0 +1,207 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/stats"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// templateTTL is the TTL of a TXT template record when no service matches.
+const templateTTL = 30
+
+// recordTemplate is a synthetic name whose records are computed from the
+// services matching query and labels.
+type recordTemplate struct {
+	name   string // fully qualified, lower cased
+	qtype  uint16 // dns.TypeSRV or dns.TypeTXT
+	query  string
+	labels map[string]string
+	text   *template.Template // TXT only
+}
+
+// templates holds the record templates loaded from file.
+type templates struct {
+	sync.RWMutex
+	file   string
+	byName map[string]*recordTemplate
+}
+
+// loadTemplates reads the record templates in file. Each line holds a name,
+// a type, a registry query and optionally labels the services must have, all
+// separated by white space. TXT templates may end with a quoted text/template
+// applied to the matching services, lines starting with # are comments.
+func loadTemplates(file, domain string) (map[string]*recordTemplate, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	byName := make(map[string]*recordTemplate)
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		text := "{{len .}}"
+		if j := strings.Index(line, `"`); j >= 0 {
+			t, err := strconv.Unquote(line[j:])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", file, i, err)
+			}
+			text, line = t, line[:j]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected a name, a type and a query", file, i)
+		}
+
+		t := &recordTemplate{
+			name:   strings.ToLower(fields[0]) + "." + dns.Fqdn(domain),
+			query:  fields[2],
+			labels: make(map[string]string),
+		}
+		switch strings.ToUpper(fields[1]) {
+		case "SRV":
+			t.qtype = dns.TypeSRV
+		case "TXT":
+			t.qtype = dns.TypeTXT
+			if t.text, err = template.New(fields[0]).Parse(text); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", file, i, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: type must be SRV or TXT", file, i)
+		}
+		for _, l := range fields[3:] {
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("%s:%d: expected label=value, got %q", file, i, l)
+			}
+			t.labels[kv[0]] = kv[1]
+		}
+		byName[t.name] = t
+	}
+	return byName, scanner.Err()
+}
+
+// EnableTemplates answers the names in file with records computed from the
+// services in the registry, e.g. the templates
+//
+//	leader.db.production SRV db.production role=primary
+//	count.web.production TXT web.production "{{len .}}"
+//
+// resolve leader.db.production to the services in db.production labeled
+// role=primary and count.web.production to the number of web services.
+func (s *Server) EnableTemplates(file string) error {
+	byName, err := loadTemplates(file, s.domain)
+	if err != nil {
+		return err
+	}
+	s.templates = &templates{file: file, byName: byName}
+	return nil
+}
+
+// ReloadTemplates reloads the record templates, the current ones are kept when
+// the file can't be loaded.
+func (s *Server) ReloadTemplates() error {
+	if s.templates == nil {
+		return nil
+	}
+	byName, err := loadTemplates(s.templates.file, s.domain)
+	if err != nil {
+		return err
+	}
+	s.templates.Lock()
+	s.templates.byName = byName
+	s.templates.Unlock()
+	return nil
+}
+
+// lookupTemplate returns the record template for name, if any.
+func (s *Server) lookupTemplate(name string) *recordTemplate {
+	if s.templates == nil {
+		return nil
+	}
+	s.templates.RLock()
+	defer s.templates.RUnlock()
+	return s.templates.byName[strings.ToLower(name)]
+}
+
+// match returns the services matching the query of t that have all of its
+// labels.
+func (s *Server) match(t *recordTemplate, sc scope) []msg.Service {
+	services, err := s.lookup(t.query, sc)
+	if err != nil {
+		return nil
+	}
+	matched := services[:0]
+Service:
+	for _, serv := range services {
+		for k, v := range t.labels {
+			if serv.Labels[k] != v {
+				continue Service
+			}
+		}
+		matched = append(matched, serv)
+	}
+	return matched
+}
+
+// templateRecords returns the answer and additional records for q computed from
+// template t.
+func (s *Server) templateRecords(q dns.Question, t *recordTemplate, sc scope) (records []dns.RR, extra []dns.RR, err error) {
+	services := s.match(t, sc)
+
+	if t.qtype == dns.TypeTXT {
+		if q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY {
+			return
+		}
+		var buf bytes.Buffer
+		if err = t.text.Execute(&buf, services); err != nil {
+			return
+		}
+		ttl := uint32(templateTTL)
+		for i, serv := range services {
+			stats.Resolved(serv.UUID)
+			if i == 0 || serv.TTL < ttl {
+				ttl = serv.TTL
+			}
+		}
+		records = append(records, &dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+			Txt: splitTXT(buf.String())})
+		return
+	}
+
+	var weight uint16
+	if len(services) > 0 {
+		weight = uint16(math.Floor(float64(100 / len(services))))
+	}
+	for _, serv := range services {
+		stats.Resolved(serv.UUID)
+		switch q.Qtype {
+		case dns.TypeSRV, dns.TypeANY:
+			srv, glue := s.srvRecord(q, serv, 10, weight)
+			records = append(records, srv)
+			extra = append(extra, glue...)
+		case dns.TypeA, dns.TypeAAAA:
+			ip4, ip6 := serv.Addresses()
+			records = append(records, addressRecords(q.Name, q.Qtype, ip4, serv.TTL)...)
+			records = append(records, addressRecords(q.Name, q.Qtype, ip6, serv.TTL)...)
+		}
+	}
+	return
+}
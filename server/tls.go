@@ -0,0 +1,184 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/logging"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// DoHPath is the path DNS-over-HTTPS queries are served on.
+const DoHPath = "/dns-query"
+
+// EnableTLS serves DNS-over-TLS on dotAddr and DNS-over-HTTPS (RFC 8484) on
+// dohAddr, using the certificate and key in certFile and keyFile. Either
+// address may be empty to leave that listener off. The certificate is reloaded
+// on SIGHUP.
+func (s *Server) EnableTLS(dotAddr, dohAddr, certFile, keyFile string) error {
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.dnsCert = cert
+	config := &tls.Config{GetCertificate: cert.get}
+
+	if dotAddr != "" {
+		s.dnsTLSServer = &dns.Server{
+			Addr:         dotAddr,
+			Net:          "tcp-tls",
+			Handler:      s.dnsHandler,
+			TLSConfig:    config,
+			ReadTimeout:  s.readTimeout,
+			WriteTimeout: s.writeTimeout,
+		}
+	}
+	if dohAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc(DoHPath, s.dohHTTPHandler)
+		s.dohServer = &http.Server{
+			Addr:           dohAddr,
+			Handler:        mux,
+			TLSConfig:      config,
+			ReadTimeout:    s.readTimeout,
+			WriteTimeout:   s.writeTimeout,
+			MaxHeaderBytes: 1 << 20,
+		}
+	}
+	return nil
+}
+
+// listenAndServeTLS starts the DNS-over-TLS and DNS-over-HTTPS listeners that
+// are enabled.
+func (s *Server) listenAndServeTLS() {
+	if s.dnsTLSServer != nil {
+		go func() {
+			err := s.dnsTLSServer.ListenAndServe()
+			if err != nil {
+				logging.Fatal("Starting listener", "net", s.dnsTLSServer.Net, "addr", s.dnsTLSServer.Addr, "err", err)
+			}
+		}()
+	}
+	if s.dohServer != nil {
+		go func() {
+			err := s.dohServer.ListenAndServeTLS("", "")
+			if err != nil && err != http.ErrServerClosed {
+				logging.Fatal("Starting listener", "net", "https", "addr", s.dohServer.Addr, "err", err)
+			}
+		}()
+	}
+}
+
+// dohHTTPHandler answers DNS-over-HTTPS queries, sent either as the base64url
+// encoded dns parameter of a GET or as the body of a POST.
+func (s *Server) dohHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	var buf []byte
+	var err error
+
+	switch req.Method {
+	case "GET":
+		buf, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case "POST":
+		if req.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(http.MaxBytesReader(w, req.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(buf) == 0 {
+		http.Error(w, "Invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil || len(m.Question) == 0 {
+		http.Error(w, "Invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	dw := &dohWriter{remote: parseAddr(req.RemoteAddr)}
+	if t := m.Question[0].Qtype; t == dns.TypeAXFR || t == dns.TypeIXFR {
+		// A zone transfer is a stream of messages, which doesn't fit in a
+		// single HTTP response.
+		r := new(dns.Msg)
+		r.SetRcode(m, dns.RcodeRefused)
+		dw.WriteMsg(r)
+	} else {
+		s.dnsHandler.ServeDNS(dw, m)
+	}
+	if dw.msg == nil {
+		http.Error(w, "No reply", http.StatusServiceUnavailable)
+		return
+	}
+
+	out, err := dw.msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(dw.msg)))
+	w.Write(out)
+}
+
+// minTTL returns the lowest TTL of the records in m, or zero if there are none.
+func minTTL(m *dns.Msg) (ttl uint32) {
+	first := true
+	for _, s := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range s {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return
+}
+
+// parseAddr turns the host:port in addr into a *net.TCPAddr.
+func parseAddr(addr string) net.Addr {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return a
+}
+
+// dohWriter is the dns.ResponseWriter for a DNS-over-HTTPS query, it keeps
+// the reply so it can be sent back in the HTTP response.
+type dohWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (d *dohWriter) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (d *dohWriter) RemoteAddr() net.Addr { return d.remote }
+func (d *dohWriter) WriteMsg(m *dns.Msg) error {
+	d.msg = m
+	return nil
+}
+func (d *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	d.msg = m
+	return len(b), nil
+}
+func (d *dohWriter) Close() error        { return nil }
+func (d *dohWriter) TsigStatus() error   { return nil }
+func (d *dohWriter) TsigTimersOnly(bool) {}
+func (d *dohWriter) Hijack()             {}
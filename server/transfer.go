@@ -0,0 +1,191 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/registry"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// transferChunk is the number of records sent per message in a zone transfer.
+const transferChunk = 100
+
+type transfer struct {
+	acl  []*net.IPNet // clients allowed to transfer the zone
+	ixfr bool         // whether incremental transfers are supported
+}
+
+// EnableTransfer allows clients in the comma separated list of CIDR ranges acl
+// to transfer the zone with AXFR, and with IXFR if ixfr is true.
+func (s *Server) EnableTransfer(acl string, ixfr bool) error {
+	nets, err := parseCIDRs(acl)
+	if err != nil {
+		return err
+	}
+	s.transfer = &transfer{acl: nets, ixfr: ixfr}
+	return nil
+}
+
+// ServeDNSTransfer is the handler for AXFR and IXFR requests for s.domain and
+// the zones. A zone has the services registered in it, which are transferred
+// as if they were in s.domain, and moved to the zone as they're written.
+func (s *Server) ServeDNSTransfer(w dns.ResponseWriter, req *dns.Msg) {
+	w, req, zone := s.zoneRequest(w, req)
+	q := req.Question[0]
+
+	if s.transfer == nil || !containsIP(s.transfer.acl, remoteIP(w)) {
+		slog.Warn("Refused zone transfer", "client", w.RemoteAddr().String())
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	serial := s.registry.Serial()
+	soa := s.soa(serial)
+
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if q.Qtype == dns.TypeIXFR {
+			// Only the current SOA, the client retries over TCP when it is behind (RFC 1995)
+			m.Authoritative = true
+			m.Answer = []dns.RR{soa}
+		} else {
+			m.SetRcode(req, dns.RcodeRefused)
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	var records []dns.RR
+	if q.Qtype == dns.TypeIXFR && s.transfer.ixfr && len(req.Ns) > 0 {
+		if clientSOA, ok := req.Ns[0].(*dns.SOA); ok {
+			records = s.incrementalZone(clientSOA.Serial, serial, zone)
+		}
+	}
+	if records == nil {
+		records = s.zone(soa, zone)
+	}
+
+	slog.Info("Transferring zone", "zone", dns.Fqdn(q.Name), "records", len(records), "serial", serial, "client", w.RemoteAddr().String())
+
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		if err := tr.Out(w, req, ch); err != nil {
+			slog.Error("Zone transfer failed", "client", w.RemoteAddr().String(), "err", err)
+		}
+		wg.Done()
+	}()
+	for len(records) > 0 {
+		n := transferChunk
+		if n > len(records) {
+			n = len(records)
+		}
+		ch <- &dns.Envelope{RR: records[:n]}
+		records = records[n:]
+	}
+	close(ch)
+	wg.Wait()
+	w.Close()
+}
+
+// zone returns all records in zone (empty for s.domain), starting and ending
+// with soa. Services out of rotation are left out, as they are of answers.
+// Aliases are only in s.domain.
+func (s *Server) zone(soa *dns.SOA, zone string) []dns.RR {
+	records := []dns.RR{soa}
+	records = append(records, s.apexRecords()...)
+
+	if services, err := s.registry.Get("*"); err == nil {
+		for _, serv := range inZone(inRotation(services), zone) {
+			records = append(records, s.serviceRecords(serv)...)
+		}
+	}
+	if zone == "" {
+		for _, a := range s.registry.GetAliases() {
+			records = append(records, s.aliasRecord(a))
+		}
+	}
+	return append(records, soa)
+}
+
+// incrementalZone returns the records of an IXFR reply of zone for a client
+// with serial, or nil when the changes since then are not known. The serial
+// is shared by all zones, changes in other zones have no records.
+func (s *Server) incrementalZone(serial, current uint32, zone string) []dns.RR {
+	changes, err := s.registry.GetChanges(serial)
+	if err != nil {
+		return nil
+	}
+	soa := s.soa(current)
+	if len(changes) == 0 {
+		return []dns.RR{soa}
+	}
+
+	records := []dns.RR{soa}
+	for _, c := range changes {
+		records = append(records, s.soa(c.Serial-1))
+		if c.Removed {
+			records = append(records, s.changeRecords(c, zone)...)
+		}
+		records = append(records, s.soa(c.Serial))
+		if !c.Removed {
+			records = append(records, s.changeRecords(c, zone)...)
+		}
+	}
+	return append(records, soa)
+}
+
+// changeRecords returns the records the change c adds to or removes from
+// zone. Services out of rotation aren't in the zone, unless c takes them out
+// or puts them back.
+func (s *Server) changeRecords(c registry.Change, zone string) []dns.RR {
+	if c.Alias != nil {
+		if zone != "" {
+			return nil
+		}
+		return []dns.RR{s.aliasRecord(*c.Alias)}
+	}
+	if len(inZone([]msg.Service{c.Service}, zone)) == 0 {
+		return nil
+	}
+	if c.Type == "" && (c.Service.Unhealthy || c.Service.Drained) {
+		return nil
+	}
+	return s.serviceRecords(c.Service)
+}
+
+// apexRecords returns the NS records of the zone, the addresses of the name
+// servers and that of the master in the SOA record.
+func (s *Server) apexRecords() (records []dns.RR) {
+	dom := dns.Fqdn(s.domain)
+	ns, glue := s.nameServers()
+	records = append(ns, glue...)
+	if h, _, err := net.SplitHostPort(s.Leader()); err == nil {
+		records = append(records, addressRecords("master."+dom, dns.TypeANY, net.ParseIP(h), 15)...)
+	}
+	return
+}
+
+// serviceRecords returns the records for the full name of serv: its SRV
+// record, its addresses and those of the target of the SRV record.
+func (s *Server) serviceRecords(serv msg.Service) []dns.RR {
+	name := registry.Key(serv) + "." + dns.Fqdn(s.domain)
+
+	srv, records := s.srvRecord(dns.Question{Name: name}, serv, 10, 100)
+	records = append([]dns.RR{srv}, records...)
+
+	ip4, ip6 := serv.Addresses()
+	records = append(records, addressRecords(name, dns.TypeANY, ip4, serv.TTL)...)
+	return append(records, addressRecords(name, dns.TypeANY, ip6, serv.TTL)...)
+}
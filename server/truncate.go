@@ -0,0 +1,62 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+)
+
+// udpSize returns the size of the largest reply the client behind w accepts
+// for req, or 0 when there is no limit (TCP).
+func udpSize(w dns.ResponseWriter, req *dns.Msg) int {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		return 0
+	}
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
+}
+
+// preference returns how much an answer is preferred, lower is better. SRV
+// records are ranked by their priority, so primaries (in the local region)
+// come before backups.
+func preference(rr dns.RR) uint16 {
+	if srv, ok := rr.(*dns.SRV); ok {
+		return srv.Priority
+	}
+	return 0
+}
+
+type byPreference []dns.RR
+
+func (b byPreference) Len() int           { return len(b) }
+func (b byPreference) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byPreference) Less(i, j int) bool { return preference(b[i]) < preference(b[j]) }
+
+// fit shrinks the reply m until it is no larger than size bytes, a size of 0
+// leaves m alone. The additional section is emptied first, then the least
+// preferred answers are removed and the TC bit is set, so the answers that
+// remain are always the most preferred ones.
+func fit(m *dns.Msg, size int) {
+	if size == 0 || m.Len() <= size {
+		return
+	}
+	sort.Stable(byPreference(m.Answer))
+
+	for i := len(m.Extra) - 1; i >= 0 && m.Len() > size; i-- {
+		if m.Extra[i].Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		m.Extra = append(m.Extra[:i], m.Extra[i+1:]...)
+	}
+	for len(m.Answer) > 1 && m.Len() > size {
+		m.Answer = m.Answer[:len(m.Answer)-1]
+		m.Truncated = true
+	}
+}
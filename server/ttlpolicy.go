@@ -0,0 +1,148 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/registry"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadTTLPolicy reads the TTL rules in file. Each line holds an environment,
+// a service name, the default TTL and optionally the minimum and maximum
+// TTL, separated by white space. A * matches all environments or names, a -
+// leaves the TTL alone. Lines starting with # are comments.
+func loadTTLPolicy(file string) (p registry.TTLPolicy, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 || len(fields) > 5 {
+			return nil, fmt.Errorf("%s:%d: expected an environment, a name, a default TTL and optionally a minimum and maximum TTL", file, i)
+		}
+		var ttls [3]uint32
+		for j, field := range fields[2:] {
+			if ttls[j], err = parseTTL(field); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", file, i, err)
+			}
+		}
+		r := registry.TTLRule{Environment: fields[0], Name: fields[1], Default: ttls[0], Min: ttls[1], Max: ttls[2]}
+		if r.Environment == "*" {
+			r.Environment = ""
+		}
+		if r.Name == "*" {
+			r.Name = ""
+		}
+		if r.Max != 0 && r.Min > r.Max {
+			return nil, fmt.Errorf("%s:%d: minimum TTL above the maximum", file, i)
+		}
+		p = append(p, r)
+	}
+	return p, scanner.Err()
+}
+
+// parseTTL parses a TTL like 30s or 5m, - is 0.
+func parseTTL(s string) (uint32, error) {
+	if s == "-" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 || d%time.Second != 0 || d/time.Second > 1<<31-1 {
+		return 0, fmt.Errorf("invalid TTL %s, must be whole seconds", s)
+	}
+	return uint32(d / time.Second), nil
+}
+
+// ttlPolicy holds the TTL rules of services and the file they are loaded from.
+type ttlPolicy struct {
+	sync.RWMutex
+	file  string
+	rules registry.TTLPolicy
+}
+
+// EnableTTLPolicy holds the TTLs of services to the rules in file when they
+// are registered or renewed, e.g.
+//
+//	# environment  name     default  min  max
+//	production     *        30s      10s  5m
+//	staging        *        10s
+//	*              Billing  5s       1s   1m
+//
+// gives services registered without a TTL in production 30 seconds and
+// keeps their TTLs between 10 seconds and 5 minutes. The leader applies the
+// rules before it commits a registration or renewal, every member of the
+// cluster should load the same rules for them to hold after an election.
+func (s *Server) EnableTTLPolicy(file string) error {
+	p, err := loadTTLPolicy(file)
+	if err != nil {
+		return err
+	}
+	s.ttlPolicy = &ttlPolicy{file: file, rules: p}
+	return nil
+}
+
+// ReloadTTLPolicy reloads the TTL rules, the current rules are kept when the
+// file can't be loaded. Services already registered keep their TTLs until
+// they are renewed.
+func (s *Server) ReloadTTLPolicy() error {
+	if s.ttlPolicy == nil {
+		return nil
+	}
+	p, err := loadTTLPolicy(s.ttlPolicy.file)
+	if err != nil {
+		return err
+	}
+	s.ttlPolicy.Lock()
+	s.ttlPolicy.rules = p
+	s.ttlPolicy.Unlock()
+	return nil
+}
+
+// policyTTL returns the TTL the rules allow serv to have instead of ttl.
+func (s *Server) policyTTL(serv msg.Service, ttl uint32) uint32 {
+	if s.ttlPolicy == nil {
+		return ttl
+	}
+	s.ttlPolicy.RLock()
+	defer s.ttlPolicy.RUnlock()
+	return s.ttlPolicy.rules.TTL(serv, ttl)
+}
+
+// enforceTTL changes the TTL of serv, about to be registered, to what the
+// rules allow. Expires moves along, it was set TTL seconds out by
+// setExpirationTime, unless serv has a lease which sets Expires instead.
+func (s *Server) enforceTTL(serv *msg.Service) {
+	ttl := s.policyTTL(*serv, serv.TTL)
+	if ttl == serv.TTL {
+		return
+	}
+	if serv.Lease == nil {
+		serv.Expires = serv.Expires.Add(time.Duration(int64(ttl)-int64(serv.TTL)) * time.Second)
+	}
+	serv.TTL = ttl
+}
+
+// updateTTLCommand returns the command that renews serv with ttl, held to the
+// rules.
+func (s *Server) updateTTLCommand(serv msg.Service, ttl uint32) *UpdateTTLCommand {
+	return NewUpdateTTLCommand(serv.UUID, s.policyTTL(serv, ttl), s.now())
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/stats"
+	"sort"
+	"strings"
+)
+
+// maxTXTString is the length of the longest string a TXT record can hold.
+const maxTXTString = 255
+
+// getTXTRecords returns a TXT record for each service matching q, holding
+// its UUID, version and metadata as key=value strings.
+func (s *Server) getTXTRecords(q dns.Question, sc scope) (records []dns.RR, err error) {
+	services, err := s.lookupHost(strings.TrimSuffix(q.Name, s.domain+"."), sc)
+	if err != nil {
+		return
+	}
+
+	for _, serv := range services {
+		stats.Resolved(serv.UUID)
+		records = append(records, &dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: serv.TTL},
+			Txt: metadataStrings(serv)})
+	}
+	return
+}
+
+// metadataStrings returns the strings of the TXT record of serv: uuid=,
+// version= and the metadata sorted by key.
+func metadataStrings(serv msg.Service) []string {
+	keys := make([]string, 0, len(serv.Metadata))
+	for k := range serv.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	txt := []string{"uuid=" + serv.UUID, "version=" + serv.Version}
+	for _, k := range keys {
+		txt = append(txt, k+"="+serv.Metadata[k])
+	}
+	for i, t := range txt {
+		if len(t) > maxTXTString {
+			txt[i] = t[:maxTXTString]
+		}
+	}
+	return txt
+}
+
+// splitTXT splits t in the strings of at most maxTXTString bytes a TXT record
+// holds.
+func splitTXT(t string) []string {
+	var txt []string
+	for len(t) > maxTXTString {
+		txt = append(txt, t[:maxTXTString])
+		t = t[maxTXTString:]
+	}
+	return append(txt, t)
+}
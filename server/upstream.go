@@ -0,0 +1,222 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/stats"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUpstreamFailures is the number of failures in a row after which
+	// a nameserver is excluded.
+	DefaultUpstreamFailures = 3
+	// DefaultUpstreamCooldown is how long a failed nameserver is excluded.
+	DefaultUpstreamCooldown = 30 * time.Second
+
+	// upstreamDecay is the weight of the history in the moving averages.
+	upstreamDecay = 0.7
+)
+
+// upstream is a nameserver queries are forwarded to, with its health.
+type upstream struct {
+	addr      string
+	rtt       time.Duration // moving average of the round trip time
+	failRate  float64       // moving average of failures, between 0 and 1
+	failures  int           // failures in a row
+	downUntil time.Time     // while in the future the nameserver is excluded
+}
+
+// score orders the nameservers, lower is better. Failures weigh heavier than
+// latency, a nameserver that fails a tenth of the time counts as if it were
+// twice as slow. Nameservers that weren't measured yet count as fast.
+func (u *upstream) score() float64 {
+	return float64(u.rtt+time.Millisecond) * (1 + 10*u.failRate)
+}
+
+// upstreams keeps track of the health of the nameservers to forward to.
+type upstreams struct {
+	sync.Mutex
+	list        []*upstream
+	maxFailures int
+	cooldown    time.Duration
+	interval    time.Duration // of active checks, 0 disables them
+}
+
+func newUpstreams(addrs []string) *upstreams {
+	u := &upstreams{maxFailures: DefaultUpstreamFailures, cooldown: DefaultUpstreamCooldown}
+	for _, a := range addrs {
+		u.list = append(u.list, &upstream{addr: a})
+	}
+	return u
+}
+
+// EnableUpstreamChecks queries each nameserver every interval to measure its
+// latency, and so excluded nameservers are taken back once they recover. A
+// nameserver is excluded for cooldown after maxFailures failures in a row.
+func (s *Server) EnableUpstreamChecks(interval time.Duration, maxFailures int, cooldown time.Duration) {
+	s.upstreams.Lock()
+	defer s.upstreams.Unlock()
+	s.upstreams.interval = interval
+	s.upstreams.maxFailures = maxFailures
+	s.upstreams.cooldown = cooldown
+}
+
+// SetNameservers replaces the nameservers queries are forwarded to, it may be
+// called while the server runs. Nameservers that stay keep their health.
+func (s *Server) SetNameservers(addrs []string) {
+	s.upstreams.Lock()
+	defer s.upstreams.Unlock()
+
+	old := make(map[string]*upstream, len(s.upstreams.list))
+	for _, p := range s.upstreams.list {
+		old[p.addr] = p
+	}
+	list := make([]*upstream, 0, len(addrs))
+	for _, a := range addrs {
+		p, ok := old[a]
+		if !ok {
+			p = &upstream{addr: a}
+		}
+		list = append(list, p)
+	}
+	s.upstreams.list = list
+}
+
+// len returns the number of nameservers.
+func (u *upstreams) len() int {
+	u.Lock()
+	defer u.Unlock()
+	return len(u.list)
+}
+
+// addrs returns the addresses of the nameservers, in the order they were set.
+func (u *upstreams) addrs() []string {
+	u.Lock()
+	defer u.Unlock()
+	addrs := make([]string, len(u.list))
+	for i, p := range u.list {
+		addrs[i] = p.addr
+	}
+	return addrs
+}
+
+// order returns the addresses of the nameservers to try, healthiest first.
+// Excluded nameservers come last, in case all of them are down.
+func (u *upstreams) order() []string {
+	u.Lock()
+	defer u.Unlock()
+
+	now := time.Now()
+	list := make([]*upstream, len(u.list))
+	copy(list, u.list)
+	sort.Stable(byHealth{list, now})
+
+	addrs := make([]string, len(list))
+	for i, p := range list {
+		addrs[i] = p.addr
+	}
+	return addrs
+}
+
+// observe records the outcome of a query sent to addr.
+func (u *upstreams) observe(addr string, rtt time.Duration, ok bool) {
+	u.Lock()
+	defer u.Unlock()
+
+	for _, p := range u.list {
+		if p.addr != addr {
+			continue
+		}
+		failed := 0.0
+		if !ok {
+			failed = 1
+		}
+		p.failRate = upstreamDecay*p.failRate + (1-upstreamDecay)*failed
+
+		if ok {
+			if p.rtt == 0 {
+				p.rtt = rtt
+			} else {
+				p.rtt = time.Duration(upstreamDecay*float64(p.rtt) + (1-upstreamDecay)*float64(rtt))
+			}
+			if !p.downUntil.IsZero() {
+				slog.Info("Nameserver recovered", "nameserver", addr)
+			}
+			p.failures, p.downUntil = 0, time.Time{}
+			return
+		}
+		p.failures++
+		if p.failures >= u.maxFailures {
+			if p.downUntil.IsZero() {
+				stats.UpstreamDownCount.Inc(1)
+				slog.Warn("Nameserver failed, excluding it", "nameserver", addr, "failures", p.failures, "cooldown", u.cooldown)
+			}
+			p.downUntil = time.Now().Add(u.cooldown)
+		}
+		return
+	}
+}
+
+// check queries all nameservers once.
+func (u *upstreams) check() {
+	u.Lock()
+	addrs := make([]string, len(u.list))
+	for i, p := range u.list {
+		addrs[i] = p.addr
+	}
+	u.Unlock()
+
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+	c := &dns.Client{ReadTimeout: 2 * time.Second}
+	for _, a := range addrs {
+		r, rtt, err := c.Exchange(m, a)
+		u.observe(a, rtt, err == nil && r.Rcode != dns.RcodeServerFailure)
+	}
+}
+
+// byHealth sorts the nameservers that aren't excluded by their score.
+type byHealth struct {
+	list []*upstream
+	now  time.Time
+}
+
+func (b byHealth) Len() int      { return len(b.list) }
+func (b byHealth) Swap(i, j int) { b.list[i], b.list[j] = b.list[j], b.list[i] }
+func (b byHealth) Less(i, j int) bool {
+	downi, downj := b.now.Before(b.list[i].downUntil), b.now.Before(b.list[j].downUntil)
+	if downi != downj {
+		return downj
+	}
+	return b.list[i].score() < b.list[j].score()
+}
+
+func (s *Server) getUpstreamsHTTPHandler(w http.ResponseWriter, req *http.Request) {
+	type status struct {
+		Addr        string
+		RTT         float64 // milliseconds
+		FailureRate float64
+		Down        bool
+	}
+
+	now := time.Now()
+	statuses := make([]status, 0)
+	s.upstreams.Lock()
+	for _, p := range s.upstreams.list {
+		statuses = append(statuses, status{p.addr, float64(p.rtt) / float64(time.Millisecond), p.failRate, now.Before(p.downUntil)})
+	}
+	s.upstreams.Unlock()
+
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		logRequestError(req, err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/skynetservices/skydns/msg"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// view is a named set of client networks.
+type view struct {
+	name string
+	nets []*net.IPNet
+}
+
+// views holds the views loaded from file, in the order of the file.
+type views struct {
+	sync.RWMutex
+	file string
+	list []view
+}
+
+// loadViews reads the views in file. Each line holds the name of a view and a
+// comma separated list of CIDR ranges. Lines starting with # are comments.
+func loadViews(file string) ([]view, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []view
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a view and CIDR ranges", file, i)
+		}
+		nets, err := parseCIDRs(strings.Join(fields[1:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, i, err)
+		}
+		list = append(list, view{strings.ToLower(fields[0]), nets})
+	}
+	return list, scanner.Err()
+}
+
+// EnableViews sorts clients into the views in file, by the network they query
+// from. The first view that has a client's network is the client's view,
+// e.g. with
+//
+//	internal 10.0.0.0/8,192.168.0.0/16
+//	external 0.0.0.0/0,::/0
+//
+// services answer clients in 10.0.0.0/8 with the Host and Port of their
+// "internal" view.
+func (s *Server) EnableViews(file string) error {
+	list, err := loadViews(file)
+	if err != nil {
+		return err
+	}
+	s.views = &views{file: file, list: list}
+	return nil
+}
+
+// ReloadViews reloads the views, the current views are kept when the file
+// can't be loaded.
+func (s *Server) ReloadViews() error {
+	if s.views == nil {
+		return nil
+	}
+	list, err := loadViews(s.views.file)
+	if err != nil {
+		return err
+	}
+	s.views.Lock()
+	s.views.list = list
+	s.views.Unlock()
+	return nil
+}
+
+// viewOf returns the name of the view of a client at ip, empty when it's in
+// none.
+func (s *Server) viewOf(ip net.IP) string {
+	if s.views == nil || ip == nil {
+		return ""
+	}
+	s.views.RLock()
+	defer s.views.RUnlock()
+	for _, v := range s.views.list {
+		if containsIP(v.nets, ip) {
+			return v.name
+		}
+	}
+	return ""
+}
+
+// inView returns the services as they're seen from view: with the Host,
+// Host6 and Port they registered for it. Services without them for view
+// keep their own.
+func inView(services []msg.Service, view string) []msg.Service {
+	if view == "" {
+		return services
+	}
+	for i, serv := range services {
+		for name, v := range serv.Views {
+			if !strings.EqualFold(name, view) {
+				continue
+			}
+			services[i].Host, services[i].Host6 = v.Host, v.Host6
+			if v.Port != 0 {
+				services[i].Port = v.Port
+			}
+		}
+	}
+	return services
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/registry"
+	"github.com/skynetservices/skydns/stats"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// webhookAttempts is the number of times a webhook is tried.
+	webhookAttempts = 5
+	// webhookBackoff is the wait before the first retry, it doubles after
+	// each one.
+	webhookBackoff = 1 * time.Second
+	// webhookTimeout is how long a webhook may take.
+	webhookTimeout = 5 * time.Second
+)
+
+// webhook is a URL the removals of services are posted to, in order.
+type webhook struct {
+	url    string
+	events chan registry.Event
+}
+
+// webhooks posts the removals and expiries of services to the webhooks.
+type webhooks struct {
+	hooks   []*webhook
+	secret  string
+	client  *http.Client
+	backoff time.Duration
+	done    chan struct{} // closed when the server stops
+}
+
+// EnableWebhooks posts the event of each service that expires or is removed
+// to urls, as JSON like the event stream. Only the leader posts, so each
+// event is posted once. A failed post is retried with a backoff, and given
+// up on after webhookAttempts tries. If secret is set the posts are signed
+// with msg.Signature, keyed with secret, in the X-SkyDNS-Signature header.
+func (s *Server) EnableWebhooks(urls []string, secret string) error {
+	w := &webhooks{secret: secret, client: &http.Client{Timeout: webhookTimeout}, backoff: webhookBackoff}
+	for _, u := range urls {
+		if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") {
+			return fmt.Errorf("Invalid webhook URL %s", u)
+		}
+		w.hooks = append(w.hooks, &webhook{url: u, events: make(chan registry.Event, eventBuffer)})
+	}
+
+	w.done = make(chan struct{})
+	s.webhooks = w
+	for _, h := range w.hooks {
+		go w.deliver(h)
+	}
+	events, stop := s.registry.Watch(eventBuffer)
+	go s.watchWebhooks(events, stop)
+	return nil
+}
+
+// watchWebhooks hands the removals of services to the webhooks, until the
+// server stops.
+func (s *Server) watchWebhooks(events <-chan registry.Event, stop func()) {
+	w := s.webhooks
+	defer func() {
+		stop()
+		for _, h := range w.hooks {
+			close(h.events)
+		}
+	}()
+
+	for {
+		var e registry.Event
+		var ok bool
+		select {
+		case <-w.done:
+			return
+		case e, ok = <-events:
+		}
+		if !ok {
+			// We fell behind, the events meanwhile are lost
+			slog.Warn("Webhooks fell behind, events were dropped")
+			events, stop = s.registry.Watch(eventBuffer)
+			continue
+		}
+		if e.Service == nil || (e.Type != registry.EventRemove && e.Type != registry.EventExpire) {
+			continue
+		}
+		if s.replica != nil || !s.IsLeader() {
+			continue
+		}
+		for _, h := range w.hooks {
+			select {
+			case h.events <- e:
+			default:
+				stats.WebhookFailCount.Inc(1)
+				slog.Warn("Webhook queue full, dropping event", "url", h.url, "uuid", e.Service.UUID)
+			}
+		}
+	}
+}
+
+// deliver posts the events of h, one at a time.
+func (w *webhooks) deliver(h *webhook) {
+	for e := range h.events {
+		body, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		backoff := w.backoff
+		for i := 1; ; i++ {
+			err := w.post(h.url, body)
+			if err == nil {
+				break
+			}
+			if i == webhookAttempts {
+				stats.WebhookFailCount.Inc(1)
+				slog.Error("Webhook failed, giving up", "url", h.url, "uuid", e.Service.UUID, "attempts", i, "err", err)
+				break
+			}
+			slog.Warn("Webhook failed, retrying", "url", h.url, "uuid", e.Service.UUID, "retry_in", backoff, "err", err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// post posts body to u, signed if there's a secret.
+func (w *webhooks) post(u string, body []byte) error {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	date := time.Now().UTC().Format(http.TimeFormat)
+	req.Header.Set("Date", date)
+	if w.secret != "" {
+		req.Header.Set("X-SkyDNS-Signature", msg.Signature(w.secret, "POST", req.URL.RequestURI(), date, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
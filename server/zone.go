@@ -0,0 +1,252 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/msg"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// scope is what an answer depends on besides the question: the view of the
+// client and the zone the question is in, or the client subnet of a
+// forwarded question.
+type scope struct {
+	view   string
+	zone   string // empty for the SkyDNS domain
+	subnet string // client subnet of forwarded queries, upstreams may answer per subnet
+}
+
+// zone is a domain served next to the SkyDNS domain.
+type zone struct {
+	name        string   // lower cased, without the trailing dot
+	nameservers []string // names not in the zone are forwarded to these
+}
+
+// zones holds the zones loaded from file.
+type zones struct {
+	sync.RWMutex
+	file string
+	list []zone
+}
+
+// loadZones reads the zones in file. Each line holds the name of a zone and
+// optionally a comma separated list of the nameservers to forward the names
+// to that it doesn't have. Lines starting with # are comments.
+func loadZones(file, domain string) ([]zone, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []zone
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: expected a zone and nameservers", file, i)
+		}
+		z := zone{name: strings.ToLower(strings.TrimSuffix(fields[0], "."))}
+		if z.name == "" || inDomain(z.name, domain) || inDomain(domain, z.name) {
+			return nil, fmt.Errorf("%s:%d: zone %s overlaps %s", file, i, fields[0], domain)
+		}
+		if len(fields) == 2 {
+			for _, ns := range strings.Split(fields[1], ",") {
+				if _, _, err := net.SplitHostPort(ns); err != nil {
+					ns = net.JoinHostPort(ns, "53")
+				}
+				z.nameservers = append(z.nameservers, ns)
+			}
+		}
+		list = append(list, z)
+	}
+	return list, scanner.Err()
+}
+
+// inDomain returns true if name is domain or a name below it.
+func inDomain(name, domain string) bool {
+	name, domain = strings.ToLower(strings.TrimSuffix(name, ".")), strings.ToLower(strings.TrimSuffix(domain, "."))
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// EnableZones makes the server authoritative for the zones in file as well,
+// e.g. with
+//
+//	dev.local
+//	prod.local 10.0.0.53:53
+//
+// web.production.dev.local is answered with the services registered with
+// "Zone":"dev.local". Each zone has its own SOA and NS records, and names a
+// zone doesn't have are forwarded to its nameservers, if it has any.
+func (s *Server) EnableZones(file string) error {
+	list, err := loadZones(file, s.domain)
+	if err != nil {
+		return err
+	}
+	s.zones = &zones{file: file, list: list}
+	return nil
+}
+
+// ReloadZones reloads the zones, the current zones are kept when the file
+// can't be loaded.
+func (s *Server) ReloadZones() error {
+	if s.zones == nil {
+		return nil
+	}
+	list, err := loadZones(s.zones.file, s.domain)
+	if err != nil {
+		return err
+	}
+	s.zones.Lock()
+	s.zones.list = list
+	s.zones.Unlock()
+	return nil
+}
+
+// zoneOf returns the zone name is in, ok is false when it is in none.
+func (s *Server) zoneOf(name string) (z zone, ok bool) {
+	if s.zones == nil {
+		return zone{}, false
+	}
+	s.zones.RLock()
+	defer s.zones.RUnlock()
+	for _, c := range s.zones.list {
+		if inDomain(name, c.name) && len(c.name) > len(z.name) {
+			z, ok = c, true
+		}
+	}
+	return
+}
+
+// zoneRequest returns the request with the zone of its query name replaced by
+// the SkyDNS domain, the zone, and a ResponseWriter that puts the zone back
+// in the reply. When the name is in no zone, w and req are returned unchanged.
+func (s *Server) zoneRequest(w dns.ResponseWriter, req *dns.Msg) (dns.ResponseWriter, *dns.Msg, string) {
+	name := req.Question[0].Name
+	z, ok := s.zoneOf(name)
+	if !ok {
+		return w, req, ""
+	}
+
+	r := req.Copy()
+	r.Question[0].Name = rename(name, z.name, s.domain)
+	return &zoneWriter{ResponseWriter: w, s: s, req: req, zone: z}, r, z.name
+}
+
+// zoneApex returns true if name is the SkyDNS domain or one of the zones.
+func (s *Server) zoneApex(name string) bool {
+	if strings.EqualFold(dns.Fqdn(name), dns.Fqdn(s.domain)) {
+		return true
+	}
+	z, ok := s.zoneOf(name)
+	return ok && strings.EqualFold(strings.TrimSuffix(name, "."), z.name)
+}
+
+// origin returns the domain the names of serv are in, its zone or the SkyDNS
+// domain.
+func (s *Server) origin(serv msg.Service) string {
+	if serv.Zone != "" {
+		return serv.Zone
+	}
+	return s.domain
+}
+
+// rename returns name with its suffix from replaced by to, name must be from
+// or a name below it.
+func rename(name, from, to string) string {
+	n := len(strings.TrimSuffix(name, ".")) - len(strings.TrimSuffix(from, "."))
+	return name[:n] + dns.Fqdn(to)
+}
+
+// inZone returns the services in zone, those without a zone are in the
+// SkyDNS domain.
+func inZone(services []msg.Service, zone string) []msg.Service {
+	z := services[:0]
+	for _, serv := range services {
+		if strings.EqualFold(strings.TrimSuffix(serv.Zone, "."), zone) {
+			z = append(z, serv)
+		}
+	}
+	return z
+}
+
+// zoneWriter moves the records in the reply from the SkyDNS domain to the
+// zone that was queried, and forwards the query when the zone doesn't have
+// the name.
+type zoneWriter struct {
+	dns.ResponseWriter
+	s    *Server
+	req  *dns.Msg // as queried
+	zone zone
+}
+
+// WriteMsg moves m to the zone and writes it.
+func (z *zoneWriter) WriteMsg(m *dns.Msg) error {
+	if m.Rcode == dns.RcodeNameError && len(z.zone.nameservers) > 0 {
+		if r := z.forward(); r != nil {
+			return z.ResponseWriter.WriteMsg(r)
+		}
+	}
+
+	for i := range m.Question {
+		m.Question[i].Name = z.req.Question[0].Name
+	}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			z.move(&rr.Header().Name)
+			switch rr := rr.(type) {
+			case *dns.SRV:
+				z.move(&rr.Target)
+			case *dns.CNAME:
+				z.move(&rr.Target)
+			case *dns.NS:
+				z.move(&rr.Ns)
+			case *dns.SOA:
+				z.move(&rr.Ns)
+				z.move(&rr.Mbox)
+			case *dns.NAPTR:
+				z.move(&rr.Replacement)
+			}
+		}
+	}
+	return z.ResponseWriter.WriteMsg(m)
+}
+
+// move moves the name at n from the SkyDNS domain to the zone.
+func (z *zoneWriter) move(n *string) {
+	if inDomain(*n, z.s.domain) {
+		*n = rename(*n, z.s.domain, z.zone.name)
+	}
+}
+
+// forward asks the nameservers of the zone, it returns nil when all of them
+// fail.
+func (z *zoneWriter) forward() *dns.Msg {
+	network := "udp"
+	if _, ok := z.RemoteAddr().(*net.TCPAddr); ok {
+		network = "tcp"
+	}
+	c := &dns.Client{Net: network}
+	for _, ns := range z.zone.nameservers {
+		r, _, err := c.Exchange(z.req, ns)
+		if err != nil || r.Rcode == dns.RcodeServerFailure {
+			slog.Warn("Forwarding DNS request", "name", z.req.Question[0].Name, "zone", z.zone.name, "nameserver", ns, "err", err)
+			continue
+		}
+		return r
+	}
+	return nil
+}
@@ -1,16 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/codegangsta/cli"
 	"github.com/skynetservices/skydns/client"
 	"github.com/skynetservices/skydns/msg"
+	"io"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// restoreBatchSize is the most bytes of services restore sends in one batch,
+// well under the default -maxbody of the server.
+const restoreBatchSize = 512 << 10
+
+// dump is the registry as written by the dump command and read by restore.
+type dump struct {
+	Services []msg.Service
+	Aliases  []msg.Alias
+}
+
 func writeError(err error) {
 	fmt.Fprintf(os.Stderr, "%s\n", err)
 	os.Exit(1)
@@ -31,9 +44,13 @@ func writeService(c *cli.Context, service *msg.Service) {
 			service.Region,
 			service.Version)
 
+		if service.Host6 != "" {
+			fmt.Printf("Host6: %s\n", service.Host6)
+		}
+
 		fmt.Printf("TTL %d\nRemaining TTL: %d\n",
 			service.TTL,
-			service.RemainingTTL())
+			service.RemainingTTL(time.Now()))
 	}
 }
 
@@ -100,6 +117,36 @@ func loadCommands(app *cli.App) {
 			Usage:  "update a service's ttl in skydns",
 			Action: updateAction,
 		},
+		{
+			Name:   "search",
+			Usage:  "list the services matching a name with wildcards",
+			Action: searchAction,
+		},
+		{
+			Name:   "bump",
+			Usage:  "update the ttl of all services matching a name with wildcards",
+			Action: bumpAction,
+		},
+		{
+			Name:   "dump",
+			Usage:  "write all services and aliases to a file, or stdout",
+			Action: dumpAction,
+		},
+		{
+			Name:   "restore",
+			Usage:  "register the services and aliases of a dump",
+			Action: restoreAction,
+		},
+		{
+			Name:   "cluster",
+			Usage:  "show the leader and the members of the cluster",
+			Action: clusterAction,
+		},
+		{
+			Name:   "events",
+			Usage:  "tail the changes of the registry",
+			Action: eventsAction,
+		},
 	}
 }
 
@@ -139,7 +186,7 @@ func deleteAction(c *cli.Context) {
 
 	uuid := c.Args().Get(0)
 
-	if err := skydns.Delete(uuid); err != nil {
+	if err := skydns.Deregister(uuid); err != nil {
 		writeError(err)
 	}
 	fmt.Printf("%s removed from skydns\n", uuid)
@@ -206,6 +253,207 @@ func getAction(c *cli.Context) {
 	}
 }
 
+// List the services matching a name in the domain format, in which labels
+// may be * or left out
+//
+// format: skydnsctl search testservice.*.east
+func searchAction(c *cli.Context) {
+	skydns, err := newClientFromContext(c)
+	if err != nil {
+		writeError(err)
+	}
+
+	services, err := skydns.Resolve(c.Args().Get(0))
+	if err != nil {
+		writeError(err)
+	}
+	for i := range services {
+		writeService(c, &services[i])
+		fmt.Printf("\n----\n")
+	}
+}
+
+// Update the ttl of all services matching a name
+//
+// format: skydnsctl bump testservice.production 3000
+func bumpAction(c *cli.Context) {
+	skydns, err := newClientFromContext(c)
+	if err != nil {
+		writeError(err)
+	}
+
+	ttl, err := strconv.Atoi(c.Args().Get(1))
+	if err != nil {
+		writeError(err)
+	}
+	services, err := skydns.Resolve(c.Args().Get(0))
+	if err != nil {
+		writeError(err)
+	}
+	for _, service := range services {
+		if err := skydns.Update(service.UUID, uint32(ttl)); err != nil {
+			writeError(fmt.Errorf("%s: %s", service.UUID, err))
+		}
+		fmt.Printf("%s ttl updated to %d\n", service.UUID, ttl)
+	}
+}
+
+// Write all services and aliases as JSON
+//
+// format: skydnsctl dump [file]
+func dumpAction(c *cli.Context) {
+	skydns, err := newClientFromContext(c)
+	if err != nil {
+		writeError(err)
+	}
+
+	var d dump
+	services, err := skydns.GetAllServices()
+	if err != nil {
+		writeError(err)
+	}
+	for _, service := range services {
+		d.Services = append(d.Services, *service)
+	}
+	if d.Aliases, err = skydns.GetAliases(); err != nil {
+		writeError(err)
+	}
+
+	var w io.Writer = os.Stdout
+	if file := c.Args().Get(0); file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			writeError(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := msg.DefaultCodec.Encode(w, d); err != nil {
+		writeError(err)
+	}
+}
+
+// Register the services and aliases of a dump, read from a file or stdin
+//
+// format: skydnsctl restore [file]
+func restoreAction(c *cli.Context) {
+	skydns, err := newClientFromContext(c)
+	if err != nil {
+		writeError(err)
+	}
+
+	var r io.Reader = os.Stdin
+	if file := c.Args().Get(0); file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			writeError(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	var d dump
+	if err := msg.DefaultCodec.Decode(r, &d); err != nil {
+		writeError(err)
+	}
+
+	services, aliases := 0, 0
+	for _, batch := range batches(d.Services, restoreBatchSize) {
+		results, err := skydns.AddBatch(batch)
+		if err != nil {
+			writeError(err)
+		}
+		for _, result := range results {
+			if result.Error != "" {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", result.UUID, result.Error)
+				continue
+			}
+			services++
+		}
+	}
+	for _, a := range d.Aliases {
+		if err := skydns.AddAlias(a); err != nil {
+			fmt.Fprintf(os.Stderr, "alias %s: %s\n", a.Name, err)
+			continue
+		}
+		aliases++
+	}
+	fmt.Printf("%d services and %d aliases restored\n", services, aliases)
+	if services < len(d.Services) || aliases < len(d.Aliases) {
+		os.Exit(1)
+	}
+}
+
+// batches splits services in batches of at most size bytes when encoded. A
+// service larger than size is a batch of its own.
+func batches(services []msg.Service, size int) (out [][]msg.Service) {
+	var b bytes.Buffer
+	start, n := 0, 0
+	for i, serv := range services {
+		b.Reset()
+		if err := msg.DefaultCodec.Encode(&b, serv); err != nil {
+			writeError(err)
+		}
+		if n+b.Len() > size && i > start {
+			out = append(out, services[start:i])
+			start, n = i, 0
+		}
+		n += b.Len()
+	}
+	if start < len(services) {
+		out = append(out, services[start:])
+	}
+	return out
+}
+
+// Show the leader and the members of the cluster
+//
+// format: skydnsctl cluster
+func clusterAction(c *cli.Context) {
+	skydns, err := newClientFromContext(c)
+	if err != nil {
+		writeError(err)
+	}
+
+	cluster, err := skydns.GetCluster()
+	if err != nil {
+		writeError(err)
+	}
+	if c.GlobalBool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(cluster); err != nil {
+			writeError(err)
+		}
+		return
+	}
+	fmt.Printf("Leader: %s\n", cluster.Leader)
+	for _, m := range cluster.Members {
+		fmt.Printf("Member: %s\n", m)
+	}
+}
+
+// Print the changes of the registry as they happen, until interrupted
+//
+// format: skydnsctl events
+func eventsAction(c *cli.Context) {
+	skydns, err := newClientFromContext(c)
+	if err != nil {
+		writeError(err)
+	}
+
+	events, _ := skydns.Watch()
+	for e := range events {
+		switch {
+		case c.GlobalBool("json"):
+			if err := json.NewEncoder(os.Stdout).Encode(e); err != nil {
+				writeError(err)
+			}
+		case e.Service != nil:
+			fmt.Printf("%d %s service %s %s:%d (%s.%s)\n", e.Serial, e.Type, e.Service.UUID, e.Service.Host, e.Service.Port, e.Service.Name, e.Service.Environment)
+		case e.Alias != nil:
+			fmt.Printf("%d %s alias %s -> %s\n", e.Serial, e.Type, e.Alias.Name, e.Alias.Target)
+		}
+	}
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Author = "skydns"
@@ -0,0 +1,250 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package skydnstest runs SkyDNS clusters in process, for tests.
+//
+//	c, err := skydnstest.NewCluster(3)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer c.Close()
+//
+// Every node listens on random ports on 127.0.0.1 and uses short raft
+// timeouts, so leaders are elected within milliseconds.
+package skydnstest
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/client"
+	"github.com/skynetservices/skydns/msg"
+	"github.com/skynetservices/skydns/server"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Domain is the domain of the clusters started by NewCluster.
+const Domain = "skydns.test"
+
+var (
+	HeartbeatInterval = 10 * time.Millisecond
+	ElectionTimeout   = 50 * time.Millisecond
+)
+
+var ErrNoLeader = errors.New("No leader elected")
+
+// Clock is a fake clock for the expiry of services, see NewClusterWithClock.
+type Clock struct {
+	sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a clock that stands still at the current time.
+func NewClock() *Clock {
+	return &Clock{now: time.Now()}
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	c.Unlock()
+}
+
+// Node is a SkyDNS server of a cluster.
+type Node struct {
+	*server.Server
+	dataDir string
+	stopped bool
+}
+
+// Cluster is a number of SkyDNS servers forming a raft cluster.
+type Cluster struct {
+	Nodes []*Node
+}
+
+// NewCluster starts a cluster of n nodes and waits for its leader to be
+// elected. The first node bootstraps the cluster, the others join it.
+func NewCluster(n int) (*Cluster, error) {
+	return NewClusterWithClock(n, nil)
+}
+
+// NewClusterWithClock starts a cluster like NewCluster whose nodes expire
+// services by clock, or the system clock if clock is nil.
+func NewClusterWithClock(n int, clock *Clock) (*Cluster, error) {
+	c := new(Cluster)
+	for i := 0; i < n; i++ {
+		var members []string
+		if i > 0 {
+			members = []string{c.Nodes[0].HTTPAddr()}
+		}
+		node, err := startNode(members, clock)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.Nodes = append(c.Nodes, node)
+		if i == 0 {
+			if _, err := c.WaitForLeader(5 * time.Second); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+func startNode(members []string, clock *Clock) (*Node, error) {
+	dir, err := ioutil.TempDir("", "skydnstest-")
+	if err != nil {
+		return nil, err
+	}
+	dnsAddr, err := freeAddr()
+	if err != nil {
+		return nil, err
+	}
+	httpAddr, err := freeAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	s := server.NewServer(members, Domain, dnsAddr, httpAddr, dir, time.Second, time.Second, "", nil)
+	s.SetRaftTimeouts(HeartbeatInterval, ElectionTimeout)
+	s.EnableForwarding()
+	if clock != nil {
+		s.SetClock(clock.Now)
+	}
+	if _, err := s.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &Node{Server: s, dataDir: dir}, waitListening(dnsAddr, httpAddr)
+}
+
+// freeAddr returns a 127.0.0.1 address with a port that is free for both TCP
+// and UDP.
+func freeAddr() (string, error) {
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+		addr := l.Addr().String()
+		l.Close()
+
+		if u, err := net.ListenPacket("udp", addr); err == nil {
+			u.Close()
+			return addr, nil
+		}
+	}
+	return "", errors.New("No free port found")
+}
+
+// waitListening waits until the DNS and HTTP servers accept connections.
+func waitListening(addrs ...string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, a := range addrs {
+		for {
+			conn, err := net.Dial("tcp", a)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				return err
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// Leader returns the index of the node that is the leader, or -1.
+func (c *Cluster) Leader() int {
+	for i, n := range c.Nodes {
+		if !n.stopped && n.IsLeader() {
+			return i
+		}
+	}
+	return -1
+}
+
+// WaitForLeader waits at most timeout for a leader to be elected and returns
+// its index.
+func (c *Cluster) WaitForLeader(timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if i := c.Leader(); i >= 0 {
+			return i, nil
+		}
+		if time.Now().After(deadline) {
+			return -1, ErrNoLeader
+		}
+		time.Sleep(HeartbeatInterval)
+	}
+}
+
+// Stop stops the raft server of node i, the cluster sees it as failed.
+func (c *Cluster) Stop(i int) {
+	if !c.Nodes[i].stopped {
+		c.Nodes[i].stopped = true
+		c.Nodes[i].Server.Stop()
+	}
+}
+
+// Close stops all nodes and removes their data.
+func (c *Cluster) Close() {
+	for i, n := range c.Nodes {
+		c.Stop(i)
+		os.RemoveAll(n.dataDir)
+	}
+}
+
+// Client returns an API client talking to node i.
+func (c *Cluster) Client(i int) (*client.Client, error) {
+	return client.NewClient("http://"+c.Nodes[i].HTTPAddr(), "", Domain, c.Nodes[i].DNSAddr())
+}
+
+// Lookup queries node i for name, relative to Domain, and type qtype.
+func (c *Cluster) Lookup(i int, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name+"."+Domain), qtype)
+	r, _, err := new(dns.Client).Exchange(m, c.Nodes[i].DNSAddr())
+	return r, err
+}
+
+// Register adds the service s with uuid through the leader.
+func (c *Cluster) Register(uuid string, s msg.Service) error {
+	i := c.Leader()
+	if i < 0 {
+		return ErrNoLeader
+	}
+	cl, err := c.Client(i)
+	if err != nil {
+		return err
+	}
+	return cl.Add(uuid, &s)
+}
+
+// WaitFor waits at most timeout for f to return true, polling every heartbeat.
+func WaitFor(timeout time.Duration, f func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !f() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(HeartbeatInterval)
+	}
+	return true
+}
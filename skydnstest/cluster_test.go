@@ -0,0 +1,167 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package skydnstest
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"github.com/skynetservices/skydns/client"
+	"github.com/skynetservices/skydns/msg"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var service = msg.Service{
+	Name:        "TestService",
+	Version:     "1.0.0",
+	Region:      "Test",
+	Host:        "localhost",
+	Environment: "Production",
+	Port:        9000,
+	TTL:         30,
+}
+
+func TestClusterReplication(t *testing.T) {
+	c, err := NewCluster(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Register("100", service); err != nil {
+		t.Fatal(err)
+	}
+	for i := range c.Nodes {
+		ok := WaitFor(time.Second, func() bool {
+			r, err := c.Lookup(i, "testservice.production", dns.TypeSRV)
+			return err == nil && len(r.Answer) == 1
+		})
+		if !ok {
+			t.Fatalf("Service should be replicated to node %d", i)
+		}
+	}
+}
+
+func TestClusterLeaderFailover(t *testing.T) {
+	c, err := NewCluster(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	old := c.Leader()
+	c.Stop(old)
+
+	i, err := c.WaitForLeader(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i == old {
+		t.Fatal("A new leader should have been elected")
+	}
+	if err := c.Register("100", service); err != nil {
+		t.Fatal("The new leader should accept registrations:", err)
+	}
+}
+
+func TestClusterForwarding(t *testing.T) {
+	c, err := NewCluster(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	leader := c.Leader()
+	follower := (leader + 1) % len(c.Nodes)
+	cl, err := c.Client(follower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Add("100", &service); err != nil {
+		t.Fatal("A follower should forward registrations to the leader:", err)
+	}
+	lc, err := c.Client(leader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lc.Get("100"); err != nil {
+		t.Fatal("The leader should have the forwarded service:", err)
+	}
+	if err := cl.Delete("100"); err != nil {
+		t.Fatal("A follower should forward removals to the leader:", err)
+	}
+
+	resp, err := http.Get("http://" + c.Nodes[follower].HTTPAddr() + "/skydns/leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Leader   string
+		IsLeader bool
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Leader != c.Nodes[leader].HTTPAddr() || reply.IsLeader {
+		t.Fatalf("Follower should point to leader %s, got %+v", c.Nodes[leader].HTTPAddr(), reply)
+	}
+}
+
+func TestClusterExpiry(t *testing.T) {
+	clock := NewClock()
+	c, err := NewClusterWithClock(3, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Register("100", service); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(31 * time.Second)
+
+	// The leader expires services every second
+	for i := range c.Nodes {
+		ok := WaitFor(3*time.Second, func() bool {
+			r, err := c.Lookup(i, "testservice.production", dns.TypeSRV)
+			return err == nil && r.Rcode == dns.RcodeNameError
+		})
+		if !ok {
+			t.Fatalf("Service should have expired on node %d", i)
+		}
+	}
+}
+
+func TestClientFailover(t *testing.T) {
+	c, err := NewCluster(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dead, _ := freeAddr()
+	n := c.Nodes[0]
+	cl, err := client.NewClient("http://"+dead+",http://"+n.HTTPAddr(), "", Domain, dead+","+n.DNSAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.SetCircuitBreaker(1, time.Minute)
+
+	if err := cl.Add("100", &service); err != nil {
+		t.Fatal("Add should fail over to the live server:", err)
+	}
+	if healthy := cl.CheckHealth(); healthy != 1 {
+		t.Fatalf("Expected 1 healthy server, got %d", healthy)
+	}
+	if err := cl.Discover(); err != nil {
+		t.Fatal(err)
+	}
+	cl.DNS = true
+	if s, err := cl.GetAllServicesDNS(); err != nil || len(s) != 1 {
+		t.Fatal("DNS queries should fail over to the live server:", err)
+	}
+}
@@ -0,0 +1,168 @@
+package stats
+
+import (
+	"github.com/rcrowley/go-metrics"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Default intervals at which metrics are reported.
+const (
+	DefaultInterval       = 10 * time.Second
+	DefaultStdErrInterval = 60 * time.Second
+)
+
+// Config tells where to report the metrics to, the zero value reports them
+// nowhere.
+type Config struct {
+	Registry       metrics.Registry // metrics to report, the SkyDNS metrics are registered in it; defaults to metrics.DefaultRegistry
+	Interval       time.Duration    // of reports to Graphite, StatHat and StatsD, defaults to DefaultInterval
+	StdErr         bool             // log the metrics to stderr every DefaultStdErrInterval
+	Graphite       string           // address of a Graphite server, e.g. 127.0.0.1:2003
+	GraphitePrefix string           // prefix of the metrics in Graphite, defaults to "skydns"
+	StatHatUser    string           // StatHat account
+	StatsD         string           // address of a StatsD server, e.g. 127.0.0.1:8125
+	StatsDPrefix   string           // prefix of the metrics in StatsD, defaults to "skydns"
+	StatsDTags     []string         // DogStatsD tags sent with every metric, e.g. "env:prod"
+}
+
+var (
+	registries      = []metrics.Registry{metrics.DefaultRegistry}
+	registriesMutex sync.Mutex
+)
+
+// register registers the metric m as name in the default registry and those
+// of the collectors.
+func register(name string, m interface{}) {
+	registriesMutex.Lock()
+	defer registriesMutex.Unlock()
+	for _, r := range registries {
+		r.Register(name, m)
+	}
+}
+
+// addRegistry registers the metrics of the default registry in r, and the
+// metrics registered from now on.
+func addRegistry(r metrics.Registry) {
+	registriesMutex.Lock()
+	defer registriesMutex.Unlock()
+	for _, have := range registries {
+		if have == r {
+			return
+		}
+	}
+	metrics.DefaultRegistry.Each(func(name string, m interface{}) { r.Register(name, m) })
+	registries = append(registries, r)
+}
+
+// Collector reports the metrics of a registry as configured.
+type Collector struct {
+	registry metrics.Registry
+	statsd   *statsd
+	cue      chan interface{} // logs the metrics to stderr when sent on
+	stop     chan struct{}    // closed by Stop
+	wg       sync.WaitGroup   // reporters running
+	once     sync.Once
+}
+
+// New returns a Collector for cfg, which starts reporting the metrics right
+// away.
+func New(cfg Config) (*Collector, error) {
+	if cfg.Registry == nil {
+		cfg.Registry = metrics.DefaultRegistry
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.GraphitePrefix == "" {
+		cfg.GraphitePrefix = "skydns"
+	}
+	if cfg.StatsDPrefix == "" {
+		cfg.StatsDPrefix = "skydns"
+	}
+
+	var g *graphite
+	if cfg.Graphite != "" {
+		addr, err := net.ResolveTCPAddr("tcp", cfg.Graphite)
+		if err != nil {
+			return nil, err
+		}
+		g = &graphite{registry: cfg.Registry, addr: addr, prefix: cfg.GraphitePrefix}
+	}
+	c := &Collector{registry: cfg.Registry, stop: make(chan struct{})}
+	if cfg.StatsD != "" {
+		var err error
+		if c.statsd, err = newStatsd(cfg.Registry, cfg.StatsD, cfg.StatsDPrefix, cfg.StatsDTags); err != nil {
+			return nil, err
+		}
+	}
+	addRegistry(cfg.Registry)
+
+	if cfg.StdErr {
+		c.cue = make(chan interface{})
+		go metrics.LogOnCue(cfg.Registry, c.cue, log.New(os.Stderr, "metrics: ", log.Lmicroseconds))
+		c.every(DefaultStdErrInterval, "stderr", func() error {
+			c.cue <- struct{}{}
+			return nil
+		})
+	}
+	if g != nil {
+		c.every(cfg.Interval, "graphite", g.report)
+	}
+	if cfg.StatHatUser != "" {
+		sh := &stathatReporter{registry: cfg.Registry, user: cfg.StatHatUser, counts: make(map[string]int64)}
+		c.every(cfg.Interval, "stathat", sh.report)
+	}
+	if c.statsd != nil {
+		c.every(cfg.Interval, "statsd", c.statsd.report)
+	}
+	return c, nil
+}
+
+// every runs report every interval until c is stopped.
+func (c *Collector) every(interval time.Duration, to string, report func() error) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-tick.C:
+				if err := report(); err != nil {
+					slog.Error("Reporting metrics", "to", to, "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops reporting the metrics, and waits for reports in flight.
+func (c *Collector) Stop() {
+	c.once.Do(func() {
+		close(c.stop)
+		c.wg.Wait()
+		if c.cue != nil {
+			close(c.cue)
+		}
+		if c.statsd != nil {
+			c.statsd.conn.Close()
+		}
+	})
+}
+
+// Registry returns the registry of the metrics c reports.
+func (c *Collector) Registry() metrics.Registry { return c.registry }
+
+// ServeHTTP serves the metrics of c to Prometheus.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WritePrometheus(w, c.registry)
+}
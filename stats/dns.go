@@ -0,0 +1,46 @@
+package stats
+
+import (
+	"github.com/rcrowley/go-metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where answers to DNS queries come from.
+const (
+	SourceRegistry = "registry" // answered from the registry
+	SourceCache    = "cache"    // answered from the forward, negative or answer cache
+	SourceForward  = "forward"  // answered by a nameserver queries are forwarded to
+)
+
+var (
+	dnsTimers   = make(map[string]metrics.Timer)   // source-qtype -> latency
+	rcodeCounts = make(map[string]metrics.Counter) // rcode -> answers
+	dnsMutex    sync.Mutex
+)
+
+// DNSAnswered records an answer to a query of type qtype (e.g. "A"), from
+// source (one of the Source* constants), with response code rcode (e.g.
+// "NXDOMAIN") that took d to answer.
+func DNSAnswered(qtype, source, rcode string, d time.Duration) {
+	qtype, rcode = strings.ToLower(qtype), strings.ToLower(rcode)
+
+	dnsMutex.Lock()
+	t, ok := dnsTimers[source+"-"+qtype]
+	if !ok {
+		t = metrics.NewTimer()
+		register("skydns-dns-latency-"+source+"-"+qtype, t)
+		dnsTimers[source+"-"+qtype] = t
+	}
+	c, ok := rcodeCounts[rcode]
+	if !ok {
+		c = metrics.NewCounter()
+		register("skydns-dns-rcode-"+rcode, c)
+		rcodeCounts[rcode] = c
+	}
+	dnsMutex.Unlock()
+
+	t.Update(d)
+	c.Inc(1)
+}
@@ -0,0 +1,70 @@
+package stats
+
+import (
+	"github.com/rcrowley/go-metrics"
+	"sync"
+	"time"
+)
+
+// LockStat summarizes the time spent waiting for, or holding, a lock. All
+// durations are in nanoseconds.
+type LockStat struct {
+	Count int64
+	Mean  float64
+	P50   float64
+	P95   float64
+	P99   float64
+	Max   int64
+}
+
+// LockStats holds the wait and hold time of a lock for one operation.
+type LockStats struct {
+	Wait LockStat
+	Hold LockStat
+}
+
+var (
+	lockTimers      = make(map[string][2]metrics.Timer) // operation -> {wait, hold}
+	lockTimersMutex sync.Mutex
+)
+
+func lockTimer(op string) [2]metrics.Timer {
+	lockTimersMutex.Lock()
+	defer lockTimersMutex.Unlock()
+
+	if t, ok := lockTimers[op]; ok {
+		return t
+	}
+	t := [2]metrics.Timer{metrics.NewTimer(), metrics.NewTimer()}
+	register("skydns-registry-lock-wait-"+op, t[0])
+	register("skydns-registry-lock-hold-"+op, t[1])
+	lockTimers[op] = t
+	return t
+}
+
+// RegistryLockWait records the time operation op waited for the registry lock.
+func RegistryLockWait(op string, d time.Duration) {
+	lockTimer(op)[0].Update(d)
+}
+
+// RegistryLockHold records the time operation op held the registry lock.
+func RegistryLockHold(op string, d time.Duration) {
+	lockTimer(op)[1].Update(d)
+}
+
+// RegistryLockStats returns the registry lock statistics per operation.
+func RegistryLockStats() map[string]LockStats {
+	lockTimersMutex.Lock()
+	defer lockTimersMutex.Unlock()
+
+	s := make(map[string]LockStats, len(lockTimers))
+	for op, t := range lockTimers {
+		s[op] = LockStats{Wait: lockStat(t[0]), Hold: lockStat(t[1])}
+	}
+	return s
+}
+
+func lockStat(t metrics.Timer) LockStat {
+	ps := t.Percentiles([]float64{0.5, 0.95, 0.99})
+	return LockStat{Count: t.Count(), Mean: t.Mean(), P50: ps[0], P95: ps[1], P99: ps[2], Max: t.Max()}
+}
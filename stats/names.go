@@ -0,0 +1,123 @@
+package stats
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxClientSubnets is the number of client subnets counted separately per name
+// and window, queries from other subnets are counted under "other".
+const MaxClientSubnets = 256
+
+// QueryWindow holds the queries for a name in a rolling window.
+type QueryWindow struct {
+	Window  string
+	Queries int64
+	Clients map[string]int64 // client subnet -> queries
+}
+
+// bucket counts the queries in one minute or hour.
+type bucket struct {
+	start   time.Time
+	queries int64
+	clients map[string]int64
+}
+
+func (b *bucket) add(start time.Time, subnet string) {
+	if !b.start.Equal(start) {
+		*b = bucket{start: start, clients: make(map[string]int64)}
+	}
+	b.queries++
+	if _, ok := b.clients[subnet]; !ok && len(b.clients) >= MaxClientSubnets {
+		subnet = "other"
+	}
+	b.clients[subnet]++
+}
+
+// nameQueries counts the queries for a name per minute for the last hour and
+// per hour for the last day.
+type nameQueries struct {
+	minutes [60]bucket
+	hours   [24]bucket
+	last    time.Time // of the last query
+}
+
+// nameIdle is how long a name without queries is kept, the longest window.
+const nameIdle = 24 * time.Hour
+
+var (
+	names      = make(map[string]*nameQueries)
+	namesMutex sync.Mutex
+	lastEvict  time.Time
+)
+
+// Queried records a query for the service name from a client in subnet.
+func Queried(name, subnet string) {
+	name = strings.ToLower(name)
+	now := time.Now()
+
+	namesMutex.Lock()
+	defer namesMutex.Unlock()
+
+	// Names are made up by clients, the ones that aren't queried anymore
+	// would pile up
+	if now.Sub(lastEvict) >= time.Minute {
+		evictNames(now)
+		lastEvict = now
+	}
+	n, ok := names[name]
+	if !ok {
+		n = new(nameQueries)
+		names[name] = n
+	}
+	n.last = now
+	m, h := now.Truncate(time.Minute), now.Truncate(time.Hour)
+	n.minutes[m.Unix()/60%60].add(m, subnet)
+	n.hours[h.Unix()/3600%24].add(h, subnet)
+}
+
+// evictNames forgets the names that had no queries in the nameIdle before
+// now, they are all 0. namesMutex must be held.
+func evictNames(now time.Time) {
+	for name, n := range names {
+		if now.Sub(n.last) >= nameIdle {
+			delete(names, name)
+		}
+	}
+}
+
+// NameQueries returns the queries for the service name in the last 5 minutes,
+// hour and day.
+func NameQueries(name string) []QueryWindow {
+	name = strings.ToLower(name)
+	now := time.Now()
+
+	namesMutex.Lock()
+	defer namesMutex.Unlock()
+
+	n, ok := names[name]
+	if !ok {
+		n = new(nameQueries)
+	}
+	return []QueryWindow{
+		sum("5m", n.minutes[:], now.Add(-5*time.Minute)),
+		sum("1h", n.minutes[:], now.Add(-time.Hour)),
+		sum("24h", n.hours[:], now.Add(-24*time.Hour)),
+	}
+}
+
+// sum adds up the buckets that started after since.
+func sum(window string, buckets []bucket, since time.Time) QueryWindow {
+	w := QueryWindow{Window: window, Clients: make(map[string]int64)}
+	for _, b := range buckets {
+		if !b.start.After(since) {
+			continue
+		}
+		w.Queries += b.queries
+		for c, q := range b.clients {
+			w.Clients[c] += q
+		}
+	}
+	return w
+}
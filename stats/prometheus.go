@@ -0,0 +1,97 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rcrowley/go-metrics"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Gauges of the state of the server, updated by the server before they're
+// exported.
+var (
+	RegistrySize metrics.Gauge // services in the registry
+	RaftState    metrics.Gauge // see the RaftState* constants
+)
+
+// Values of the RaftState gauge.
+const (
+	RaftStateStopped = iota
+	RaftStateFollower
+	RaftStateCandidate
+	RaftStateLeader
+)
+
+// quantiles exported for timers and histograms.
+var quantiles = []float64{0.5, 0.95, 0.99}
+
+func init() {
+	RegistrySize = metrics.NewGauge()
+	register("skydns-registry-services", RegistrySize)
+
+	RaftState = metrics.NewGauge()
+	register("skydns-raft-state", RaftState)
+}
+
+// prometheusName returns the Prometheus name of the metric name, e.g.
+// skydns_requests for skydns-requests.
+func prometheusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// WritePrometheus writes the metrics in r to w in the Prometheus text format.
+// Counters and meters become counters with a _total suffix, timers become
+// summaries in seconds and histograms summaries of their values.
+func WritePrometheus(w io.Writer, r metrics.Registry) error {
+	all := make(map[string]interface{})
+	r.Each(func(name string, m interface{}) { all[prometheusName(name)] = m })
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := bufio.NewWriter(w)
+	for _, name := range names {
+		switch m := all[name].(type) {
+		case metrics.Counter:
+			fmt.Fprintf(b, "# TYPE %s_total counter\n%s_total %d\n", name, name, m.Count())
+		case metrics.Meter:
+			fmt.Fprintf(b, "# TYPE %s_total counter\n%s_total %d\n", name, name, m.Count())
+		case metrics.Gauge:
+			fmt.Fprintf(b, "# TYPE %s gauge\n%s %d\n", name, name, m.Value())
+		case metrics.GaugeFloat64:
+			fmt.Fprintf(b, "# TYPE %s gauge\n%s %g\n", name, name, m.Value())
+		case metrics.Timer:
+			t := m.Snapshot()
+			summary(b, name+"_seconds", t.Percentiles(quantiles), float64(t.Sum())/1e9, t.Count(), 1e9)
+		case metrics.Histogram:
+			h := m.Snapshot()
+			summary(b, name, h.Percentiles(quantiles), float64(h.Sum()), h.Count(), 1)
+		}
+	}
+	return b.Flush()
+}
+
+// summary writes a summary, the quantiles are divided by unit.
+func summary(w io.Writer, name string, ps []float64, sum float64, count int64, unit float64) {
+	fmt.Fprintf(w, "# TYPE %s summary\n", name)
+	for i, q := range quantiles {
+		fmt.Fprintf(w, "%s{quantile=\"%g\"} %g\n", name, q, ps[i]/unit)
+	}
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, sum, name, count)
+}
+
+// PrometheusHandler serves the metrics of the default registry to Prometheus.
+func PrometheusHandler(w http.ResponseWriter, req *http.Request) {
+	(&Collector{registry: metrics.DefaultRegistry}).ServeHTTP(w, req)
+}
@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stathat/go"
+	"net"
+	"time"
+)
+
+// each calls f for every metric of r with its value. Counters and meters are
+// counts, of timers the count is a count and the mean and percentiles are
+// values in milliseconds, named after the timer with a suffix.
+func each(r metrics.Registry, f func(name string, value interface{}, count bool)) {
+	r.Each(func(name string, m interface{}) {
+		switch m := m.(type) {
+		case metrics.Counter:
+			f(name, m.Count(), true)
+		case metrics.Meter:
+			f(name, m.Count(), true)
+		case metrics.Gauge:
+			f(name, m.Value(), false)
+		case metrics.GaugeFloat64:
+			f(name, m.Value(), false)
+		case metrics.Timer:
+			t := m.Snapshot()
+			f(name+".count", t.Count(), true)
+			f(name+".mean", t.Mean()/1e6, false)
+			for i, p := range t.Percentiles(quantiles) {
+				f(fmt.Sprintf("%s.p%g", name, quantiles[i]*100), p/1e6, false)
+			}
+		}
+	})
+}
+
+// graphite reports the metrics of a registry to a Graphite server, in its
+// plaintext protocol over a new TCP connection each time.
+type graphite struct {
+	registry metrics.Registry
+	addr     *net.TCPAddr
+	prefix   string
+}
+
+// report sends the metrics once, counts as they are.
+func (g *graphite) report() error {
+	conn, err := net.DialTCP("tcp", nil, g.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	now := time.Now().Unix()
+	each(g.registry, func(name string, value interface{}, _ bool) {
+		fmt.Fprintf(w, "%s.%s %v %d\n", g.prefix, name, value, now)
+	})
+	return w.Flush()
+}
+
+// stathatReporter reports the metrics of a registry to a StatHat account.
+type stathatReporter struct {
+	registry metrics.Registry
+	user     string
+	counts   map[string]int64 // counts last reported, counters are sent as deltas
+}
+
+// report sends the metrics once.
+func (s *stathatReporter) report() error {
+	var err error
+	each(s.registry, func(name string, value interface{}, count bool) {
+		var e error
+		switch v := value.(type) {
+		case int64:
+			if !count {
+				e = stathat.PostEZValue(name, s.user, float64(v))
+				break
+			}
+			if d := v - s.counts[name]; d != 0 {
+				e = stathat.PostEZCount(name, s.user, int(d))
+			}
+			s.counts[name] = v
+		case float64:
+			e = stathat.PostEZValue(name, s.user, v)
+		}
+		if e != nil {
+			err = e
+		}
+	})
+	return err
+}
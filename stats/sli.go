@@ -0,0 +1,86 @@
+package stats
+
+import (
+	"github.com/rcrowley/go-metrics"
+	"sync"
+	"time"
+)
+
+// Service level indicators for the discovery layer.
+var (
+	// Answers given while this node knew a cluster leader, or a replica followed
+	// a member, i.e. from up to date data.
+	FreshAnswerCount metrics.Counter
+	// Answers given while this node had no leader, i.e. from possibly stale data.
+	StaleAnswerCount metrics.Counter
+	// Percentage of answers given from fresh data.
+	FreshAnswerPercentage metrics.GaugeFloat64
+	// Time from registration of a service until it was first returned in an answer.
+	RegistrationLatency metrics.Timer
+)
+
+var (
+	pending      = make(map[string]time.Time) // UUID -> registration time
+	pendingMutex sync.RWMutex
+)
+
+func init() {
+	FreshAnswerCount = metrics.NewCounter()
+	register("skydns-fresh-answers", FreshAnswerCount)
+
+	StaleAnswerCount = metrics.NewCounter()
+	register("skydns-stale-answers", StaleAnswerCount)
+
+	FreshAnswerPercentage = metrics.NewGaugeFloat64()
+	register("skydns-fresh-answers-percentage", FreshAnswerPercentage)
+
+	RegistrationLatency = metrics.NewTimer()
+	register("skydns-registration-to-resolvable", RegistrationLatency)
+}
+
+// Answered records an answer from the registry, fresh tells whether the data
+// it was built from is known to be up to date.
+func Answered(fresh bool) {
+	if fresh {
+		FreshAnswerCount.Inc(1)
+	} else {
+		StaleAnswerCount.Inc(1)
+	}
+	f, s := FreshAnswerCount.Count(), StaleAnswerCount.Count()
+	FreshAnswerPercentage.Update(float64(f) / float64(f+s) * 100)
+}
+
+// Registered records that the service with uuid was registered at t. Only the
+// node that accepted the registration calls it, not every member that applies
+// it.
+func Registered(uuid string, t time.Time) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	pending[uuid] = t
+}
+
+// Resolved records that the service with uuid was returned in an answer, the
+// first time this happens after registration the latency is recorded.
+func Resolved(uuid string) {
+	pendingMutex.RLock()
+	_, ok := pending[uuid]
+	pendingMutex.RUnlock()
+	if !ok {
+		return
+	}
+
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	if t, ok := pending[uuid]; ok {
+		RegistrationLatency.UpdateSince(t)
+		delete(pending, uuid)
+	}
+}
+
+// Forget stops tracking the service with uuid, e.g. when it is removed before
+// it ever was resolved.
+func Forget(uuid string) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	delete(pending, uuid)
+}
@@ -11,24 +11,97 @@ var (
 	UpdateTTLCount     metrics.Counter
 	GetServiceCount    metrics.Counter
 	RemoveServiceCount metrics.Counter
+
+	ForwardCacheHitCount  metrics.Counter
+	ForwardCacheMissCount metrics.Counter
+	NegativeCacheHitCount metrics.Counter
+	AnswerCacheHitCount   metrics.Counter
+	AnswerCacheMissCount  metrics.Counter
+
+	ExpiringCount  metrics.Counter // services seen about to expire
+	AtRiskServices metrics.Gauge   // services currently about to expire
+
+	RateLimitDropCount metrics.Counter // queries over the rate limit that were dropped or refused
+	RateLimitSlipCount metrics.Counter // queries over the rate limit answered with a truncated reply
+
+	UpstreamDownCount metrics.Counter // nameservers excluded after failing
+
+	HealthCheckFailCount metrics.Counter // failed health checks of services
+
+	WebhookFailCount metrics.Counter // events not delivered to a webhook
+
+	QuotaExceededCount metrics.Counter // registrations refused for exceeding a quota
+
+	StaleRefusedCount metrics.Counter // queries failed because the registry was stale for too long
+
+	MalformedQueryCount metrics.Counter // queries refused for not being well formed
+	PanicCount          metrics.Counter // queries answered with SERVFAIL after a panic
 )
 
 func init() {
 	ExpiredCount = metrics.NewCounter()
-	metrics.Register("skydns-expired-entries", ExpiredCount)
+	register("skydns-expired-entries", ExpiredCount)
 
 	RequestCount = metrics.NewCounter()
-	metrics.Register("skydns-requests", RequestCount)
+	register("skydns-requests", RequestCount)
 
 	AddServiceCount = metrics.NewCounter()
-	metrics.Register("skydns-add-service-requests", AddServiceCount)
+	register("skydns-add-service-requests", AddServiceCount)
 
 	UpdateTTLCount = metrics.NewCounter()
-	metrics.Register("skydns-update-ttl-requests", UpdateTTLCount)
+	register("skydns-update-ttl-requests", UpdateTTLCount)
 
 	GetServiceCount = metrics.NewCounter()
-	metrics.Register("skydns-get-service-requests", GetServiceCount)
+	register("skydns-get-service-requests", GetServiceCount)
 
 	RemoveServiceCount = metrics.NewCounter()
-	metrics.Register("skydns-remove-service-requests", RemoveServiceCount)
+	register("skydns-remove-service-requests", RemoveServiceCount)
+
+	ForwardCacheHitCount = metrics.NewCounter()
+	register("skydns-forward-cache-hits", ForwardCacheHitCount)
+
+	ForwardCacheMissCount = metrics.NewCounter()
+	register("skydns-forward-cache-misses", ForwardCacheMissCount)
+
+	NegativeCacheHitCount = metrics.NewCounter()
+	register("skydns-negative-cache-hits", NegativeCacheHitCount)
+
+	AnswerCacheHitCount = metrics.NewCounter()
+	register("skydns-answer-cache-hits", AnswerCacheHitCount)
+
+	AnswerCacheMissCount = metrics.NewCounter()
+	register("skydns-answer-cache-misses", AnswerCacheMissCount)
+
+	ExpiringCount = metrics.NewCounter()
+	register("skydns-expiring-entries", ExpiringCount)
+
+	AtRiskServices = metrics.NewGauge()
+	register("skydns-at-risk-entries", AtRiskServices)
+
+	RateLimitDropCount = metrics.NewCounter()
+	register("skydns-rate-limit-drops", RateLimitDropCount)
+
+	RateLimitSlipCount = metrics.NewCounter()
+	register("skydns-rate-limit-slips", RateLimitSlipCount)
+
+	UpstreamDownCount = metrics.NewCounter()
+	register("skydns-upstream-down", UpstreamDownCount)
+
+	HealthCheckFailCount = metrics.NewCounter()
+	register("skydns-health-check-failures", HealthCheckFailCount)
+
+	WebhookFailCount = metrics.NewCounter()
+	register("skydns-webhook-failures", WebhookFailCount)
+
+	QuotaExceededCount = metrics.NewCounter()
+	register("skydns-quota-exceeded", QuotaExceededCount)
+
+	StaleRefusedCount = metrics.NewCounter()
+	register("skydns-stale-refused", StaleRefusedCount)
+
+	MalformedQueryCount = metrics.NewCounter()
+	register("skydns-malformed-queries", MalformedQueryCount)
+
+	PanicCount = metrics.NewCounter()
+	register("skydns-panics", PanicCount)
 }
@@ -0,0 +1,237 @@
+// Copyright (c) 2013 Erik St. Martin, Brian Ketelsen. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"github.com/rcrowley/go-metrics"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsd(t *testing.T) {
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	r := metrics.NewRegistry()
+	c, g, tm := metrics.NewCounter(), metrics.NewGauge(), metrics.NewTimer()
+	r.Register("requests", c)
+	r.Register("services", g)
+	r.Register("latency", tm)
+	c.Inc(3)
+	g.Update(7)
+	tm.Update(5 * time.Millisecond)
+
+	sd, err := newStatsd(r, sink.LocalAddr().String(), "skydns", []string{"env:test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func() []string {
+		if err := sd.report(); err != nil {
+			t.Fatal(err)
+		}
+		sink.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, statsdPacketSize)
+		n, _, err := sink.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(string(buf[:n]), "\n")
+	}
+	has := func(lines []string, want string) bool {
+		for _, l := range lines {
+			if l == want {
+				return true
+			}
+		}
+		return false
+	}
+
+	lines := read()
+	for _, want := range []string{
+		"skydns.requests:3|c|#env:test",
+		"skydns.services:7|g|#env:test",
+		"skydns.latency.count:1|c|#env:test",
+		"skydns.latency.mean:5|g|#env:test",
+		"skydns.latency.p99:5|g|#env:test",
+	} {
+		if !has(lines, want) {
+			t.Errorf("Expected %q in %v", want, lines)
+		}
+	}
+
+	// Counters are sent as the change since the last report
+	c.Inc(2)
+	lines = read()
+	if !has(lines, "skydns.requests:2|c|#env:test") || has(lines, "skydns.latency.count:0|c|#env:test") {
+		t.Errorf("Expected only the counters that changed, as deltas, got %v", lines)
+	}
+}
+
+func TestRegistrationLatency(t *testing.T) {
+	RegistrationLatency = metrics.NewTimer()
+
+	now := time.Now()
+	Registered("a", now.Add(-1*time.Second))
+	Registered("b", now.Add(-3*time.Second))
+	Registered("c", now.Add(-5*time.Second))
+	Registered("d", now.Add(-time.Hour))
+	Forget("d")
+
+	for _, uuid := range []string{"a", "b", "c", "d", "unknown"} {
+		Resolved(uuid)
+	}
+	// Only the first answer after the registration counts
+	Resolved("a")
+	Resolved("c")
+
+	if n := RegistrationLatency.Count(); n != 3 {
+		t.Fatalf("Wrong number of latencies: %d, expected 3", n)
+	}
+	for _, c := range []struct {
+		p   float64
+		min time.Duration
+	}{{0, 1 * time.Second}, {0.5, 3 * time.Second}, {1, 5 * time.Second}} {
+		got := time.Duration(RegistrationLatency.Percentile(c.p))
+		if got < c.min || got > c.min+time.Second {
+			t.Errorf("Wrong percentile %.2f: %s, expected about %s", c.p, got, c.min)
+		}
+	}
+	if got := time.Duration(RegistrationLatency.Max()); got >= time.Hour {
+		t.Errorf("Forgotten service was measured: %s", got)
+	}
+
+	pendingMutex.RLock()
+	defer pendingMutex.RUnlock()
+	if len(pending) != 0 {
+		t.Errorf("Services still pending: %v", pending)
+	}
+}
+
+func TestFreshAnswerPercentage(t *testing.T) {
+	FreshAnswerCount = metrics.NewCounter()
+	StaleAnswerCount = metrics.NewCounter()
+	FreshAnswerPercentage = metrics.NewGaugeFloat64()
+
+	for _, c := range []struct {
+		fresh bool
+		want  float64
+	}{{true, 100}, {false, 50}, {true, 100.0 * 2 / 3}, {true, 75}} {
+		Answered(c.fresh)
+		if got := FreshAnswerPercentage.Value(); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("Wrong fresh answer percentage: %f, expected %f", got, c.want)
+		}
+	}
+	if f, s := FreshAnswerCount.Count(), StaleAnswerCount.Count(); f != 3 || s != 1 {
+		t.Errorf("Wrong answer counts: %d fresh, %d stale, expected 3 and 1", f, s)
+	}
+}
+
+func TestEvictNames(t *testing.T) {
+	Queried("idleservice", "10.0.0.0/24")
+	Queried("busyservice", "10.0.0.0/24")
+
+	namesMutex.Lock()
+	names["idleservice"].last = time.Now().Add(-nameIdle)
+	lastEvict = time.Time{}
+	namesMutex.Unlock()
+
+	// The next query evicts the idle names
+	Queried("busyservice", "10.0.0.0/24")
+
+	namesMutex.Lock()
+	_, idle := names["idleservice"]
+	_, busy := names["busyservice"]
+	namesMutex.Unlock()
+	if idle || !busy {
+		t.Fatalf("Expected only the idle name to be evicted, idle kept: %t, busy kept: %t", idle, busy)
+	}
+	if w := NameQueries("idleservice"); w[2].Queries != 0 {
+		t.Fatalf("Evicted name should have no queries, got %d", w[2].Queries)
+	}
+	if w := NameQueries("busyservice"); w[0].Queries != 2 || w[2].Clients["10.0.0.0/24"] != 2 {
+		t.Fatalf("Expected 2 queries for the busy name, got %v", w)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	graphite, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer graphite.Close()
+
+	r := metrics.NewRegistry()
+	c, err := New(Config{Registry: r, Interval: 10 * time.Millisecond, StatsD: sink.LocalAddr().String(), Graphite: graphite.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	RequestCount.Inc(3)
+	// Registered after the collector started
+	DNSAnswered("A", SourceRegistry, "NOERROR", 5*time.Millisecond)
+	if r.Get("skydns-requests") == nil || r.Get("skydns-dns-rcode-noerror") == nil {
+		t.Fatal("SkyDNS metrics should be registered in the registry of the collector")
+	}
+
+	want := map[string]bool{
+		"skydns.skydns-requests:3|c":                     false,
+		"skydns.skydns-dns-rcode-noerror:1|c":            false,
+		"skydns.skydns-dns-latency-registry-a.count:1|c": false,
+		"skydns.skydns-dns-latency-registry-a.mean:5|g":  false,
+		"skydns.skydns-dns-latency-registry-a.p99:5|g":   false,
+	}
+	sink.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 65536)
+	for missing := len(want); missing > 0; {
+		n, _, err := sink.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Metrics not reported: %v", want)
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if seen, ok := want[line]; ok && !seen {
+				want[line] = true
+				missing--
+			}
+		}
+	}
+
+	// Graphite gets the same metrics, with a timestamp
+	graphite.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+	conn, err := graphite.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil || !strings.Contains(string(b), "skydns.skydns-requests 3 ") {
+		t.Fatalf("Expected the metrics in Graphite, got %q, %v", b, err)
+	}
+
+	// Nothing is reported after Stop
+	c.Stop()
+	for {
+		sink.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, _, err := sink.ReadFrom(buf); err != nil {
+			break
+		}
+	}
+	sink.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := sink.ReadFrom(buf); err == nil {
+		t.Fatalf("Metrics reported after Stop: %q", buf[:n])
+	}
+}
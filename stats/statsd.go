@@ -0,0 +1,75 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rcrowley/go-metrics"
+	"net"
+	"strings"
+)
+
+// statsdPacketSize keeps packets within the MTU of most networks.
+const statsdPacketSize = 1432
+
+// statsd reports the metrics of a registry to a StatsD server over UDP.
+type statsd struct {
+	registry metrics.Registry
+	conn     net.Conn
+	prefix   string
+	tags     string           // DogStatsD tags, with the leading "|#"
+	counts   map[string]int64 // counts last reported, counters are sent as deltas
+}
+
+func newStatsd(r metrics.Registry, addr, prefix string, tags []string) (*statsd, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &statsd{registry: r, conn: conn, prefix: prefix, counts: make(map[string]int64)}
+	if len(tags) > 0 {
+		s.tags = "|#" + strings.Join(tags, ",")
+	}
+	return s, nil
+}
+
+// report sends the metrics once. Counters and meters are sent as counters,
+// gauges as gauges and of timers the count is sent as a counter and the mean
+// and percentiles, in milliseconds, as gauges.
+func (s *statsd) report() error {
+	var (
+		lines []string
+		err   error
+	)
+	each(s.registry, func(name string, value interface{}, count bool) {
+		typ := "g"
+		if count {
+			d := value.(int64) - s.counts[name]
+			s.counts[name] = value.(int64)
+			if d == 0 {
+				return
+			}
+			value, typ = d, "c"
+		}
+		lines = append(lines, fmt.Sprintf("%s.%s:%v|%s%s", s.prefix, name, value, typ, s.tags))
+	})
+
+	var b bytes.Buffer
+	for _, l := range lines {
+		if b.Len() > 0 && b.Len()+1+len(l) > statsdPacketSize {
+			if _, e := s.conn.Write(b.Bytes()); e != nil {
+				err = e
+			}
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(l)
+	}
+	if b.Len() > 0 {
+		if _, e := s.conn.Write(b.Bytes()); e != nil {
+			err = e
+		}
+	}
+	return err
+}